@@ -0,0 +1,317 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"syscall"
+)
+
+// BalanceStatus describes the state of a balance operation.
+type BalanceStatus struct {
+	Flags    BalanceFlags
+	State    BalanceState
+	Progress BalanceProgress
+}
+
+// Running reports if balance is currently running (or was paused).
+func (s BalanceStatus) Running() bool {
+	return s.State&BalanceStateRunning != 0
+}
+
+// Balance starts a balance operation and blocks until it completes.
+//
+// Deprecated: use BalanceStart.
+func (f *FS) Balance(flags BalanceFlags) (BalanceProgress, error) {
+	return f.BalanceStart(flags)
+}
+
+// BalanceStart starts a balance operation on the filesystem and blocks until it completes,
+// is paused or is cancelled. Flags select which chunk types will be processed.
+func (f *FS) BalanceStart(flags BalanceFlags) (BalanceProgress, error) {
+	if flags&BalanceMask == 0 {
+		flags |= BalanceMask
+	}
+	args := btrfs_ioctl_balance_args{flags: flags}
+	err := f.exclusive(func() error {
+		return iocBalanceV2(f.file(), &args)
+	})
+	return args.stat, err
+}
+
+// BalanceStartArgs validates balance filters and starts a balance operation.
+// It blocks until the balance completes, is paused or is cancelled.
+// On zoned filesystems, conversion to unsupported profiles fails with ErrZonedProfile.
+func (f *FS) BalanceStartArgs(args BalanceArgs) (BalanceProgress, error) {
+	return f.balanceStartArgs(args, notArmed)
+}
+
+// balanceStartArgs starts a balance operation and calls arm right before issuing the request.
+// See withCancel.
+func (f *FS) balanceStartArgs(args BalanceArgs, arm func() error) (BalanceProgress, error) {
+	if err := args.Validate(); err != nil {
+		return BalanceProgress{}, err
+	}
+	if args.converts() {
+		feat, err := f.GetFeatures()
+		if err != nil {
+			return BalanceProgress{}, err
+		} else if err = args.validateZoned(feat.Incompatible); err != nil {
+			return BalanceProgress{}, err
+		}
+	}
+	arg := args.toArgs()
+	err := f.exclusive(func() error {
+		if err := arm(); err != nil {
+			return err
+		}
+		return iocBalanceV2(f.file(), &arg)
+	})
+	return arg.stat, err
+}
+
+// BalanceContext is similar to BalanceStartArgs, but cancels the balance when the context is done.
+func (f *FS) BalanceContext(ctx context.Context, args BalanceArgs) (BalanceProgress, error) {
+	var prog BalanceProgress
+	err := withCancel(ctx, f.BalanceCancel, func(arm func() error) error {
+		var err error
+		prog, err = f.balanceStartArgs(args, arm)
+		return err
+	})
+	return prog, err
+}
+
+// BalancePause requests the running balance to pause.
+// It returns when the balance is paused.
+func (f *FS) BalancePause() error {
+	return iocBalanceCtl(f.file(), _BTRFS_BALANCE_CTL_PAUSE)
+}
+
+// BalanceCancel cancels the running or paused balance.
+// It returns when the balance is stopped.
+func (f *FS) BalanceCancel() error {
+	return iocBalanceCtl(f.file(), _BTRFS_BALANCE_CTL_CANCEL)
+}
+
+// BalanceResume resumes a paused balance and blocks until it completes.
+func (f *FS) BalanceResume() (BalanceProgress, error) {
+	args := btrfs_ioctl_balance_args{flags: BalanceResume}
+	err := f.exclusive(func() error {
+		return iocBalanceV2(f.file(), &args)
+	})
+	return args.stat, err
+}
+
+// BalanceStatus returns the state of current balance operation.
+// Zero status is returned if balance is not running.
+func (f *FS) BalanceStatus() (BalanceStatus, error) {
+	var args btrfs_ioctl_balance_args
+	if err := iocBalanceProgress(f.file(), &args); err == syscall.ENOTCONN {
+		return BalanceStatus{}, nil
+	} else if err != nil {
+		return BalanceStatus{}, err
+	}
+	return BalanceStatus{
+		Flags:    args.flags,
+		State:    args.state,
+		Progress: args.stat,
+	}, nil
+}
+
+// BalanceRange is an inclusive range of values used by balance filters.
+type BalanceRange struct {
+	Min, Max uint64
+}
+
+func (r *BalanceRange) validate(name string, max uint64) error {
+	if r.Min > r.Max {
+		return fmt.Errorf("%s: min value is larger than max (%d > %d)", name, r.Min, r.Max)
+	} else if r.Max > max {
+		return fmt.Errorf("%s: value out of range (%d > %d)", name, r.Max, max)
+	}
+	return nil
+}
+
+// BalanceFilter selects which chunks of a specific type will be processed by balance.
+// Nil ranges and zero values disable corresponding filters.
+type BalanceFilter struct {
+	// Profiles limits balance to chunks with one of the given profiles.
+	Profiles Profile
+	// Usage selects chunks with usage percent in the range (0..100).
+	Usage *BalanceRange
+	// DevID selects chunks that have at least one stripe on the given device.
+	DevID uint64
+	// DevRange selects chunks that overlap a physical byte range on the device (drange).
+	// It requires DevID to be set.
+	DevRange *BalanceRange
+	// VirtRange selects chunks that overlap a logical byte range (vrange).
+	VirtRange *BalanceRange
+	// Convert changes the profile of selected chunks.
+	Convert Profile
+	// Soft skips chunks that already have the target profile. It requires Convert to be set.
+	Soft bool
+	// Limit sets the minimal and maximal number of chunks to process.
+	Limit *BalanceRange
+	// Stripes selects chunks that span a number of devices in the range.
+	Stripes *BalanceRange
+}
+
+func (f *BalanceFilter) validate(typ string) error {
+	if f.Usage != nil {
+		if err := f.Usage.validate(typ+" usage", 100); err != nil {
+			return err
+		}
+	}
+	if f.DevRange != nil {
+		if f.DevID == 0 {
+			return fmt.Errorf("%s: drange filter requires devid filter", typ)
+		} else if err := f.DevRange.validate(typ+" drange", maxUint64); err != nil {
+			return err
+		}
+	}
+	if f.VirtRange != nil {
+		if err := f.VirtRange.validate(typ+" vrange", maxUint64); err != nil {
+			return err
+		}
+	}
+	if f.Limit != nil {
+		if err := f.Limit.validate(typ+" limit", 1<<32-1); err != nil {
+			return err
+		}
+	}
+	if f.Stripes != nil {
+		if err := f.Stripes.validate(typ+" stripes", 1<<32-1); err != nil {
+			return err
+		}
+	}
+	const allProfiles = ProfileSingle | Profile(_BTRFS_BLOCK_GROUP_PROFILE_MASK)
+	if f.Profiles&^allProfiles != 0 {
+		return fmt.Errorf("%s: invalid profiles: %v", typ, f.Profiles)
+	}
+	if f.Convert != 0 {
+		if f.Convert&^allProfiles != 0 || bits.OnesCount64(uint64(f.Convert)) != 1 {
+			return fmt.Errorf("%s: convert requires exactly one profile, got %v", typ, f.Convert)
+		}
+	} else if f.Soft {
+		return fmt.Errorf("%s: soft filter requires convert", typ)
+	}
+	return nil
+}
+
+func (f *BalanceFilter) toArgs() (arg btrfs_balance_args) {
+	if f.Profiles != 0 {
+		arg.flags |= _BTRFS_BALANCE_ARGS_PROFILES
+		arg.profiles = uint64(f.Profiles)
+	}
+	if r := f.Usage; r != nil {
+		if r.Min == 0 {
+			arg.flags |= _BTRFS_BALANCE_ARGS_USAGE
+			arg.usage.setN(r.Max)
+		} else {
+			arg.flags |= _BTRFS_BALANCE_ARGS_USAGE_RANGE
+			arg.usage.setMinMax(uint32(r.Min), uint32(r.Max))
+		}
+	}
+	if f.DevID != 0 {
+		arg.flags |= _BTRFS_BALANCE_ARGS_DEVID
+		arg.devid = f.DevID
+	}
+	if r := f.DevRange; r != nil {
+		// kernel range is [start, end)
+		arg.flags |= _BTRFS_BALANCE_ARGS_DRANGE
+		arg.pstart, arg.pend = r.Min, r.Max+1
+		if arg.pend == 0 {
+			arg.pend = maxUint64
+		}
+	}
+	if r := f.VirtRange; r != nil {
+		arg.flags |= _BTRFS_BALANCE_ARGS_VRANGE
+		arg.vstart, arg.vend = r.Min, r.Max+1
+		if arg.vend == 0 {
+			arg.vend = maxUint64
+		}
+	}
+	if f.Convert != 0 {
+		arg.flags |= _BTRFS_BALANCE_ARGS_CONVERT
+		arg.target = uint64(f.Convert)
+		if f.Soft {
+			arg.flags |= _BTRFS_BALANCE_ARGS_SOFT
+		}
+	}
+	if r := f.Limit; r != nil {
+		if r.Min == 0 {
+			arg.flags |= _BTRFS_BALANCE_ARGS_LIMIT
+			arg.limit.setN(r.Max)
+		} else {
+			arg.flags |= _BTRFS_BALANCE_ARGS_LIMIT_RANGE
+			arg.limit.setMinMax(uint32(r.Min), uint32(r.Max))
+		}
+	}
+	if r := f.Stripes; r != nil {
+		arg.flags |= _BTRFS_BALANCE_ARGS_STRIPES_RANGE
+		arg.stripes_min, arg.stripes_max = uint32(r.Min), uint32(r.Max)
+	}
+	return
+}
+
+// BalanceArgs describes a filtered balance operation.
+// Chunk types with nil filters are not processed. If all filters are nil,
+// all chunk types are processed. Like btrfs-progs, system chunks are processed
+// with Metadata filters if System is nil.
+type BalanceArgs struct {
+	Data     *BalanceFilter
+	Metadata *BalanceFilter
+	System   *BalanceFilter
+	// Force allows operations on system chunks and reducing metadata redundancy.
+	Force bool
+}
+
+// Validate checks balance filters for invalid combinations.
+func (a BalanceArgs) Validate() error {
+	if a.Data != nil {
+		if err := a.Data.validate("data"); err != nil {
+			return err
+		}
+	}
+	if a.Metadata != nil {
+		if err := a.Metadata.validate("metadata"); err != nil {
+			return err
+		}
+	}
+	if a.System != nil {
+		if err := a.System.validate("system"); err != nil {
+			return err
+		}
+		if !a.Force {
+			return fmt.Errorf("refusing to explicitly operate on system chunks without force")
+		}
+	}
+	return nil
+}
+
+func (a BalanceArgs) toArgs() btrfs_ioctl_balance_args {
+	var arg btrfs_ioctl_balance_args
+	if a.Data != nil {
+		arg.flags |= BalanceData
+		arg.data = a.Data.toArgs()
+	}
+	if a.Metadata != nil {
+		arg.flags |= BalanceMetadata
+		arg.meta = a.Metadata.toArgs()
+	}
+	if a.System != nil {
+		arg.flags |= BalanceSystem
+		arg.sys = a.System.toArgs()
+	} else if a.Metadata != nil {
+		// system chunks are usually converted together with metadata
+		arg.flags |= BalanceSystem
+		arg.sys = arg.meta
+	}
+	if arg.flags&BalanceMask == 0 {
+		arg.flags |= BalanceMask
+	}
+	if a.Force {
+		arg.flags |= BalanceForce
+	}
+	return arg
+}
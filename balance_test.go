@@ -0,0 +1,143 @@
+package btrfs
+
+import (
+	"errors"
+	"testing"
+)
+
+var casesBalanceArgs = []struct {
+	name  string
+	args  BalanceArgs
+	valid bool
+}{
+	{name: "empty", args: BalanceArgs{}, valid: true},
+	{
+		name:  "usage",
+		args:  BalanceArgs{Data: &BalanceFilter{Usage: &BalanceRange{Max: 50}}},
+		valid: true,
+	},
+	{
+		name: "usage over 100",
+		args: BalanceArgs{Data: &BalanceFilter{Usage: &BalanceRange{Max: 101}}},
+	},
+	{
+		name: "inverted limit",
+		args: BalanceArgs{Metadata: &BalanceFilter{Limit: &BalanceRange{Min: 5, Max: 2}}},
+	},
+	{
+		name: "drange without devid",
+		args: BalanceArgs{Data: &BalanceFilter{DevRange: &BalanceRange{Max: 1 << 30}}},
+	},
+	{
+		name:  "drange with devid",
+		args:  BalanceArgs{Data: &BalanceFilter{DevID: 1, DevRange: &BalanceRange{Max: 1 << 30}}},
+		valid: true,
+	},
+	{
+		name: "soft without convert",
+		args: BalanceArgs{Data: &BalanceFilter{Soft: true}},
+	},
+	{
+		name:  "soft convert",
+		args:  BalanceArgs{Data: &BalanceFilter{Convert: ProfileRAID1, Soft: true}},
+		valid: true,
+	},
+	{
+		name: "convert to multiple profiles",
+		args: BalanceArgs{Data: &BalanceFilter{Convert: ProfileRAID1 | ProfileDup}},
+	},
+	{
+		name: "system without force",
+		args: BalanceArgs{System: &BalanceFilter{}},
+	},
+	{
+		name:  "system with force",
+		args:  BalanceArgs{System: &BalanceFilter{}, Force: true},
+		valid: true,
+	},
+}
+
+func TestBalanceArgsValidate(t *testing.T) {
+	for _, c := range casesBalanceArgs {
+		err := c.args.Validate()
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestBalanceArgsEncode(t *testing.T) {
+	args := BalanceArgs{
+		Data: &BalanceFilter{
+			Usage:   &BalanceRange{Min: 10, Max: 20},
+			Convert: ProfileRAID1,
+			Soft:    true,
+			Limit:   &BalanceRange{Max: 3},
+		},
+	}
+	arg := args.toArgs()
+	if arg.flags != BalanceData {
+		t.Fatalf("unexpected flags: %x", arg.flags)
+	}
+	const exp = _BTRFS_BALANCE_ARGS_USAGE_RANGE | _BTRFS_BALANCE_ARGS_CONVERT |
+		_BTRFS_BALANCE_ARGS_SOFT | _BTRFS_BALANCE_ARGS_LIMIT
+	if arg.data.flags != exp {
+		t.Fatalf("unexpected filter flags: %x vs %x", arg.data.flags, exp)
+	}
+	if min, max := arg.data.usage.asMinMax(); min != 10 || max != 20 {
+		t.Fatalf("unexpected usage range: %d..%d", min, max)
+	}
+	if n := arg.data.limit.asN(); n != 3 {
+		t.Fatalf("unexpected limit: %d", n)
+	}
+
+	args = BalanceArgs{Metadata: &BalanceFilter{Convert: ProfileDup}}
+	arg = args.toArgs()
+	if arg.flags != BalanceMetadata|BalanceSystem {
+		t.Fatalf("unexpected flags: %x", arg.flags)
+	} else if arg.sys != arg.meta || arg.sys.flags != _BTRFS_BALANCE_ARGS_CONVERT {
+		t.Fatalf("metadata filters are not used for system chunks: %+v", arg.sys)
+	}
+
+	args.System = &BalanceFilter{Usage: &BalanceRange{Max: 5}}
+	arg = args.toArgs()
+	if arg.sys.flags != _BTRFS_BALANCE_ARGS_USAGE {
+		t.Fatalf("unexpected system filter flags: %x", arg.sys.flags)
+	}
+}
+
+func TestBalanceArgsZoned(t *testing.T) {
+	const zoned = FeatureIncompatZoned
+	for _, c := range []struct {
+		name     string
+		args     BalanceArgs
+		incompat IncompatFeatures
+		valid    bool
+	}{
+		{name: "not zoned", args: BalanceArgs{Data: &BalanceFilter{Convert: ProfileRAID5}}, valid: true},
+		{name: "single", args: BalanceArgs{Data: &BalanceFilter{Convert: ProfileSingle}}, incompat: zoned, valid: true},
+		{name: "metadata dup", args: BalanceArgs{Metadata: &BalanceFilter{Convert: ProfileDup}}, incompat: zoned, valid: true},
+		{name: "data raid1", args: BalanceArgs{Data: &BalanceFilter{Convert: ProfileRAID1}}, incompat: zoned},
+		{
+			name:     "data raid1 with stripe tree",
+			args:     BalanceArgs{Data: &BalanceFilter{Convert: ProfileRAID1}},
+			incompat: zoned | FeatureIncompatRAIDStripeTree,
+			valid:    true,
+		},
+		{
+			name:     "raid6",
+			args:     BalanceArgs{Metadata: &BalanceFilter{Convert: ProfileRAID6}},
+			incompat: zoned | FeatureIncompatRAIDStripeTree,
+		},
+		{name: "no convert", args: BalanceArgs{Data: &BalanceFilter{Profiles: ProfileRAID5}}, incompat: zoned, valid: true},
+	} {
+		err := c.args.validateZoned(c.incompat)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		} else if !c.valid && !errors.Is(err, ErrZonedProfile) {
+			t.Errorf("%s: expected zoned profile error, got: %v", c.name, err)
+		}
+	}
+}
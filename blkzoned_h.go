@@ -0,0 +1,76 @@
+package btrfs
+
+import (
+	"github.com/dennwc/btrfs/ioctl"
+	"unsafe"
+)
+
+// Zoned block device ioctls from linux/blkzoned.h.
+
+// blk_zone_report is followed by nr_zones blk_zone structures.
+type blk_zone_report struct {
+	sector   uint64
+	nr_zones uint32
+	flags    uint32
+}
+
+type blk_zone struct {
+	start    uint64 // zone start sector
+	len      uint64 // zone length in number of sectors
+	wp       uint64 // zone write pointer position
+	typ      uint8  // zone type
+	cond     uint8  // zone condition
+	non_seq  uint8  // non-sequential write resources active
+	reset    uint8  // reset write pointer recommended
+	resv     [4]uint8
+	capacity uint64 // zone capacity in number of sectors
+	reserved [24]uint8
+}
+
+const (
+	_BLK_ZONE_REP_CAPACITY = 1 << 0 // zone capacity is valid
+
+	blkSectorSize = 512
+)
+
+var (
+	_BLKREPORTZONE = ioctl.IOWR(0x12, 130, unsafe.Sizeof(blk_zone_report{}))
+	_BLKGETZONESZ  = ioctl.IOR(0x12, 132, unsafe.Sizeof(uint32(0)))
+	_BLKGETNRZONES = ioctl.IOR(0x12, 133, unsafe.Sizeof(uint32(0)))
+)
+
+// iocReportZones fills zones starting from a given sector and returns the number of reported zones.
+func iocReportZones(f ioctlFile, sector uint64, zones []blk_zone) ([]blk_zone, error) {
+	const hdr = unsafe.Sizeof(blk_zone_report{})
+	buf := make([]byte, hdr+uintptr(len(zones))*unsafe.Sizeof(blk_zone{}))
+	rep := (*blk_zone_report)(unsafe.Pointer(&buf[0]))
+	rep.sector = sector
+	rep.nr_zones = uint32(len(zones))
+	if err := doIoctl(f, _BLKREPORTZONE, buf); err != nil {
+		return nil, err
+	}
+	n := int(rep.nr_zones)
+	if n > len(zones) {
+		n = len(zones)
+	}
+	for i := 0; i < n; i++ {
+		z := (*blk_zone)(unsafe.Pointer(&buf[hdr+uintptr(i)*unsafe.Sizeof(blk_zone{})]))
+		zones[i] = *z
+		if rep.flags&_BLK_ZONE_REP_CAPACITY == 0 {
+			zones[i].capacity = z.len
+		}
+	}
+	return zones[:n], nil
+}
+
+func iocGetZoneSize(f ioctlFile) (uint32, error) {
+	var v uint32
+	err := doIoctl(f, _BLKGETZONESZ, &v)
+	return v, err
+}
+
+func iocGetNrZones(f ioctlFile) (uint32, error) {
+	var v uint32
+	err := doIoctl(f, _BLKGETNRZONES, &v)
+	return v, err
+}
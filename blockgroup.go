@@ -0,0 +1,129 @@
+package btrfs
+
+import (
+	"os"
+)
+
+// BlockGroup describes a single chunk of the filesystem and its usage.
+type BlockGroup struct {
+	Start  uint64          `json:"start"` // logical address
+	Length uint64          `json:"length"`
+	Used   uint64          `json:"used"`
+	Flags  BlockGroupFlags `json:"flags"` // type and profile of the block group
+	// StripeLen is the size of a single stripe unit for striped profiles.
+	StripeLen  uint64             `json:"stripe_len"`
+	SubStripes uint16             `json:"sub_stripes,omitempty"`
+	Stripes    []BlockGroupStripe `json:"stripes"`
+}
+
+// Type returns the type of the block group: data, metadata or system.
+func (bg BlockGroup) Type() BlockGroupFlags {
+	return bg.Flags.Type()
+}
+
+// Profile returns the allocation profile of the block group.
+func (bg BlockGroup) Profile() Profile {
+	return bg.Flags.Profile()
+}
+
+// Free returns the number of unused bytes in the block group.
+func (bg BlockGroup) Free() uint64 {
+	if bg.Used > bg.Length {
+		return 0
+	}
+	return bg.Length - bg.Used
+}
+
+// BlockGroupStripe is a physical location of a block group stripe.
+type BlockGroupStripe struct {
+	DevID    uint64 `json:"devid"`
+	DevUUID  UUID   `json:"dev_uuid"`
+	Physical uint64 `json:"physical"` // offset on the device
+	// Zone is the index of the device zone where the stripe starts.
+	// It is only set on zoned filesystems.
+	Zone uint64 `json:"zone,omitempty"`
+}
+
+// BlockGroups returns all block groups of the filesystem sorted by logical address.
+// Mapping is read from the chunk tree, and usage from the extent tree (or the block group tree).
+// It requires CAP_SYS_ADMIN.
+func (f *FS) BlockGroups() ([]BlockGroup, error) {
+	if err := requireAdmin("block groups", f.f.Name()); err != nil {
+		return nil, err
+	}
+	feat, err := f.GetFeatures()
+	if err != nil {
+		return nil, &os.PathError{Op: "get features", Path: f.f.Name(), Err: err}
+	}
+	var zoneSize uint64
+	if feat.Incompatible&FeatureIncompatZoned != 0 {
+		if zoneSize, err = f.ZoneSize(); err != nil {
+			return nil, err
+		}
+	}
+	bgTree := extentTreeObjectid
+	if feat.CompatibleRO&FeatureCompatROBlockGroupTree != 0 {
+		bgTree = objectID(BlockGroupTreeID)
+	}
+	it := newSearchIterator(f.file(), btrfs_ioctl_search_key{
+		tree_id:      chunkTreeObjectid,
+		min_objectid: firstChunkTreeObjectid,
+		max_objectid: firstChunkTreeObjectid,
+		min_type:     chunkItemKey,
+		max_type:     chunkItemKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+	})
+	var out []BlockGroup
+	for it.Next() {
+		item := it.Item()
+		c, err := DecodeChunkItem(item.Data)
+		if err != nil {
+			return nil, err
+		}
+		bg := BlockGroup{
+			Start:      item.Offset,
+			Length:     c.Length,
+			Flags:      c.Type,
+			StripeLen:  c.StripeLen,
+			SubStripes: c.SubStripes,
+			Stripes:    make([]BlockGroupStripe, 0, len(c.Stripes)),
+		}
+		for _, s := range c.Stripes {
+			st := BlockGroupStripe{DevID: s.DevID, DevUUID: s.DevUUID, Physical: s.Offset}
+			if zoneSize != 0 {
+				st.Zone = s.Offset / zoneSize
+			}
+			bg.Stripes = append(bg.Stripes, st)
+		}
+		out = append(out, bg)
+	}
+	if err = it.Err(); err != nil {
+		return nil, &os.PathError{Op: "tree search", Path: f.f.Name(), Err: err}
+	}
+	for i := range out {
+		bg := &out[i]
+		items, err := treeSearchRaw(f.file(), btrfs_ioctl_search_key{
+			tree_id:      bgTree,
+			min_objectid: objectID(bg.Start),
+			max_objectid: objectID(bg.Start),
+			min_type:     blockGroupItemKey,
+			max_type:     blockGroupItemKey,
+			min_offset:   bg.Length,
+			max_offset:   bg.Length,
+			max_transid:  maxUint64,
+			nr_items:     1,
+		})
+		if err != nil {
+			return nil, &os.PathError{Op: "tree search", Path: f.f.Name(), Err: err}
+		} else if len(items) == 0 {
+			continue
+		}
+		bgi, err := DecodeBlockGroupItem(items[0].Data)
+		if err != nil {
+			return nil, err
+		}
+		bg.Used = bgi.Used
+	}
+	return out, nil
+}
@@ -1,27 +1,23 @@
 package btrfs
 
 import (
+	"context"
 	"fmt"
-	"github.com/dennwc/btrfs/ioctl"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"syscall"
 )
 
 const SuperMagic = 0x9123683E
 
-func CloneFile(dst, src *os.File) error {
-	return iocClone(dst, src)
-}
-
+// Open opens a btrfs filesystem at a given directory. The directory doesn't need to be
+// a subvolume root: operations on the subvolume itself (e.g. Snapshot) are applied
+// to the subvolume that contains it, while relative paths are resolved from the directory.
 func Open(path string, ro bool) (*FS, error) {
-	if ok, err := IsSubVolume(path); err != nil {
-		return nil, err
-	} else if !ok {
-		return nil, ErrNotBtrfs{Path: path}
-	}
 	var (
 		dir *os.File
 		err error
@@ -33,18 +29,115 @@ func Open(path string, ro bool) (*FS, error) {
 	}
 	if err != nil {
 		return nil, err
-	} else if st, err := dir.Stat(); err != nil {
+	}
+	fs, err := NewFS(dir)
+	if err != nil {
 		dir.Close()
 		return nil, err
+	}
+	return fs, nil
+}
+
+// oPath is O_PATH open flag, which is not defined in syscall.
+const oPath = 0x200000
+
+// NewFS creates an FS from an open directory on a btrfs filesystem. The FS takes
+// ownership of the file and closes it in Close.
+//
+// Files opened with O_PATH cannot be used for ioctls, thus they are reopened
+// through /proc/self/fd and closed.
+func NewFS(f *os.File) (*FS, error) {
+	var stfs syscall.Statfs_t
+	if err := fstatfs(f, &stfs); err != nil {
+		return nil, err
+	} else if stfs.Type != SuperMagic {
+		return nil, ErrNotBtrfs{Path: f.Name()}
+	}
+	if st, err := f.Stat(); err != nil {
+		return nil, err
 	} else if !st.IsDir() {
-		dir.Close()
-		return nil, fmt.Errorf("not a directory: %s", path)
+		return nil, fmt.Errorf("not a directory: %s", f.Name())
+	}
+	var flags uintptr
+	if err := withFd(f, func(fd int) error {
+		var errno syscall.Errno
+		if flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFL, 0); errno != 0 {
+			return errno
+		}
+		return nil
+	}); err != nil {
+		return nil, &os.PathError{Op: "fcntl", Path: f.Name(), Err: err}
+	} else if flags&oPath != 0 {
+		var fd int
+		if err = withFd(f, func(ofd int) (err error) {
+			fd, err = syscall.Open(fdPath(uintptr(ofd)), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+			return err
+		}); err != nil {
+			return nil, &os.PathError{Op: "open", Path: f.Name(), Err: err}
+		}
+		f.Close()
+		f = os.NewFile(uintptr(fd), fdPath(uintptr(fd)))
 	}
-	return &FS{f: dir}, nil
+	return &FS{f: f}, nil
+}
+
+// FromFd creates an FS from a file descriptor of a directory on a btrfs filesystem,
+// for example, received over a unix socket. See NewFS.
+//
+// Since the path of the directory may be unknown or not accessible in the current
+// mount namespace, paths passed to the FS are resolved through /proc/self/fd.
+//
+// FromFd always takes ownership of the descriptor: it is closed if FromFd fails.
+func FromFd(fd uintptr) (*FS, error) {
+	f := os.NewFile(fd, fdPath(fd))
+	fs, err := NewFS(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// fdPath returns a path that refers to an open file descriptor.
+func fdPath(fd uintptr) string {
+	return "/proc/self/fd/" + strconv.FormatUint(uint64(fd), 10)
 }
 
+// FS is an open btrfs filesystem. It is safe for concurrent use by multiple goroutines.
+//
+// Queries and most operations are passed to the kernel as is and may run in parallel.
+// Exclusive operations (balance, resize, adding, removing or replacing a device) are
+// serialized: the kernel allows only one of them at a time and fails the rest, so FS
+// waits for the running one to finish instead. Balance pause and cancel, as well as
+// replace cancel, are never blocked. Operations started on different FS instances,
+// or by other processes, are not serialized.
+//
+// Close may be called while other operations are in progress; the file descriptor of the
+// opened directory is released after they return, and all subsequent operations fail with
+// os.ErrClosed. This doesn't apply to files passed to methods by the caller (e.g. a clone
+// source), which must be kept open until the call returns.
+//
+// Relative paths passed to methods are resolved against the opened directory with openat(2),
+// thus they keep working if the mount point is moved. Absolute paths are used as is.
 type FS struct {
-	f *os.File
+	f    *os.File
+	d    IoctlDoer  // set by NewFSWithIoctl; nil means the kernel
+	excl sync.Mutex // held during exclusive operations
+}
+
+// file returns the opened directory for ioctl requests of the FS.
+func (f *FS) file() ioctlFile {
+	if f.d == nil {
+		return f.f
+	}
+	return doerFile{File: f.f, d: f.d}
+}
+
+// exclusive runs fn while holding the lock for exclusive operations.
+func (f *FS) exclusive(fn func() error) error {
+	f.excl.Lock()
+	defer f.excl.Unlock()
+	return fn()
 }
 
 func (f *FS) Close() error {
@@ -52,17 +145,21 @@ func (f *FS) Close() error {
 }
 
 type Info struct {
-	MaxID          uint64
-	NumDevices     uint64
-	FSID           FSID
-	NodeSize       uint32
-	SectorSize     uint32
-	CloneAlignment uint32
+	MaxID          uint64 `json:"max_id"`
+	NumDevices     uint64 `json:"num_devices"`
+	FSID           FSID   `json:"fsid"`
+	NodeSize       uint32 `json:"node_size"`
+	SectorSize     uint32 `json:"sector_size"`
+	CloneAlignment uint32 `json:"clone_alignment"`
+	// CsumType is the checksum algorithm. Kernels before 5.5 always report crc32c.
+	CsumType CsumType `json:"csum_type"`
+	// Generation is the current transaction id. It is zero on kernels before 5.5.
+	Generation uint64 `json:"generation,omitempty"`
 }
 
 func (f *FS) Info() (out Info, err error) {
 	var arg btrfs_ioctl_fs_info_args
-	arg, err = iocFsInfo(f.f)
+	arg, err = iocFsInfo(f.file())
 	if err == nil {
 		out = Info{
 			MaxID:          arg.max_id,
@@ -72,29 +169,44 @@ func (f *FS) Info() (out Info, err error) {
 			SectorSize:     arg.sectorsize,
 			CloneAlignment: arg.clone_alignment,
 		}
+		if arg.flags&_BTRFS_FS_INFO_FLAG_CSUM_INFO != 0 {
+			out.CsumType = CsumType(arg.csum_type)
+		}
+		if arg.flags&_BTRFS_FS_INFO_FLAG_GENERATION != 0 {
+			out.Generation = arg.generation
+		}
 	}
 	return
 }
 
 type DevStats struct {
-	WriteErrs uint64
-	ReadErrs  uint64
-	FlushErrs uint64
+	WriteErrs uint64 `json:"write_errs"`
+	ReadErrs  uint64 `json:"read_errs"`
+	FlushErrs uint64 `json:"flush_errs"`
 	// Checksum error, bytenr error or contents is illegal: this is an
 	// indication that the block was damaged during read or write, or written to
 	// wrong location or read from wrong location.
-	CorruptionErrs uint64
+	CorruptionErrs uint64 `json:"corruption_errs"`
 	// An indication that blocks have not been written.
-	GenerationErrs uint64
-	Unknown        []uint64
+	GenerationErrs uint64   `json:"generation_errs"`
+	Unknown        []uint64 `json:"unknown,omitempty"`
 }
 
 func (f *FS) GetDevStats(id uint64) (out DevStats, err error) {
+	return f.getDevStats(id, 0)
+}
+
+// ResetDevStats resets error counters of a device. It returns counter values before the reset.
+func (f *FS) ResetDevStats(id uint64) (DevStats, error) {
+	return f.getDevStats(id, _BTRFS_DEV_STATS_RESET)
+}
+
+func (f *FS) getDevStats(id uint64, flags uint64) (out DevStats, err error) {
 	var arg btrfs_ioctl_get_dev_stats
 	arg.devid = id
-	//arg.nr_items = _BTRFS_DEV_STAT_VALUES_MAX
-	arg.flags = 0
-	if err = ioctl.Do(f.f, _BTRFS_IOC_GET_DEV_STATS, &arg); err != nil {
+	arg.nr_items = _BTRFS_DEV_STAT_VALUES_MAX
+	arg.flags = flags
+	if err = doIoctl(f.file(), _BTRFS_IOC_GET_DEV_STATS, &arg); err != nil {
 		return
 	}
 	i := 0
@@ -115,14 +227,14 @@ func (f *FS) GetDevStats(id uint64) (out DevStats, err error) {
 }
 
 type FSFeatureFlags struct {
-	Compatible   FeatureFlags
-	CompatibleRO FeatureFlags
-	Incompatible IncompatFeatures
+	Compatible   CompatFeatures   `json:"compat"`
+	CompatibleRO FeatureFlags     `json:"compat_ro"`
+	Incompatible IncompatFeatures `json:"incompat"`
 }
 
 func (f *FS) GetFeatures() (out FSFeatureFlags, err error) {
 	var arg btrfs_ioctl_feature_flags
-	if err = ioctl.Do(f.f, _BTRFS_IOC_GET_FEATURES, &arg); err != nil {
+	if err = doIoctl(f.file(), _BTRFS_IOC_GET_FEATURES, &arg); err != nil {
 		return
 	}
 	out = FSFeatureFlags{
@@ -135,7 +247,7 @@ func (f *FS) GetFeatures() (out FSFeatureFlags, err error) {
 
 func (f *FS) GetSupportedFeatures() (out FSFeatureFlags, err error) {
 	var arg [3]btrfs_ioctl_feature_flags
-	if err = ioctl.Do(f.f, _BTRFS_IOC_GET_SUPPORTED_FEATURES, &arg); err != nil {
+	if err = doIoctl(f.file(), _BTRFS_IOC_GET_SUPPORTED_FEATURES, &arg); err != nil {
 		return
 	}
 	out = FSFeatureFlags{
@@ -153,112 +265,230 @@ func (f *FS) GetSupportedFeatures() (out FSFeatureFlags, err error) {
 	return
 }
 
+// GetFlags returns flags of the subvolume that contains the opened directory.
 func (f *FS) GetFlags() (SubvolFlags, error) {
-	return iocSubvolGetflags(f.f)
+	sub, err := openSubvolumeRoot(f.f)
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Close()
+	return iocSubvolGetflags(sub)
 }
 
+// SetFlags sets flags of the subvolume that contains the opened directory.
 func (f *FS) SetFlags(flags SubvolFlags) error {
-	return iocSubvolSetflags(f.f, flags)
+	sub, err := openSubvolumeRoot(f.f)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	return iocSubvolSetflags(sub, flags)
 }
 
-func (f *FS) Sync() (err error) {
-	if err = ioctl.Ioctl(f.f, _BTRFS_IOC_START_SYNC, 0); err != nil {
-		return
+// Sync commits the current transaction and waits for the commit to complete.
+func (f *FS) Sync() error {
+	transid, err := f.StartSync()
+	if err != nil {
+		return err
 	}
-	return ioctl.Ioctl(f.f, _BTRFS_IOC_WAIT_SYNC, 0)
+	return f.WaitSync(transid)
+}
+
+// StartSync starts a commit of the current transaction without waiting for it to complete.
+// It returns the id of the transaction that is being committed, which can be passed to WaitSync.
+func (f *FS) StartSync() (uint64, error) {
+	var transid uint64
+	if err := iocStartSync(f.file(), &transid); err != nil {
+		return 0, err
+	}
+	return transid, nil
+}
+
+// WaitSync waits until the transaction with a given id is committed to disk.
+// Zero transid waits for the commit of the current transaction.
+// It fails with EINVAL if the transaction was not started yet.
+func (f *FS) WaitSync(transid uint64) error {
+	return iocWaitSync(f.file(), &transid)
 }
 
+// CreateSubVolume creates a subvolume. Relative paths are resolved against the opened directory.
 func (f *FS) CreateSubVolume(name string) error {
-	return CreateSubVolume(filepath.Join(f.f.Name(), name))
+	return f.CreateSubVolumeWithOptions(name, CreateOptions{})
+}
+
+func (f *FS) CreateSubVolumeWithOptions(name string, opts CreateOptions) error {
+	return createSubVolumeAt(f.f, name, opts)
 }
 
 func (f *FS) DeleteSubVolume(name string) error {
-	return DeleteSubVolume(filepath.Join(f.f.Name(), name))
+	return deleteSubVolumeAt(f.f, name)
+}
+
+// DeleteSubVolumeWithOptions deletes a subvolume relative to the opened directory.
+// See DeleteSubVolumeWithOptions.
+func (f *FS) DeleteSubVolumeWithOptions(name string, opts DeleteOptions) error {
+	return deleteSubVolumesAt(f.f, opts, []string{name})
+}
+
+// DeleteSubVolumes deletes subvolumes relative to the opened directory. See DeleteSubVolumes.
+func (f *FS) DeleteSubVolumes(opts DeleteOptions, names ...string) error {
+	return deleteSubVolumesAt(f.f, opts, names)
 }
 
+func (f *FS) DeleteSubVolumeRecursive(name string) error {
+	return deleteSubVolumeRecursiveAt(f.f, name)
+}
+
+// Snapshot creates a snapshot of the subvolume that contains the opened directory.
 func (f *FS) Snapshot(dst string, ro bool) error {
-	return SnapshotSubVolume(f.f.Name(), filepath.Join(f.f.Name(), dst), ro)
+	src, err := openSubvolumeRoot(f.f)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	// the path of the root may be unknown if the FS was created from a file descriptor
+	name := filepath.Base(src.Name())
+	if args, err := iocGetSubvolInfo(src); err == nil {
+		var info SubvolInfo
+		info.fillFromArgs(&args)
+		name = info.Name
+	}
+	return snapshotAt(src, name, f.f, dst, SnapshotOptions{ReadOnly: ro})
 }
 
 func (f *FS) SnapshotSubVolume(name string, dst string, ro bool) error {
-	return SnapshotSubVolume(filepath.Join(f.f.Name(), name),
-		filepath.Join(f.f.Name(), dst), ro)
+	return f.SnapshotSubVolumeWithOptions(name, dst, SnapshotOptions{ReadOnly: ro})
 }
 
-func (f *FS) Send(w io.Writer, parent string, subvols ...string) error {
-	if parent != "" {
-		parent = filepath.Join(f.f.Name(), parent)
-	}
-	sub := make([]string, 0, len(subvols))
-	for _, s := range subvols {
-		sub = append(sub, filepath.Join(f.f.Name(), s))
+func (f *FS) SnapshotSubVolumeWithOptions(name string, dst string, opts SnapshotOptions) error {
+	src, err := openSubvolumeAt("snapshot subvolume", f.f, name)
+	if err != nil {
+		return err
 	}
-	return Send(w, parent, sub...)
+	defer src.Close()
+	return snapshotAt(src, filepath.Base(src.Name()), f.f, dst, opts)
+}
+
+func (f *FS) Send(w io.Writer, parent string, subvols ...string) error {
+	return f.SendWithOptions(w, SendOptions{Parent: parent}, subvols...)
+}
+
+func (f *FS) SendWithOptions(w io.Writer, opts SendOptions, subvols ...string) error {
+	return sendAt(context.Background(), f.f, w, opts, subvols...)
+}
+
+// SendEstimate returns an estimated size of the send stream for given subvolumes.
+// See SendEstimate for details.
+func (f *FS) SendEstimate(parent string, subvols ...string) (uint64, error) {
+	return sendEstimate(func(w io.Writer) error {
+		return f.SendWithOptions(w, SendOptions{Parent: parent, NoFileData: true}, subvols...)
+	})
 }
 
 func (f *FS) Receive(r io.Reader) error {
-	return Receive(r, f.f.Name())
+	return receiveAt(context.Background(), r, f.f, ".")
 }
 
 func (f *FS) ReceiveTo(r io.Reader, mount string) error {
-	return Receive(r, filepath.Join(f.f.Name(), mount))
+	return receiveAt(context.Background(), r, f.f, mount)
 }
 
+// ListSubvolumes returns all subvolumes of the filesystem that match the filter.
+// See SubvolumeIter for a version that doesn't keep the whole list in memory.
+//
+// Without CAP_SYS_ADMIN, it lists only subvolumes under the opened one that are accessible
+// by the user, with paths relative to it. This requires kernel 4.18+.
 func (f *FS) ListSubvolumes(filter func(SubvolInfo) bool) ([]SubvolInfo, error) {
-	m, err := listSubVolumes(f.f, filter)
-	if err != nil {
-		return nil, err
+	var out []SubvolInfo
+	it := f.SubvolumeIter()
+	for it.Next() {
+		if v := it.Subvolume(); filter == nil || filter(v) {
+			out = append(out, v)
+		}
 	}
-	out := make([]SubvolInfo, 0, len(m))
-	for _, v := range m {
-		out = append(out, v)
+	if err := it.Err(); err != nil {
+		return nil, err
 	}
 	return out, nil
 }
 
 func (f *FS) SubvolumeByUUID(uuid UUID) (*SubvolInfo, error) {
-	id, err := lookupUUIDSubvolItem(f.f, uuid)
+	id, err := lookupUUIDSubvolItem(f.file(), uuid)
 	if err != nil {
 		return nil, err
 	}
-	return subvolSearchByRootID(f.f, id, "")
+	return subvolSearchByRootID(f.file(), id, "")
+}
+
+// SubvolumeByID returns information about a subvolume with a given tree id.
+// It returns ErrNotFound if subvolume does not exist.
+func (f *FS) SubvolumeByID(id uint64) (*SubvolInfo, error) {
+	return subvolSearchByRootID(f.file(), objectID(id), "")
 }
 
 func (f *FS) SubvolumeByReceivedUUID(uuid UUID) (*SubvolInfo, error) {
-	id, err := lookupUUIDReceivedSubvolItem(f.f, uuid)
+	id, err := lookupUUIDReceivedSubvolItem(f.file(), uuid)
 	if err != nil {
 		return nil, err
 	}
-	return subvolSearchByRootID(f.f, id, "")
+	return subvolSearchByRootID(f.file(), id, "")
 }
 
-func (f *FS) SubvolumeByPath(path string) (*SubvolInfo, error) {
-	return subvolSearchByPath(f.f, path)
+// FindReceivedSubvolume finds a local copy of the subvolume with a given UUID and transaction id,
+// as referenced by parent and clone sources in incremental send streams.
+//
+// Subvolumes received from the given UUID at the given transaction are preferred, followed by
+// the original subvolume if it exists on this filesystem. Zero transid matches any transaction.
+// It returns ErrNotFound if there is no such subvolume.
+func (f *FS) FindReceivedSubvolume(uuid UUID, transid uint64) (*SubvolInfo, error) {
+	ids, err := uuidTreeLookupAll(f.file(), uuid, uuidKeyReceivedSubvol)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	for _, id := range ids {
+		info, err := subvolSearchByRootID(f.file(), id, "")
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if transid == 0 || info.STransID == transid {
+			return info, nil
+		}
+	}
+	info, err := f.SubvolumeByUUID(uuid)
+	if err != nil {
+		return nil, err
+	} else if transid != 0 && info.CTransID != transid {
+		return nil, ErrNotFound
+	}
+	return info, nil
 }
 
-func (f *FS) Usage() (UsageInfo, error) { return spaceUsage(f.f) }
-
-func (f *FS) Balance(flags BalanceFlags) (BalanceProgress, error) {
-	args := btrfs_ioctl_balance_args{flags: flags}
-	err := iocBalanceV2(f.f, &args)
-	return args.stat, err
+// SetReceivedSubvolume sets the received UUID and transaction id of a subvolume.
+// Relative paths are resolved against the opened directory. See SetReceivedSubvolume for details.
+func (f *FS) SetReceivedSubvolume(path string, uuid UUID, stransid uint64) error {
+	sub, err := openAt(f.f, path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	return setReceivedSubvolume(sub, uuid, stransid)
 }
 
-func (f *FS) Resize(size int64) error {
-	amount := strconv.FormatInt(size, 10)
-	args := &btrfs_ioctl_vol_args{}
-	args.SetName(amount)
-	if err := iocResize(f.f, args); err != nil {
-		return fmt.Errorf("resize failed: %v", err)
-	}
-	return nil
+// DirFS returns a read-only io/fs view of the filesystem. See DirFS for details.
+//
+// Files are opened relative to the open directory, thus the view stays valid if it was moved.
+// The file system must not be used after FS is closed.
+func (f *FS) DirFS() fs.FS {
+	return dirFSAt(f.f)
 }
 
-func (f *FS) ResizeToMax() error {
-	args := &btrfs_ioctl_vol_args{}
-	args.SetName("max")
-	if err := iocResize(f.f, args); err != nil {
-		return fmt.Errorf("resize failed: %v", err)
-	}
-	return nil
+// SubvolumeByPath returns information about the subvolume that contains a given path.
+// Relative paths are resolved against the opened directory. Path of the result is set
+// to the path as given.
+func (f *FS) SubvolumeByPath(path string) (*SubvolInfo, error) {
+	return subvolSearchByPath(f.f, path)
 }
+
+func (f *FS) Usage() (UsageInfo, error) { return spaceUsage(f.file()) }
@@ -1,39 +1,203 @@
 package btrfs
 
-import "strings"
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 const maxUint64 = 1<<64 - 1
 
 const labelSize = 256
 
+// CompatFeatures are compatible features of the filesystem. None are currently defined.
+type CompatFeatures uint64
+
+var compatFeatureNames featureTable
+
+func (f CompatFeatures) names() []string {
+	return flagNames(uint64(f), compatFeatureNames.jsonNames())
+}
+
+func (f CompatFeatures) String() string {
+	return strings.Join(flagNames(uint64(f), compatFeatureNames.displayNames()), ",")
+}
+
+// MarshalJSON encodes flags as a list of names.
+func (f CompatFeatures) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.names())
+}
+
+// UnmarshalJSON decodes a list of flag names.
+func (f *CompatFeatures) UnmarshalJSON(p []byte) error {
+	v, err := unmarshalFlags(p, compatFeatureNames.jsonNames())
+	*f = CompatFeatures(v)
+	return err
+}
+
+// FeatureFlags are read-only compatible features of the filesystem.
 type FeatureFlags uint64
 
 const (
-	FeatureCompatROFreeSpaceTree = FeatureFlags(1 << 0)
+	FeatureCompatROFreeSpaceTree      = FeatureFlags(1 << 0)
+	FeatureCompatROFreeSpaceTreeValid = FeatureFlags(1 << 1)
+	FeatureCompatROVerity             = FeatureFlags(1 << 2)
+	FeatureCompatROBlockGroupTree     = FeatureFlags(1 << 3)
 )
 
+var compatROFeatureNames = featureTable{
+	{"FreeSpaceTree", "free-space-tree"},
+	{"FreeSpaceTreeValid", "free-space-tree-valid"},
+	{"Verity", "verity"},
+	{"BlockGroupTree", "block-group-tree"},
+}
+
+func (f FeatureFlags) names() []string {
+	return flagNames(uint64(f), compatROFeatureNames.jsonNames())
+}
+
+func (f FeatureFlags) String() string {
+	return strings.Join(flagNames(uint64(f), compatROFeatureNames.displayNames()), ",")
+}
+
+// MarshalJSON encodes flags as a list of names.
+func (f FeatureFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.names())
+}
+
+// UnmarshalJSON decodes a list of flag names.
+func (f *FeatureFlags) UnmarshalJSON(p []byte) error {
+	v, err := unmarshalFlags(p, compatROFeatureNames.jsonNames())
+	*f = FeatureFlags(v)
+	return err
+}
+
+// IncompatFeatures are incompatible features of the filesystem.
 type IncompatFeatures uint64
 
+func (f IncompatFeatures) names() []string {
+	return flagNames(uint64(f), incompatFeatureNames.jsonNames())
+}
+
 func (f IncompatFeatures) String() string {
-	var s []string
-	for i, name := range incompatFeatureNames {
-		if uint64(f)&uint64(i) != 0 {
-			s = append(s, name)
+	return strings.Join(flagNames(uint64(f), incompatFeatureNames.displayNames()), ",")
+}
+
+// MarshalJSON encodes flags as a list of names.
+func (f IncompatFeatures) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.names())
+}
+
+// UnmarshalJSON decodes a list of flag names.
+func (f *IncompatFeatures) UnmarshalJSON(p []byte) error {
+	v, err := unmarshalFlags(p, incompatFeatureNames.jsonNames())
+	*f = IncompatFeatures(v)
+	return err
+}
+
+// featureName holds the names of a feature bit.
+type featureName struct {
+	json    string // name used in JSON, e.g. "NoHoles"
+	display string // name shown in /sys/fs/btrfs/features and accepted by btrfs-progs, e.g. "no-holes"
+}
+
+// featureTable lists names of feature bits, indexed by the bit number.
+type featureTable []featureName
+
+// jsonNames returns JSON names of all bits in a form accepted by flagNames.
+func (t featureTable) jsonNames() []string {
+	out := make([]string, len(t))
+	for i, n := range t {
+		out[i] = n.json
+	}
+	return out
+}
+
+// displayNames returns human-readable names of all bits in a form accepted by flagNames.
+func (t featureTable) displayNames() []string {
+	out := make([]string, len(t))
+	for i, n := range t {
+		out[i] = n.display
+	}
+	return out
+}
+
+// flagNames returns names of bits set in v, where names[i] is the name of bit i.
+// Unknown bits are returned as hex numbers.
+func flagNames(v uint64, names []string) []string {
+	out := []string{}
+	for i, name := range names {
+		if name != "" && v&(1<<uint(i)) != 0 {
+			out = append(out, name)
+			v &^= 1 << uint(i)
 		}
 	}
-	return strings.Join(s, ",")
+	if v != 0 {
+		out = append(out, "0x"+strconv.FormatUint(v, 16))
+	}
+	return out
 }
 
-var incompatFeatureNames = []string{
-	"DefaultSubvol",
-	"MixedGroups",
-	"CompressLZO",
-	"CompressLZOv2",
-	"BigMetadata",
-	"ExtendedIRef",
-	"RAID56",
-	"SkinnyMetadata",
-	"NoHoles",
+// flagAliases maps old flag names to the names used by flagNames. They are only accepted when parsing.
+var flagAliases = map[string]string{
+	"CompressLZOv2": "CompressZSTD",
+}
+
+// parseFlagNames is the reverse of flagNames.
+func parseFlagNames(list []string, names []string) (uint64, error) {
+	var v uint64
+loop:
+	for _, s := range list {
+		if a, ok := flagAliases[s]; ok {
+			s = a
+		}
+		if strings.HasPrefix(s, "0x") {
+			x, err := strconv.ParseUint(s[2:], 16, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid flag: %q", s)
+			}
+			v |= x
+			continue
+		}
+		for i, name := range names {
+			if name != "" && name == s {
+				v |= 1 << uint(i)
+				continue loop
+			}
+		}
+		return 0, fmt.Errorf("unknown flag: %q", s)
+	}
+	return v, nil
+}
+
+// unmarshalFlags decodes a list of flag names encoded by flagNames.
+func unmarshalFlags(p []byte, names []string) (uint64, error) {
+	var list []string
+	if err := json.Unmarshal(p, &list); err != nil {
+		return 0, err
+	}
+	return parseFlagNames(list, names)
+}
+
+var incompatFeatureNames = featureTable{
+	{"MixedBackRef", "mixed-backref"},
+	{"DefaultSubvol", "default-subvol"},
+	{"MixedGroups", "mixed-groups"},
+	{"CompressLZO", "compress-lzo"},
+	{"CompressZSTD", "compress-zstd"},
+	{"BigMetadata", "big-metadata"},
+	{"ExtendedIRef", "extended-iref"},
+	{"RAID56", "raid56"},
+	{"SkinnyMetadata", "skinny-metadata"},
+	{"NoHoles", "no-holes"},
+	{"MetadataUUID", "metadata-uuid"},
+	{"RAID1C34", "raid1c34"},
+	{"Zoned", "zoned"},
+	{"ExtentTreeV2", "extent-tree-v2"},
+	{"RAIDStripeTree", "raid-stripe-tree"},
+	{},
+	{"SimpleQuota", "simple-quota"},
 }
 
 const (
@@ -42,10 +206,11 @@ const (
 	FeatureIncompatMixedGroups   = IncompatFeatures(1 << 2)
 	FeatureIncompatCompressLZO   = IncompatFeatures(1 << 3)
 
-	// Some patches floated around with a second compression method
-	// lets save that incompat here for when they do get in.
-	// Note we don't actually support it, we're just reserving the number.
-	FeatureIncompatCompressLZOv2 = IncompatFeatures(1 << 4)
+	FeatureIncompatCompressZSTD = IncompatFeatures(1 << 4)
+	// The bit was originally reserved for a second LZO version, which was never merged.
+	//
+	// Deprecated: use FeatureIncompatCompressZSTD.
+	FeatureIncompatCompressLZOv2 = FeatureIncompatCompressZSTD
 
 	// Older kernels tried to do bigger metadata blocks, but the
 	// code was pretty buggy. Lets not let them try anymore.
@@ -55,6 +220,12 @@ const (
 	FeatureIncompatRAID56         = IncompatFeatures(1 << 7)
 	FeatureIncompatSkinnyMetadata = IncompatFeatures(1 << 8)
 	FeatureIncompatNoHoles        = IncompatFeatures(1 << 9)
+	FeatureIncompatMetadataUUID   = IncompatFeatures(1 << 10)
+	FeatureIncompatRAID1C34       = IncompatFeatures(1 << 11)
+	FeatureIncompatZoned          = IncompatFeatures(1 << 12)
+	FeatureIncompatExtentTreeV2   = IncompatFeatures(1 << 13)
+	FeatureIncompatRAIDStripeTree = IncompatFeatures(1 << 14)
+	FeatureIncompatSimpleQuota    = IncompatFeatures(1 << 16)
 )
 
 // Flags definition for balance.
@@ -71,3 +242,112 @@ const (
 	BalanceForce  = BalanceFlags(1 << 3)
 	BalanceResume = BalanceFlags(1 << 4)
 )
+
+// Profile is a block group (chunk) allocation profile.
+type Profile uint64
+
+const (
+	ProfileRAID0  = Profile(blockGroupRaid0)
+	ProfileRAID1  = Profile(blockGroupRaid1)
+	ProfileDup    = Profile(blockGroupDup)
+	ProfileRAID10 = Profile(blockGroupRaid10)
+	ProfileRAID5  = Profile(blockGroupRaid5)
+	ProfileRAID6  = Profile(blockGroupRaid6)
+	// ProfileRAID1C3 and ProfileRAID1C4 keep 3 and 4 copies of data. They require FeatureIncompatRAID1C34.
+	ProfileRAID1C3 = Profile(blockGroupRaid1c3)
+	ProfileRAID1C4 = Profile(blockGroupRaid1c4)
+	// ProfileSingle is an extended profile bit that denotes chunks without redundancy.
+	// It is only valid for balance filters.
+	ProfileSingle = Profile(availAllocBitSingle)
+)
+
+var profileNames = []struct {
+	p    Profile
+	name string
+}{
+	{ProfileSingle, "single"},
+	{ProfileRAID0, "raid0"},
+	{ProfileRAID1, "raid1"},
+	{ProfileDup, "dup"},
+	{ProfileRAID10, "raid10"},
+	{ProfileRAID5, "raid5"},
+	{ProfileRAID6, "raid6"},
+	{ProfileRAID1C3, "raid1c3"},
+	{ProfileRAID1C4, "raid1c4"},
+}
+
+func (p Profile) String() string {
+	if p == 0 {
+		return "single"
+	}
+	var s []string
+	for _, v := range profileNames {
+		if p&v.p != 0 {
+			s = append(s, v.name)
+			p &^= v.p
+		}
+	}
+	if p != 0 {
+		s = append(s, "0x"+strconv.FormatUint(uint64(p), 16))
+	}
+	return strings.Join(s, "|")
+}
+
+// MarshalText encodes the profile as its name.
+func (p Profile) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// ParseProfile parses a profile name, as used by btrfs-progs.
+func ParseProfile(s string) (Profile, error) {
+	s = strings.ToLower(s)
+	for _, v := range profileNames {
+		if v.name == s {
+			return v.p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown profile: %q", s)
+}
+
+// BlockGroupFlags describes the type and the profile of a block group (chunk).
+type BlockGroupFlags uint64
+
+const (
+	BlockGroupData     = BlockGroupFlags(blockGroupData)
+	BlockGroupSystem   = BlockGroupFlags(blockGroupSystem)
+	BlockGroupMetadata = BlockGroupFlags(blockGroupMetadata)
+	// BlockGroupGlobalReserve is a fake block group type used to report global reserve.
+	BlockGroupGlobalReserve = BlockGroupFlags(spaceInfoGlobalRsv)
+
+	blockGroupTypeMask = BlockGroupData | BlockGroupSystem | BlockGroupMetadata | BlockGroupGlobalReserve
+)
+
+// Type returns the type bits of the block group.
+func (f BlockGroupFlags) Type() BlockGroupFlags {
+	return f & blockGroupTypeMask
+}
+
+// Profile returns the profile of the block group. Zero profile means "single".
+func (f BlockGroupFlags) Profile() Profile {
+	return Profile(f) & Profile(_BTRFS_BLOCK_GROUP_PROFILE_MASK)
+}
+
+func (f BlockGroupFlags) String() string {
+	var s []string
+	if f&BlockGroupData != 0 {
+		s = append(s, "Data")
+	}
+	if f&BlockGroupMetadata != 0 {
+		s = append(s, "Metadata")
+	}
+	if f&BlockGroupSystem != 0 {
+		s = append(s, "System")
+	}
+	if f&BlockGroupGlobalReserve != 0 {
+		s = append(s, "GlobalReserve")
+	}
+	if len(s) == 0 {
+		s = append(s, "unknown")
+	}
+	return strings.Join(s, "+") + ", " + f.Profile().String()
+}
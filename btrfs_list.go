@@ -1,8 +1,11 @@
 package btrfs
 
-import "os"
+import (
+	"os"
+	"syscall"
+)
 
-func getFileRootID(file *os.File) (objectID, error) {
+func getFileRootID(file ioctlFile) (objectID, error) {
 	args := btrfs_ioctl_ino_lookup_args{
 		objectid: firstFreeObjectid,
 	}
@@ -12,11 +15,29 @@ func getFileRootID(file *os.File) (objectID, error) {
 	return args.treeid, nil
 }
 
-func getPathRootID(path string) (objectID, error) {
-	fs, err := Open(path, true)
+// rootIDAt returns the id of the subvolume that contains a path relative to dir. See openAt.
+func rootIDAt(dir *os.File, path string) (objectID, error) {
+	f, err := openAt(dir, path, syscall.O_RDONLY, 0)
 	if err != nil {
 		return 0, err
 	}
-	defer fs.Close()
-	return getFileRootID(fs.f)
+	defer f.Close()
+	id, err := getFileRootID(f)
+	if err == syscall.ENOTTY {
+		return 0, ErrNotBtrfs{Path: f.Name()}
+	} else if err != nil {
+		return 0, &os.PathError{Op: "ino lookup", Path: f.Name(), Err: err}
+	}
+	return id, nil
+}
+
+// SubvolumeID returns the id of the subvolume that contains a given file or directory.
+// It doesn't require CAP_SYS_ADMIN.
+func SubvolumeID(path string) (uint64, error) {
+	id, err := getPathRootID(path)
+	return uint64(id), err
+}
+
+func getPathRootID(path string) (objectID, error) {
+	return rootIDAt(nil, path)
 }
@@ -1,6 +1,8 @@
 package btrfs
 
 import (
+	"bytes"
+	"errors"
 	"github.com/dennwc/btrfs/test"
 	"io"
 	"io/ioutil"
@@ -8,6 +10,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"syscall"
 	"testing"
 )
 
@@ -25,6 +28,393 @@ func TestOpen(t *testing.T) {
 	}
 }
 
+func TestOpenDir(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	sub := filepath.Join(dir, "sub")
+	if err := CreateSubVolume(sub); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(sub, "a", "b")
+	if err := os.MkdirAll(plain, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsBtrfs(plain); err != nil || !ok {
+		t.Fatalf("expected btrfs: %v, %v", ok, err)
+	} else if ok, err = IsBtrfs("/proc"); err != nil || ok {
+		t.Fatalf("expected non-btrfs: %v, %v", ok, err)
+	}
+	fs, err := Open(plain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.Snapshot("snap", true); err != nil {
+		t.Fatal(err)
+	}
+	// snapshot of the containing subvolume has the same directory tree
+	if _, err = os.Stat(filepath.Join(plain, "snap", "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	// flags are applied to the containing subvolume as well
+	if err = fs.SetFlags(SubvolReadOnly); err != nil {
+		t.Fatal(err)
+	} else if ro, err := IsReadOnly(sub); err != nil {
+		t.Fatal(err)
+	} else if !ro {
+		t.Fatal("expected the subvolume to be read-only")
+	}
+	if flags, err := fs.GetFlags(); err != nil {
+		t.Fatal(err)
+	} else if !flags.ReadOnly() {
+		t.Fatalf("unexpected flags: %v", flags)
+	}
+}
+
+func TestFromFd(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fd, err := syscall.Open(dir, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := FromFd(uintptr(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err = fs.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	} else if ok, err := IsSubVolume(filepath.Join(dir, "sub")); err != nil || !ok {
+		t.Fatalf("expected a subvolume: %v, %v", ok, err)
+	}
+}
+
+func TestOpenMoved(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	if err := CreateSubVolume(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := Open(filepath.Join(dir, "a"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	moved := filepath.Join(dir, "b")
+	if err = os.Rename(filepath.Join(dir, "a"), moved); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	} else if err = fs.SnapshotSubVolume("sub", "snap", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sub", "snap"} {
+		if ok, err := IsSubVolume(filepath.Join(moved, name)); err != nil || !ok {
+			t.Fatalf("expected a subvolume at %s: %v, %v", name, ok, err)
+		}
+	}
+	if err = fs.Send(ioutil.Discard, "", "snap"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.SubvolumeByPath("sub"); err != nil {
+		t.Fatal(err)
+	} else if info.Name != "sub" {
+		t.Fatalf("unexpected subvolume: %q", info.Name)
+	}
+	if info, err := fs.SubvolumeInfo("snap"); err != nil {
+		t.Fatal(err)
+	} else if info.Name != "snap" {
+		t.Fatalf("unexpected subvolume: %q", info.Name)
+	}
+	if err = ioutil.WriteFile(filepath.Join(moved, "sub", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	} else if err = fs.Defrag("sub/file", DefragOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.DeleteSubVolume("snap"); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(moved, "snap")); !os.IsNotExist(err) {
+		t.Fatalf("expected the snapshot to be deleted: %v", err)
+	}
+}
+
+func TestContainingSubvolume(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	sub := filepath.Join(dir, "sub")
+	if err := CreateSubVolume(sub); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(sub, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(sub, "a", "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := ContainingSubvolume(file)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp, _ := filepath.EvalSymlinks(sub); root != exp {
+		t.Fatalf("unexpected root: %q vs %q", root, exp)
+	}
+	id, err := SubvolumeID(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subID, err := SubvolumeID(sub)
+	if err != nil {
+		t.Fatal(err)
+	} else if id != subID || id <= uint64(fsTreeObjectid) {
+		t.Fatalf("unexpected ids: %d vs %d", id, subID)
+	}
+	if topID, err := SubvolumeID(dir); err != nil {
+		t.Fatal(err)
+	} else if topID == id {
+		t.Fatal("expected different subvolume ids")
+	}
+}
+
+func TestDeleteSubVolumesCommit(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	for _, mode := range []DeleteCommit{CommitNone, CommitAfter, CommitEach} {
+		names := []string{"a", "b", "c"}
+		for _, name := range names {
+			if err = fs.CreateSubVolume(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// start deletions in a new transaction
+		if err = fs.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		before, err := fs.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fs.DeleteSubVolumes(DeleteOptions{Commit: mode}, names...); err != nil {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+		after, err := fs.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// each commit ends a transaction, and the next deletion starts a new one
+		commits := uint64(0)
+		switch mode {
+		case CommitAfter:
+			commits = 1
+		case CommitEach:
+			commits = uint64(len(names))
+		}
+		if before.Generation != 0 && after.Generation < before.Generation+commits {
+			t.Fatalf("mode %d: expected at least %d commits, generation: %d -> %d",
+				mode, commits, before.Generation, after.Generation)
+		}
+		for _, name := range names {
+			if _, err = os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Fatalf("mode %d: expected %s to be deleted: %v", mode, name, err)
+			}
+		}
+	}
+	if err = fs.DeleteSubVolumes(DeleteOptions{Commit: CommitAfter}, "missing"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSnapshotSet(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	for _, name := range []string{"db", "wal", "snaps"} {
+		if err = fs.CreateSubVolume(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quiesced, resumed := false, false
+	err = fs.SnapshotSetWithOptions([]SnapshotSpec{
+		{Source: "db", Dest: "snaps/db", SnapshotOptions: SnapshotOptions{ReadOnly: true}},
+		{Source: "wal", Dest: "snaps"},
+	}, SnapshotSetOptions{Quiesce: func() (func(), error) {
+		quiesced = true
+		return func() { resumed = true }, nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !quiesced || !resumed {
+		t.Fatalf("unexpected quiesce state: %v, %v", quiesced, resumed)
+	}
+	for _, name := range []string{"db", "wal"} {
+		if ok, err := IsSubVolume(filepath.Join(dir, "snaps", name)); err != nil || !ok {
+			t.Fatalf("expected a snapshot at %s: %v, %v", name, ok, err)
+		}
+	}
+	if ro, err := IsReadOnly(filepath.Join(dir, "snaps", "db")); err != nil || !ro {
+		t.Fatalf("expected a read-only snapshot: %v, %v", ro, err)
+	}
+	// the second snapshot fails in a read-only subvolume, thus the first one must be deleted
+	err = fs.SnapshotSet([]SnapshotSpec{
+		{Source: "db", Dest: "db2"},
+		{Source: "wal", Dest: "snaps/db/wal"},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	} else if _, err = os.Stat(filepath.Join(dir, "db2")); !os.IsNotExist(err) {
+		t.Fatalf("expected the snapshot to be deleted: %v", err)
+	}
+}
+
+func TestPromoteSnapshot(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.CreateSubVolume("live"); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "live", "file")
+	if err = ioutil.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.SnapshotSubVolume("live", "ro", true); err != nil {
+		t.Fatal(err)
+	} else if err = fs.PromoteSnapshot("live", "ro"); !errors.Is(err, ErrReadOnlySnapshot) {
+		t.Fatalf("expected ErrReadOnlySnapshot, got: %v", err)
+	}
+	if err = fs.SnapshotSubVolume("live", "next", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "next", "file"), []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check := func(exp string) {
+		t.Helper()
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(data) != exp {
+			t.Fatalf("unexpected data: %q vs %q", data, exp)
+		}
+	}
+	if err = fs.PromoteSnapshot("live", "next"); err != nil {
+		t.Fatal(err)
+	}
+	check("v2")
+	// promoting again rolls back
+	if err = fs.PromoteSnapshot("live", "next"); err != nil {
+		t.Fatal(err)
+	}
+	check("v1")
+}
+
+func TestTempSubvolume(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = os.Mkdir(filepath.Join(dir, "layers"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := fs.CreateTempSubvolume("layers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Discard()
+	if ok, err := IsSubVolume(tmp.Path()); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected a subvolume")
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmp.Path(), "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, "layers", "taken"), 0755); err != nil {
+		t.Fatal(err)
+	} else if err = tmp.Promote("taken"); !errors.Is(err, syscall.EEXIST) {
+		t.Fatalf("expected EEXIST, got: %v", err)
+	}
+	if err = tmp.Promote("top"); err != nil {
+		t.Fatal(err)
+	}
+	final := filepath.Join(dir, "layers", "top")
+	if tmp.Path() != final {
+		t.Fatalf("unexpected path: %q", tmp.Path())
+	} else if data, err := ioutil.ReadFile(filepath.Join(final, "file")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "data" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+	// discarding a promoted subvolume does nothing
+	if err = tmp.Discard(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(final); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err = CreateTempSubvolume(filepath.Join(dir, "layers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tmp.Path()
+	if err = CreateSubVolume(filepath.Join(path, "nested")); err != nil {
+		t.Fatal(err)
+	} else if err = tmp.Discard(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the subvolume to be deleted, got: %v", err)
+	} else if err = tmp.Promote("other"); err == nil {
+		t.Fatal("expected promote to fail after discard")
+	}
+
+	// the subvolume can be opened after its parent directory is moved
+	tmp, err = fs.CreateTempSubvolume("layers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Discard()
+	if err = os.Rename(filepath.Join(dir, "layers"), filepath.Join(dir, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := tmp.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if ok, err := isSubvolumeFile(sub); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected a subvolume")
+	}
+	if err = tmp.Promote("moved-top"); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(dir, "moved", "moved-top")); err != nil {
+		t.Fatal(err)
+	} else if _, err = tmp.Open(); err == nil {
+		t.Fatal("expected open to fail after promote")
+	}
+}
+
 func TestIsSubvolume(t *testing.T) {
 	dir, closer := btrfstest.New(t, sizeDef)
 	defer closer()
@@ -111,6 +501,8 @@ func TestSubvolumes(t *testing.T) {
 		for _, s := range subs {
 			if s.UUID.IsZero() {
 				t.Fatalf("zero uuid in %+v", s)
+			} else if s.Name != filepath.Base(s.Path) || s.ParentID == 0 {
+				t.Fatalf("unexpected backref in %+v", s)
 			}
 			if s.Path != "" {
 				got = append(got, s.Path)
@@ -121,6 +513,22 @@ func TestSubvolumes(t *testing.T) {
 		if !reflect.DeepEqual(got, exp) {
 			t.Fatalf("list failed:\ngot: %v\nvs\nexp: %v", got, exp)
 		}
+		// unprivileged listing must return the same subvolumes
+		m, err := listSubVolumesUser(fs.f, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = got[:0]
+		for _, s := range m {
+			if s.UUID.IsZero() || s.Name != filepath.Base(s.Path) {
+				t.Fatalf("unexpected subvolume: %+v", s)
+			}
+			got = append(got, s.Path)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("user list failed:\ngot: %v\nvs\nexp: %v", got, exp)
+		}
 	}
 
 	names := []string{"foo", "bar", "baz"}
@@ -156,6 +564,43 @@ func TestSubvolumes(t *testing.T) {
 	}
 }
 
+func TestSnapshotsOf(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	if err = fs.CreateSubVolume("a"); err != nil {
+		t.Fatal(err)
+	} else if err = fs.CreateSubVolume("b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.1", "a.2", "a.3"} {
+		if err = fs.SnapshotSubVolume("a", name, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fs.SnapshotSubVolume("b", "b.1", true); err != nil {
+		t.Fatal(err)
+	} else if err = fs.SnapshotSubVolume("a.1", "a.1.1", true); err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := fs.SnapshotsOf("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range snaps {
+		got = append(got, s.Path)
+	}
+	if exp := []string{"a.1", "a.2", "a.3"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected snapshots: %v", got)
+	}
+}
+
 func TestCompression(t *testing.T) {
 	dir, closer := btrfstest.New(t, sizeDef)
 	defer closer()
@@ -179,6 +624,75 @@ func TestCompression(t *testing.T) {
 	}
 }
 
+func TestProperties(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	sub := filepath.Join(dir, "sub")
+	if err := CreateSubVolume(sub); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(sub, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	list := func(path string, exp ...string) {
+		t.Helper()
+		props, err := ListProperties(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, p := range props {
+			names = append(names, p.Name)
+		}
+		if !reflect.DeepEqual(names, exp) {
+			t.Fatalf("unexpected properties of %s: %v", path, names)
+		}
+	}
+	list(dir, "compression", "label", "ro")
+	list(sub, "compression", "ro")
+	list(file, "compression")
+
+	check := func(path, name, exp string) {
+		t.Helper()
+		if v, err := GetProperty(path, name); err != nil {
+			t.Fatal(err)
+		} else if v != exp {
+			t.Fatalf("unexpected value of %q on %s: %q", name, path, v)
+		}
+	}
+	if err := SetProperty(dir, "label", "data"); err != nil {
+		t.Fatal(err)
+	}
+	check(dir, "label", "data")
+
+	if err := SetProperty(file, "compression", string(ZLIB)); err != nil {
+		t.Fatal(err)
+	}
+	check(file, "compression", string(ZLIB))
+
+	check(sub, "ro", "false")
+	if err := SetProperty(sub, "ro", "true"); err != nil {
+		t.Fatal(err)
+	}
+	check(sub, "ro", "true")
+	if err := ioutil.WriteFile(filepath.Join(sub, "new"), nil, 0644); !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("expected the subvolume to be read-only, got: %v", err)
+	}
+	if err := SetProperty(sub, "ro", "false"); err != nil {
+		t.Fatal(err)
+	}
+	check(sub, "ro", "false")
+
+	if err := SetProperty(sub, "ro", "maybe"); err == nil {
+		t.Fatal("expected an error for an invalid value")
+	} else if _, err = GetProperty(sub, "label"); err == nil {
+		t.Fatal("expected an error for a property of another object type")
+	} else if _, err = GetProperty(sub, "unknown"); err == nil {
+		t.Fatal("expected an error for an unknown property")
+	}
+}
+
 func TestCloneFile(t *testing.T) {
 	dir, closer := btrfstest.New(t, sizeDef)
 	defer closer()
@@ -217,6 +731,229 @@ func TestCloneFile(t *testing.T) {
 	}
 }
 
+func TestVerifyFile(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	data := make([]byte, 1<<20+123)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := fs.VerifyFile("file")
+	if err != nil {
+		t.Fatal(err)
+	} else if !rep.OK() {
+		t.Fatalf("unexpected mismatches: %v", rep.Mismatches)
+	} else if rep.Verified != uint64(len(data)) {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.Open(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(sub, "clone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err = CloneFile(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	// nested subvolumes are included
+	vol := filepath.Join(dir, "vol")
+	if err = CreateSubVolume(vol); err != nil {
+		t.Fatal(err)
+	}
+	own := data[:64*1024]
+	if err = ioutil.WriteFile(filepath.Join(vol, "file"), own, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// mount points are skipped
+	for _, m := range []struct {
+		name, src, typ string
+		flags          uintptr
+	}{
+		{name: "bind", src: sub, flags: syscall.MS_BIND},
+		{name: "tmp", src: "tmpfs", typ: "tmpfs"},
+	} {
+		mnt := filepath.Join(dir, m.name)
+		if err = os.Mkdir(mnt, 0755); err != nil {
+			t.Fatal(err)
+		} else if err = syscall.Mount(m.src, mnt, m.typ, m.flags, ""); err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Unmount(mnt, 0)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "tmp", "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	du, err := DiskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, owned := uint64(len(data)), uint64(len(own))
+	if du.Total != 2*size+owned || du.Exclusive != owned || du.SetShared != size {
+		t.Fatalf("unexpected usage: %+v", du)
+	} else if !du.Subvolume || len(du.Dirs) != 2 {
+		t.Fatalf("unexpected dirs: %+v", du.Dirs)
+	} else if d := du.Dirs[0]; d.Path != sub || d.Subvolume || d.Total != size {
+		t.Fatalf("unexpected usage of a directory: %+v", d)
+	} else if d = du.Dirs[1]; d.Path != vol || !d.Subvolume || d.Total != owned {
+		t.Fatalf("unexpected usage of a subvolume: %+v", d)
+	}
+}
+
+func TestBlockGroups(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	groups, err := fs.BlockGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[BlockGroupFlags]bool)
+	for i, bg := range groups {
+		if i > 0 && bg.Start <= groups[i-1].Start {
+			t.Fatalf("block groups are not sorted: %+v", groups)
+		} else if len(bg.Stripes) == 0 || bg.Used > bg.Length {
+			t.Fatalf("unexpected block group: %+v", bg)
+		}
+		types[bg.Type()] = true
+	}
+	for _, typ := range []BlockGroupFlags{BlockGroupData, BlockGroupMetadata, BlockGroupSystem} {
+		if !types[typ] {
+			t.Errorf("no %v block groups", typ)
+		}
+	}
+}
+
+func TestSubvolumeReadOnly(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+
+	sub := filepath.Join(dir, "sub")
+	if err := CreateSubVolume(sub); err != nil {
+		t.Fatal(err)
+	}
+	isRO := func(exp bool) {
+		t.Helper()
+		if flags, err := GetSubvolumeFlags(sub); err != nil {
+			t.Fatal(err)
+		} else if flags.ReadOnly() != exp {
+			t.Fatalf("unexpected flags: %v", flags)
+		}
+	}
+	if err := SetSubvolumeReadOnly(sub, true); err != nil {
+		t.Fatal(err)
+	}
+	isRO(true)
+	if err := SetSubvolumeReadOnly(sub, false); err != nil {
+		t.Fatal(err)
+	}
+	isRO(false)
+
+	if err := SetReceivedSubvolume(sub, UUID{1, 2, 3}, 10); err != nil {
+		t.Fatal(err)
+	} else if err = SetSubvolumeReadOnly(sub, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSubvolumeReadOnly(sub, false); !errors.Is(err, ErrReceivedSubvolume) {
+		t.Fatalf("expected an error, got: %v", err)
+	}
+	isRO(true)
+	if err := SetSubvolumeReadOnlyWithOptions(sub, false, ReadOnlyOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	isRO(false)
+	if err := os.Mkdir(filepath.Join(sub, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	} else if _, err = GetSubvolumeFlags(filepath.Join(sub, "dir")); !errors.Is(err, ErrNotSubvolume) {
+		t.Fatalf("expected an error, got: %v", err)
+	}
+}
+
+func TestFindNewUnlinked(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	gen, err := fs.StartSync()
+	if err != nil {
+		t.Fatal(err)
+	} else if err = fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string) *os.File {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write(bytes.Repeat([]byte{1}, 64*1024)); err != nil {
+			t.Fatal(err)
+		} else if err = f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	kept := write("kept")
+	kept.Close()
+	// keep the unlinked file open, so its extents are not deleted
+	gone := write("gone")
+	defer gone.Close()
+	if err = os.Remove(gone.Name()); err != nil {
+		t.Fatal(err)
+	} else if err = fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := fs.FindNew(".", gen+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]int)
+	for _, c := range changes {
+		paths[c.Path]++
+	}
+	if paths["kept"] == 0 {
+		t.Fatalf("expected changes of the linked file, got: %v", changes)
+	} else if paths[""] == 0 {
+		t.Fatalf("expected changes of the unlinked file, got: %v", changes)
+	}
+}
+
 func TestResize(t *testing.T) {
 	dir, err := ioutil.TempDir("", "btrfs_data_")
 	if err != nil {
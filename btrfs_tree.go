@@ -3,7 +3,6 @@ package btrfs
 import (
 	"fmt"
 	"time"
-	"unsafe"
 )
 
 const (
@@ -15,42 +14,31 @@ const (
 		blockGroupRaid5 |
 		blockGroupRaid6 |
 		blockGroupDup |
-		blockGroupRaid10)
+		blockGroupRaid10 |
+		blockGroupRaid1c3 |
+		blockGroupRaid1c4)
 	_BTRFS_BLOCK_GROUP_MASK = _BTRFS_BLOCK_GROUP_TYPE_MASK | _BTRFS_BLOCK_GROUP_PROFILE_MASK
 )
 
-type rootRef struct {
+// RootRef is a ROOT_REF or ROOT_BACKREF item that links a subvolume to the directory entry.
+type RootRef struct {
 	DirID    objectID
 	Sequence uint64
 	Name     string
 }
 
-func (rootRef) btrfsSize() int { return 18 }
+func (RootRef) btrfsSize() int { return 18 }
 
 func asUint64(p []byte) uint64 {
-	return *(*uint64)(unsafe.Pointer(&p[0]))
+	return order.Uint64(p)
 }
 
 func asUint32(p []byte) uint32 {
-	return *(*uint32)(unsafe.Pointer(&p[0]))
+	return order.Uint32(p)
 }
 
 func asUint16(p []byte) uint16 {
-	return *(*uint16)(unsafe.Pointer(&p[0]))
-}
-
-func asRootRef(p []byte) rootRef {
-	const sz = 18
-	// assuming that it is highly unsafe to have sizeof(struct) > len(data)
-	// (*btrfs_root_ref)(unsafe.Pointer(&p[0])) and sizeof(btrfs_root_ref) == 24
-	ref := rootRef{
-		DirID:    objectID(asUint64(p[0:])),
-		Sequence: asUint64(p[8:]),
-	}
-	if n := asUint16(p[16:]); n > 0 {
-		ref.Name = string(p[sz : sz+n : sz+n])
-	}
-	return ref
+	return order.Uint16(p)
 }
 
 var treeKeyNames = map[treeKeyType]string{
@@ -104,15 +92,16 @@ func (t treeKeyType) String() string {
 // btrfs_disk_key_raw is a raw bytes for btrfs_disk_key structure
 type btrfs_disk_key_raw [17]byte
 
-func (p btrfs_disk_key_raw) Decode() diskKey {
-	return diskKey{
+func (p btrfs_disk_key_raw) Decode() DiskKey {
+	return DiskKey{
 		ObjectID: asUint64(p[0:]),
 		Type:     p[8],
 		Offset:   asUint64(p[9:]),
 	}
 }
 
-type diskKey struct {
+// DiskKey is a key of an item in btrfs tree.
+type DiskKey struct {
 	ObjectID uint64
 	Type     byte
 	Offset   uint64
@@ -151,28 +140,8 @@ type btrfs_inode_item_raw struct {
 	times timeBlock
 }
 
-func (v btrfs_inode_item_raw) Decode() inodeItem {
-	return inodeItem{
-		Gen:        v.generation,
-		TransID:    v.transid,
-		Size:       v.size,
-		NBytes:     v.nbytes,
-		BlockGroup: v.block_group,
-		NLink:      v.nlink,
-		UID:        v.uid,
-		GID:        v.gid,
-		Mode:       v.mode,
-		RDev:       v.rdev,
-		Flags:      v.flags,
-		Sequence:   v.sequence,
-		ATime:      v.times[0].Decode(),
-		CTime:      v.times[1].Decode(),
-		MTime:      v.times[2].Decode(),
-		OTime:      v.times[3].Decode(),
-	}
-}
-
-type inodeItem struct {
+// InodeItem is an INODE_ITEM stored in the filesystem tree.
+type InodeItem struct {
 	Gen        uint64 // nfs style generation number
 	TransID    uint64 // transid that last touched this inode
 	Size       uint64
@@ -191,55 +160,11 @@ type inodeItem struct {
 	OTime      time.Time
 }
 
-func asRootItem(p []byte) *btrfs_root_item_raw {
-	return (*btrfs_root_item_raw)(unsafe.Pointer(&p[0]))
-}
-
 type btrfs_root_item_raw [439]byte
 
-func (p btrfs_root_item_raw) Decode() rootItem {
-	const (
-		off2 = unsafe.Sizeof(btrfs_root_item_raw_p1{})
-		off3 = off2 + 23
-	)
-	p1 := (*btrfs_root_item_raw_p1)(unsafe.Pointer(&p[0]))
-	p2 := p[off2 : off2+23]
-	p2_k := (*btrfs_disk_key_raw)(unsafe.Pointer(&p[off2+4]))
-	p2_b := p2[4+17:]
-	p3 := (*btrfs_root_item_raw_p3)(unsafe.Pointer(&p[off3]))
-	return rootItem{
-		Inode:        p1.inode.Decode(),
-		Gen:          p1.generation,
-		RootDirID:    p1.root_dirid,
-		ByteNr:       p1.bytenr,
-		ByteLimit:    p1.byte_limit,
-		BytesUsed:    p1.bytes_used,
-		LastSnapshot: p1.last_snapshot,
-		Flags:        p1.flags,
-		// from here, Go structure become misaligned with C structure
-		Refs:         asUint32(p2[0:]),
-		DropProgress: p2_k.Decode(),
-		DropLevel:    p2_b[0],
-		Level:        p2_b[1],
-		// these fields are still misaligned by 1 bytes
-		// TODO(dennwc): it's a copy of Gen to check structure version; hide it maybe?
-		GenV2:        p3.generation_v2,
-		UUID:         p3.uuid,
-		ParentUUID:   p3.parent_uuid,
-		ReceivedUUID: p3.received_uuid,
-		CTransID:     p3.ctransid,
-		OTransID:     p3.otransid,
-		STransID:     p3.stransid,
-		RTransID:     p3.rtransid,
-		CTime:        p3.times[0].Decode(),
-		OTime:        p3.times[1].Decode(),
-		STime:        p3.times[2].Decode(),
-		RTime:        p3.times[3].Decode(),
-	}
-}
-
-type rootItem struct {
-	Inode        inodeItem
+// RootItem is a ROOT_ITEM stored in the tree of tree roots.
+type RootItem struct {
+	Inode        InodeItem
 	Gen          uint64
 	RootDirID    uint64
 	ByteNr       uint64
@@ -248,7 +173,7 @@ type rootItem struct {
 	LastSnapshot uint64
 	Flags        uint64
 	Refs         uint32
-	DropProgress diskKey
+	DropProgress DiskKey
 	DropLevel    uint8
 	Level        uint8
 	GenV2        uint64
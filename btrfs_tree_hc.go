@@ -458,6 +458,8 @@ const (
 	blockGroupRaid10   blockGroup = (1 << 6)
 	blockGroupRaid5    blockGroup = (1 << 7)
 	blockGroupRaid6    blockGroup = (1 << 8)
+	blockGroupRaid1c3  blockGroup = (1 << 9)
+	blockGroupRaid1c4  blockGroup = (1 << 10)
 
 	// We need a bit for restriper to be able to tell when chunks of type
 	// SINGLE are available. This "extended" profile format is used in
@@ -0,0 +1,155 @@
+package btrfsdump
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"io"
+)
+
+// DumpSuperblock prints a human-readable description of the superblock,
+// similar to 'btrfs inspect-internal dump-super --full'.
+func DumpSuperblock(w io.Writer, sb *Superblock) error {
+	bw := bufio.NewWriter(w)
+	field := func(name string, format string, args ...interface{}) {
+		fmt.Fprintf(bw, "%-24s"+format+"\n", append([]interface{}{name}, args...)...)
+	}
+	field("csum_type", "%d (%v)", uint16(sb.CsumType), sb.CsumType)
+	field("csum_size", "%d", sb.CsumType.Size())
+	field("csum", "0x%x", sb.Csum)
+	field("bytenr", "%d", sb.ByteNr)
+	field("flags", "0x%x", sb.Flags)
+	field("fsid", "%v", btrfs.UUID(sb.FSID))
+	field("metadata_uuid", "%v", btrfs.UUID(sb.MetadataUUID))
+	field("label", "%s", sb.Label)
+	field("generation", "%d", sb.Generation)
+	field("root", "%d", sb.Root)
+	field("sys_array_size", "%d", sysChunkArrayLen(sb.SysChunks))
+	field("chunk_root_generation", "%d", sb.ChunkRootGen)
+	field("root_level", "%d", sb.RootLevel)
+	field("chunk_root", "%d", sb.ChunkRoot)
+	field("chunk_root_level", "%d", sb.ChunkRootLevel)
+	field("log_root", "%d", sb.LogRoot)
+	field("log_root_level", "%d", sb.LogRootLevel)
+	field("total_bytes", "%d", sb.TotalBytes)
+	field("bytes_used", "%d", sb.BytesUsed)
+	field("sectorsize", "%d", sb.SectorSize)
+	field("nodesize", "%d", sb.NodeSize)
+	field("stripesize", "%d", sb.StripeSize)
+	field("root_dir", "%d", sb.RootDirID)
+	field("num_devices", "%d", sb.NumDevices)
+	field("compat_flags", "0x%x (%v)", uint64(sb.Features.Compatible), sb.Features.Compatible)
+	field("compat_ro_flags", "0x%x (%v)", uint64(sb.Features.CompatibleRO), sb.Features.CompatibleRO)
+	field("incompat_flags", "0x%x (%v)", uint64(sb.Features.Incompatible), sb.Features.Incompatible)
+	field("cache_generation", "%d", sb.CacheGen)
+	field("uuid_tree_generation", "%d", sb.UUIDTreeGen)
+	field("dev_item.uuid", "%v", sb.Dev.UUID)
+	field("dev_item.fsid", "%v", btrfs.UUID(sb.Dev.FSID))
+	field("dev_item.type", "%d", sb.Dev.Type)
+	field("dev_item.total_bytes", "%d", sb.Dev.TotalBytes)
+	field("dev_item.bytes_used", "%d", sb.Dev.BytesUsed)
+	field("dev_item.io_align", "%d", sb.Dev.IOAlign)
+	field("dev_item.io_width", "%d", sb.Dev.IOWidth)
+	field("dev_item.sector_size", "%d", sb.Dev.SectorSize)
+	field("dev_item.devid", "%d", sb.Dev.DevID)
+	field("dev_item.dev_group", "%d", sb.Dev.DevGroup)
+	field("dev_item.seek_speed", "%d", sb.Dev.SeekSpeed)
+	field("dev_item.bandwidth", "%d", sb.Dev.Bandwidth)
+	field("dev_item.generation", "%d", sb.Dev.Generation)
+
+	fmt.Fprintf(bw, "sys_chunk_array[%d]:\n", sysChunkArraySize)
+	for i, c := range sb.SysChunks {
+		fmt.Fprintf(bw, "\titem %d key (%d %v %d)\n", i, c.Key.ObjectID, btrfs.KeyType(c.Key.Type), c.Key.Offset)
+		dumpChunk(bw, "\t\t", c.Chunk)
+	}
+	fmt.Fprintf(bw, "backup_roots[%d]:\n", len(sb.BackupRoots))
+	for i, r := range sb.BackupRoots {
+		fmt.Fprintf(bw, "\tbackup %d:\n", i)
+		fmt.Fprintf(bw, "\t\tbackup_tree_root:\t%d\tgen: %d\tlevel: %d\n", r.TreeRoot, r.TreeRootGen, r.TreeRootLevel)
+		fmt.Fprintf(bw, "\t\tbackup_chunk_root:\t%d\tgen: %d\tlevel: %d\n", r.ChunkRoot, r.ChunkRootGen, r.ChunkRootLevel)
+		fmt.Fprintf(bw, "\t\tbackup_extent_root:\t%d\tgen: %d\tlevel: %d\n", r.ExtentRoot, r.ExtentRootGen, r.ExtentRootLevel)
+		fmt.Fprintf(bw, "\t\tbackup_fs_root:\t\t%d\tgen: %d\tlevel: %d\n", r.FSRoot, r.FSRootGen, r.FSRootLevel)
+		fmt.Fprintf(bw, "\t\tbackup_dev_root:\t%d\tgen: %d\tlevel: %d\n", r.DevRoot, r.DevRootGen, r.DevRootLevel)
+		fmt.Fprintf(bw, "\t\tbackup_csum_root:\t%d\tgen: %d\tlevel: %d\n", r.CsumRoot, r.CsumRootGen, r.CsumRootLevel)
+		fmt.Fprintf(bw, "\t\tbackup_total_bytes:\t%d\n", r.TotalBytes)
+		fmt.Fprintf(bw, "\t\tbackup_bytes_used:\t%d\n", r.BytesUsed)
+		fmt.Fprintf(bw, "\t\tbackup_num_devices:\t%d\n", r.NumDevices)
+	}
+	return bw.Flush()
+}
+
+// sysChunkArrayLen returns the size of encoded system chunks.
+func sysChunkArrayLen(list []SysChunk) int {
+	n := 0
+	for _, c := range list {
+		n += diskKeySize + chunkItemLen(c.Chunk)
+	}
+	return n
+}
+
+func chunkItemLen(c btrfs.ChunkItem) int {
+	return 48 + 32*len(c.Stripes)
+}
+
+func dumpChunk(w io.Writer, indent string, c btrfs.ChunkItem) {
+	fmt.Fprintf(w, "%slength %d owner %d stripe_len %d type %v\n", indent, c.Length, c.Owner, c.StripeLen, c.Type)
+	fmt.Fprintf(w, "%sio_align %d io_width %d sector_size %d\n", indent, c.IOAlign, c.IOWidth, c.SectorSize)
+	fmt.Fprintf(w, "%snum_stripes %d sub_stripes %d\n", indent, len(c.Stripes), c.SubStripes)
+	for i, s := range c.Stripes {
+		fmt.Fprintf(w, "%s\tstripe %d devid %d offset %d\n", indent, i, s.DevID, s.Offset)
+		fmt.Fprintf(w, "%s\tdev_uuid %v\n", indent, s.DevUUID)
+	}
+}
+
+// DumpTree prints all blocks of a tree with a given id, similar to 'btrfs inspect-internal dump-tree'.
+// Items are decoded if their type is supported by btrfs.SearchItem.Decode.
+func (im *Image) DumpTree(w io.Writer, tree uint64) error {
+	root, err := im.Tree(tree)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	err = im.WalkNodes(root.ByteNr, func(n *Node) error {
+		dumpNode(bw, n, im.Super.NodeSize)
+		return nil
+	})
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// DumpNode prints a single tree block, similar to 'btrfs inspect-internal dump-tree -b'.
+func (im *Image) DumpNode(w io.Writer, n *Node) error {
+	bw := bufio.NewWriter(w)
+	dumpNode(bw, n, im.Super.NodeSize)
+	return bw.Flush()
+}
+
+func dumpKey(k btrfs.DiskKey) string {
+	return fmt.Sprintf("(%d %v %d)", k.ObjectID, btrfs.KeyType(k.Type), k.Offset)
+}
+
+func dumpNode(w io.Writer, n *Node, nodeSize uint32) {
+	kind := "leaf"
+	if n.IsLeaf() {
+		fmt.Fprintf(w, "leaf %d items %d free space %d generation %d owner %d\n",
+			n.ByteNr, n.NumItems, n.FreeSpace(nodeSize), n.Generation, n.Owner)
+	} else {
+		kind = "node"
+		fmt.Fprintf(w, "node %d level %d items %d free %d generation %d owner %d\n",
+			n.ByteNr, n.Level, n.NumItems, n.FreeSpace(nodeSize), n.Generation, n.Owner)
+	}
+	fmt.Fprintf(w, "%s %d flags 0x%x backref revision %d\n", kind, n.ByteNr, n.Flags, n.Revision)
+	fmt.Fprintf(w, "fs uuid %v\n", btrfs.UUID(n.FSID))
+	fmt.Fprintf(w, "chunk uuid %v\n", n.ChunkTreeUUID)
+	for _, p := range n.Ptrs {
+		fmt.Fprintf(w, "\tkey %s block %d gen %d\n", dumpKey(p.Key), p.BlockPtr, p.Generation)
+	}
+	for i, it := range n.Items {
+		fmt.Fprintf(w, "\titem %d key %s itemoff %d itemsize %d\n", i, dumpKey(it.Key), it.Offset, len(it.Data))
+		if v, err := it.Decode(); err == nil {
+			fmt.Fprintf(w, "\t\t%+v\n", v)
+		}
+	}
+}
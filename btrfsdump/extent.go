@@ -0,0 +1,130 @@
+package btrfsdump
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"io"
+)
+
+// ErrUnsupportedCompression is returned when file data is compressed with an algorithm
+// that cannot be decoded by this package. Only zlib and LZO are supported; zstd is not.
+var ErrUnsupportedCompression = errors.New("btrfsdump: unsupported compression")
+
+// defaultSectorSize is used if the superblock does not specify the sector size.
+const defaultSectorSize = 4096
+
+// sectorSize returns the sector size of the filesystem.
+func (im *Image) sectorSize() uint32 {
+	if im.Super == nil || im.Super.SectorSize == 0 {
+		return defaultSectorSize
+	}
+	return im.Super.SectorSize
+}
+
+// ReadFileExtent reads and decompresses the data of a file extent.
+// It returns data for the range of the file described by the extent.
+// Holes and preallocated extents return zeros. Extents compressed with zstd
+// fail with ErrUnsupportedCompression.
+func (im *Image) ReadFileExtent(fe btrfs.FileExtentItem) ([]byte, error) {
+	switch fe.Type {
+	case btrfs.FileExtentInline:
+		return decompress(fe.Compression, fe.Inline, fe.RAMBytes, im.sectorSize())
+	case btrfs.FileExtentPrealloc:
+		return make([]byte, fe.NumBytes), nil
+	}
+	if fe.DiskByteNr == 0 {
+		return make([]byte, fe.NumBytes), nil
+	}
+	if fe.Compression == btrfs.CompressionNone {
+		buf := make([]byte, fe.NumBytes)
+		if err := im.ReadLogical(buf, fe.DiskByteNr+fe.Offset); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	// compressed extents are always read as a whole
+	buf := make([]byte, fe.DiskNumBytes)
+	if err := im.ReadLogical(buf, fe.DiskByteNr); err != nil {
+		return nil, err
+	}
+	data, err := decompress(fe.Compression, buf, fe.RAMBytes, im.sectorSize())
+	if err != nil {
+		return nil, err
+	}
+	if fe.Offset >= uint64(len(data)) {
+		return make([]byte, fe.NumBytes), nil
+	}
+	data = data[fe.Offset:]
+	if uint64(len(data)) >= fe.NumBytes {
+		return data[:fe.NumBytes], nil
+	}
+	// the tail of the extent can be implicitly zero
+	out := make([]byte, fe.NumBytes)
+	copy(out, data)
+	return out, nil
+}
+
+// decompress decodes data compressed by btrfs. Size is the expected size of decompressed data,
+// and sector is the sector size of the filesystem, which determines LZO framing.
+func decompress(c btrfs.Compression, p []byte, size uint64, sector uint32) ([]byte, error) {
+	switch c.Algorithm() {
+	case btrfs.CompressionNone:
+		return p, nil
+	case btrfs.ZLIB:
+		zr, err := zlib.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, fmt.Errorf("btrfsdump: zlib: %w", err)
+		}
+		defer zr.Close()
+		out := bytes.NewBuffer(make([]byte, 0, size))
+		if _, err = io.Copy(out, io.LimitReader(zr, int64(size))); err != nil {
+			return nil, fmt.Errorf("btrfsdump: zlib: %w", err)
+		}
+		return out.Bytes(), nil
+	case btrfs.LZO:
+		return decompressLZO(p, size, int(sector))
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, c.Algorithm())
+}
+
+// decompressLZO decodes LZO data in btrfs framing: a total length followed by
+// length-prefixed segments, each holding at most one sector of data.
+// Segment headers never cross a sector boundary.
+func decompressLZO(p []byte, size uint64, sector int) ([]byte, error) {
+	if len(p) < 4 {
+		return nil, errors.New("btrfsdump: lzo: data is too short")
+	}
+	total := int(order.Uint32(p))
+	if total > len(p) || total < 4 {
+		return nil, fmt.Errorf("btrfsdump: lzo: invalid length %d", total)
+	}
+	out := make([]byte, 0, size)
+	off := 4
+	for off < total && uint64(len(out)) < size {
+		if rem := sector - off%sector; rem < 4 {
+			off += rem // padding at the end of the sector
+			continue
+		}
+		if off+4 > total {
+			break
+		}
+		n := int(order.Uint32(p[off:]))
+		off += 4
+		if off+n > total {
+			return nil, fmt.Errorf("btrfsdump: lzo: segment at %d is out of bounds", off-4)
+		}
+		var err error
+		out, err = lzo1xDecompress(out, p[off:off+n])
+		if err != nil {
+			return nil, fmt.Errorf("btrfsdump: lzo: segment at %d: %w", off-4, err)
+		}
+		off += n
+	}
+	if uint64(len(out)) > size {
+		out = out[:size]
+	}
+	return out, nil
+}
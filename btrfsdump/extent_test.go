@@ -0,0 +1,101 @@
+package btrfsdump
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"github.com/dennwc/btrfs"
+	"testing"
+)
+
+// testLZO is a hand-encoded LZO1X block that uses all kinds of matches.
+var testLZO = []byte{
+	17 + 3, 'a', 'b', 'c', // initial literals
+	0xe8, 0x00, // M2 match: 8 bytes, distance 3
+	0x01, 'w', 'x', 'y', 'z', // literal run
+	0x23, 13, 0, '!', // M3 match: 5 bytes, distance 4, one trailing literal
+	0x04, 0x00, // M1 match: 2 bytes, distance 2
+	0x11, 0x00, 0x00, // end of stream
+}
+
+const testLZOData = "abcabcabcabwxyzwxyzw!w!"
+
+func TestLZO(t *testing.T) {
+	out, err := lzo1xDecompress(nil, testLZO)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(out) != testLZOData {
+		t.Fatalf("unexpected data: %q", out)
+	}
+	if _, err = lzo1xDecompress(nil, testLZO[:len(testLZO)-3]); err == nil {
+		t.Fatal("expected an error for truncated data")
+	}
+
+	// btrfs framing: total length, then a single segment
+	p := make([]byte, 8, 8+len(testLZO))
+	order.PutUint32(p[0:], uint32(8+len(testLZO)))
+	order.PutUint32(p[4:], uint32(len(testLZO)))
+	p = append(p, testLZO...)
+	out, err = decompress(btrfs.LZO, p, uint64(len(testLZOData)), defaultSectorSize)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(out) != testLZOData {
+		t.Fatalf("unexpected data: %q", out)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("btrfs "), 1000)
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	out, err := decompress(btrfs.ZLIB, buf.Bytes(), uint64(len(data)), defaultSectorSize)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(out, data) {
+		t.Fatalf("unexpected data: %q", out)
+	}
+	if _, err = decompress(btrfs.Compression("foo"), nil, 0, defaultSectorSize); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err = decompress(btrfs.ZSTD, nil, 0, defaultSectorSize); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Fatalf("expected an unsupported compression error, got: %v", err)
+	}
+}
+
+// literalLZO encodes data as a single LZO1X block with one literal run of up to 238 bytes.
+func literalLZO(data []byte) []byte {
+	p := append([]byte{byte(17 + len(data))}, data...)
+	return append(p, 0x11, 0, 0) // end marker
+}
+
+func TestLZOSectorSize(t *testing.T) {
+	// segments are placed so that the last header starts 2 bytes before the end of
+	// a 4KiB sector, which is only valid if the sector is larger
+	var sizes []int
+	for i := 0; i < 17; i++ {
+		sizes = append(sizes, 230)
+	}
+	sizes = append(sizes, 36, 10)
+	p := make([]byte, 4)
+	var exp []byte
+	for i, n := range sizes {
+		data := bytes.Repeat([]byte{byte('a' + i)}, n)
+		exp = append(exp, data...)
+		seg := literalLZO(data)
+		var hdr [4]byte
+		order.PutUint32(hdr[:], uint32(len(seg)))
+		p = append(append(p, hdr[:]...), seg...)
+	}
+	order.PutUint32(p, uint32(len(p)))
+	out, err := decompress(btrfs.LZO, p, uint64(len(exp)), 8192)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(out, exp) {
+		t.Fatalf("unexpected data: %q", out)
+	}
+	if out, err = decompress(btrfs.LZO, p, uint64(len(exp)), 4096); err == nil && bytes.Equal(out, exp) {
+		t.Fatal("expected 4KiB framing to misread the data")
+	}
+}
@@ -0,0 +1,253 @@
+package btrfsdump
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"io"
+	"os"
+	"sort"
+)
+
+// Image is a btrfs filesystem opened for offline reading.
+// It can consist of multiple devices or image files.
+type Image struct {
+	// Super is the latest valid superblock of all devices.
+	Super *Superblock
+
+	devs   map[uint64]io.ReaderAt
+	chunks []chunkMapping // sorted by logical address
+	files  []*os.File
+}
+
+// chunkMapping maps a range of logical addresses to stripes on devices.
+type chunkMapping struct {
+	Logical uint64
+	btrfs.ChunkItem
+}
+
+// Open opens devices or image files of a single filesystem for reading.
+func Open(paths ...string) (*Image, error) {
+	var (
+		files []*os.File
+		devs  []io.ReaderAt
+	)
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		devs = append(devs, f)
+	}
+	im, err := NewImage(devs...)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	im.files = files
+	return im, nil
+}
+
+// NewImage reads the superblock and the chunk tree from devices of a single filesystem.
+func NewImage(devs ...io.ReaderAt) (*Image, error) {
+	if len(devs) == 0 {
+		return nil, errors.New("btrfsdump: no devices")
+	}
+	im := &Image{devs: make(map[uint64]io.ReaderAt)}
+	for i, d := range devs {
+		sb, err := LatestSuperblock(ReadSuperblocks(d))
+		if err != nil {
+			return nil, fmt.Errorf("btrfsdump: device %d: %w", i, err)
+		}
+		if im.Super != nil && sb.FSID != im.Super.FSID {
+			return nil, fmt.Errorf("btrfsdump: device %d belongs to a different filesystem: %v", i, btrfs.UUID(sb.FSID))
+		}
+		if _, ok := im.devs[sb.Dev.DevID]; ok {
+			return nil, fmt.Errorf("btrfsdump: duplicate device id: %d", sb.Dev.DevID)
+		}
+		im.devs[sb.Dev.DevID] = d
+		if im.Super == nil || sb.Generation > im.Super.Generation {
+			im.Super = sb
+		}
+	}
+	for _, c := range im.Super.SysChunks {
+		im.addChunk(c.Key.Offset, c.Chunk)
+	}
+	err := im.WalkNodes(im.Super.ChunkRoot, func(n *Node) error {
+		for _, it := range n.Items {
+			if it.Key.Type != byte(btrfs.KeyChunkItem) {
+				continue
+			}
+			c, err := btrfs.DecodeChunkItem(it.Data)
+			if err != nil {
+				return err
+			}
+			im.addChunk(it.Key.Offset, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("btrfsdump: cannot read chunk tree: %w", err)
+	}
+	return im, nil
+}
+
+// Close closes all files opened by Open.
+func (im *Image) Close() error {
+	var last error
+	for _, f := range im.files {
+		if err := f.Close(); err != nil {
+			last = err
+		}
+	}
+	im.files = nil
+	return last
+}
+
+func (im *Image) addChunk(logical uint64, c btrfs.ChunkItem) {
+	i := sort.Search(len(im.chunks), func(i int) bool {
+		return im.chunks[i].Logical >= logical
+	})
+	if i < len(im.chunks) && im.chunks[i].Logical == logical {
+		im.chunks[i].ChunkItem = c
+		return
+	}
+	im.chunks = append(im.chunks, chunkMapping{})
+	copy(im.chunks[i+1:], im.chunks[i:])
+	im.chunks[i] = chunkMapping{Logical: logical, ChunkItem: c}
+}
+
+// chunkFor returns a chunk that contains a given logical address.
+func (im *Image) chunkFor(logical uint64) (*chunkMapping, error) {
+	i := sort.Search(len(im.chunks), func(i int) bool {
+		return im.chunks[i].Logical > logical
+	})
+	if i == 0 || logical >= im.chunks[i-1].Logical+im.chunks[i-1].Length {
+		return nil, fmt.Errorf("btrfsdump: logical address %d is not mapped", logical)
+	}
+	return &im.chunks[i-1], nil
+}
+
+// mirrors returns the number of copies of data in the chunk.
+func (c *chunkMapping) mirrors() int {
+	p := c.Type.Profile()
+	switch {
+	case p&(btrfs.ProfileRAID0|btrfs.ProfileRAID5|btrfs.ProfileRAID6) != 0:
+		return 1
+	case p&btrfs.ProfileRAID10 != 0:
+		return int(c.SubStripes)
+	}
+	// single, dup and all raid1 variants keep a full copy on each stripe
+	return len(c.Stripes)
+}
+
+// physical maps a logical address to a device offset of a given mirror.
+// It also returns the number of bytes that are stored contiguously at that offset.
+func (c *chunkMapping) physical(logical uint64, mirror int) (devid, off, n uint64) {
+	rel := logical - c.Logical
+	p := c.Type.Profile()
+	var (
+		data   = uint64(len(c.Stripes)) // number of stripes holding distinct data
+		factor = uint64(1)              // copies of each data stripe
+		parity = uint64(0)
+	)
+	switch {
+	case p&btrfs.ProfileRAID0 != 0:
+	case p&btrfs.ProfileRAID10 != 0:
+		factor = uint64(c.SubStripes)
+		data /= factor
+	case p&btrfs.ProfileRAID5 != 0:
+		parity = 1
+		data -= parity
+	case p&btrfs.ProfileRAID6 != 0:
+		parity = 2
+		data -= parity
+	default:
+		s := c.Stripes[mirror]
+		return s.DevID, s.Offset + rel, c.Length - rel
+	}
+	stripeNr := rel / c.StripeLen
+	stripeOff := rel % c.StripeLen
+	idx := stripeNr % data
+	stripeNr /= data
+	if parity != 0 {
+		// parity rotates across devices with each full stripe
+		idx = (idx + stripeNr) % uint64(len(c.Stripes))
+	} else {
+		idx = idx*factor + uint64(mirror)
+	}
+	s := c.Stripes[idx]
+	return s.DevID, s.Offset + stripeNr*c.StripeLen + stripeOff, c.StripeLen - stripeOff
+}
+
+// readMirror reads data at a logical address from a given mirror.
+func (im *Image) readMirror(c *chunkMapping, p []byte, logical uint64, mirror int) error {
+	for len(p) > 0 {
+		if logical >= c.Logical+c.Length {
+			next, err := im.chunkFor(logical)
+			if err != nil {
+				return err
+			}
+			c = next
+			if mirror >= c.mirrors() {
+				mirror = 0
+			}
+		}
+		devid, off, n := c.physical(logical, mirror)
+		dev, ok := im.devs[devid]
+		if !ok {
+			return fmt.Errorf("btrfsdump: device %d is missing", devid)
+		}
+		if n > uint64(len(p)) {
+			n = uint64(len(p))
+		}
+		if _, err := dev.ReadAt(p[:n], int64(off)); err != nil {
+			return err
+		}
+		p, logical = p[n:], logical+n
+	}
+	return nil
+}
+
+// ReadLogical reads data at a logical address. If one of the mirrors cannot be read,
+// other mirrors are tried.
+func (im *Image) ReadLogical(p []byte, logical uint64) error {
+	c, err := im.chunkFor(logical)
+	if err != nil {
+		return err
+	}
+	for m := 0; m < c.mirrors(); m++ {
+		if err = im.readMirror(c, p, logical, m); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Mirrors returns the number of copies of data stored at a given logical address.
+func (im *Image) Mirrors(logical uint64) (int, error) {
+	c, err := im.chunkFor(logical)
+	if err != nil {
+		return 0, err
+	}
+	return c.mirrors(), nil
+}
+
+// ReadMirror reads data at a logical address from a specific mirror, starting from zero.
+func (im *Image) ReadMirror(p []byte, logical uint64, mirror int) error {
+	c, err := im.chunkFor(logical)
+	if err != nil {
+		return err
+	}
+	if mirror < 0 || mirror >= c.mirrors() {
+		return fmt.Errorf("btrfsdump: invalid mirror %d for address %d", mirror, logical)
+	}
+	return im.readMirror(c, p, logical, mirror)
+}
@@ -0,0 +1,169 @@
+package btrfsdump
+
+import (
+	"bytes"
+	"errors"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/internal/imagetest"
+	"strings"
+	"testing"
+)
+
+const testNodeSize = 4096
+
+func testChunk(length, devid, offset uint64) []byte {
+	c := make([]byte, 48+32)
+	order.PutUint64(c[0:], length)
+	order.PutUint64(c[8:], 2)
+	order.PutUint64(c[16:], 64<<10)
+	order.PutUint64(c[24:], uint64(btrfs.BlockGroupMetadata))
+	order.PutUint16(c[44:], 1)
+	order.PutUint64(c[48:], devid)
+	order.PutUint64(c[56:], offset)
+	return c
+}
+
+// testImage builds a single-device image with chunk, root and fs trees.
+// The fs tree is stored in a chunk that is only described by the chunk tree.
+func testImage() []byte {
+	const (
+		sysChunk   = 1 << 20
+		chunkRoot  = sysChunk
+		rootRoot   = sysChunk + testNodeSize
+		metaChunk  = 100 << 20
+		metaPhys   = 9 << 20
+		fsTreeRoot = metaChunk
+	)
+	img := make([]byte, 10<<20)
+	var fsid btrfs.FSID
+	copy(fsid[:], "0123456789abcdef")
+
+	sb := img[SuperblockOffsets[0]:]
+	copy(sb[32:], fsid[:])
+	order.PutUint64(sb[48:], uint64(SuperblockOffsets[0]))
+	order.PutUint64(sb[64:], SuperblockMagic)
+	order.PutUint64(sb[72:], 7)
+	order.PutUint64(sb[80:], rootRoot)
+	order.PutUint64(sb[88:], chunkRoot)
+	order.PutUint32(sb[144:], 4096)
+	order.PutUint32(sb[148:], testNodeSize)
+	order.PutUint64(sb[201:], 1) // devid
+	imagetest.PutKey(sb[811:], btrfs.DiskKey{ObjectID: btrfs.FirstChunkTreeID, Type: byte(btrfs.KeyChunkItem), Offset: sysChunk})
+	copy(sb[811+diskKeySize:], testChunk(8<<20, 1, sysChunk))
+	order.PutUint32(sb[160:], uint32(diskKeySize+48+32))
+	imagetest.PutCsum(sb[:SuperblockSize])
+
+	devItem := make([]byte, 98)
+	order.PutUint64(devItem[0:], 1)
+	copy(img[chunkRoot:], imagetest.Leaf(testNodeSize, fsid, chunkRoot, btrfs.ChunkTreeID, []imagetest.Item{
+		{Key: btrfs.DiskKey{ObjectID: 1, Type: byte(btrfs.KeyDevItem), Offset: 1}, Data: devItem},
+		{Key: btrfs.DiskKey{ObjectID: btrfs.FirstChunkTreeID, Type: byte(btrfs.KeyChunkItem), Offset: sysChunk}, Data: testChunk(8<<20, 1, sysChunk)},
+		{Key: btrfs.DiskKey{ObjectID: btrfs.FirstChunkTreeID, Type: byte(btrfs.KeyChunkItem), Offset: metaChunk}, Data: testChunk(1<<20, 1, metaPhys)},
+	}))
+
+	rootItem := make([]byte, 439)
+	order.PutUint64(rootItem[160:], 7)          // generation
+	order.PutUint64(rootItem[168:], 256)        // root dir
+	order.PutUint64(rootItem[176:], fsTreeRoot) // bytenr
+	copy(img[rootRoot:], imagetest.Leaf(testNodeSize, fsid, rootRoot, btrfs.RootTreeID, []imagetest.Item{
+		{Key: btrfs.DiskKey{ObjectID: btrfs.FSTreeID, Type: byte(btrfs.KeyRootItem)}, Data: rootItem},
+	}))
+
+	inode := make([]byte, 160)
+	order.PutUint64(inode[16:], 42)     // size
+	order.PutUint32(inode[52:], 040755) // mode
+	copy(img[metaPhys:], imagetest.Leaf(testNodeSize, fsid, fsTreeRoot, btrfs.FSTreeID, []imagetest.Item{
+		{Key: btrfs.DiskKey{ObjectID: 256, Type: byte(btrfs.KeyInodeItem)}, Data: inode},
+	}))
+	return img
+}
+
+func TestImage(t *testing.T) {
+	img := testImage()
+	im, err := NewImage(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(im.chunks) != 2 {
+		t.Fatalf("unexpected chunks: %+v", im.chunks)
+	}
+	trees, err := im.Trees()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(trees) != 3 || trees[2].ID != btrfs.FSTreeID || trees[2].ByteNr != 100<<20 {
+		t.Fatalf("unexpected trees: %+v", trees)
+	}
+	var items []Item
+	err = im.Walk(btrfs.FSTreeID, func(it Item) error {
+		items = append(items, it)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(items) != 1 {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+	v, err := items[0].Decode()
+	if err != nil {
+		t.Fatal(err)
+	} else if inode, ok := v.(btrfs.InodeItem); !ok || inode.Size != 42 {
+		t.Fatalf("unexpected item: %+v", v)
+	}
+
+	var buf bytes.Buffer
+	if err = im.DumpTree(&buf, btrfs.ChunkTreeID); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"leaf 1048576 items 3", "item 2 key (256 chunkItem 104857600)"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected %q in the dump:\n%s", s, buf.String())
+		}
+	}
+
+	img[9<<20+500] ^= 0xff
+	if _, err = im.ReadNode(100 << 20); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expected checksum error, got: %v", err)
+	}
+	if _, err = im.Tree(1000); err != btrfs.ErrNotFound {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestChunkMapping(t *testing.T) {
+	stripes := func(n int) []btrfs.Stripe {
+		out := make([]btrfs.Stripe, n)
+		for i := range out {
+			out[i] = btrfs.Stripe{DevID: uint64(i + 1), Offset: uint64(i+1) << 30}
+		}
+		return out
+	}
+	const sl = 64 << 10
+	cases := []struct {
+		name    string
+		typ     btrfs.BlockGroupFlags
+		stripes int
+		sub     uint16
+		rel     uint64
+		mirror  int
+		devid   uint64
+		off     uint64
+	}{
+		{name: "single", stripes: 1, rel: 100, devid: 1, off: 1<<30 + 100},
+		{name: "raid1", typ: btrfs.BlockGroupFlags(btrfs.ProfileRAID1), stripes: 2, rel: 100, mirror: 1, devid: 2, off: 2<<30 + 100},
+		{name: "raid0", typ: btrfs.BlockGroupFlags(btrfs.ProfileRAID0), stripes: 2, rel: 3*sl + 5, devid: 2, off: 2<<30 + sl + 5},
+		{name: "raid10", typ: btrfs.BlockGroupFlags(btrfs.ProfileRAID10), stripes: 4, sub: 2, rel: sl + 5, mirror: 1, devid: 4, off: 4<<30 + 5},
+		{name: "raid5", typ: btrfs.BlockGroupFlags(btrfs.ProfileRAID5), stripes: 3, rel: 2*sl + 5, devid: 2, off: 2<<30 + sl + 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &chunkMapping{Logical: 1 << 40, ChunkItem: btrfs.ChunkItem{
+				Length: 1 << 30, StripeLen: sl, Type: c.typ | btrfs.BlockGroupData,
+				SubStripes: c.sub, Stripes: stripes(c.stripes),
+			}}
+			devid, off, _ := m.physical(m.Logical+c.rel, c.mirror)
+			if devid != c.devid || off != c.off {
+				t.Fatalf("unexpected mapping: dev %d off %d, expected dev %d off %d", devid, off, c.devid, c.off)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package btrfsdump
+
+import "errors"
+
+var (
+	errLZOInput   = errors.New("input overrun")
+	errLZOLookBeh = errors.New("lookbehind overrun")
+	errLZOEOF     = errors.New("no end marker")
+)
+
+// lzo1xDecompress decodes a single LZO1X block and appends the result to dst.
+// Back references are only allowed within the block.
+func lzo1xDecompress(dst, src []byte) ([]byte, error) {
+	base := len(dst)
+	ip := 0
+	in := func() (int, error) {
+		if ip >= len(src) {
+			return 0, errLZOInput
+		}
+		b := src[ip]
+		ip++
+		return int(b), nil
+	}
+	literals := func(n int) error {
+		if ip+n > len(src) {
+			return errLZOInput
+		}
+		dst = append(dst, src[ip:ip+n]...)
+		ip += n
+		return nil
+	}
+	// run reads an extended length: a sequence of zero bytes, each adding 255,
+	// followed by a non-zero byte that is added together with a given base.
+	run := func(base int) (int, error) {
+		t := 0
+		for ip < len(src) && src[ip] == 0 {
+			t += 255
+			ip++
+		}
+		b, err := in()
+		if err != nil {
+			return 0, err
+		}
+		return t + base + b, nil
+	}
+	le16 := func() (int, error) {
+		if ip+2 > len(src) {
+			return 0, errLZOInput
+		}
+		v := int(src[ip]) | int(src[ip+1])<<8
+		ip += 2
+		return v, nil
+	}
+	// copyMatch copies n bytes from a given distance back in the output.
+	copyMatch := func(dist, n int) error {
+		pos := len(dst) - dist
+		if dist <= 0 || pos < base {
+			return errLZOLookBeh
+		}
+		for i := 0; i < n; i++ {
+			dst = append(dst, dst[pos+i])
+		}
+		return nil
+	}
+
+	state := 0
+	if len(src) > 0 && src[0] > 17 {
+		t := int(src[0]) - 17
+		ip++
+		if err := literals(t); err != nil {
+			return dst, err
+		}
+		if t < 4 {
+			state = t
+		} else {
+			state = 4
+		}
+	}
+	for {
+		t, err := in()
+		if err != nil {
+			return dst, errLZOEOF
+		}
+		var dist, n, next int
+		switch {
+		case t < 16 && state == 0:
+			// literal run
+			if t == 0 {
+				if t, err = run(15); err != nil {
+					return dst, err
+				}
+			}
+			if err = literals(t + 3); err != nil {
+				return dst, err
+			}
+			state = 4
+			continue
+		case t < 16:
+			b, err := in()
+			if err != nil {
+				return dst, err
+			}
+			next = t & 3
+			dist = 1 + t>>2 + b<<2
+			n = 2
+			if state == 4 {
+				dist += 0x800
+				n = 3
+			}
+		case t >= 64:
+			b, err := in()
+			if err != nil {
+				return dst, err
+			}
+			next = t & 3
+			dist = 1 + (t>>2)&7 + b<<3
+			n = t>>5 + 1
+		case t >= 32:
+			n = t&31 + 2
+			if n == 2 {
+				if n, err = run(31 + 2); err != nil {
+					return dst, err
+				}
+			}
+			v, err := le16()
+			if err != nil {
+				return dst, err
+			}
+			dist = 1 + v>>2
+			next = v & 3
+		default: // 16..31
+			dist = (t & 8) << 11
+			n = t&7 + 2
+			if n == 2 {
+				if n, err = run(7 + 2); err != nil {
+					return dst, err
+				}
+			}
+			v, err := le16()
+			if err != nil {
+				return dst, err
+			}
+			dist += v >> 2
+			next = v & 3
+			if dist == 0 {
+				return dst, nil // end of stream
+			}
+			dist += 0x4000
+		}
+		if err = copyMatch(dist, n); err != nil {
+			return dst, err
+		}
+		if err = literals(next); err != nil {
+			return dst, err
+		}
+		state = next
+	}
+}
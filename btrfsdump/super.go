@@ -0,0 +1,337 @@
+// Package btrfsdump reads btrfs metadata directly from a device or an image file,
+// without mounting the filesystem.
+package btrfsdump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"io"
+	"os"
+)
+
+var order = binary.LittleEndian
+
+const (
+	// SuperblockSize is the size of a single superblock copy.
+	SuperblockSize = 4096
+	// SuperblockMagic is the magic string stored in every superblock ("_BHRfS_M").
+	SuperblockMagic = 0x4D5F53665248425F
+
+	sysChunkArraySize = 2048
+	numBackupRoots    = 4
+	backupRootSize    = 168
+	csumFieldSize     = 32
+)
+
+// SuperblockOffsets are the offsets of the primary superblock and its mirrors.
+// Mirrors that do not fit into the device are not written.
+var SuperblockOffsets = []int64{64 << 10, 64 << 20, 256 << 30}
+
+var (
+	// ErrBadMagic is returned when the block does not contain a btrfs superblock.
+	ErrBadMagic = errors.New("btrfsdump: bad superblock magic")
+	// ErrChecksum is returned when the checksum of a block does not match its contents.
+	ErrChecksum = errors.New("btrfsdump: checksum mismatch")
+	// ErrUnsupportedCsum is returned when the checksum algorithm is not supported.
+	ErrUnsupportedCsum = errors.New("btrfsdump: unsupported checksum type")
+)
+
+// Superblock flags.
+const (
+	SuperFlagError    = uint64(1 << 2)
+	SuperFlagSeeding  = uint64(1 << 32)
+	SuperFlagMetadump = uint64(1 << 33)
+)
+
+// Superblock is a decoded btrfs superblock.
+type Superblock struct {
+	Csum       []byte // checksum of the superblock, as stored on disk
+	FSID       btrfs.FSID
+	ByteNr     uint64 // physical offset of this copy
+	Flags      uint64
+	Generation uint64
+
+	Root           uint64 // logical address of the root tree
+	ChunkRoot      uint64 // logical address of the chunk tree
+	LogRoot        uint64 // logical address of the log tree, if any
+	RootLevel      uint8
+	ChunkRootGen   uint64
+	ChunkRootLevel uint8
+	LogRootLevel   uint8
+	RootDirID      uint64
+	TotalBytes     uint64
+	BytesUsed      uint64
+	NumDevices     uint64
+	SectorSize     uint32
+	NodeSize       uint32
+	StripeSize     uint32
+	Features       btrfs.FSFeatureFlags
+	CsumType       btrfs.CsumType
+	Dev            btrfs.DevItem // device this copy was read from
+	Label          string
+	CacheGen       uint64
+	UUIDTreeGen    uint64
+	MetadataUUID   btrfs.FSID
+	NrGlobalRoots  uint64
+
+	// SysChunks is the bootstrap part of the chunk tree needed to read the chunk tree itself.
+	SysChunks []SysChunk
+	// BackupRoots are the tree roots of the last few transactions.
+	BackupRoots []BackupRoot
+}
+
+// SysChunk is a chunk stored in the system chunk array of the superblock.
+type SysChunk struct {
+	Key   btrfs.DiskKey // key of the chunk item; offset is the logical address
+	Chunk btrfs.ChunkItem
+}
+
+// BackupRoot is a copy of tree roots of a past transaction, stored in the superblock.
+type BackupRoot struct {
+	TreeRoot, TreeRootGen     uint64
+	ChunkRoot, ChunkRootGen   uint64
+	ExtentRoot, ExtentRootGen uint64
+	FSRoot, FSRootGen         uint64
+	DevRoot, DevRootGen       uint64
+	CsumRoot, CsumRootGen     uint64
+	TotalBytes                uint64
+	BytesUsed                 uint64
+	NumDevices                uint64
+
+	TreeRootLevel   uint8
+	ChunkRootLevel  uint8
+	ExtentRootLevel uint8
+	FSRootLevel     uint8
+	DevRootLevel    uint8
+	CsumRootLevel   uint8
+}
+
+// HasMetadataUUID reports if tree blocks are stamped with MetadataUUID instead of FSID.
+func (sb *Superblock) HasMetadataUUID() bool {
+	return sb.Features.Incompatible&btrfs.FeatureIncompatMetadataUUID != 0
+}
+
+// ChecksumBlock computes a checksum of the block using a given algorithm.
+// The result is padded with zeros to the size of the on-disk checksum field.
+func ChecksumBlock(typ btrfs.CsumType, p []byte) ([]byte, error) {
+	sum, err := btrfs.Checksum(typ, p)
+	if err != nil {
+		return nil, ErrUnsupportedCsum
+	}
+	out := make([]byte, csumFieldSize)
+	copy(out, sum)
+	return out, nil
+}
+
+// verifyBlock checks the checksum stored in the first bytes of a metadata block.
+func verifyBlock(typ btrfs.CsumType, p []byte) error {
+	sum, err := ChecksumBlock(typ, p[csumFieldSize:])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum[:typ.Size()], p[:typ.Size()]) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// DecodeSuperblock decodes the superblock and verifies its checksum.
+//
+// If the checksum does not match or the algorithm is not supported, the decoded superblock
+// is returned together with ErrChecksum or ErrUnsupportedCsum.
+func DecodeSuperblock(p []byte) (*Superblock, error) {
+	if len(p) < SuperblockSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if order.Uint64(p[64:]) != SuperblockMagic {
+		return nil, ErrBadMagic
+	}
+	sb := &Superblock{
+		ByteNr:       order.Uint64(p[48:]),
+		Flags:        order.Uint64(p[56:]),
+		Generation:   order.Uint64(p[72:]),
+		Root:         order.Uint64(p[80:]),
+		ChunkRoot:    order.Uint64(p[88:]),
+		LogRoot:      order.Uint64(p[96:]),
+		TotalBytes:   order.Uint64(p[112:]),
+		BytesUsed:    order.Uint64(p[120:]),
+		RootDirID:    order.Uint64(p[128:]),
+		NumDevices:   order.Uint64(p[136:]),
+		SectorSize:   order.Uint32(p[144:]),
+		NodeSize:     order.Uint32(p[148:]),
+		StripeSize:   order.Uint32(p[156:]),
+		ChunkRootGen: order.Uint64(p[164:]),
+		Features: btrfs.FSFeatureFlags{
+			Compatible:   btrfs.CompatFeatures(order.Uint64(p[172:])),
+			CompatibleRO: btrfs.FeatureFlags(order.Uint64(p[180:])),
+			Incompatible: btrfs.IncompatFeatures(order.Uint64(p[188:])),
+		},
+		CsumType:       btrfs.CsumType(order.Uint16(p[196:])),
+		RootLevel:      p[198],
+		ChunkRootLevel: p[199],
+		LogRootLevel:   p[200],
+		CacheGen:       order.Uint64(p[555:]),
+		UUIDTreeGen:    order.Uint64(p[563:]),
+		NrGlobalRoots:  order.Uint64(p[587:]),
+	}
+	sb.Csum = append([]byte(nil), p[:csumFieldSize]...)
+	if n := sb.CsumType.Size(); n != 0 {
+		sb.Csum = sb.Csum[:n]
+	}
+	copy(sb.FSID[:], p[32:])
+	copy(sb.MetadataUUID[:], p[571:])
+	if !sb.HasMetadataUUID() {
+		sb.MetadataUUID = sb.FSID
+	}
+	dev, err := btrfs.DecodeDevItem(p[201:299])
+	if err != nil {
+		return nil, err
+	}
+	sb.Dev = dev
+	label := p[299 : 299+256]
+	if i := bytes.IndexByte(label, 0); i >= 0 {
+		label = label[:i]
+	}
+	sb.Label = string(label)
+
+	n := int(order.Uint32(p[160:]))
+	if n > sysChunkArraySize {
+		return nil, fmt.Errorf("btrfsdump: invalid system chunk array size: %d", n)
+	}
+	if sb.SysChunks, err = decodeSysChunks(p[811 : 811+n]); err != nil {
+		return nil, err
+	}
+	for i := 0; i < numBackupRoots; i++ {
+		sb.BackupRoots = append(sb.BackupRoots, decodeBackupRoot(p[811+sysChunkArraySize+i*backupRootSize:]))
+	}
+	return sb, verifyBlock(sb.CsumType, p[:SuperblockSize])
+}
+
+func decodeDiskKey(p []byte) btrfs.DiskKey {
+	return btrfs.DiskKey{
+		ObjectID: order.Uint64(p[0:]),
+		Type:     p[8],
+		Offset:   order.Uint64(p[9:]),
+	}
+}
+
+const diskKeySize = 17
+
+func decodeSysChunks(p []byte) ([]SysChunk, error) {
+	var out []SysChunk
+	for len(p) > 0 {
+		if len(p) < diskKeySize {
+			return out, fmt.Errorf("btrfsdump: truncated system chunk array")
+		}
+		c := SysChunk{Key: decodeDiskKey(p)}
+		p = p[diskKeySize:]
+		if c.Key.Type != byte(btrfs.KeyChunkItem) {
+			return out, fmt.Errorf("btrfsdump: unexpected item in system chunk array: %v", btrfs.KeyType(c.Key.Type))
+		}
+		chunk, err := btrfs.DecodeChunkItem(p)
+		if err != nil {
+			return out, err
+		}
+		c.Chunk = chunk
+		out = append(out, c)
+		p = p[chunkItemLen(chunk):]
+	}
+	return out, nil
+}
+
+func decodeBackupRoot(p []byte) BackupRoot {
+	return BackupRoot{
+		TreeRoot:        order.Uint64(p[0:]),
+		TreeRootGen:     order.Uint64(p[8:]),
+		ChunkRoot:       order.Uint64(p[16:]),
+		ChunkRootGen:    order.Uint64(p[24:]),
+		ExtentRoot:      order.Uint64(p[32:]),
+		ExtentRootGen:   order.Uint64(p[40:]),
+		FSRoot:          order.Uint64(p[48:]),
+		FSRootGen:       order.Uint64(p[56:]),
+		DevRoot:         order.Uint64(p[64:]),
+		DevRootGen:      order.Uint64(p[72:]),
+		CsumRoot:        order.Uint64(p[80:]),
+		CsumRootGen:     order.Uint64(p[88:]),
+		TotalBytes:      order.Uint64(p[96:]),
+		BytesUsed:       order.Uint64(p[104:]),
+		NumDevices:      order.Uint64(p[112:]),
+		TreeRootLevel:   p[152],
+		ChunkRootLevel:  p[153],
+		ExtentRootLevel: p[154],
+		FSRootLevel:     p[155],
+		DevRootLevel:    p[156],
+		CsumRootLevel:   p[157],
+	}
+}
+
+// ReadSuperblock reads and decodes the superblock copy at a given offset.
+func ReadSuperblock(r io.ReaderAt, off int64) (*Superblock, error) {
+	buf := make([]byte, SuperblockSize)
+	if _, err := r.ReadAt(buf, off); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	sb, err := DecodeSuperblock(buf)
+	if err == nil && sb.ByteNr != uint64(off) {
+		err = fmt.Errorf("btrfsdump: superblock at %d claims to be at %d", off, sb.ByteNr)
+	}
+	return sb, err
+}
+
+// SuperblockCopy is a result of reading one of the superblock copies.
+type SuperblockCopy struct {
+	Offset int64
+	Super  *Superblock // nil if the copy cannot be decoded
+	Err    error       // decoding or verification error
+}
+
+// ReadSuperblocks reads all superblock copies that fit into the device.
+// Copies that cannot be decoded or fail verification are returned with an error set.
+func ReadSuperblocks(r io.ReaderAt) []SuperblockCopy {
+	var out []SuperblockCopy
+	for _, off := range SuperblockOffsets {
+		sb, err := ReadSuperblock(r, off)
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		out = append(out, SuperblockCopy{Offset: off, Super: sb, Err: err})
+	}
+	return out
+}
+
+// ReadSuperblocksFile is like ReadSuperblocks, but opens a device or an image file by path.
+func ReadSuperblocksFile(path string) ([]SuperblockCopy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSuperblocks(f), nil
+}
+
+// LatestSuperblock returns the valid copy with the highest generation.
+// It returns ErrBadMagic if none of the copies are valid.
+func LatestSuperblock(list []SuperblockCopy) (*Superblock, error) {
+	var (
+		best    *Superblock
+		lastErr error = ErrBadMagic
+	)
+	for _, c := range list {
+		if c.Err != nil {
+			lastErr = c.Err
+			continue
+		}
+		if best == nil || c.Super.Generation > best.Generation {
+			best = c.Super
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+	return best, nil
+}
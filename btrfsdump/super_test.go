@@ -0,0 +1,114 @@
+package btrfsdump
+
+import (
+	"bytes"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/internal/imagetest"
+	"strings"
+	"testing"
+)
+
+// testSuperblock builds a minimal superblock with a single system chunk.
+func testSuperblock(off int64, gen uint64) []byte {
+	p := make([]byte, SuperblockSize)
+	copy(p[32:], "0123456789abcdef") // fsid
+	order.PutUint64(p[48:], uint64(off))
+	order.PutUint64(p[64:], SuperblockMagic)
+	order.PutUint64(p[72:], gen)
+	order.PutUint64(p[80:], 30408704)
+	order.PutUint64(p[88:], 22020096)
+	order.PutUint64(p[112:], 1<<30)
+	order.PutUint64(p[128:], 6)
+	order.PutUint64(p[136:], 1)
+	order.PutUint32(p[144:], 4096)
+	order.PutUint32(p[148:], 16384)
+	order.PutUint64(p[188:], uint64(btrfs.FeatureIncompatMixedBackRef|btrfs.FeatureIncompatNoHoles))
+	order.PutUint64(p[201:], 1) // devid
+	copy(p[299:], "test-label")
+
+	// system chunk array
+	arr := p[811:]
+	order.PutUint64(arr[0:], 256)
+	arr[8] = byte(btrfs.KeyChunkItem)
+	order.PutUint64(arr[9:], 22020096)
+	c := arr[diskKeySize:]
+	order.PutUint64(c[0:], 8<<20)                           // length
+	order.PutUint64(c[8:], 2)                               // owner
+	order.PutUint64(c[24:], uint64(btrfs.BlockGroupSystem)) // type
+	order.PutUint16(c[44:], 1)                              // num_stripes
+	order.PutUint64(c[48:], 1)                              // stripe devid
+	order.PutUint64(c[56:], 22020096)                       // stripe offset
+	order.PutUint32(p[160:], uint32(diskKeySize+48+32))
+
+	// backup roots
+	order.PutUint64(p[811+sysChunkArraySize:], 30408704)
+
+	imagetest.PutCsum(p[:SuperblockSize])
+	return p
+}
+
+func TestDecodeSuperblock(t *testing.T) {
+	p := testSuperblock(SuperblockOffsets[0], 7)
+	sb, err := DecodeSuperblock(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.Generation != 7 || sb.NodeSize != 16384 || sb.Label != "test-label" || sb.Dev.DevID != 1 {
+		t.Fatalf("unexpected superblock: %+v", sb)
+	}
+	if sb.CsumType != btrfs.CsumCRC32C || len(sb.Csum) != 4 {
+		t.Fatalf("unexpected checksum: %v %x", sb.CsumType, sb.Csum)
+	}
+	if sb.MetadataUUID != sb.FSID {
+		t.Fatalf("expected metadata uuid to match fsid: %v", sb.MetadataUUID)
+	}
+	if len(sb.SysChunks) != 1 {
+		t.Fatalf("unexpected system chunks: %+v", sb.SysChunks)
+	} else if c := sb.SysChunks[0]; c.Key.Offset != 22020096 || c.Chunk.Length != 8<<20 || len(c.Chunk.Stripes) != 1 {
+		t.Fatalf("unexpected system chunk: %+v", c)
+	}
+	if len(sb.BackupRoots) != numBackupRoots || sb.BackupRoots[0].TreeRoot != 30408704 {
+		t.Fatalf("unexpected backup roots: %+v", sb.BackupRoots)
+	}
+
+	p[100] ^= 0xff
+	if _, err = DecodeSuperblock(p); err != ErrChecksum {
+		t.Fatalf("expected checksum error, got: %v", err)
+	}
+	p[64] = 0
+	if _, err = DecodeSuperblock(p); err != ErrBadMagic {
+		t.Fatalf("expected magic error, got: %v", err)
+	}
+}
+
+func TestReadSuperblocks(t *testing.T) {
+	img := make([]byte, SuperblockOffsets[1]+SuperblockSize)
+	copy(img[SuperblockOffsets[0]:], testSuperblock(SuperblockOffsets[0], 5))
+	copy(img[SuperblockOffsets[1]:], testSuperblock(SuperblockOffsets[1], 6))
+
+	list := ReadSuperblocks(bytes.NewReader(img))
+	if len(list) != 2 {
+		t.Fatalf("unexpected number of copies: %d", len(list))
+	}
+	for _, c := range list {
+		if c.Err != nil {
+			t.Fatalf("copy at %d: %v", c.Offset, c.Err)
+		}
+	}
+	sb, err := LatestSuperblock(list)
+	if err != nil {
+		t.Fatal(err)
+	} else if sb.Generation != 6 {
+		t.Fatalf("unexpected generation: %d", sb.Generation)
+	}
+
+	var buf bytes.Buffer
+	if err = DumpSuperblock(&buf, sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"test-label", "mixed-backref,no-holes", "stripe 0 devid 1 offset 22020096"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected %q in the dump:\n%s", s, buf.String())
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package btrfsdump
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+)
+
+const (
+	headerSize  = 101
+	itemSize    = 25
+	keyPtrSize  = 33
+	maxLevel    = 8
+	flagsMask   = 1<<56 - 1
+	revisionBit = 56
+)
+
+// Tree ids that are not stored in the root tree.
+const (
+	TreeLogID = uint64(1<<64 - 6)
+)
+
+// Header is a header of a tree block.
+type Header struct {
+	Csum          []byte
+	FSID          btrfs.FSID
+	ByteNr        uint64 // logical address of the block
+	Flags         uint64
+	Revision      uint8 // backref revision
+	ChunkTreeUUID btrfs.UUID
+	Generation    uint64
+	Owner         uint64 // id of the tree the block belongs to
+	NumItems      uint32
+	Level         uint8 // zero for leaves
+}
+
+// Item is an item stored in a leaf.
+type Item struct {
+	Key    btrfs.DiskKey
+	Offset uint32 // offset of the data in the leaf, after the header
+	Data   []byte
+}
+
+// Decode decodes the item data according to its type.
+// See btrfs.SearchItem.Decode for a list of supported types.
+func (it Item) Decode() (interface{}, error) {
+	return btrfs.SearchItem{
+		ObjectID: it.Key.ObjectID,
+		Type:     btrfs.KeyType(it.Key.Type),
+		Offset:   it.Key.Offset,
+		Data:     it.Data,
+	}.Decode()
+}
+
+// KeyPtr is a pointer to a child block, stored in an internal node.
+type KeyPtr struct {
+	Key        btrfs.DiskKey
+	BlockPtr   uint64
+	Generation uint64
+}
+
+// Node is a decoded tree block. Leaves contain items, internal nodes contain pointers.
+type Node struct {
+	Header
+	Items []Item
+	Ptrs  []KeyPtr
+}
+
+// IsLeaf reports if the block is a leaf.
+func (n *Node) IsLeaf() bool { return n.Level == 0 }
+
+// FreeSpace returns the number of unused bytes in the block.
+func (n *Node) FreeSpace(nodeSize uint32) int {
+	if !n.IsLeaf() {
+		return int(nodeSize) - headerSize - len(n.Ptrs)*keyPtrSize
+	}
+	used := headerSize + len(n.Items)*itemSize
+	for _, it := range n.Items {
+		used += len(it.Data)
+	}
+	return int(nodeSize) - used
+}
+
+// DecodeNode decodes a tree block. It does not verify the checksum.
+func DecodeNode(p []byte) (*Node, error) {
+	if len(p) < headerSize {
+		return nil, errors.New("btrfsdump: tree block is too short")
+	}
+	flags := order.Uint64(p[56:])
+	n := &Node{Header: Header{
+		Csum:       append([]byte(nil), p[:csumFieldSize]...),
+		ByteNr:     order.Uint64(p[48:]),
+		Flags:      flags & flagsMask,
+		Revision:   uint8(flags >> revisionBit),
+		Generation: order.Uint64(p[80:]),
+		Owner:      order.Uint64(p[88:]),
+		NumItems:   order.Uint32(p[96:]),
+		Level:      p[100],
+	}}
+	copy(n.FSID[:], p[32:])
+	copy(n.ChunkTreeUUID[:], p[64:])
+	if n.Level >= maxLevel {
+		return n, fmt.Errorf("btrfsdump: block %d: invalid level %d", n.ByteNr, n.Level)
+	}
+	data := p[headerSize:]
+	if n.Level != 0 {
+		if int(n.NumItems)*keyPtrSize > len(data) {
+			return n, fmt.Errorf("btrfsdump: block %d: too many pointers: %d", n.ByteNr, n.NumItems)
+		}
+		n.Ptrs = make([]KeyPtr, n.NumItems)
+		for i := range n.Ptrs {
+			b := data[i*keyPtrSize:]
+			n.Ptrs[i] = KeyPtr{
+				Key:        decodeDiskKey(b),
+				BlockPtr:   order.Uint64(b[17:]),
+				Generation: order.Uint64(b[25:]),
+			}
+		}
+		return n, nil
+	}
+	if int(n.NumItems)*itemSize > len(data) {
+		return n, fmt.Errorf("btrfsdump: block %d: too many items: %d", n.ByteNr, n.NumItems)
+	}
+	n.Items = make([]Item, n.NumItems)
+	for i := range n.Items {
+		b := data[i*itemSize:]
+		it := Item{Key: decodeDiskKey(b), Offset: order.Uint32(b[17:])}
+		size := order.Uint32(b[21:])
+		if end := uint64(it.Offset) + uint64(size); end > uint64(len(data)) {
+			n.Items = n.Items[:i]
+			return n, fmt.Errorf("btrfsdump: block %d: item %d is out of bounds", n.ByteNr, i)
+		}
+		it.Data = data[it.Offset : it.Offset+size]
+		n.Items[i] = it
+	}
+	return n, nil
+}
+
+// ReadNode reads and verifies a tree block at a given logical address.
+// If the block fails verification, other mirrors are tried.
+//
+// If all mirrors fail verification, the last decoded block is returned
+// together with an error, so it can still be inspected.
+func (im *Image) ReadNode(logical uint64) (*Node, error) {
+	c, err := im.chunkFor(logical)
+	if err != nil {
+		return nil, err
+	}
+	var node *Node
+	buf := make([]byte, im.Super.NodeSize)
+	for m := 0; m < c.mirrors(); m++ {
+		if err = im.readMirror(c, buf, logical, m); err != nil {
+			continue
+		}
+		var n *Node
+		if n, err = im.verifyNode(buf, logical); n != nil {
+			node = n
+		}
+		if err == nil {
+			return node, nil
+		}
+	}
+	return node, err
+}
+
+// ReadNodeMirror reads and verifies a tree block from a specific mirror.
+// As with ReadNode, the decoded block may be returned together with a verification error.
+func (im *Image) ReadNodeMirror(logical uint64, mirror int) (*Node, error) {
+	buf := make([]byte, im.Super.NodeSize)
+	if err := im.ReadMirror(buf, logical, mirror); err != nil {
+		return nil, err
+	}
+	return im.verifyNode(buf, logical)
+}
+
+// verifyNode decodes the block and checks its checksum and header fields.
+func (im *Image) verifyNode(buf []byte, logical uint64) (*Node, error) {
+	err := verifyBlock(im.Super.CsumType, buf)
+	if err == ErrUnsupportedCsum {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("btrfsdump: block %d: %w", logical, err)
+	}
+	n, derr := DecodeNode(buf)
+	if n == nil {
+		return nil, derr
+	}
+	// copy the data, so the buffer can be reused for other mirrors
+	n = cloneNode(n)
+	if err != nil {
+		return n, err
+	} else if derr != nil {
+		return n, derr
+	}
+	if n.ByteNr != logical {
+		return n, fmt.Errorf("btrfsdump: block %d: bad bytenr %d", logical, n.ByteNr)
+	} else if n.FSID != im.Super.MetadataUUID {
+		return n, fmt.Errorf("btrfsdump: block %d: bad fsid %v", logical, btrfs.UUID(n.FSID))
+	}
+	return n, nil
+}
+
+func cloneNode(n *Node) *Node {
+	c := *n
+	if n.Items != nil {
+		c.Items = make([]Item, len(n.Items))
+		for i, it := range n.Items {
+			it.Data = append([]byte(nil), it.Data...)
+			c.Items[i] = it
+		}
+	}
+	return &c
+}
+
+// ErrSkipNode can be returned from WalkNodes callback to skip children of a node.
+var ErrSkipNode = errors.New("btrfsdump: skip node")
+
+// WalkNodes calls fn for all blocks of the tree starting at a given logical address,
+// in key order, parents before their children.
+func (im *Image) WalkNodes(root uint64, fn func(n *Node) error) error {
+	n, err := im.ReadNode(root)
+	if err != nil {
+		return err
+	}
+	if err = fn(n); err == ErrSkipNode {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, p := range n.Ptrs {
+		if err = im.WalkNodes(p.BlockPtr, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for all items of a tree with a given id, in key order.
+func (im *Image) Walk(tree uint64, fn func(it Item) error) error {
+	root, err := im.Tree(tree)
+	if err != nil {
+		return err
+	}
+	return im.WalkNodes(root.ByteNr, func(n *Node) error {
+		for _, it := range n.Items {
+			if err := fn(it); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// compareKeys compares two keys in the tree order.
+func compareKeys(a, b btrfs.DiskKey) int {
+	switch {
+	case a.ObjectID != b.ObjectID:
+		if a.ObjectID < b.ObjectID {
+			return -1
+		}
+		return 1
+	case a.Type != b.Type:
+		if a.Type < b.Type {
+			return -1
+		}
+		return 1
+	case a.Offset != b.Offset:
+		if a.Offset < b.Offset {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// errStopSearch stops the search once the keys go past the upper bound.
+var errStopSearch = errors.New("btrfsdump: stop search")
+
+// Search calls fn for all items of a tree with a given id with keys in [min, max], in key order.
+// Unlike Walk, only blocks that may contain keys from the range are read.
+func (im *Image) Search(tree uint64, min, max btrfs.DiskKey, fn func(it Item) error) error {
+	root, err := im.Tree(tree)
+	if err != nil {
+		return err
+	}
+	err = im.searchNode(root.ByteNr, min, max, fn)
+	if err == errStopSearch {
+		err = nil
+	}
+	return err
+}
+
+func (im *Image) searchNode(bytenr uint64, min, max btrfs.DiskKey, fn func(it Item) error) error {
+	n, err := im.ReadNode(bytenr)
+	if err != nil {
+		return err
+	}
+	for _, it := range n.Items {
+		if compareKeys(it.Key, min) < 0 {
+			continue
+		} else if compareKeys(it.Key, max) > 0 {
+			return errStopSearch
+		}
+		if err = fn(it); err != nil {
+			return err
+		}
+	}
+	for i, p := range n.Ptrs {
+		if compareKeys(p.Key, max) > 0 {
+			return errStopSearch
+		}
+		if i+1 < len(n.Ptrs) && compareKeys(n.Ptrs[i+1].Key, min) <= 0 {
+			continue // all keys of the child are below the range
+		}
+		if err = im.searchNode(p.BlockPtr, min, max, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithRootTree returns a copy of the image that uses a different root tree block,
+// for example one from the superblock backup roots, or found by scanning the device.
+// It allows to access trees of older transactions if the current root is damaged.
+func (im *Image) WithRootTree(bytenr uint64) (*Image, error) {
+	n, err := im.ReadNode(bytenr)
+	if err != nil {
+		return nil, err
+	} else if n.Owner != btrfs.RootTreeID {
+		return nil, fmt.Errorf("btrfsdump: block %d belongs to tree %d, not the root tree", bytenr, n.Owner)
+	}
+	sb := *im.Super
+	sb.Root, sb.RootLevel, sb.Generation = n.ByteNr, n.Level, n.Generation
+	c := *im
+	c.Super = &sb
+	c.files = nil // files are owned by the original image
+	return &c, nil
+}
+
+// TreeRoot describes the location of the root block of a tree.
+type TreeRoot struct {
+	ID         uint64
+	ByteNr     uint64
+	Level      uint8
+	Generation uint64
+	// Item is the root item of the tree.
+	// It is not set for trees referenced directly from the superblock.
+	Item *btrfs.RootItem
+}
+
+// Tree returns the root of a tree with a given id.
+// Trees that are not referenced by the superblock are looked up in the root tree.
+func (im *Image) Tree(id uint64) (TreeRoot, error) {
+	sb := im.Super
+	switch id {
+	case btrfs.RootTreeID:
+		return TreeRoot{ID: id, ByteNr: sb.Root, Level: sb.RootLevel, Generation: sb.Generation}, nil
+	case btrfs.ChunkTreeID:
+		return TreeRoot{ID: id, ByteNr: sb.ChunkRoot, Level: sb.ChunkRootLevel, Generation: sb.ChunkRootGen}, nil
+	case TreeLogID:
+		if sb.LogRoot == 0 {
+			return TreeRoot{}, btrfs.ErrNotFound
+		}
+		return TreeRoot{ID: id, ByteNr: sb.LogRoot, Level: sb.LogRootLevel, Generation: sb.Generation + 1}, nil
+	}
+	var (
+		found *TreeRoot
+		last  = errors.New("stop")
+	)
+	err := im.walkRoots(func(r TreeRoot) error {
+		if r.ID == id {
+			found = &r
+		} else if r.ID > id {
+			return last
+		}
+		return nil
+	})
+	if err != nil && err != last {
+		return TreeRoot{}, err
+	} else if found == nil {
+		return TreeRoot{}, btrfs.ErrNotFound
+	}
+	return *found, nil
+}
+
+// Trees returns roots of all trees, including the root and the chunk trees.
+func (im *Image) Trees() ([]TreeRoot, error) {
+	var out []TreeRoot
+	for _, id := range []uint64{btrfs.RootTreeID, btrfs.ChunkTreeID} {
+		r, _ := im.Tree(id)
+		out = append(out, r)
+	}
+	err := im.walkRoots(func(r TreeRoot) error {
+		out = append(out, r)
+		return nil
+	})
+	return out, err
+}
+
+// walkRoots calls fn for every root item in the root tree.
+func (im *Image) walkRoots(fn func(r TreeRoot) error) error {
+	return im.WalkNodes(im.Super.Root, func(n *Node) error {
+		for _, it := range n.Items {
+			if it.Key.Type != byte(btrfs.KeyRootItem) {
+				continue
+			}
+			ri, err := btrfs.DecodeRootItem(it.Data)
+			if err != nil {
+				return err
+			}
+			if err = fn(TreeRoot{
+				ID: it.Key.ObjectID, ByteNr: ri.ByteNr, Level: ri.Level,
+				Generation: ri.Gen, Item: &ri,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,155 @@
+package btrfs
+
+import (
+	"bufio"
+	"errors"
+	"github.com/dennwc/btrfs/mtab"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Capabilities lists operations that are permitted for the caller on the filesystem.
+type Capabilities struct {
+	// Admin is set if the process has CAP_SYS_ADMIN. It's required for device management,
+	// balance, scrub, quotas, and for reading internal structures of the filesystem.
+	Admin bool `json:"admin"`
+	// TreeSearch is set if tree search is permitted. Without it, subvolumes can only be
+	// listed with UserSubvolumes, and functions that read trees (BlockGroups, VerifyFile,
+	// CompressionStats, SubvolumeInfo) return ErrNeedsRoot.
+	TreeSearch bool `json:"tree_search"`
+	// UserSubvolumes is set if subvolumes can be listed and inspected without CAP_SYS_ADMIN.
+	// It requires kernel 4.18+.
+	UserSubvolumes bool `json:"user_subvolumes"`
+	// DeleteSubvolumes is set if subvolumes can be deleted: either the process is an admin,
+	// or the filesystem is mounted with user_subvol_rm_allowed and the user owns the subvolume.
+	DeleteSubvolumes bool `json:"delete_subvolumes"`
+	// Writable is set if the filesystem is mounted read-write.
+	Writable bool `json:"writable"`
+}
+
+// Capabilities probes which operations are permitted with privileges of the calling process.
+// Services that may run without root can use it to disable features in advance.
+func (f *FS) Capabilities() (Capabilities, error) {
+	c := Capabilities{Admin: isAdmin()}
+
+	_, err := treeSearchRaw(f.file(), btrfs_ioctl_search_key{
+		tree_id:      rootTreeObjectid,
+		min_objectid: fsTreeObjectid,
+		max_objectid: fsTreeObjectid,
+		min_type:     rootItemKey,
+		max_type:     rootItemKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+		nr_items:     1,
+	})
+	if err == nil {
+		c.TreeSearch = true
+	} else if !errors.Is(err, ErrNeedsRoot) {
+		return c, &os.PathError{Op: "tree search", Path: f.f.Name(), Err: err}
+	}
+
+	if _, err = iocGetSubvolInfo(f.file()); err == nil {
+		c.UserSubvolumes = true
+	} else if err != syscall.ENOTTY {
+		return c, &os.PathError{Op: "get subvolume info", Path: f.f.Name(), Err: err}
+	}
+
+	var st syscall.Statfs_t
+	if err = fstatfs(f.f, &st); err != nil {
+		return c, err
+	}
+	c.Writable = st.Flags&stRdOnly == 0
+
+	c.DeleteSubvolumes = c.Admin
+	if !c.Admin {
+		opts, err := f.mountOptions()
+		if err != nil {
+			return c, err
+		}
+		for _, o := range strings.Split(opts, ",") {
+			if o == "user_subvol_rm_allowed" {
+				c.DeleteSubvolumes = true
+			}
+		}
+	}
+	return c, nil
+}
+
+// mountOptions returns mount options of the filesystem.
+func (f *FS) mountOptions() (string, error) {
+	path, err := filepath.Abs(f.f.Name())
+	if err != nil {
+		return "", err
+	}
+	root, err := findMountRoot(path)
+	if err != nil {
+		return "", err
+	}
+	mounts, err := mtab.Mounts()
+	if err != nil {
+		return "", err
+	}
+	opts := ""
+	for _, m := range mounts {
+		// the last mount wins if there are multiple mounts on the same path
+		if m.Mount == root {
+			opts = m.Opts
+		}
+	}
+	return opts, nil
+}
+
+// requireAdmin returns ErrNeedsRoot if the process doesn't have CAP_SYS_ADMIN.
+// It's used by operations that would otherwise fail after doing a part of the work.
+func requireAdmin(op, path string) error {
+	if isAdmin() {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: path, Err: ErrNeedsRoot}
+}
+
+// capSysAdmin is the bit of CAP_SYS_ADMIN in the capability set.
+const capSysAdmin = 21
+
+// isAdmin reports if the process has CAP_SYS_ADMIN in the initial user namespace,
+// which is checked by the kernel for privileged btrfs ioctls.
+var isAdmin = func() bool {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return os.Geteuid() == 0
+	}
+	caps, ok := parseCapEff(string(status))
+	if !ok || caps&(1<<capSysAdmin) == 0 {
+		return false
+	}
+	// capabilities in a child user namespace are not valid for the filesystem
+	uidMap, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return true
+	}
+	return isInitUserNS(string(uidMap))
+}
+
+// parseCapEff returns the effective capability set from /proc/self/status.
+func parseCapEff(status string) (uint64, bool) {
+	sc := bufio.NewScanner(strings.NewReader(status))
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		return v, err == nil
+	}
+	return 0, false
+}
+
+// isInitUserNS checks if the uid map is an identity mapping of all ids.
+func isInitUserNS(uidMap string) bool {
+	f := strings.Fields(uidMap)
+	return len(f) == 3 && f[0] == "0" && f[1] == "0" && f[2] == "4294967295"
+}
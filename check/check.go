@@ -0,0 +1,331 @@
+// Package check performs read-only consistency checks of unmounted btrfs filesystems.
+//
+// It verifies checksums and structure of all tree blocks, reference counts in the extent tree,
+// and cross-checks inodes with directory entries in every subvolume. Problems are reported
+// as a list of findings instead of failing on the first error.
+package check
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+)
+
+// Severity is a severity of a finding.
+type Severity int
+
+const (
+	// Warning is reported for problems that do not cause data loss or corruption,
+	// like leaked extents or a bad copy of a block that has a good mirror.
+	Warning Severity = iota
+	// Error is reported for inconsistencies that will likely cause errors when mounted.
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+	return fmt.Sprintf("severity%d", int(s))
+}
+
+// MarshalText encodes the severity as its name.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Kind is a class of the finding.
+type Kind string
+
+const (
+	KindChecksum Kind = "checksum" // checksum mismatch of a tree block
+	KindBlock    Kind = "block"    // unreadable or invalid tree block
+	KindTree     Kind = "tree"     // broken tree structure: levels, generations or key order
+	KindExtent   Kind = "extent"   // extent tree references
+	KindInode    Kind = "inode"    // inode link counts and directory entries
+)
+
+// Finding is a single problem found by the checker.
+type Finding struct {
+	Severity Severity       `json:"severity"`
+	Kind     Kind           `json:"kind"`
+	Tree     uint64         `json:"tree,omitempty"`  // id of the tree, if known
+	Block    uint64         `json:"block,omitempty"` // logical address of the tree block, if known
+	Key      *btrfs.DiskKey `json:"key,omitempty"`   // key of the item, if known
+	Message  string         `json:"message"`
+}
+
+func (f Finding) String() string {
+	s := f.Severity.String() + ": " + string(f.Kind)
+	if f.Tree != 0 {
+		s += fmt.Sprintf(" tree %d", f.Tree)
+	}
+	if f.Block != 0 {
+		s += fmt.Sprintf(" block %d", f.Block)
+	}
+	if f.Key != nil {
+		s += fmt.Sprintf(" key (%d %v %d)", f.Key.ObjectID, btrfs.KeyType(f.Key.Type), f.Key.Offset)
+	}
+	return s + ": " + f.Message
+}
+
+// Report is the result of the check.
+type Report struct {
+	Findings []Finding `json:"findings"`
+	Trees    int       `json:"trees"`  // number of checked trees
+	Blocks   int       `json:"blocks"` // number of distinct tree blocks
+	Items    int       `json:"items"`  // number of items in distinct leaves
+}
+
+// OK reports if no errors were found. Warnings are ignored.
+func (r *Report) OK() bool {
+	return r.Errors() == 0
+}
+
+// Errors returns the number of findings with Error severity.
+func (r *Report) Errors() int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Severity == Error {
+			n++
+		}
+	}
+	return n
+}
+
+// Options control which checks are performed.
+type Options struct {
+	// SkipExtents disables cross-checks of the extent tree.
+	SkipExtents bool
+	// SkipInodes disables checks of inodes and directory entries.
+	SkipInodes bool
+}
+
+// Files opens devices or image files of a single filesystem and checks it.
+func Files(opts Options, paths ...string) (*Report, error) {
+	im, err := btrfsdump.Open(paths...)
+	if err != nil {
+		return nil, err
+	}
+	defer im.Close()
+	return Run(im, opts)
+}
+
+// Run checks the filesystem image. An error is returned only if the check cannot proceed,
+// for example if the root tree is unreadable; all other problems are reported as findings.
+func Run(im *btrfsdump.Image, opts Options) (*Report, error) {
+	trees, err := im.Trees()
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{
+		im:      im,
+		opts:    opts,
+		rep:     &Report{},
+		visited: make(map[uint64]bool),
+		extents: newExtentChecker(),
+	}
+	if im.Super.LogRoot != 0 {
+		// extents referenced by the log are not reachable from other trees
+		c.reportf(Warning, KindTree, btrfsdump.TreeLogID, im.Super.LogRoot, "log tree is not replayed")
+		c.extents.partial = true
+	}
+	for _, t := range trees {
+		c.checkTree(t)
+	}
+	c.rep.Blocks = len(c.visited)
+	if !opts.SkipExtents {
+		c.extents.finish(c)
+	}
+	return c.rep, nil
+}
+
+type checker struct {
+	im   *btrfsdump.Image
+	opts Options
+	rep  *Report
+
+	// visited tracks verified tree blocks; the value is false if the block is unusable
+	visited map[uint64]bool
+	extents *extentChecker
+}
+
+func (c *checker) report(f Finding) {
+	c.rep.Findings = append(c.rep.Findings, f)
+}
+
+func (c *checker) reportf(sev Severity, kind Kind, tree, block uint64, format string, args ...interface{}) {
+	c.report(Finding{
+		Severity: sev, Kind: kind, Tree: tree, Block: block,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func itemFinding(sev Severity, kind Kind, tree uint64, key btrfs.DiskKey, msg string) Finding {
+	return Finding{Severity: sev, Kind: kind, Tree: tree, Key: &key, Message: msg}
+}
+
+// isFSTree reports if the tree stores files and directories.
+func isFSTree(id uint64) bool {
+	return id == btrfs.FSTreeID || (id >= btrfs.FirstFreeID && id <= btrfs.LastFreeID)
+}
+
+func (c *checker) checkTree(t btrfsdump.TreeRoot) {
+	if t.Item != nil && t.Item.DropProgress.ObjectID != 0 {
+		// parts of trees that are being deleted may already be freed and reused
+		c.reportf(Warning, KindTree, t.ID, t.ByteNr, "tree is being deleted, skipped")
+		c.extents.partial = true
+		return
+	}
+	c.rep.Trees++
+	var visit func(it btrfsdump.Item)
+	switch {
+	case t.ID == btrfs.ExtentTreeID && !c.opts.SkipExtents:
+		c.extents.found = true
+		visit = func(it btrfsdump.Item) { c.extents.addExtentItem(c, t.ID, it) }
+	case isFSTree(t.ID):
+		var ic *inodeChecker
+		if !c.opts.SkipInodes {
+			ic = newInodeChecker(t.ID)
+			defer ic.finish(c)
+		}
+		visit = func(it btrfsdump.Item) {
+			if ic != nil {
+				ic.add(c, it)
+			}
+			if !c.opts.SkipExtents {
+				c.extents.addFileExtent(c, t.ID, it)
+			}
+		}
+	}
+	c.checkBlock(t.ID, t.ByteNr, t.Level, t.Generation, nil, visit)
+}
+
+// compareKeys compares two keys in the tree order.
+func compareKeys(a, b btrfs.DiskKey) int {
+	switch {
+	case a.ObjectID < b.ObjectID:
+		return -1
+	case a.ObjectID > b.ObjectID:
+		return 1
+	case a.Type < b.Type:
+		return -1
+	case a.Type > b.Type:
+		return 1
+	case a.Offset < b.Offset:
+		return -1
+	case a.Offset > b.Offset:
+		return 1
+	}
+	return 0
+}
+
+// readBlock reads all mirrors of the block and reports those that fail verification.
+// It returns the first good copy, or nil if there is none.
+func (c *checker) readBlock(tree, bytenr uint64) *btrfsdump.Node {
+	mirrors, err := c.im.Mirrors(bytenr)
+	if err != nil {
+		c.reportf(Error, KindBlock, tree, bytenr, "%v", err)
+		return nil
+	}
+	var (
+		good *btrfsdump.Node
+		bad  []error
+	)
+	for m := 0; m < mirrors; m++ {
+		n, err := c.im.ReadNodeMirror(bytenr, m)
+		if err != nil {
+			bad = append(bad, fmt.Errorf("mirror %d: %w", m, err))
+		} else if good == nil {
+			good = n
+		}
+	}
+	sev := Error
+	if good != nil {
+		sev = Warning
+	}
+	for _, err := range bad {
+		kind := KindBlock
+		if errors.Is(err, btrfsdump.ErrChecksum) {
+			kind = KindChecksum
+		}
+		c.reportf(sev, kind, tree, bytenr, "%v", err)
+	}
+	return good
+}
+
+// checkBlock verifies the block and its children, and passes all leaf items to visit.
+// Blocks shared between trees are verified once, but their items are visited for each tree.
+func (c *checker) checkBlock(tree, bytenr uint64, level uint8, gen uint64, first *btrfs.DiskKey, visit func(it btrfsdump.Item)) {
+	var n *btrfsdump.Node
+	if ok, seen := c.visited[bytenr]; seen {
+		if !ok || visit == nil {
+			return
+		}
+		var err error
+		if n, err = c.im.ReadNode(bytenr); err != nil {
+			return
+		}
+	} else {
+		n = c.readBlock(tree, bytenr)
+		c.visited[bytenr] = n != nil && c.verifyNode(tree, n, level, gen, first)
+		if !c.visited[bytenr] {
+			return
+		}
+		c.rep.Items += len(n.Items)
+		c.extents.addTreeBlock(tree, bytenr)
+	}
+	if visit != nil {
+		for _, it := range n.Items {
+			visit(it)
+		}
+	}
+	for _, p := range n.Ptrs {
+		key := p.Key
+		c.checkBlock(tree, p.BlockPtr, n.Level-1, p.Generation, &key, visit)
+	}
+}
+
+// verifyNode checks the structure of a single block. It returns false if children
+// of the block must not be followed.
+func (c *checker) verifyNode(tree uint64, n *btrfsdump.Node, level uint8, gen uint64, first *btrfs.DiskKey) bool {
+	ok := true
+	if n.Level != level {
+		c.reportf(Error, KindTree, tree, n.ByteNr, "wrong level: %d, expected %d", n.Level, level)
+		ok = false
+	}
+	if gen != 0 && n.Generation != gen {
+		c.reportf(Error, KindTree, tree, n.ByteNr, "parent transid verify failed: wanted %d, found %d", gen, n.Generation)
+	}
+	if n.Generation > c.im.Super.Generation+1 {
+		c.reportf(Error, KindTree, tree, n.ByteNr, "generation %d is newer than the superblock (%d)", n.Generation, c.im.Super.Generation)
+	}
+	var keys []btrfs.DiskKey
+	for _, it := range n.Items {
+		keys = append(keys, it.Key)
+	}
+	for _, p := range n.Ptrs {
+		keys = append(keys, p.Key)
+	}
+	if len(keys) == 0 && level != 0 {
+		c.reportf(Error, KindTree, tree, n.ByteNr, "empty node")
+		return false
+	}
+	if first != nil && len(keys) != 0 && compareKeys(keys[0], *first) != 0 {
+		c.reportf(Error, KindTree, tree, n.ByteNr, "first key (%d %v %d) does not match the parent pointer (%d %v %d)",
+			keys[0].ObjectID, btrfs.KeyType(keys[0].Type), keys[0].Offset,
+			first.ObjectID, btrfs.KeyType(first.Type), first.Offset)
+	}
+	for i := 1; i < len(keys); i++ {
+		if compareKeys(keys[i-1], keys[i]) >= 0 {
+			c.reportf(Error, KindTree, tree, n.ByteNr, "bad key order: slot %d", i)
+			ok = false
+			break
+		}
+	}
+	return ok
+}
@@ -0,0 +1,169 @@
+package check
+
+import (
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func key(obj uint64, typ btrfs.KeyType, off uint64) btrfs.DiskKey {
+	return btrfs.DiskKey{ObjectID: obj, Type: byte(typ), Offset: off}
+}
+
+func inodeItem(mode uint32, nlink uint32, size uint64) []byte {
+	p := make([]byte, 160)
+	order.PutUint64(p[16:], size)
+	order.PutUint32(p[40:], nlink)
+	order.PutUint32(p[52:], mode)
+	return p
+}
+
+func inodeRef(index uint64, name string) []byte {
+	p := make([]byte, 10+len(name))
+	order.PutUint64(p[0:], index)
+	order.PutUint16(p[8:], uint16(len(name)))
+	copy(p[10:], name)
+	return p
+}
+
+func dirItem(target uint64, name string) []byte {
+	p := make([]byte, 30+len(name))
+	order.PutUint64(p[0:], target)
+	p[8] = byte(btrfs.KeyInodeItem)
+	order.PutUint16(p[27:], uint16(len(name)))
+	p[29] = 1
+	copy(p[30:], name)
+	return p
+}
+
+// testTree returns items of a small fs tree: a root dir with a single file.
+func testTree() []btrfsdump.Item {
+	const (
+		root = 256
+		file = 257
+	)
+	return []btrfsdump.Item{
+		{Key: key(root, btrfs.KeyInodeItem, 0), Data: inodeItem(syscall.S_IFDIR|0755, 1, 8)},
+		{Key: key(root, btrfs.KeyInodeRef, root), Data: inodeRef(0, "..")},
+		{Key: key(root, btrfs.KeyDirItem, 123), Data: dirItem(file, "file")},
+		{Key: key(root, btrfs.KeyDirIndex, 2), Data: dirItem(file, "file")},
+		{Key: key(file, btrfs.KeyInodeItem, 0), Data: inodeItem(syscall.S_IFREG|0644, 1, 0)},
+		{Key: key(file, btrfs.KeyInodeRef, root), Data: inodeRef(2, "file")},
+	}
+}
+
+func runInodes(items []btrfsdump.Item) *Report {
+	c := &checker{rep: &Report{}}
+	ic := newInodeChecker(btrfs.FSTreeID)
+	for _, it := range items {
+		ic.add(c, it)
+	}
+	ic.finish(c)
+	return c.rep
+}
+
+func expectFindings(t *testing.T, rep *Report, msgs ...string) {
+	t.Helper()
+	if len(rep.Findings) != len(msgs) {
+		t.Fatalf("unexpected findings: %v", rep.Findings)
+	}
+	for i, m := range msgs {
+		if s := rep.Findings[i].String(); !strings.Contains(s, m) {
+			t.Errorf("finding %d: %q, expected %q", i, s, m)
+		}
+	}
+}
+
+func TestInodes(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		expectFindings(t, runInodes(testTree()))
+	})
+	t.Run("nlink", func(t *testing.T) {
+		items := testTree()
+		items[4].Data = inodeItem(syscall.S_IFREG|0644, 2, 0)
+		expectFindings(t, runInodes(items), "key (257 inodeItem 0): link count 2, found 1 names")
+	})
+	t.Run("orphan", func(t *testing.T) {
+		items := testTree()
+		items[4].Data = inodeItem(syscall.S_IFREG|0644, 2, 0)
+		items = append(items, btrfsdump.Item{Key: key(orphanObjectID, btrfs.KeyOrphanItem, 257)})
+		expectFindings(t, runInodes(items))
+	})
+	t.Run("dir size", func(t *testing.T) {
+		items := testTree()
+		items[0].Data = inodeItem(syscall.S_IFDIR|0755, 1, 10)
+		expectFindings(t, runInodes(items), "directory size 10, expected 8")
+	})
+	t.Run("missing inode", func(t *testing.T) {
+		items := testTree()
+		items = append(items[:4:4], items[5])
+		expectFindings(t, runInodes(items),
+			"key (256 dirItem 123): directory entry points to a missing inode 257",
+			"key (256 dirIndex 2): directory entry points to a missing inode 257",
+			"key (257 inodeRef 256): inode reference without an inode item",
+		)
+	})
+	t.Run("missing index", func(t *testing.T) {
+		items := testTree()
+		items = append(items[:3:3], items[4:]...)
+		expectFindings(t, runInodes(items),
+			"directory size 8, expected 4",
+			"found 1 names, but 1 dir items and 0 dir index entries",
+		)
+	})
+}
+
+func extentItem(refs uint64, flags uint64, inline ...[]byte) []byte {
+	p := make([]byte, 24)
+	order.PutUint64(p[0:], refs)
+	order.PutUint64(p[8:], 1)
+	order.PutUint64(p[16:], flags)
+	for _, r := range inline {
+		p = append(p, r...)
+	}
+	return p
+}
+
+func treeBlockRef(root uint64) []byte {
+	p := make([]byte, 9)
+	p[0] = byte(btrfs.KeyTreeBlockRef)
+	order.PutUint64(p[1:], root)
+	return p
+}
+
+func TestExtents(t *testing.T) {
+	c := &checker{rep: &Report{}}
+	e := newExtentChecker()
+	e.found = true
+	e.addTreeBlock(btrfs.FSTreeID, 4096)
+	e.addTreeBlock(btrfs.FSTreeID, 8192)
+
+	fe := make([]byte, 53)
+	fe[20] = byte(btrfs.FileExtentReg)
+	order.PutUint64(fe[21:], 1<<20)
+	e.addFileExtent(c, btrfs.FSTreeID, btrfsdump.Item{Key: key(257, btrfs.KeyExtentData, 0), Data: fe})
+
+	dataRef := make([]byte, 28)
+	order.PutUint32(dataRef[24:], 1)
+	for _, it := range []btrfsdump.Item{
+		{Key: key(4096, btrfs.KeyMetadataItem, 0), Data: extentItem(1, btrfs.ExtentFlagTreeBlock, treeBlockRef(5))},
+		// keyed back reference is missing
+		{Key: key(1<<20, btrfs.KeyExtentItem, 4096), Data: extentItem(2, btrfs.ExtentFlagData)},
+		{Key: key(1<<20, btrfs.KeyExtentDataRef, 1), Data: dataRef},
+		// not referenced by any tree
+		{Key: key(2<<20, btrfs.KeyExtentItem, 4096), Data: extentItem(0, btrfs.ExtentFlagData)},
+	} {
+		e.addExtentItem(c, btrfs.ExtentTreeID, it)
+	}
+	e.finish(c)
+	expectFindings(t, c.rep,
+		"error: extent tree 5 block 8192: tree block has no metadata extent record",
+		"key (1048576 extentItem 4096): reference count mismatch: item has 2, found 1 back references",
+		"warning: extent tree 2 key (2097152 extentItem 4096): extent is not referenced by any tree",
+	)
+	if c.rep.OK() || c.rep.Errors() != 2 {
+		t.Fatalf("unexpected error count: %d", c.rep.Errors())
+	}
+}
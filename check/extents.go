@@ -0,0 +1,179 @@
+package check
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+	"sort"
+)
+
+var order = binary.LittleEndian
+
+// extentRecord is an extent found in the extent tree.
+type extentRecord struct {
+	key       btrfs.DiskKey
+	refs      uint64 // reference count stored in the extent item
+	found     uint64 // sum of inline and keyed back references
+	treeBlock bool
+	used      bool // referenced by a tree block pointer or a file extent
+}
+
+// extentChecker cross-checks the extent tree with tree blocks and file extents.
+type extentChecker struct {
+	found   bool // extent tree was found
+	partial bool // some trees were skipped, so unused extents are not reported
+	extents map[uint64]*extentRecord
+
+	// references collected before the extent tree was walked
+	blocks map[uint64]uint64 // tree block -> owner tree
+	data   []dataRef
+}
+
+type dataRef struct {
+	tree   uint64
+	key    btrfs.DiskKey
+	bytenr uint64
+}
+
+func newExtentChecker() *extentChecker {
+	return &extentChecker{
+		extents: make(map[uint64]*extentRecord),
+		blocks:  make(map[uint64]uint64),
+	}
+}
+
+// addTreeBlock records a reachable tree block.
+func (e *extentChecker) addTreeBlock(tree, bytenr uint64) {
+	if _, ok := e.blocks[bytenr]; !ok {
+		e.blocks[bytenr] = tree
+	}
+}
+
+// addFileExtent records a data extent referenced by a file.
+func (e *extentChecker) addFileExtent(c *checker, tree uint64, it btrfsdump.Item) {
+	if it.Key.Type != byte(btrfs.KeyExtentData) {
+		return
+	}
+	fe, err := btrfs.DecodeFileExtentItem(it.Data)
+	if err != nil {
+		c.report(itemFinding(Error, KindExtent, tree, it.Key, err.Error()))
+		return
+	}
+	if fe.Type == btrfs.FileExtentInline || fe.DiskByteNr == 0 {
+		return
+	}
+	e.data = append(e.data, dataRef{tree: tree, key: it.Key, bytenr: fe.DiskByteNr})
+}
+
+// addExtentItem records an item from the extent tree.
+func (e *extentChecker) addExtentItem(c *checker, tree uint64, it btrfsdump.Item) {
+	switch btrfs.KeyType(it.Key.Type) {
+	case btrfs.KeyExtentItem, btrfs.KeyMetadataItem:
+		meta := btrfs.KeyType(it.Key.Type) == btrfs.KeyMetadataItem
+		ei, err := btrfs.DecodeExtentItem(it.Data, meta)
+		if err != nil {
+			c.report(itemFinding(Error, KindExtent, tree, it.Key, err.Error()))
+			return
+		}
+		r := &extentRecord{
+			key:       it.Key,
+			refs:      ei.Refs,
+			treeBlock: meta || ei.Flags&btrfs.ExtentFlagTreeBlock != 0,
+		}
+		for _, ref := range ei.InlineRefs {
+			r.found += refCount(ref.Type, uint64(ref.Count))
+		}
+		e.extents[it.Key.ObjectID] = r
+	case btrfs.KeyTreeBlockRef, btrfs.KeySharedBlockRef, btrfs.KeyExtentDataRef, btrfs.KeySharedDataRef:
+		r := e.extents[it.Key.ObjectID]
+		if r == nil {
+			c.report(itemFinding(Error, KindExtent, tree, it.Key, "back reference without an extent item"))
+			return
+		}
+		var cnt uint64
+		switch btrfs.KeyType(it.Key.Type) {
+		case btrfs.KeyExtentDataRef:
+			if len(it.Data) < 28 {
+				c.report(itemFinding(Error, KindExtent, tree, it.Key, "data reference is too short"))
+				return
+			}
+			cnt = uint64(order.Uint32(it.Data[24:]))
+		case btrfs.KeySharedDataRef:
+			if len(it.Data) < 4 {
+				c.report(itemFinding(Error, KindExtent, tree, it.Key, "shared data reference is too short"))
+				return
+			}
+			cnt = uint64(order.Uint32(it.Data[0:]))
+		}
+		r.found += refCount(btrfs.KeyType(it.Key.Type), cnt)
+	}
+}
+
+// refCount returns the number of references represented by a back reference.
+// Only data references have an explicit count, all other refs count as one.
+func refCount(typ btrfs.KeyType, cnt uint64) uint64 {
+	switch typ {
+	case btrfs.KeyExtentDataRef, btrfs.KeySharedDataRef:
+		return cnt
+	}
+	return 1
+}
+
+// finish reports references to missing extents, reference count mismatches and unused extents.
+func (e *extentChecker) finish(c *checker) {
+	if !e.found {
+		c.reportf(Warning, KindExtent, btrfs.ExtentTreeID, 0, "extent tree not found, references are not checked")
+		return
+	}
+	blocks := make([]uint64, 0, len(e.blocks))
+	for bytenr := range e.blocks {
+		blocks = append(blocks, bytenr)
+	}
+	sortUint64s(blocks)
+	for _, bytenr := range blocks {
+		r := e.extents[bytenr]
+		if r == nil || !r.treeBlock {
+			c.reportf(Error, KindExtent, e.blocks[bytenr], bytenr, "tree block has no metadata extent record")
+			continue
+		}
+		r.used = true
+	}
+	for _, d := range e.data {
+		r := e.extents[d.bytenr]
+		if r == nil || r.treeBlock {
+			key := d.key
+			c.report(Finding{
+				Severity: Error, Kind: KindExtent, Tree: d.tree, Key: &key,
+				Message: fmt.Sprintf("file extent points to a missing data extent %d", d.bytenr),
+			})
+			continue
+		}
+		r.used = true
+	}
+	extents := make([]uint64, 0, len(e.extents))
+	for bytenr := range e.extents {
+		extents = append(extents, bytenr)
+	}
+	sortUint64s(extents)
+	for _, bytenr := range extents {
+		r := e.extents[bytenr]
+		key := r.key
+		if r.refs != r.found {
+			c.report(Finding{
+				Severity: Error, Kind: KindExtent, Tree: btrfs.ExtentTreeID, Key: &key,
+				Message: fmt.Sprintf("reference count mismatch: item has %d, found %d back references", r.refs, r.found),
+			})
+		}
+		if !r.used && !e.partial {
+			c.report(Finding{
+				Severity: Warning, Kind: KindExtent, Tree: btrfs.ExtentTreeID, Key: &key,
+				Message: "extent is not referenced by any tree",
+			})
+		}
+	}
+}
+
+func sortUint64s(arr []uint64) {
+	sort.Slice(arr, func(i, j int) bool { return arr[i] < arr[j] })
+}
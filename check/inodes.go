@@ -0,0 +1,161 @@
+package check
+
+import (
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+	"syscall"
+)
+
+// orphanObjectID is the object id of ORPHAN_ITEM keys.
+const orphanObjectID = 1<<64 - 5
+
+// inodeRecord collects everything known about a single inode of a subvolume.
+type inodeRecord struct {
+	item    *btrfs.InodeItem
+	key     btrfs.DiskKey // key of the inode item
+	refs    uint32        // names in INODE_REF and INODE_EXTREF items, excluding ".." of the root dir
+	dirItem uint32        // DIR_ITEM entries pointing to the inode
+	dirIdx  uint32        // DIR_INDEX entries pointing to the inode
+	dirSize uint64        // expected size of a directory, sum of name lengths of all entries
+	orphan  bool
+	parents []btrfs.DiskKey // keys of INODE_REF and INODE_EXTREF items
+}
+
+// inodeChecker cross-checks inodes, their back references and directory entries of a single tree.
+type inodeChecker struct {
+	tree   uint64
+	inodes map[uint64]*inodeRecord
+	// entries collects directory entries, as they may point to inodes that were not seen yet
+	entries []dirEntry
+}
+
+type dirEntry struct {
+	key    btrfs.DiskKey // key of the DIR_ITEM or DIR_INDEX item
+	target uint64
+}
+
+func newInodeChecker(tree uint64) *inodeChecker {
+	return &inodeChecker{tree: tree, inodes: make(map[uint64]*inodeRecord)}
+}
+
+func (ic *inodeChecker) inode(ino uint64) *inodeRecord {
+	r := ic.inodes[ino]
+	if r == nil {
+		r = &inodeRecord{}
+		ic.inodes[ino] = r
+	}
+	return r
+}
+
+// add records a single item of the tree. Items must be passed in key order.
+func (ic *inodeChecker) add(c *checker, it btrfsdump.Item) {
+	key := it.Key
+	if key.ObjectID == orphanObjectID && btrfs.KeyType(key.Type) == btrfs.KeyOrphanItem {
+		ic.inode(key.Offset).orphan = true
+		return
+	}
+	if key.ObjectID < btrfs.FirstFreeID || key.ObjectID > btrfs.LastFreeID {
+		return
+	}
+	var err error
+	switch btrfs.KeyType(key.Type) {
+	case btrfs.KeyInodeItem:
+		var ii btrfs.InodeItem
+		if ii, err = btrfs.DecodeInodeItem(it.Data); err == nil {
+			r := ic.inode(key.ObjectID)
+			r.item, r.key = &ii, key
+		}
+	case btrfs.KeyInodeRef:
+		var refs []btrfs.InodeRef
+		if refs, err = btrfs.DecodeInodeRefs(it.Data); err == nil {
+			r := ic.inode(key.ObjectID)
+			r.parents = append(r.parents, key)
+			if key.Offset != key.ObjectID {
+				r.refs += uint32(len(refs))
+			}
+		}
+	case btrfs.KeyInodeExtref:
+		var refs []btrfs.InodeExtref
+		if refs, err = btrfs.DecodeInodeExtrefs(it.Data); err == nil {
+			r := ic.inode(key.ObjectID)
+			for _, ref := range refs {
+				pkey := key
+				pkey.Offset = ref.Parent
+				r.parents = append(r.parents, pkey)
+			}
+			r.refs += uint32(len(refs))
+		}
+	case btrfs.KeyDirItem, btrfs.KeyDirIndex:
+		var ents []btrfs.DirItem
+		if ents, err = btrfs.DecodeDirItems(it.Data); err == nil {
+			dir := ic.inode(key.ObjectID)
+			for _, e := range ents {
+				dir.dirSize += uint64(len(e.Name))
+				if btrfs.KeyType(e.Location.Type) != btrfs.KeyInodeItem {
+					continue // subvolume
+				}
+				r := ic.inode(e.Location.ObjectID)
+				if btrfs.KeyType(key.Type) == btrfs.KeyDirItem {
+					r.dirItem++
+				} else {
+					r.dirIdx++
+				}
+				ic.entries = append(ic.entries, dirEntry{key: key, target: e.Location.ObjectID})
+			}
+		}
+	}
+	if err != nil {
+		c.report(itemFinding(Error, KindInode, ic.tree, key, err.Error()))
+	}
+}
+
+// finish reports inconsistencies between collected records.
+func (ic *inodeChecker) finish(c *checker) {
+	errorf := func(key btrfs.DiskKey, format string, args ...interface{}) {
+		c.report(itemFinding(Error, KindInode, ic.tree, key, fmt.Sprintf(format, args...)))
+	}
+	for _, e := range ic.entries {
+		if r := ic.inodes[e.target]; r.item == nil {
+			errorf(e.key, "directory entry points to a missing inode %d", e.target)
+		}
+	}
+	inos := make([]uint64, 0, len(ic.inodes))
+	for ino := range ic.inodes {
+		inos = append(inos, ino)
+	}
+	sortUint64s(inos)
+	for _, ino := range inos {
+		r := ic.inodes[ino]
+		if r.item == nil {
+			for _, key := range r.parents {
+				errorf(key, "inode reference without an inode item")
+			}
+			continue
+		}
+		for _, key := range r.parents {
+			if p := ic.inodes[key.Offset]; p == nil || p.item == nil {
+				errorf(key, "parent directory %d does not exist", key.Offset)
+			}
+		}
+		if r.item.Mode&syscall.S_IFMT == syscall.S_IFDIR && r.item.Size != r.dirSize {
+			// each name is stored both as DIR_ITEM and DIR_INDEX, so it is counted twice
+			errorf(r.key, "directory size %d, expected %d", r.item.Size, r.dirSize)
+		}
+		if r.orphan {
+			// orphans are waiting for deletion and may have no names left
+			continue
+		}
+		if ino == btrfs.FirstFreeID {
+			// root directory only has a ".." reference to itself
+			if r.item.NLink != 1 {
+				errorf(r.key, "root directory link count %d, expected 1", r.item.NLink)
+			}
+		} else if r.item.NLink != r.refs {
+			errorf(r.key, "link count %d, found %d names", r.item.NLink, r.refs)
+		}
+		if r.dirItem != r.refs || r.dirIdx != r.refs {
+			errorf(r.key, "found %d names, but %d dir items and %d dir index entries", r.refs, r.dirItem, r.dirIdx)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// CloneFile clones all the data from src to dst (reflink).
+// Files must be on the same filesystem. Data is shared until one of the files is modified.
+func CloneFile(dst, src *os.File) error {
+	if err := iocClone(dst, src); err != nil {
+		return &os.PathError{Op: "clone", Path: dst.Name(), Err: err}
+	}
+	return nil
+}
+
+// Clone creates a copy of the src file at dst path by cloning its data (cp --reflink).
+// Existing dst file will be truncated. Relative paths are resolved against the opened directory.
+//
+// Whole-file clones are not affected by filesystem CloneAlignment, since the unaligned
+// tail of the file is cloned up to EOF.
+func (f *FS) Clone(dstPath, srcPath string) error {
+	src, err := openAt(f.f, srcPath, syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := openAt(f.f, dstPath, syscall.O_CREAT|syscall.O_WRONLY|syscall.O_TRUNC, uint32(st.Mode().Perm()))
+	if err != nil {
+		return err
+	}
+	if err = CloneFile(dst, src); err != nil {
+		dst.Close()
+		withFd(f.f, func(fd int) error { return syscall.Unlinkat(fd, dstPath) })
+		return err
+	}
+	return dst.Close()
+}
+
+// cloneAlignment returns the required alignment of clone offsets for a filesystem that contains the file.
+func cloneAlignment(f *os.File) (uint64, error) {
+	info, err := iocFsInfo(f)
+	if err != nil {
+		return 0, err
+	}
+	if info.clone_alignment != 0 {
+		return uint64(info.clone_alignment), nil
+	}
+	return uint64(info.sectorsize), nil
+}
+
+// CloneRange clones a range of data from src to dst (reflink).
+// Offsets and length must be aligned to filesystem CloneAlignment, except for the range
+// that ends at the end of src file. Zero length clones the data from srcOff to the end of src.
+//
+// ErrMisaligned is returned if offsets or length are not aligned.
+func CloneRange(dst *os.File, dstOff int64, src *os.File, srcOff, length int64) error {
+	if dstOff < 0 || srcOff < 0 || length < 0 {
+		return fmt.Errorf("invalid clone range: src %d+%d, dst %d", srcOff, length, dstOff)
+	}
+	align, err := cloneAlignment(src)
+	if err != nil {
+		return err
+	}
+	aligned := func(v int64) bool { return uint64(v)%align == 0 }
+	if !aligned(srcOff) || !aligned(dstOff) {
+		return &ErrMisaligned{Alignment: align, SrcOffset: srcOff, DstOffset: dstOff, Length: length}
+	} else if length != 0 && !aligned(length) {
+		st, err := src.Stat()
+		if err != nil {
+			return err
+		} else if srcOff+length != st.Size() {
+			return &ErrMisaligned{Alignment: align, SrcOffset: srcOff, DstOffset: dstOff, Length: length}
+		}
+	}
+	args := btrfs_ioctl_clone_range_args{
+		src_fd:      int64(src.Fd()),
+		src_offset:  uint64(srcOff),
+		src_length:  uint64(length),
+		dest_offset: uint64(dstOff),
+	}
+	if err := iocCloneRange(dst, &args); err != nil {
+		return &os.PathError{Op: "clone range", Path: dst.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+	"strconv"
+)
+
+func init() {
+	QgroupCmd.AddCommand(
+		QgroupListCmd,
+		QgroupCreateCmd,
+		QgroupDestroyCmd,
+		QgroupLimitCmd,
+	)
+	QgroupLimitCmd.Flags().BoolP("exclusive", "e", false, "Limit the exclusive size instead of the referenced size.")
+
+	DeviceCmd.AddCommand(
+		DeviceListCmd,
+		DeviceAddCmd,
+		DeviceRemoveCmd,
+		DeviceStatsCmd,
+	)
+	DeviceStatsCmd.Flags().BoolP("reset", "z", false, "Reset statistics after reading them.")
+}
+
+var QgroupCmd = &cobra.Command{
+	Use:   "qgroup <command> <args>",
+	Short: "Manage quota groups.",
+}
+
+var QgroupListCmd = &cobra.Command{
+	Use:   "list <mount>",
+	Short: "List quota groups with their usage and limits.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], true, func(fs *btrfs.FS) error {
+			list, err := fs.Qgroups()
+			if err != nil {
+				return err
+			}
+			return printJSON(list)
+		})
+	},
+}
+
+var QgroupCreateCmd = &cobra.Command{
+	Use:   "create <qgroupid> <mount>",
+	Short: "Create a quota group.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := btrfs.ParseQgroupID(args[0])
+		if err != nil {
+			return err
+		}
+		return withFS(args[1], false, func(fs *btrfs.FS) error {
+			if err := fs.QgroupCreate(id); err != nil {
+				return err
+			}
+			return printJSON(map[string]string{"created": id.String()})
+		})
+	},
+}
+
+var QgroupDestroyCmd = &cobra.Command{
+	Use:   "destroy <qgroupid> <mount>",
+	Short: "Destroy a quota group.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := btrfs.ParseQgroupID(args[0])
+		if err != nil {
+			return err
+		}
+		return withFS(args[1], false, func(fs *btrfs.FS) error {
+			if err := fs.QgroupDestroy(id); err != nil {
+				return err
+			}
+			return printJSON(map[string]string{"destroyed": id.String()})
+		})
+	},
+}
+
+var QgroupLimitCmd = &cobra.Command{
+	Use:   "limit [-e] <size>|none <qgroupid> <mount>",
+	Short: "Set the size limit of a quota group.",
+	Args:  cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		size := btrfs.QgroupNoLimit
+		if args[0] != "none" {
+			v, err := parseSize(args[0])
+			if err != nil {
+				return err
+			}
+			size = v
+		}
+		id, err := btrfs.ParseQgroupID(args[1])
+		if err != nil {
+			return err
+		}
+		var limit btrfs.QgroupLimit
+		if excl, _ := cmd.Flags().GetBool("exclusive"); excl {
+			limit.Exclusive = size
+		} else {
+			limit.Referenced = size
+		}
+		return withFS(args[2], false, func(fs *btrfs.FS) error {
+			if err := fs.QgroupSetLimit(id, limit); err != nil {
+				return err
+			}
+			return printJSON(limit)
+		})
+	},
+}
+
+var DeviceCmd = &cobra.Command{
+	Use:     "device <command> <args>",
+	Short:   "Manage devices of the filesystem.",
+	Aliases: []string{"dev"},
+}
+
+var DeviceListCmd = &cobra.Command{
+	Use:   "list <mount>",
+	Short: "List devices of the filesystem.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], true, func(fs *btrfs.FS) error {
+			list, err := fs.Devices()
+			if err != nil {
+				return err
+			}
+			return printJSON(list)
+		})
+	},
+}
+
+var DeviceAddCmd = &cobra.Command{
+	Use:   "add <device> <mount>",
+	Short: "Add a device to the filesystem.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[1], false, func(fs *btrfs.FS) error {
+			if err := fs.AddDevice(args[0]); err != nil {
+				return err
+			}
+			return printJSON(map[string]string{"added": args[0]})
+		})
+	},
+}
+
+var DeviceRemoveCmd = &cobra.Command{
+	Use:   "remove <device>|<devid>|missing <mount>",
+	Short: "Remove a device from the filesystem.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[1], false, func(fs *btrfs.FS) error {
+			var err error
+			if id, perr := strconv.ParseUint(args[0], 10, 64); perr == nil {
+				err = fs.RemoveDeviceByID(id)
+			} else {
+				err = fs.RemoveDevice(args[0])
+			}
+			if err != nil {
+				return err
+			}
+			return printJSON(map[string]string{"removed": args[0]})
+		})
+	},
+}
+
+// deviceStats is a JSON representation of error statistics of a single device.
+type deviceStats struct {
+	DevID uint64         `json:"devid"`
+	Path  string         `json:"path"`
+	Stats btrfs.DevStats `json:"stats"`
+}
+
+var DeviceStatsCmd = &cobra.Command{
+	Use:   "stats [-z] <mount>",
+	Short: "Show error statistics of devices.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		reset, _ := cmd.Flags().GetBool("reset")
+		return withFS(args[0], !reset, func(fs *btrfs.FS) error {
+			devs, err := fs.Devices()
+			if err != nil {
+				return err
+			}
+			out := make([]deviceStats, 0, len(devs))
+			for _, d := range devs {
+				var st btrfs.DevStats
+				if reset {
+					st, err = fs.ResetDevStats(d.DevID)
+				} else {
+					st, err = fs.GetDevStats(d.DevID)
+				}
+				if err != nil {
+					return err
+				}
+				out = append(out, deviceStats{DevID: d.DevID, Path: d.Path, Stats: st})
+			}
+			return printJSON(out)
+		})
+	},
+}
@@ -0,0 +1,81 @@
+// Command btrfsctl manages btrfs filesystems using the btrfs package.
+//
+// All commands except send print results as JSON to stdout.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RootCmd.AddCommand(
+		SubvolumeCmd,
+		SnapshotCmd,
+		SendCmd,
+		ReceiveCmd,
+		ScrubCmd,
+		BalanceCmd,
+		QgroupCmd,
+		DeviceCmd,
+	)
+}
+
+var RootCmd = &cobra.Command{
+	Use:          "btrfsctl <command> [<args>]",
+	Short:        "Manage btrfs filesystems.",
+	SilenceUsage: true,
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// withFS opens the filesystem at path and passes it to fn.
+func withFS(path string, ro bool, fn func(fs *btrfs.FS) error) error {
+	fs, err := btrfs.Open(path, ro)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	return fn(fs)
+}
+
+// errString converts an error to a string that can be printed in JSON.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// parseSize parses a size in bytes with an optional binary suffix (K, M, G, T, P).
+func parseSize(s string) (uint64, error) {
+	mult := uint64(1)
+	if n := len(s); n != 0 {
+		if i := strings.IndexByte("KMGTP", s[n-1]&^0x20); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return v * mult, nil
+}
+
+func main() {
+	if err := RootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	ScrubCmd.AddCommand(
+		ScrubStartCmd,
+		ScrubStatusCmd,
+		ScrubCancelCmd,
+	)
+	ScrubStartCmd.Flags().BoolP("readonly", "r", false, "Do not repair detected errors.")
+
+	BalanceCmd.AddCommand(
+		BalanceStartCmd,
+		BalanceStatusCmd,
+		BalancePauseCmd,
+		BalanceCancelCmd,
+		BalanceResumeCmd,
+	)
+	BalanceStartCmd.Flags().Uint64("data-usage", 0, "Only balance data chunks with usage below the given percent.")
+	BalanceStartCmd.Flags().Uint64("metadata-usage", 0, "Only balance metadata chunks with usage below the given percent.")
+	BalanceStartCmd.Flags().Bool("force", false, "Allow operations on system chunks and reducing metadata redundancy.")
+}
+
+// scrubStatus is a JSON representation of btrfs.ScrubDeviceStatus.
+type scrubStatus struct {
+	DevID    uint64              `json:"devid"`
+	Running  bool                `json:"running"`
+	Progress btrfs.ScrubProgress `json:"progress"`
+	Error    string              `json:"error,omitempty"`
+}
+
+func printScrubStatus(list []btrfs.ScrubDeviceStatus) error {
+	out := make([]scrubStatus, 0, len(list))
+	for _, st := range list {
+		out = append(out, scrubStatus{
+			DevID: st.DevID, Running: st.Running,
+			Progress: st.Progress, Error: errString(st.Err),
+		})
+	}
+	return printJSON(out)
+}
+
+var ScrubCmd = &cobra.Command{
+	Use:   "scrub <command> <args>",
+	Short: "Verify checksums of data and metadata.",
+}
+
+var ScrubStartCmd = &cobra.Command{
+	Use:   "start [-r] <mount>",
+	Short: "Run scrub on all devices and wait for it to complete.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts btrfs.ScrubOptions
+		opts.ReadOnly, _ = cmd.Flags().GetBool("readonly")
+		return withFS(args[0], true, func(fs *btrfs.FS) error {
+			list, err := fs.ScrubStart(opts)
+			if len(list) != 0 {
+				if perr := printScrubStatus(list); err == nil {
+					err = perr
+				}
+			}
+			return err
+		})
+	},
+}
+
+var ScrubStatusCmd = &cobra.Command{
+	Use:   "status <mount>",
+	Short: "Show the progress of a running scrub.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], true, func(fs *btrfs.FS) error {
+			list, err := fs.ScrubStatus()
+			if err != nil {
+				return err
+			}
+			return printScrubStatus(list)
+		})
+	},
+}
+
+var ScrubCancelCmd = &cobra.Command{
+	Use:   "cancel <mount>",
+	Short: "Cancel a running scrub.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], true, func(fs *btrfs.FS) error {
+			if err := fs.ScrubCancel(); err != nil {
+				return err
+			}
+			return printJSON(map[string]bool{"cancelled": true})
+		})
+	},
+}
+
+var BalanceCmd = &cobra.Command{
+	Use:   "balance <command> <args>",
+	Short: "Balance chunks across devices.",
+}
+
+var BalanceStartCmd = &cobra.Command{
+	Use:   "start [--data-usage <percent>] [--metadata-usage <percent>] [--force] <mount>",
+	Short: "Run balance and wait for it to complete.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var bargs btrfs.BalanceArgs
+		if v, _ := cmd.Flags().GetUint64("data-usage"); v != 0 {
+			bargs.Data = &btrfs.BalanceFilter{Usage: &btrfs.BalanceRange{Max: v}}
+		}
+		if v, _ := cmd.Flags().GetUint64("metadata-usage"); v != 0 {
+			bargs.Metadata = &btrfs.BalanceFilter{Usage: &btrfs.BalanceRange{Max: v}}
+		}
+		if bargs.Data == nil && bargs.Metadata == nil {
+			bargs.Data = &btrfs.BalanceFilter{}
+			bargs.Metadata = &btrfs.BalanceFilter{}
+			bargs.System = &btrfs.BalanceFilter{}
+		}
+		bargs.Force, _ = cmd.Flags().GetBool("force")
+		return withFS(args[0], false, func(fs *btrfs.FS) error {
+			prog, err := fs.BalanceStartArgs(bargs)
+			if err != nil {
+				return err
+			}
+			return printJSON(prog)
+		})
+	},
+}
+
+var BalanceStatusCmd = &cobra.Command{
+	Use:   "status <mount>",
+	Short: "Show the status of a running or paused balance.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], true, func(fs *btrfs.FS) error {
+			st, err := fs.BalanceStatus()
+			if err != nil {
+				return err
+			}
+			return printJSON(st)
+		})
+	},
+}
+
+var BalancePauseCmd = &cobra.Command{
+	Use:   "pause <mount>",
+	Short: "Pause a running balance.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], false, func(fs *btrfs.FS) error {
+			if err := fs.BalancePause(); err != nil {
+				return err
+			}
+			return printJSON(map[string]bool{"paused": true})
+		})
+	},
+}
+
+var BalanceCancelCmd = &cobra.Command{
+	Use:   "cancel <mount>",
+	Short: "Cancel a running or paused balance.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], false, func(fs *btrfs.FS) error {
+			if err := fs.BalanceCancel(); err != nil {
+				return err
+			}
+			return printJSON(map[string]bool{"cancelled": true})
+		})
+	},
+}
+
+var BalanceResumeCmd = &cobra.Command{
+	Use:   "resume <mount>",
+	Short: "Resume a paused balance and wait for it to complete.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], false, func(fs *btrfs.FS) error {
+			prog, err := fs.BalanceResume()
+			if err != nil {
+				return err
+			}
+			return printJSON(prog)
+		})
+	},
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/send"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+func init() {
+	SubvolumeCmd.AddCommand(
+		SubvolumeCreateCmd,
+		SubvolumeDeleteCmd,
+		SubvolumeListCmd,
+		SubvolumeShowCmd,
+	)
+	SubvolumeDeleteCmd.Flags().BoolP("recursive", "R", false, "Delete nested subvolumes as well.")
+	SnapshotCmd.Flags().BoolP("readonly", "r", false, "Create a read-only snapshot.")
+
+	SendCmd.Flags().StringP("parent", "p", "", "Send an incremental stream from <parent> to <subvol>.")
+	SendCmd.Flags().StringSliceP("clone-src", "c", nil, "Use <clone-src> as an additional clone source.")
+	SendCmd.Flags().StringP("file", "f", "", "Write the stream to <outfile> instead of stdout.")
+	SendCmd.Flags().Bool("no-data", false, "Send metadata only; the stream cannot be received.")
+
+	ReceiveCmd.Flags().StringP("file", "f", "", "Read the stream from <infile> instead of stdin.")
+	ReceiveCmd.Flags().Bool("native", false, "Use the native receive implementation instead of 'btrfs receive'.")
+}
+
+var SubvolumeCmd = &cobra.Command{
+	Use:     "subvolume <command> <args>",
+	Short:   "Manage subvolumes.",
+	Aliases: []string{"subvol", "sub", "sv"},
+}
+
+var SubvolumeCreateCmd = &cobra.Command{
+	Use:   "create <path>",
+	Short: "Create a subvolume.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := btrfs.CreateSubVolume(args[0]); err != nil {
+			return err
+		}
+		return printJSON(map[string]string{"created": args[0]})
+	},
+}
+
+var SubvolumeDeleteCmd = &cobra.Command{
+	Use:   "delete [-R] <subvolume> [<subvolume>...]",
+	Short: "Delete subvolumes.",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		recursive, _ := cmd.Flags().GetBool("recursive")
+		for _, arg := range args {
+			var err error
+			if recursive {
+				err = btrfs.DeleteSubVolumeRecursive(arg)
+			} else {
+				err = btrfs.DeleteSubVolume(arg)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return printJSON(map[string][]string{"deleted": args})
+	},
+}
+
+var SubvolumeListCmd = &cobra.Command{
+	Use:     "list <mount>",
+	Short:   "List subvolumes.",
+	Aliases: []string{"ls"},
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], true, func(fs *btrfs.FS) error {
+			list, err := fs.ListSubvolumes(nil)
+			if err != nil {
+				return err
+			}
+			return printJSON(list)
+		})
+	},
+}
+
+var SubvolumeShowCmd = &cobra.Command{
+	Use:   "show <subvolume>",
+	Short: "Show details about a subvolume.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withFS(args[0], true, func(fs *btrfs.FS) error {
+			info, err := fs.SubvolumeInfo(".")
+			if err != nil {
+				return err
+			}
+			return printJSON(info)
+		})
+	},
+}
+
+var SnapshotCmd = &cobra.Command{
+	Use:   "snapshot [-r] <source> <dest>",
+	Short: "Create a snapshot of a subvolume.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ro, _ := cmd.Flags().GetBool("readonly")
+		if err := btrfs.SnapshotSubVolume(args[0], args[1], ro); err != nil {
+			return err
+		}
+		return printJSON(map[string]string{"source": args[0], "snapshot": args[1]})
+	},
+}
+
+var SendCmd = &cobra.Command{
+	Use:   "send [-p <parent>] [-c <clone-src>] [-f <outfile>] <subvol> [<subvol>...]",
+	Short: "Send subvolumes to stdout.",
+	Long: `Sends the subvolume(s) specified by <subvol> to stdout.
+<subvol> should be read-only here.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var (
+			opts btrfs.SendOptions
+			w    io.Writer = os.Stdout
+		)
+		opts.Parent, _ = cmd.Flags().GetString("parent")
+		opts.CloneSources, _ = cmd.Flags().GetStringSlice("clone-src")
+		opts.NoFileData, _ = cmd.Flags().GetBool("no-data")
+		if name, _ := cmd.Flags().GetString("file"); name != "" {
+			f, err := os.Create(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return btrfs.SendWithOptions(w, opts, args...)
+	},
+}
+
+var ReceiveCmd = &cobra.Command{
+	Use:   "receive [-f <infile>] [--native] <mount>",
+	Short: "Receive subvolumes from stdin.",
+	Long: `Receives one or more subvolumes that were previously
+sent with btrfs send. The received subvolumes are stored
+into <mount>.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var r io.Reader = os.Stdin
+		if name, _ := cmd.Flags().GetString("file"); name != "" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var err error
+		if native, _ := cmd.Flags().GetBool("native"); native {
+			err = send.Receive(r, args[0])
+		} else {
+			err = btrfs.Receive(r, args[0])
+		}
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]string{"received": args[0]})
+	},
+}
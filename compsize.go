@@ -0,0 +1,164 @@
+package btrfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// CompressionUsage is the space used by file extents of a single kind.
+type CompressionUsage struct {
+	Disk         uint64 `json:"disk"`         // space used on disk
+	Uncompressed uint64 `json:"uncompressed"` // size of data after decompression
+	Referenced   uint64 `json:"referenced"`   // bytes referenced by files; shared data is counted multiple times
+}
+
+// Ratio returns the ratio of the disk size to the uncompressed size, or 0 if there is no data.
+func (u CompressionUsage) Ratio() float64 {
+	if u.Uncompressed == 0 {
+		return 0
+	}
+	return float64(u.Disk) / float64(u.Uncompressed)
+}
+
+func (u *CompressionUsage) add(o CompressionUsage) {
+	u.Disk += o.Disk
+	u.Uncompressed += o.Uncompressed
+	u.Referenced += o.Referenced
+}
+
+// CompressionReport is the result of CompressionStats.
+type CompressionReport struct {
+	Files   uint64           `json:"files"`
+	Extents uint64           `json:"extents"` // number of distinct disk extents
+	Inline  uint64           `json:"inline"`  // number of inline extents
+	Total   CompressionUsage `json:"total"`
+	// ByType is the usage of data extents by compression algorithm.
+	// Uncompressed extents are reported as CompressionNone.
+	ByType map[Compression]CompressionUsage `json:"by_type"`
+	// Prealloc is the usage of preallocated extents. It is included in Total.
+	Prealloc CompressionUsage `json:"prealloc"`
+}
+
+// CompressionStats walks files under the given paths and reports their uncompressed
+// and on-disk sizes by compression algorithm, similar to compsize. Extents shared between
+// the files are counted once in Disk and Uncompressed sizes. Hard links are counted once.
+//
+// Sizes are computed from EXTENT_DATA items, thus it requires CAP_SYS_ADMIN.
+// All paths are expected to be on the same filesystem.
+func CompressionStats(paths ...string) (*CompressionReport, error) {
+	if err := requireAdmin("compression stats", strings.Join(paths, ",")); err != nil {
+		return nil, err
+	}
+	c := &compressionCounter{
+		rep:     &CompressionReport{ByType: make(map[Compression]CompressionUsage)},
+		extents: make(map[uint64]struct{}),
+		inodes:  make(map[LogicalInode]struct{}),
+	}
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				if ok, err := IsBtrfs(path); err != nil {
+					return err
+				} else if !ok {
+					return filepath.SkipDir
+				}
+				return nil
+			} else if !fi.Mode().IsRegular() {
+				return nil
+			}
+			return c.file(path)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.rep, nil
+}
+
+type compressionCounter struct {
+	rep     *CompressionReport
+	extents map[uint64]struct{} // disk extents that were already counted
+	inodes  map[LogicalInode]struct{}
+}
+
+// file counts all extents of a regular file.
+func (c *compressionCounter) file(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	root, err := getFileRootID(f)
+	if err != nil {
+		return &os.PathError{Op: "ino lookup", Path: path, Err: err}
+	}
+	ino := st.Sys().(*syscall.Stat_t).Ino
+	id := LogicalInode{Root: uint64(root), Inode: ino}
+	if _, ok := c.inodes[id]; ok {
+		return nil
+	}
+	c.inodes[id] = struct{}{}
+	c.rep.Files++
+	it := newSearchIterator(f, btrfs_ioctl_search_key{
+		tree_id:      root,
+		min_objectid: objectID(ino),
+		max_objectid: objectID(ino),
+		min_type:     extentDataKey,
+		max_type:     extentDataKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+	})
+	for it.Next() {
+		ext, err := DecodeFileExtentItem(it.Item().Data)
+		if err != nil {
+			return err
+		}
+		c.extent(ext)
+	}
+	if err = it.Err(); err != nil {
+		return &os.PathError{Op: "tree search", Path: path, Err: err}
+	}
+	return nil
+}
+
+// extent counts a single file extent item.
+func (c *compressionCounter) extent(ext FileExtentItem) {
+	var u CompressionUsage
+	switch {
+	case ext.Type == FileExtentInline:
+		c.rep.Inline++
+		u = CompressionUsage{
+			Disk:         uint64(len(ext.Inline)),
+			Uncompressed: ext.RAMBytes,
+			Referenced:   ext.RAMBytes,
+		}
+	case ext.DiskByteNr == 0:
+		// hole
+		return
+	default:
+		u.Referenced = ext.NumBytes
+		if _, ok := c.extents[ext.DiskByteNr]; !ok {
+			c.extents[ext.DiskByteNr] = struct{}{}
+			c.rep.Extents++
+			u.Disk = ext.DiskNumBytes
+			u.Uncompressed = ext.RAMBytes
+		}
+	}
+	c.rep.Total.add(u)
+	if ext.Type == FileExtentPrealloc {
+		c.rep.Prealloc.add(u)
+		return
+	}
+	t := c.rep.ByType[ext.Compression]
+	t.add(u)
+	c.rep.ByType[ext.Compression] = t
+}
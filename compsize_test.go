@@ -0,0 +1,45 @@
+package btrfs
+
+import (
+	"testing"
+)
+
+func TestCompressionCounter(t *testing.T) {
+	c := &compressionCounter{
+		rep:     &CompressionReport{ByType: make(map[Compression]CompressionUsage)},
+		extents: make(map[uint64]struct{}),
+	}
+	exts := []FileExtentItem{
+		{Type: FileExtentInline, Compression: ZSTD, RAMBytes: 3000, Inline: make([]byte, 1000)},
+		{Type: FileExtentReg, Compression: ZSTD, RAMBytes: 128 << 10, DiskByteNr: 1 << 20, DiskNumBytes: 32 << 10, NumBytes: 128 << 10},
+		// the same extent referenced again, partially
+		{Type: FileExtentReg, Compression: ZSTD, RAMBytes: 128 << 10, DiskByteNr: 1 << 20, DiskNumBytes: 32 << 10, Offset: 4096, NumBytes: 4096},
+		{Type: FileExtentReg, RAMBytes: 8192, DiskByteNr: 2 << 20, DiskNumBytes: 8192, NumBytes: 8192},
+		// hole
+		{Type: FileExtentReg, NumBytes: 1 << 20},
+		{Type: FileExtentPrealloc, RAMBytes: 4096, DiskByteNr: 3 << 20, DiskNumBytes: 4096, NumBytes: 4096},
+	}
+	for _, e := range exts {
+		c.extent(e)
+	}
+	rep := c.rep
+	if rep.Extents != 3 || rep.Inline != 1 {
+		t.Fatalf("unexpected counts: %+v", rep)
+	}
+	exp := CompressionUsage{Disk: 1000 + 32<<10, Uncompressed: 3000 + 128<<10, Referenced: 3000 + 128<<10 + 4096}
+	if got := rep.ByType[ZSTD]; got != exp {
+		t.Fatalf("unexpected zstd usage: %+v", got)
+	}
+	exp = CompressionUsage{Disk: 8192, Uncompressed: 8192, Referenced: 8192}
+	if got := rep.ByType[CompressionNone]; got != exp {
+		t.Fatalf("unexpected uncompressed usage: %+v", got)
+	}
+	exp = CompressionUsage{Disk: 4096, Uncompressed: 4096, Referenced: 4096}
+	if rep.Prealloc != exp {
+		t.Fatalf("unexpected prealloc usage: %+v", rep.Prealloc)
+	}
+	exp = CompressionUsage{Disk: 1000 + 32<<10 + 8192 + 4096, Uncompressed: 3000 + 128<<10 + 8192 + 4096, Referenced: 3000 + 128<<10 + 4096 + 8192 + 4096}
+	if rep.Total != exp {
+		t.Fatalf("unexpected total usage: %+v", rep.Total)
+	}
+}
@@ -0,0 +1,84 @@
+package btrfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"strconv"
+)
+
+// CsumType is a checksum algorithm used for data and metadata of the filesystem.
+type CsumType uint16
+
+const (
+	CsumCRC32C   = CsumType(0)
+	CsumXXHash64 = CsumType(1)
+	CsumSHA256   = CsumType(2)
+	CsumBLAKE2b  = CsumType(3)
+)
+
+var csumTypeNames = []string{
+	CsumCRC32C:   "crc32c",
+	CsumXXHash64: "xxhash64",
+	CsumSHA256:   "sha256",
+	CsumBLAKE2b:  "blake2b",
+}
+
+func (t CsumType) String() string {
+	if int(t) < len(csumTypeNames) {
+		return csumTypeNames[t]
+	}
+	return "csum" + strconv.Itoa(int(t))
+}
+
+// Size returns the size of a checksum in bytes, or zero for unknown algorithms.
+func (t CsumType) Size() int {
+	switch t {
+	case CsumCRC32C:
+		return 4
+	case CsumXXHash64:
+		return 8
+	case CsumSHA256, CsumBLAKE2b:
+		return 32
+	}
+	return 0
+}
+
+// NewCsumHash returns a hash for a given checksum algorithm.
+// The hash appends checksums in the same format as they are stored on disk.
+func NewCsumHash(t CsumType) (hash.Hash, error) {
+	switch t {
+	case CsumCRC32C:
+		return crc32le{crc32.New(crc32.MakeTable(crc32.Castagnoli))}, nil
+	case CsumXXHash64:
+		return newXXHash64(), nil
+	case CsumSHA256:
+		return sha256.New(), nil
+	case CsumBLAKE2b:
+		return newBlake2b256(), nil
+	}
+	return nil, ErrUnsupportedCsum
+}
+
+// Checksum calculates a checksum of data or a metadata block, as stored on disk.
+// For metadata blocks, the checksum covers everything except the checksum field.
+func Checksum(t CsumType, p []byte) ([]byte, error) {
+	h, err := NewCsumHash(t)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(p)
+	return h.Sum(nil), nil
+}
+
+// crc32le is a crc32 hash that stores the checksum in little-endian, as btrfs does.
+type crc32le struct {
+	hash.Hash32
+}
+
+func (h crc32le) Sum(b []byte) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], h.Sum32())
+	return append(b, buf[:]...)
+}
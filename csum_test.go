@@ -0,0 +1,66 @@
+package btrfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+var casesChecksum = []struct {
+	typ  CsumType
+	data []byte
+	exp  string
+}{
+	{CsumCRC32C, []byte("123456789"), "839206e3"},
+	{CsumXXHash64, nil, "99e9d85137db46ef"},
+	{CsumXXHash64, []byte("abc"), "990977adf52cbc44"},
+	{CsumXXHash64, []byte("Nobody inspects the spammish repetition"), "f18b378a3ca8cefb"},
+	{CsumSHA256, []byte("abc"), "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	{CsumBLAKE2b, nil, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+	{CsumBLAKE2b, []byte("abc"), "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+	{CsumBLAKE2b, bytes.Repeat([]byte("x"), 128), "164ffb7089bae6f5a62fb0795e751dc9e88eac92e1a5b2fafe93a25abf2d9c3b"},
+}
+
+func TestChecksum(t *testing.T) {
+	for _, c := range casesChecksum {
+		sum, err := Checksum(c.typ, c.data)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(sum) != c.typ.Size() {
+			t.Errorf("%v: unexpected size: %d", c.typ, len(sum))
+		} else if got := hex.EncodeToString(sum); got != c.exp {
+			t.Errorf("%v(%q): unexpected checksum: %s vs %s", c.typ, c.data, got, c.exp)
+		}
+	}
+	if _, err := Checksum(CsumType(4), nil); !errors.Is(err, ErrUnsupportedCsum) {
+		t.Fatalf("expected unsupported error, got: %v", err)
+	}
+}
+
+func TestChecksumStream(t *testing.T) {
+	var data []byte
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 256; j++ {
+			data = append(data, byte(j))
+		}
+	}
+	for _, typ := range []CsumType{CsumCRC32C, CsumXXHash64, CsumSHA256, CsumBLAKE2b} {
+		exp, err := Checksum(typ, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _ := NewCsumHash(typ)
+		for i := 0; i < len(data); i += 7 {
+			end := i + 7
+			if end > len(data) {
+				end = len(data)
+			}
+			h.Write(data[i:end])
+			h.Sum(nil) // must not change the state
+		}
+		if got := h.Sum(nil); !bytes.Equal(got, exp) {
+			t.Errorf("%v: unexpected checksum: %x vs %x", typ, got, exp)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sameArgsSize = unsafe.Sizeof(btrfs_ioctl_same_args{})
+	sameInfoSize = unsafe.Sizeof(btrfs_ioctl_same_extent_info{})
+
+	// maxDedupeTargets is the maximal number of targets accepted in one call.
+	// Kernel limits the size of arguments to a single page.
+	maxDedupeTargets = int((4096 - sameArgsSize) / sameInfoSize)
+
+	// maxDedupeLen is the maximal length deduplicated in one call (BTRFS_MAX_DEDUPE_LEN).
+	// Older kernels silently truncate longer ranges.
+	maxDedupeLen = 16 << 20
+)
+
+// DedupeTarget is a destination range for DedupeRange.
+type DedupeTarget struct {
+	File   *os.File
+	Offset int64
+}
+
+// DedupeResult is a per-target result of DedupeRange.
+type DedupeResult struct {
+	// Bytes is the number of bytes deduplicated.
+	Bytes int64
+	// DataDiffers is set if the data in the target range differs from the source.
+	DataDiffers bool
+	// Err is set if the kernel failed to deduplicate this target.
+	Err error
+}
+
+// DedupeRange deduplicates a range of the source file with ranges of the same length
+// in target files (FIDEDUPERANGE). The data is shared only if it's the same in both files.
+//
+// Targets are submitted together, and requests are split to respect the kernel limits
+// on the number of targets and the length of a single call. If the data differs or
+// the kernel fails for a part of the range, the rest of the range is skipped for that target.
+//
+// Zero length dedupes until the end of the source file. If a call fails, results of the calls
+// that were already completed are returned together with the error.
+func DedupeRange(src *os.File, srcOff, length int64, targets []DedupeTarget) ([]DedupeResult, error) {
+	return dedupeRangeAll(src, srcOff, length, targets)
+}
+
+// dedupeRangeAll is the same as DedupeRange, but accepts any ioctlFile.
+func dedupeRangeAll(src ioctlFile, srcOff, length int64, targets []DedupeTarget) ([]DedupeResult, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	} else if srcOff < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid dedupe range: %d+%d", srcOff, length)
+	}
+	for _, t := range targets {
+		if t.Offset < 0 {
+			return nil, fmt.Errorf("invalid dedupe target offset: %d", t.Offset)
+		}
+	}
+	if length == 0 {
+		// the kernel treats zero length as a no-op
+		sf, _ := ioctlDoerOf(src)
+		var st syscall.Stat_t
+		if err := fstat(sf, &st); err != nil {
+			return nil, err
+		}
+		length = st.Size - srcOff
+	}
+	out := make([]DedupeResult, len(targets))
+	active := make([]int, 0, maxDedupeTargets)
+	for start := 0; start < len(targets); start += maxDedupeTargets {
+		end := start + maxDedupeTargets
+		if end > len(targets) {
+			end = len(targets)
+		}
+		var off int64
+		for {
+			n := length - off
+			if n > maxDedupeLen {
+				n = maxDedupeLen
+			}
+			active = active[:0]
+			for i := start; i < end; i++ {
+				if !out[i].DataDiffers && out[i].Err == nil {
+					active = append(active, i)
+				}
+			}
+			if len(active) == 0 || n <= 0 {
+				break
+			}
+			if err := dedupeRange(src, srcOff+off, n, off, targets, active, out); err != nil {
+				return out, err
+			}
+			off += n
+			if off >= length {
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// dedupeRange submits a single FIDEDUPERANGE call for a subset of targets,
+// with target offsets shifted by delta. Results are added to out.
+func dedupeRange(src ioctlFile, srcOff, length, delta int64, targets []DedupeTarget, active []int, out []DedupeResult) error {
+	buf := make([]byte, sameArgsSize+uintptr(len(active))*sameInfoSize)
+	basePtr := unsafe.Pointer(&buf[0])
+	arg := (*btrfs_ioctl_same_args)(basePtr)
+	arg.logical_offset = uint64(srcOff)
+	arg.length = uint64(length)
+	arg.dest_count = uint16(len(active))
+	infoAt := func(i int) *btrfs_ioctl_same_extent_info {
+		return (*btrfs_ioctl_same_extent_info)(unsafe.Pointer(&buf[sameArgsSize+uintptr(i)*sameInfoSize]))
+	}
+	for i, ti := range active {
+		t := targets[ti]
+		info := infoAt(i)
+		info.fd = int64(t.File.Fd())
+		info.logical_offset = uint64(t.Offset + delta)
+	}
+	if err := iocFileExtentSame(src, arg); err != nil {
+		return &os.PathError{Op: "dedupe", Path: src.Name(), Err: err}
+	}
+	for i, ti := range active {
+		info := infoAt(i)
+		out[ti].Bytes += int64(info.bytes_deduped)
+		switch {
+		case info.status == _BTRFS_SAME_DATA_DIFFERS:
+			out[ti].DataDiffers = true
+		case info.status < 0:
+			out[ti].Err = syscall.Errno(-info.status)
+		}
+	}
+	return nil
+}
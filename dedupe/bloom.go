@@ -0,0 +1,38 @@
+package dedupe
+
+const (
+	// bloomBitsPerItem is the number of filter bits per block.
+	// With bloomHashes functions, it gives about 1% of false positives.
+	bloomBitsPerItem = 10
+	bloomHashes      = 7
+)
+
+// bloom is a Bloom filter for 64 bit block digests.
+type bloom struct {
+	bits []uint64
+	n    uint64 // number of bits
+}
+
+func newBloom(items int64) *bloom {
+	n := uint64(items) * bloomBitsPerItem
+	if n < 64 {
+		n = 64
+	}
+	return &bloom{bits: make([]uint64, (n+63)/64), n: n}
+}
+
+// add inserts a digest into the filter and reports if it might have been added before.
+func (b *bloom) add(h uint64) bool {
+	// double hashing: derive all hash functions from two halves of the digest
+	h1, h2 := h&0xffffffff, h>>32|1
+	seen := true
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % b.n
+		w, m := bit/64, uint64(1)<<(bit%64)
+		if b.bits[w]&m == 0 {
+			seen = false
+			b.bits[w] |= m
+		}
+	}
+	return seen
+}
@@ -0,0 +1,315 @@
+// Package dedupe finds identical blocks in files and shares their data on disk using
+// FIDEDUPERANGE, similar to duperemove.
+//
+// Files are read block by block and each block is hashed. A Bloom filter is used in
+// the same pass to select digests that were seen more than once. Digests of all blocks
+// are kept in memory until the scan completes (8 bytes per block), after which only
+// locations of possible duplicates are kept. Candidates are then compared byte by byte
+// and submitted to the kernel, which verifies the data again before sharing it.
+package dedupe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DefaultBlockSize is the default size of compared blocks.
+const DefaultBlockSize = 128 << 10
+
+// batchSize is the max number of target files opened for a single submission.
+const batchSize = 64
+
+// Config describes a deduplication job.
+type Config struct {
+	Paths []string // files and directories to scan
+	// BlockSize is the size of compared blocks. It must be a multiple of the filesystem
+	// sector size, otherwise Run fails. Smaller blocks find more duplicates, but use more memory.
+	// Defaults to DefaultBlockSize.
+	BlockSize int64
+	DryRun    bool // only find duplicates, do not deduplicate them
+}
+
+// Result describes a completed deduplication.
+type Result struct {
+	Files      int   // number of scanned files
+	Blocks     int64 // number of hashed blocks
+	Duplicates int64 // number of blocks identical to other blocks
+	Deduped    int64 // bytes deduplicated by the kernel
+	Differs    int64 // number of blocks that were modified before they were deduplicated
+	Failed     int64 // number of blocks that the kernel failed to deduplicate
+}
+
+type file struct {
+	path string
+	size int64
+	sums []uint64 // digests of blocks
+}
+
+// location is a block in a file.
+type location struct {
+	file int
+	off  int64
+}
+
+// Run scans files for identical blocks and deduplicates them.
+// Hard links are scanned once, and symlinks are not followed.
+// Files that are not owned by the user require CAP_SYS_ADMIN.
+func Run(conf Config) (*Result, error) {
+	if conf.BlockSize <= 0 {
+		conf.BlockSize = DefaultBlockSize
+	}
+	for _, path := range conf.Paths {
+		if err := checkBlockSize(path, conf.BlockSize); err != nil {
+			return nil, err
+		}
+	}
+	files, err := scan(conf.Paths, conf.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Files: len(files)}
+	groups, err := hashFiles(files, conf.BlockSize, res)
+	if err != nil {
+		return res, err
+	}
+	d := &deduper{files: files, bs: conf.BlockSize, dry: conf.DryRun, res: res}
+	for _, g := range groups {
+		if err := d.group(g); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// checkBlockSize checks that the block size is a multiple of the block size of the filesystem
+// that contains path. The kernel rejects unaligned dedupe ranges that don't end at EOF.
+func checkBlockSize(path string, bs int64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	if st.Bsize > 0 && bs%int64(st.Bsize) != 0 {
+		return fmt.Errorf("block size %d is not a multiple of the filesystem block size %d", bs, st.Bsize)
+	}
+	return nil
+}
+
+// scan lists regular files with at least one full block.
+func scan(paths []string, bs int64) ([]file, error) {
+	type inode struct {
+		dev, ino uint64
+	}
+	seen := make(map[inode]struct{})
+	var files []file
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if !fi.Mode().IsRegular() || fi.Size() < bs {
+				return nil
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			id := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if _, ok := seen[id]; ok {
+				return nil
+			}
+			seen[id] = struct{}{}
+			files = append(files, file{path: path, size: fi.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// hashFiles computes block digests of all files and returns groups of blocks
+// with the same digest, in order of their first occurrence.
+func hashFiles(files []file, bs int64, res *Result) ([][]location, error) {
+	var total int64
+	for _, f := range files {
+		total += f.size / bs
+	}
+	filter := newBloom(total)
+	cand := make(map[uint64]struct{})
+	h, err := btrfs.NewCsumHash(btrfs.CsumXXHash64)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, bs)
+	for i := range files {
+		f := &files[i]
+		if err := f.hash(h, buf); err != nil {
+			return nil, err
+		}
+		res.Blocks += int64(len(f.sums))
+		for _, s := range f.sums {
+			if filter.add(s) {
+				cand[s] = struct{}{}
+			}
+		}
+	}
+	// first occurrences were added before the digest became a candidate
+	byDigest := make(map[uint64][]location, len(cand))
+	var order []uint64
+	for i, f := range files {
+		for j, s := range f.sums {
+			if _, ok := cand[s]; !ok {
+				continue
+			}
+			if _, ok := byDigest[s]; !ok {
+				order = append(order, s)
+			}
+			byDigest[s] = append(byDigest[s], location{file: i, off: int64(j) * bs})
+		}
+		files[i].sums = nil
+	}
+	var groups [][]location
+	for _, s := range order {
+		if g := byDigest[s]; len(g) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// hash computes digests of all full blocks of the file.
+func (f *file) hash(h hash.Hash, buf []byte) error {
+	fd, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	n := f.size / int64(len(buf))
+	f.sums = make([]uint64, 0, n)
+	for i := int64(0); i < n; i++ {
+		if _, err := io.ReadFull(fd, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			// file was truncated
+			break
+		} else if err != nil {
+			return err
+		}
+		h.Reset()
+		h.Write(buf)
+		f.sums = append(f.sums, binary.LittleEndian.Uint64(h.Sum(nil)))
+	}
+	return nil
+}
+
+type deduper struct {
+	files []file
+	bs    int64
+	dry   bool
+	res   *Result
+}
+
+// group verifies and deduplicates a group of blocks with the same digest.
+func (d *deduper) group(g []location) error {
+	src := make([]byte, d.bs)
+	buf := make([]byte, d.bs)
+	for len(g) > 1 {
+		// blocks may differ in case of a digest collision; split them by content
+		if err := d.read(g[0], src); err != nil {
+			return err
+		}
+		var same, rest []location
+		for _, l := range g[1:] {
+			if err := d.read(l, buf); err != nil {
+				return err
+			}
+			if bytes.Equal(src, buf) {
+				same = append(same, l)
+			} else {
+				rest = append(rest, l)
+			}
+		}
+		if len(same) != 0 {
+			d.res.Duplicates += int64(len(same))
+			if !d.dry {
+				if err := d.submit(g[0], same); err != nil {
+					return err
+				}
+			}
+		}
+		g = rest
+	}
+	return nil
+}
+
+// read reads a block at a given location.
+func (d *deduper) read(l location, p []byte) error {
+	f, err := os.Open(d.files[l.file].path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(p, l.off)
+	return err
+}
+
+// submit deduplicates target blocks with the source block.
+func (d *deduper) submit(src location, targets []location) error {
+	sf, err := os.Open(d.files[src.file].path)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	for len(targets) > 0 {
+		batch := targets
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		targets = targets[len(batch):]
+		if err := d.batch(sf, src, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batch submits a single dedupe request. Target files are opened only for the request.
+func (d *deduper) batch(sf *os.File, src location, batch []location) error {
+	open := make(map[int]*os.File)
+	open[src.file] = sf
+	defer func() {
+		for i, f := range open {
+			if i != src.file {
+				f.Close()
+			}
+		}
+	}()
+	list := make([]btrfs.DedupeTarget, 0, len(batch))
+	for _, t := range batch {
+		f, ok := open[t.file]
+		if !ok {
+			var err error
+			if f, err = os.Open(d.files[t.file].path); err != nil {
+				return err
+			}
+			open[t.file] = f
+		}
+		list = append(list, btrfs.DedupeTarget{File: f, Offset: t.off})
+	}
+	out, err := btrfs.DedupeRange(sf, src.off, d.bs, list)
+	if err != nil {
+		return err
+	}
+	for _, r := range out {
+		d.res.Deduped += r.Bytes
+		switch {
+		case r.DataDiffers:
+			d.res.Differs++
+		case r.Err != nil:
+			d.res.Failed++
+		}
+	}
+	return nil
+}
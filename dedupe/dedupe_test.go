@@ -0,0 +1,85 @@
+package dedupe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloom(t *testing.T) {
+	b := newBloom(1000)
+	for i := uint64(0); i < 1000; i++ {
+		if b.add(i * 0x9E3779B97F4A7C15) {
+			// false positives are allowed, but should be rare
+			t.Logf("false positive: %d", i)
+		}
+	}
+	for i := uint64(0); i < 1000; i++ {
+		if !b.add(i * 0x9E3779B97F4A7C15) {
+			t.Fatalf("digest %d was not found", i)
+		}
+	}
+}
+
+func TestRunDry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_dedupe_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const bs = 4096
+	block := func(b byte) []byte {
+		p := make([]byte, bs)
+		for i := range p {
+			p[i] = b + byte(i)
+		}
+		return p
+	}
+	join := func(blocks ...[]byte) []byte {
+		var p []byte
+		for _, b := range blocks {
+			p = append(p, b...)
+		}
+		return p
+	}
+	files := map[string][]byte{
+		"a":     join(block(1), block(2), block(3)),
+		"b":     join(block(2), block(4), block(1)),
+		"c/d":   join(block(1), block(1)),
+		"small": block(1)[:100],
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Run(Config{Paths: []string{dir}, BlockSize: bs, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// block 1 is found 4 times, block 2 twice
+	exp := Result{Files: 3, Blocks: 8, Duplicates: 4}
+	if *res != exp {
+		t.Fatalf("unexpected result: %+v", *res)
+	}
+}
+
+func TestRunUnaligned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_dedupe_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = Run(Config{Paths: []string{dir}, BlockSize: 4096 + 512, DryRun: true}); err == nil {
+		t.Fatal("expected an error for unaligned block size")
+	}
+}
@@ -0,0 +1,181 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// compression types as stored on disk
+const (
+	compressNone = 0
+	compressZlib = 1
+	compressLZO  = 2
+	compressZstd = 3
+)
+
+func (c Compression) compressType() (uint32, error) {
+	switch c.Algorithm() {
+	case CompressionNone:
+		return compressNone, nil
+	case ZLIB:
+		return compressZlib, nil
+	case LZO:
+		return compressLZO, nil
+	case ZSTD:
+		return compressZstd, nil
+	}
+	return 0, fmt.Errorf("unsupported compression: %q", string(c))
+}
+
+// DefragOptions controls a defragmentation of a file.
+type DefragOptions struct {
+	// Start and Len limits the byte range to defragment.
+	// Zero Len means until the end of the file.
+	Start, Len uint64
+	// ExtentThreshold sets the size of extents that will be considered already defragmented.
+	// Zero value uses a kernel default.
+	ExtentThreshold uint32
+	// Flush starts writeback of defragmented data immediately.
+	Flush bool
+	// Compress recompresses the data with a given algorithm while defragmenting.
+	Compress Compression
+	// Progress is called by DefragTree after each file is processed, possibly from
+	// multiple goroutines. Returning an error stops the walk. If not set, the first
+	// error stops the walk.
+	Progress func(path string, err error) error
+}
+
+func (opts DefragOptions) toArgs() (btrfs_ioctl_defrag_range_args, error) {
+	args := btrfs_ioctl_defrag_range_args{
+		start:         opts.Start,
+		len:           opts.Len,
+		extent_thresh: opts.ExtentThreshold,
+	}
+	if args.len == 0 {
+		args.len = maxUint64
+	}
+	if opts.Flush {
+		args.flags |= uint64(_BTRFS_DEFRAG_RANGE_START_IO)
+	}
+	if opts.Compress != CompressionNone {
+		typ, err := opts.Compress.compressType()
+		if err != nil {
+			return args, err
+		}
+		args.flags |= uint64(_BTRFS_DEFRAG_RANGE_COMPRESS)
+		args.compress_type = typ
+	}
+	return args, nil
+}
+
+// DefragFile defragments an opened file.
+func DefragFile(f *os.File, opts DefragOptions) error {
+	args, err := opts.toArgs()
+	if err != nil {
+		return err
+	}
+	if err = iocDefragRange(f, &args); err != nil {
+		return &os.PathError{Op: "defrag", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// Defrag defragments a file with a given path.
+func Defrag(path string, opts DefragOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return DefragFile(f, opts)
+}
+
+// Defrag defragments a file. Relative paths are resolved against the opened directory.
+func (f *FS) Defrag(path string, opts DefragOptions) error {
+	file, err := openAt(f.f, path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return DefragFile(file, opts)
+}
+
+var errStopWalk = errors.New("stop walk")
+
+// DefragTree recursively defragments all regular files in a directory tree using
+// a given number of workers. Nested subvolumes, snapshots and other mount points are skipped.
+//
+// Note that defragmentation breaks reflinks and snapshot sharing,
+// thus it may significantly increase the space usage.
+func DefragTree(root string, opts DefragOptions, workers int) error {
+	if workers <= 0 {
+		workers = 1
+	}
+	var rst syscall.Stat_t
+	if err := syscall.Stat(root, &rst); err != nil {
+		return &os.PathError{Op: "stat", Path: root, Err: err}
+	}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	stop := make(chan struct{})
+	setErr := func(err error) {
+		mu.Lock()
+		if first == nil {
+			first = err
+			close(stop)
+		}
+		mu.Unlock()
+	}
+	files := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				err := Defrag(path, opts)
+				if opts.Progress != nil {
+					err = opts.Progress(path, err)
+				}
+				if err != nil {
+					setErr(err)
+				}
+			}
+		}()
+	}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path == root {
+				return nil
+			}
+			st, ok := fi.Sys().(*syscall.Stat_t)
+			if ok && (st.Dev != rst.Dev || objectID(st.Ino) == firstFreeObjectid) {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+		select {
+		case files <- path:
+			return nil
+		case <-stop:
+			return errStopWalk
+		}
+	})
+	close(files)
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+func checkBlockDevice(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if m := st.Mode(); m&os.ModeDevice == 0 || m&os.ModeCharDevice != 0 {
+		return fmt.Errorf("not a block device: %s", path)
+	}
+	return nil
+}
+
+// AddDevice adds a block device to the filesystem.
+//
+// It returns ErrDeviceBusy if device is used by someone else, and ErrDeviceInFS
+// if device is already a part of this filesystem.
+func (f *FS) AddDevice(path string) error {
+	if err := checkBlockDevice(path); err != nil {
+		return err
+	}
+	var args btrfs_ioctl_vol_args
+	if len(path) >= len(args.name) {
+		return fmt.Errorf("device path is too long: %s", path)
+	}
+	args.SetName(path)
+	err := f.exclusive(func() error {
+		return iocAddDev(f.file(), &args)
+	})
+	if err == nil {
+		return nil
+	} else if errors.Is(err, syscall.EBUSY) {
+		err = ErrDeviceBusy
+	} else if err == syscall.EEXIST {
+		err = ErrDeviceInFS
+	}
+	return &os.PathError{Op: "add device", Path: path, Err: err}
+}
+
+// MissingDevice is a special device name that can be passed to RemoveDevice
+// to remove the first device that is missing from a degraded filesystem.
+const MissingDevice = "missing"
+
+// RemoveDevice removes a device from the filesystem by its path.
+// Path can be set to MissingDevice to remove a missing device from a degraded filesystem.
+func (f *FS) RemoveDevice(path string) error {
+	if path != MissingDevice {
+		if err := checkBlockDevice(path); err != nil {
+			return err
+		}
+	}
+	args := btrfs_ioctl_vol_args_v2{}
+	if len(path) >= len(args.name) {
+		return fmt.Errorf("device path is too long: %s", path)
+	}
+	args.SetName(path)
+	err := f.exclusive(func() error {
+		err := iocRmDevV2(f.file(), &args)
+		if err == syscall.ENOTTY || err == syscall.EOPNOTSUPP {
+			// old kernel, try v1 ioctl
+			var args1 btrfs_ioctl_vol_args
+			args1.SetName(path)
+			err = iocRmDev(f.file(), &args1)
+		}
+		return err
+	})
+	if errors.Is(err, syscall.EBUSY) {
+		err = ErrDeviceBusy
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove device", Path: path, Err: err}
+	}
+	return nil
+}
+
+// RemoveDeviceByID removes a device from the filesystem by its id.
+// The id is used as the path in returned errors, as in "btrfs device remove".
+func (f *FS) RemoveDeviceByID(devid uint64) error {
+	args := btrfs_ioctl_vol_args_v2{flags: deviceSpecByID}
+	args.SetDevID(devid)
+	err := f.exclusive(func() error {
+		return iocRmDevV2(f.file(), &args)
+	})
+	if errors.Is(err, syscall.EBUSY) {
+		err = ErrDeviceBusy
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove device", Path: strconv.FormatUint(devid, 10), Err: err}
+	}
+	return nil
+}
+
+// DeviceInfo describes a device of the filesystem.
+type DeviceInfo struct {
+	DevID      uint64 `json:"devid"`
+	UUID       UUID   `json:"uuid"`
+	Path       string `json:"path"`
+	TotalBytes uint64 `json:"total_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"` // allocated for chunks
+	// Missing is set if the device is not present in the system.
+	Missing bool `json:"missing"`
+}
+
+// Devices returns all devices of the filesystem.
+func (f *FS) Devices() ([]DeviceInfo, error) {
+	info, err := iocFsInfo(f.file())
+	if err != nil {
+		return nil, &os.PathError{Op: "fs info", Path: f.f.Name(), Err: err}
+	}
+	var out []DeviceInfo
+	for i := uint64(0); i <= info.max_id; i++ {
+		dev, err := iocDevInfo(f.file(), i, UUID{})
+		if err == syscall.ENODEV {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "dev info", Path: f.f.Name(), Err: err}
+		}
+		path := dev.Path()
+		out = append(out, DeviceInfo{
+			DevID:      dev.devid,
+			UUID:       dev.uuid,
+			Path:       path,
+			TotalBytes: dev.total_bytes,
+			UsedBytes:  dev.bytes_used,
+			Missing:    path == "",
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,205 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// DiskUsageEntry is the disk usage of a file or a directory tree, as reported by "btrfs filesystem du".
+type DiskUsageEntry struct {
+	Path string `json:"path"`
+	// Subvolume is set if the directory is the root of a subvolume.
+	Subvolume bool `json:"subvolume,omitempty"`
+	// Total is the number of bytes in file extents, including shared ones.
+	Total uint64 `json:"total"`
+	// Exclusive is the number of bytes in extents that are not shared.
+	Exclusive uint64 `json:"exclusive"`
+	// SetShared is the number of bytes in shared extents referenced from the tree,
+	// with every extent counted only once.
+	SetShared uint64 `json:"set_shared"`
+	// Dirs lists usage of subdirectories.
+	Dirs []*DiskUsageEntry `json:"dirs,omitempty"`
+}
+
+// DiskUsage walks a file tree and computes the total, exclusive and shared bytes
+// for each directory and subvolume in it. Unlike du, data that is shared between files
+// in the tree (reflinks, snapshots) is counted only once in SetShared.
+//
+// Extents are classified by the FIEMAP shared flag, thus it does not require CAP_SYS_ADMIN.
+// Hard links are counted once. Nested subvolumes are included, while mount points of other
+// filesystems and bind mounts of directories are skipped. Subvolumes of the same filesystem
+// that are mounted inside the tree cannot be told apart from nested ones and are included.
+func DiskUsage(root string) (*DiskUsageEntry, error) {
+	if ok, err := IsBtrfs(root); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrNotBtrfs{Path: root}
+	}
+	st, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+	fsid, err := fsidOf(root)
+	if err != nil {
+		return nil, err
+	}
+	w := &duWalker{fsid: fsid, seen: make(map[duInode]struct{})}
+	ent, _, err := w.walk(root, st)
+	return ent, err
+}
+
+// fsidOf returns the id of the btrfs filesystem that contains path.
+func fsidOf(path string) (FSID, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FSID{}, err
+	}
+	defer f.Close()
+	info, err := iocFsInfo(f)
+	if err != nil {
+		return FSID{}, &os.PathError{Op: "fs info", Path: path, Err: err}
+	}
+	return info.fsid, nil
+}
+
+type duInode struct {
+	dev, ino uint64
+}
+
+type duWalker struct {
+	fsid FSID                 // filesystem of the tree root
+	seen map[duInode]struct{} // inodes with multiple links
+}
+
+// sameFS checks if a directory that has a different device than its parent is the root
+// of a subvolume of the same filesystem, rather than a mount point.
+func (w *duWalker) sameFS(path string, st *syscall.Stat_t) (bool, error) {
+	if objectID(st.Ino) != firstFreeObjectid {
+		// only subvolume roots have this inode number on btrfs, other filesystems may
+		// use it as well, thus fsid is compared below
+		return false, nil
+	}
+	if ok, err := IsBtrfs(path); err != nil || !ok {
+		return false, err
+	}
+	fsid, err := fsidOf(path)
+	if err != nil {
+		return false, err
+	}
+	return fsid == w.fsid, nil
+}
+
+// walk computes usage of a file or a directory, and returns a set of shared extents referenced from it.
+func (w *duWalker) walk(path string, st os.FileInfo) (*DiskUsageEntry, extentSet, error) {
+	ent := &DiskUsageEntry{Path: path}
+	sys := st.Sys().(*syscall.Stat_t)
+	switch {
+	case st.Mode().IsRegular():
+		if sys.Nlink > 1 {
+			id := duInode{dev: uint64(sys.Dev), ino: sys.Ino}
+			if _, ok := w.seen[id]; ok {
+				return ent, nil, nil
+			}
+			w.seen[id] = struct{}{}
+		}
+		set, err := ent.file(path)
+		return ent, set, err
+	case !st.IsDir():
+		return ent, nil, nil
+	}
+	ent.Subvolume = objectID(sys.Ino) == firstFreeObjectid
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var set extentSet
+	for _, fi := range infos {
+		sub := filepath.Join(path, fi.Name())
+		if cst := fi.Sys().(*syscall.Stat_t); fi.IsDir() && cst.Dev != sys.Dev {
+			if ok, err := w.sameFS(sub, cst); err != nil {
+				return nil, nil, err
+			} else if !ok {
+				continue
+			}
+		}
+		e, s, err := w.walk(sub, fi)
+		if err != nil {
+			return nil, nil, err
+		}
+		ent.Total += e.Total
+		ent.Exclusive += e.Exclusive
+		set = append(set, s...)
+		if fi.IsDir() {
+			ent.Dirs = append(ent.Dirs, e)
+		}
+	}
+	set = set.normalize()
+	ent.SetShared = set.size()
+	return ent, set, nil
+}
+
+// file computes usage of a regular file.
+func (ent *DiskUsageEntry) file(path string) (extentSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	exts, err := FileExtents(f)
+	if err != nil {
+		return nil, err
+	}
+	var set extentSet
+	for _, e := range exts {
+		ent.Total += e.Length
+		if e.Shared() && e.Flags&(FiemapUnknown|FiemapDataInline) == 0 {
+			set = append(set, extentRange{start: e.Physical, end: e.Physical + e.Length})
+		} else {
+			ent.Exclusive += e.Length
+		}
+	}
+	set = set.normalize()
+	ent.SetShared = set.size()
+	return set, nil
+}
+
+type extentRange struct {
+	start, end uint64
+}
+
+// extentSet is a set of logical address ranges.
+type extentSet []extentRange
+
+// normalize sorts ranges and merges the overlapping ones.
+func (s extentSet) normalize() extentSet {
+	if len(s) < 2 {
+		return s
+	}
+	sort.Slice(s, func(i, j int) bool {
+		return s[i].start < s[j].start
+	})
+	out := s[:1]
+	for _, r := range s[1:] {
+		last := &out[len(out)-1]
+		if r.start <= last.end {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// size returns the number of bytes in a normalized set.
+func (s extentSet) size() uint64 {
+	var n uint64
+	for _, r := range s {
+		n += r.end - r.start
+	}
+	return n
+}
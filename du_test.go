@@ -0,0 +1,24 @@
+package btrfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtentSet(t *testing.T) {
+	s := extentSet{
+		{start: 100, end: 200},
+		{start: 0, end: 50},
+		{start: 150, end: 250},
+		{start: 250, end: 300},
+		{start: 120, end: 130},
+		{start: 400, end: 500},
+	}
+	s = s.normalize()
+	exp := extentSet{{start: 0, end: 50}, {start: 100, end: 300}, {start: 400, end: 500}}
+	if !reflect.DeepEqual(s, exp) {
+		t.Fatalf("unexpected set: %v", s)
+	} else if n := s.size(); n != 350 {
+		t.Fatalf("unexpected size: %d", n)
+	}
+}
@@ -3,6 +3,7 @@ package btrfs
 import (
 	"errors"
 	"fmt"
+	"syscall"
 )
 
 type ErrNotBtrfs struct {
@@ -13,6 +14,20 @@ func (e ErrNotBtrfs) Error() string {
 	return fmt.Sprintf("not a btrfs filesystem: %s", e.Path)
 }
 
+// ErrMisaligned is returned when offsets or length of a range operation are
+// not aligned to the filesystem block size.
+type ErrMisaligned struct {
+	Alignment uint64
+	SrcOffset int64
+	DstOffset int64
+	Length    int64
+}
+
+func (e *ErrMisaligned) Error() string {
+	return fmt.Sprintf("range is not aligned to %d bytes: src %d+%d, dst %d",
+		e.Alignment, e.SrcOffset, e.Length, e.DstOffset)
+}
+
 // Error codes as returned by the kernel
 type ErrCode int
 
@@ -47,6 +62,78 @@ var errorString = map[ErrCode]string{
 }
 
 var (
-	ErrNotFound       = errors.New("not found")
-	errNotImplemented = errors.New("not implemented")
+	ErrNotFound   = errors.New("not found")
+	ErrDeviceBusy = errors.New("device is busy")
+	ErrDeviceInFS = errors.New("device is already in the filesystem")
+
+	ErrReplaceNotStarted      = errors.New("device replace is not started")
+	ErrReplaceAlreadyStarted  = errors.New("device replace is already started")
+	ErrReplaceScrubInProgress = errors.New("scrub is in progress")
+	ErrQuotaNotEnabled        = errors.New("quota is not enabled")
+	ErrFreezeWorkDir          = errors.New("refusing to freeze the filesystem containing working directory")
+	ErrUnsupportedCsum        = errors.New("unsupported checksum type")
+	ErrReceivedSubvolume      = errors.New("subvolume was received, making it writable breaks incremental receive")
+	ErrSeedMetadataUUID       = errors.New("seeding flag cannot be changed on a filesystem with metadata UUID")
+	ErrReadOnlySnapshot       = errors.New("snapshot is read-only, promote a writable snapshot of it instead")
+	errNotImplemented         = errors.New("not implemented")
+
+	// ErrZoneMisaligned is returned when a size on a zoned filesystem is not a multiple of the zone size.
+	ErrZoneMisaligned = errors.New("size is not aligned to the zone size")
+	// ErrZonedProfile is returned when a block group profile is not supported on a zoned filesystem.
+	ErrZonedProfile = errors.New("profile is not supported on zoned filesystems")
 )
+
+// Errors that describe common failure causes. Errors returned by the kernel are annotated
+// with them, so both errors.Is(err, ErrBusy) and errors.Is(err, syscall.EBUSY) can be used.
+var (
+	ErrNotSubvolume  = errors.New("not a subvolume")
+	ErrReadOnlyFS    = errors.New("read-only filesystem")
+	ErrNoSpace       = errors.New("no space left on device")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrBusy          = errors.New("resource busy")
+	// ErrNeedsRoot is returned when an operation requires CAP_SYS_ADMIN. EPERM is only
+	// annotated with it for requests that are always privileged.
+	ErrNeedsRoot = errors.New("operation requires CAP_SYS_ADMIN")
+)
+
+// errnoError is an errno returned by the kernel, annotated with a sentinel error.
+type errnoError struct {
+	errno syscall.Errno
+	kind  error
+}
+
+func (e errnoError) Error() string {
+	return e.errno.Error()
+}
+
+func (e errnoError) Unwrap() error {
+	return e.errno
+}
+
+func (e errnoError) Is(target error) bool {
+	return target == e.kind
+}
+
+// wrapErrno annotates known errno values with a matching sentinel error.
+// Other errors are returned as-is. EPERM is annotated with ErrNeedsRoot only
+// for privileged ioctls, see adminIoctls.
+func wrapErrno(err error) error {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	var kind error
+	switch errno {
+	case syscall.EBUSY:
+		kind = ErrBusy
+	case syscall.EROFS:
+		kind = ErrReadOnlyFS
+	case syscall.ENOSPC:
+		kind = ErrNoSpace
+	case syscall.EDQUOT:
+		kind = ErrQuotaExceeded
+	default:
+		return err
+	}
+	return errnoError{errno: errno, kind: kind}
+}
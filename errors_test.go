@@ -0,0 +1,160 @@
+package btrfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestWrapErrno(t *testing.T) {
+	err := error(&os.PathError{Op: "delete subvolume", Path: "/mnt/a", Err: wrapErrno(syscall.EBUSY)})
+	if !errors.Is(err, ErrBusy) {
+		t.Error("expected ErrBusy")
+	}
+	if !errors.Is(err, syscall.EBUSY) {
+		t.Error("expected EBUSY")
+	}
+	if errors.Is(err, ErrNoSpace) {
+		t.Error("unexpected ErrNoSpace")
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) || errno != syscall.EBUSY {
+		t.Errorf("unexpected errno: %v", errno)
+	}
+	if exp := "delete subvolume /mnt/a: " + syscall.EBUSY.Error(); err.Error() != exp {
+		t.Errorf("unexpected message: %q", err.Error())
+	}
+	if err = wrapErrno(syscall.ENOENT); err != syscall.ENOENT {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestWrappedErrno(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	fs := NewFSWithIoctl(d, fake)
+	defer fs.Close()
+
+	fake.Respond("BTRFS_IOC_GET_FEATURES", IoctlResponse{})
+	fake.Respond("BTRFS_IOC_RESIZE", IoctlResponse{Err: syscall.ENOSPC})
+	if err = fs.Resize("+1g"); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("expected ErrNoSpace, got: %v", err)
+	}
+	fake.Respond("BTRFS_IOC_QGROUP_CREATE", IoctlResponse{Err: syscall.EBUSY})
+	if err = fs.QgroupCreate(NewQgroupID(1, 100)); !errors.Is(err, ErrBusy) {
+		t.Errorf("expected ErrBusy, got: %v", err)
+	}
+	fake.Respond("BTRFS_IOC_QGROUP_LIMIT", IoctlResponse{Err: syscall.EDQUOT})
+	if err = fs.QgroupSetLimit(NewQgroupID(0, 256), QgroupLimit{Referenced: 1 << 20}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got: %v", err)
+	}
+	fake.Respond("BTRFS_IOC_RM_DEV_V2", IoctlResponse{Err: syscall.EBUSY})
+	var perr *os.PathError
+	if err = fs.RemoveDeviceByID(2); !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("expected ErrDeviceBusy, got: %v", err)
+	} else if !errors.As(err, &perr) || perr.Op != "remove device" || perr.Path != "2" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestNeedsRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	fs := NewFSWithIoctl(d, fake)
+	defer fs.Close()
+	// only privileged requests are annotated
+	fake.Respond("BTRFS_IOC_TREE_SEARCH_V2", IoctlResponse{Err: syscall.EPERM})
+	fake.Respond("BTRFS_IOC_SUBVOL_SETFLAGS", IoctlResponse{Err: syscall.EPERM})
+	if err = doIoctl(fs.file(), _BTRFS_IOC_TREE_SEARCH_V2, nil); !errors.Is(err, ErrNeedsRoot) || !errors.Is(err, syscall.EPERM) {
+		t.Errorf("unexpected error: %#v", err)
+	}
+	if err = iocSubvolSetflags(fs.file(), SubvolReadOnly); errors.Is(err, ErrNeedsRoot) || !errors.Is(err, syscall.EPERM) {
+		t.Errorf("unexpected error: %#v", err)
+	}
+	defer func(fn func() bool) { isAdmin = fn }(isAdmin)
+	isAdmin = func() bool { return false }
+	if err = requireAdmin("verify", "/mnt/a"); !errors.Is(err, ErrNeedsRoot) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	isAdmin = func() bool { return true }
+	if err = requireAdmin("verify", "/mnt/a"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseCapEff(t *testing.T) {
+	const status = "Name:\tcat\nCapInh:\t0000000000000000\nCapPrm:\t000001ffffffffff\nCapEff:\t0000000000200000\n"
+	caps, ok := parseCapEff(status)
+	if !ok || caps != 1<<capSysAdmin {
+		t.Fatalf("unexpected caps: %x (%v)", caps, ok)
+	}
+	if _, ok = parseCapEff("Name:\tcat\n"); ok {
+		t.Fatal("expected no caps")
+	}
+	if !isInitUserNS("         0          0 4294967295\n") {
+		t.Fatal("expected init user namespace")
+	}
+	if isInitUserNS("         0       1000          1\n") {
+		t.Fatal("unexpected init user namespace")
+	}
+}
+
+func TestNewFSNotBtrfs(t *testing.T) {
+	f, err := os.Open("/proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = NewFS(f); !errors.As(err, new(ErrNotBtrfs)) {
+		t.Fatalf("expected ErrNotBtrfs, got: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "btrfs_newfs_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if ok, err := IsBtrfs(dir); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Skip("temp dir is on btrfs")
+	}
+	if _, err = Open(dir, true); !errors.As(err, new(ErrNotBtrfs)) {
+		t.Fatalf("expected ErrNotBtrfs, got: %v", err)
+	}
+	if _, err = SubvolumeID(dir); !errors.As(err, new(ErrNotBtrfs)) {
+		t.Fatalf("expected ErrNotBtrfs, got: %v", err)
+	}
+	if _, err = ContainingSubvolume(dir); !errors.As(err, new(ErrNotBtrfs)) {
+		t.Fatalf("expected ErrNotBtrfs, got: %v", err)
+	}
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = FromFd(uintptr(fd)); !errors.As(err, new(ErrNotBtrfs)) {
+		t.Fatalf("expected ErrNotBtrfs, got: %v", err)
+	}
+	// the descriptor is closed on failure
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0); errno != syscall.EBADF {
+		syscall.Close(fd)
+		t.Fatalf("expected the descriptor to be closed, got: %v", errno)
+	}
+}
@@ -0,0 +1,159 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// featureAliases maps alternative names to canonical feature names: names used by mkfs.btrfs,
+// and old names of features.
+var featureAliases = map[string]string{
+	"extref":        "extended-iref",
+	"mixed-bg":      "mixed-groups",
+	"squota":        "simple-quota",
+	"compresslzov2": "compress-zstd",
+}
+
+// normFeatureName converts a feature name to a form that is compared when parsing.
+// The case and separators are ignored, thus "no-holes", "no_holes" and "NoHoles" are the same.
+func normFeatureName(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if a, ok := featureAliases[s]; ok {
+		s = a
+	}
+	return strings.NewReplacer("-", "", "_", "").Replace(s)
+}
+
+// parseFeature returns the bit of a named feature and the index of the table it was found in.
+// Both display and JSON names are accepted, since they only differ in case and separators.
+// Hex values are accepted as well and are returned for the first table.
+func parseFeature(s string, tables ...featureTable) (uint64, int, bool) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") {
+		v, err := strconv.ParseUint(s[2:], 16, 64)
+		return v, 0, err == nil
+	}
+	name := normFeatureName(s)
+	for ti, names := range tables {
+		for i, n := range names {
+			if n.display != "" && normFeatureName(n.display) == name {
+				return 1 << uint(i), ti, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// splitFeatures splits a comma-separated list of features, skipping empty entries.
+func splitFeatures(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// parseFeatureList parses a comma-separated list of features from a single set.
+func parseFeatureList(s string, names featureTable) (uint64, error) {
+	var v uint64
+	for _, f := range splitFeatures(s) {
+		bit, _, ok := parseFeature(f, names)
+		if !ok {
+			return 0, fmt.Errorf("unknown feature: %q", f)
+		}
+		v |= bit
+	}
+	return v, nil
+}
+
+// ParseCompatFeatures parses a comma-separated list of compatible features.
+// Since no such features are defined, only hex values are accepted.
+func ParseCompatFeatures(s string) (CompatFeatures, error) {
+	v, err := parseFeatureList(s, compatFeatureNames)
+	return CompatFeatures(v), err
+}
+
+// ParseFeatureFlags parses a comma-separated list of read-only compatible features,
+// for example "free-space-tree,block-group-tree".
+func ParseFeatureFlags(s string) (FeatureFlags, error) {
+	v, err := parseFeatureList(s, compatROFeatureNames)
+	return FeatureFlags(v), err
+}
+
+// ParseIncompatFeatures parses a comma-separated list of incompatible features,
+// for example "no-holes,skinny-metadata".
+func ParseIncompatFeatures(s string) (IncompatFeatures, error) {
+	v, err := parseFeatureList(s, incompatFeatureNames)
+	return IncompatFeatures(v), err
+}
+
+// ParseFeatures parses a comma-separated list of features of any kind, as printed by
+// FSFeatureFlags.String. Hex values are interpreted as incompatible features.
+func ParseFeatures(s string) (FSFeatureFlags, error) {
+	var out FSFeatureFlags
+	for _, f := range splitFeatures(s) {
+		bit, table, ok := parseFeature(f, incompatFeatureNames, compatROFeatureNames, compatFeatureNames)
+		if !ok {
+			return FSFeatureFlags{}, fmt.Errorf("unknown feature: %q", f)
+		}
+		switch table {
+		case 0:
+			out.Incompatible |= IncompatFeatures(bit)
+		case 1:
+			out.CompatibleRO |= FeatureFlags(bit)
+		default:
+			out.Compatible |= CompatFeatures(bit)
+		}
+	}
+	return out, nil
+}
+
+// String returns names of all features, as a comma-separated list.
+func (f FSFeatureFlags) String() string {
+	var list []string
+	for _, s := range []string{f.Compatible.String(), f.CompatibleRO.String(), f.Incompatible.String()} {
+		if s != "" {
+			list = append(list, s)
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// IsZero checks if no features are set.
+func (f FSFeatureFlags) IsZero() bool {
+	return f == FSFeatureFlags{}
+}
+
+// SetFeatures enables features from set and disables features from clear on a mounted filesystem.
+// The kernel only allows changing a limited set of features online (see GetSupportedFeatures).
+// It requires CAP_SYS_ADMIN.
+func (f *FS) SetFeatures(set, clear FSFeatureFlags) error {
+	if set.Compatible&clear.Compatible != 0 || set.CompatibleRO&clear.CompatibleRO != 0 ||
+		set.Incompatible&clear.Incompatible != 0 {
+		return fmt.Errorf("features are both set and cleared: %v", FSFeatureFlags{
+			Compatible:   set.Compatible & clear.Compatible,
+			CompatibleRO: set.CompatibleRO & clear.CompatibleRO,
+			Incompatible: set.Incompatible & clear.Incompatible,
+		})
+	}
+	// the first element is a mask of changed features, and the second one has their new values
+	var arg [2]btrfs_ioctl_feature_flags
+	arg[0] = btrfs_ioctl_feature_flags{
+		compat_flags:    set.Compatible | clear.Compatible,
+		compat_ro_flags: set.CompatibleRO | clear.CompatibleRO,
+		incompat_flags:  set.Incompatible | clear.Incompatible,
+	}
+	arg[1] = btrfs_ioctl_feature_flags{
+		compat_flags:    set.Compatible,
+		compat_ro_flags: set.CompatibleRO,
+		incompat_flags:  set.Incompatible,
+	}
+	if err := iocSetFeatures(f.file(), &arg); err != nil {
+		return &os.PathError{Op: "set features", Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
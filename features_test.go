@@ -0,0 +1,87 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFeatureNames(t *testing.T) {
+	f := FSFeatureFlags{
+		CompatibleRO: FeatureCompatROFreeSpaceTree | FeatureCompatROBlockGroupTree,
+		Incompatible: FeatureIncompatExtendedIRef | FeatureIncompatSkinnyMetadata | FeatureIncompatNoHoles | 1<<40,
+	}
+	const exp = "free-space-tree,block-group-tree,extended-iref,skinny-metadata,no-holes,0x10000000000"
+	if s := f.String(); s != exp {
+		t.Fatalf("unexpected names:\n%s\nvs\n%s", s, exp)
+	}
+	got, err := ParseFeatures(exp)
+	if err != nil {
+		t.Fatal(err)
+	} else if got != f {
+		t.Fatalf("unexpected features: %+v vs %+v", got, f)
+	}
+
+	inc, err := ParseIncompatFeatures("extref, NoHoles,skinny_metadata,raid1c34")
+	if err != nil {
+		t.Fatal(err)
+	} else if e := FeatureIncompatExtendedIRef | FeatureIncompatNoHoles | FeatureIncompatSkinnyMetadata | FeatureIncompatRAID1C34; inc != e {
+		t.Fatalf("unexpected features: %v vs %v", inc, e)
+	}
+	if _, err = ParseIncompatFeatures("free-space-tree"); err == nil {
+		t.Fatal("expected an error for a feature from another set")
+	}
+	if _, err = ParseFeatures("zoned,unknown"); err == nil {
+		t.Fatal("expected an error for an unknown feature")
+	}
+	for i, name := range incompatFeatureNames {
+		if name.display == "" {
+			continue
+		}
+		for _, s := range []string{name.display, name.json} {
+			if v, err := ParseIncompatFeatures(s); err != nil || v != 1<<uint(i) {
+				t.Errorf("cannot parse %q: %v (%v)", s, v, err)
+			}
+		}
+	}
+}
+
+func TestSetFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_features_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	fs := NewFSWithIoctl(d, fake)
+	defer fs.Close()
+
+	var got [2]btrfs_ioctl_feature_flags
+	fake.Respond("BTRFS_IOC_SET_FEATURES", IoctlResponse{Fill: func(arg interface{}) {
+		got = *arg.(*[2]btrfs_ioctl_feature_flags)
+	}})
+	err = fs.SetFeatures(
+		FSFeatureFlags{CompatibleRO: FeatureCompatROFreeSpaceTree | FeatureCompatROFreeSpaceTreeValid},
+		FSFeatureFlags{Incompatible: FeatureIncompatNoHoles},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].compat_ro_flags != FeatureCompatROFreeSpaceTree|FeatureCompatROFreeSpaceTreeValid ||
+		got[0].incompat_flags != FeatureIncompatNoHoles {
+		t.Errorf("unexpected mask: %+v", got[0])
+	}
+	if got[1].compat_ro_flags != FeatureCompatROFreeSpaceTree|FeatureCompatROFreeSpaceTreeValid ||
+		got[1].incompat_flags != 0 {
+		t.Errorf("unexpected values: %+v", got[1])
+	}
+
+	both := FSFeatureFlags{Incompatible: FeatureIncompatNoHoles}
+	if err = fs.SetFeatures(both, both); err == nil {
+		t.Fatal("expected an error")
+	}
+}
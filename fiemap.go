@@ -0,0 +1,119 @@
+package btrfs
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FiemapFlags describes a file extent returned by FIEMAP.
+type FiemapFlags uint32
+
+const (
+	FiemapLast          = FiemapFlags(0x00000001) // last extent in the file
+	FiemapUnknown       = FiemapFlags(0x00000002) // data location is unknown
+	FiemapDelalloc      = FiemapFlags(0x00000004) // location is still pending; sets FiemapUnknown
+	FiemapEncoded       = FiemapFlags(0x00000008) // data cannot be read while the filesystem is unmounted (compressed)
+	FiemapDataEncrypted = FiemapFlags(0x00000080) // data is encrypted; sets FiemapEncoded
+	FiemapNotAligned    = FiemapFlags(0x00000100) // extent offsets may not be block aligned
+	FiemapDataInline    = FiemapFlags(0x00000200) // data is mixed with metadata; sets FiemapNotAligned
+	FiemapDataTail      = FiemapFlags(0x00000400) // multiple files in a block; sets FiemapNotAligned
+	FiemapUnwritten     = FiemapFlags(0x00000800) // space is allocated, but no data (preallocated)
+	FiemapMerged        = FiemapFlags(0x00001000) // file does not natively support extents; result is merged
+	FiemapShared        = FiemapFlags(0x00002000) // space is shared with other files (reflinks, snapshots)
+)
+
+var fiemapFlagNames = []struct {
+	f    FiemapFlags
+	name string
+}{
+	{FiemapLast, "last"},
+	{FiemapUnknown, "unknown"},
+	{FiemapDelalloc, "delalloc"},
+	{FiemapEncoded, "encoded"},
+	{FiemapDataEncrypted, "encrypted"},
+	{FiemapNotAligned, "not_aligned"},
+	{FiemapDataInline, "inline"},
+	{FiemapDataTail, "tail"},
+	{FiemapUnwritten, "unwritten"},
+	{FiemapMerged, "merged"},
+	{FiemapShared, "shared"},
+}
+
+func (f FiemapFlags) String() string {
+	var s []string
+	for _, v := range fiemapFlagNames {
+		if f&v.f != 0 {
+			s = append(s, v.name)
+			f &^= v.f
+		}
+	}
+	if f != 0 {
+		s = append(s, "0x"+strconv.FormatUint(uint64(f), 16))
+	}
+	return strings.Join(s, "|")
+}
+
+// FileExtent is a single extent of a file, as reported by FIEMAP.
+type FileExtent struct {
+	Logical uint64 `json:"logical"` // offset in the file
+	// Physical is the address of the extent data. On btrfs, it's an address in the
+	// logical address space of the filesystem, not an offset on a device.
+	Physical uint64      `json:"physical"`
+	Length   uint64      `json:"length"`
+	Flags    FiemapFlags `json:"flags"`
+}
+
+// Shared reports if the extent data is shared with other files or snapshots.
+func (e FileExtent) Shared() bool {
+	return e.Flags&FiemapShared != 0
+}
+
+// Inline reports if the extent data is stored together with metadata.
+func (e FileExtent) Inline() bool {
+	return e.Flags&FiemapDataInline != 0
+}
+
+// Encoded reports if the extent data is compressed or encrypted.
+func (e FileExtent) Encoded() bool {
+	return e.Flags&FiemapEncoded != 0
+}
+
+// fiemapBatch is the number of extents requested at once.
+const fiemapBatch = 256
+
+// FileExtents returns all extents of a file using FIEMAP.
+// Delayed allocations are flushed first, thus all extents have known locations.
+// Holes are not reported.
+func FileExtents(f *os.File) ([]FileExtent, error) {
+	return fileExtents(f)
+}
+
+func fileExtents(f ioctlFile) ([]FileExtent, error) {
+	buf := make([]fiemap_extent, fiemapBatch)
+	var (
+		out   []FileExtent
+		start uint64
+	)
+	for {
+		list, err := iocFiemap(f, start, maxUint64-start, _FIEMAP_FLAG_SYNC, buf)
+		if err != nil {
+			return out, &os.PathError{Op: "fiemap", Path: f.Name(), Err: err}
+		} else if len(list) == 0 {
+			return out, nil
+		}
+		for _, e := range list {
+			out = append(out, FileExtent{
+				Logical:  e.fe_logical,
+				Physical: e.fe_physical,
+				Length:   e.fe_length,
+				Flags:    FiemapFlags(e.fe_flags),
+			})
+		}
+		last := out[len(out)-1]
+		if last.Flags&FiemapLast != 0 || last.Length == 0 {
+			return out, nil
+		}
+		start = last.Logical + last.Length
+	}
+}
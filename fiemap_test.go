@@ -0,0 +1,68 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+func TestFileExtents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fiemap_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fake := &FakeIoctl{}
+
+	// report a file with more extents than a single batch
+	const total = fiemapBatch + 10
+	var starts []uint64
+	fake.Respond("FS_IOC_FIEMAP", IoctlResponse{Fill: func(arg interface{}) {
+		buf := arg.([]byte)
+		fm := (*fiemap)(unsafe.Pointer(&buf[0]))
+		starts = append(starts, fm.fm_start)
+		if fm.fm_flags != _FIEMAP_FLAG_SYNC {
+			t.Errorf("unexpected flags: %x", fm.fm_flags)
+		}
+		first := int(fm.fm_start / 4096)
+		n := 0
+		for i := first; i < total && n < int(fm.fm_extent_count); i++ {
+			e := (*fiemap_extent)(unsafe.Pointer(&buf[unsafe.Sizeof(fiemap{})+uintptr(n)*unsafe.Sizeof(fiemap_extent{})]))
+			e.fe_logical = uint64(i) * 4096
+			e.fe_physical = 1<<30 + uint64(i)*4096
+			e.fe_length = 4096
+			if i%2 == 1 {
+				e.fe_flags = uint32(FiemapShared)
+			}
+			if i == total-1 {
+				e.fe_flags |= uint32(FiemapLast)
+			}
+			n++
+		}
+		fm.fm_mapped_extents = uint32(n)
+	}})
+	list, err := fileExtents(doerFile{File: f, d: fake})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(list) != total {
+		t.Fatalf("unexpected number of extents: %d", len(list))
+	}
+	for i, e := range list {
+		if e.Logical != uint64(i)*4096 || e.Length != 4096 || e.Shared() != (i%2 == 1) {
+			t.Fatalf("unexpected extent %d: %+v", i, e)
+		}
+	}
+	if len(starts) != 2 || starts[1] != fiemapBatch*4096 {
+		t.Fatalf("unexpected requests: %v", starts)
+	}
+	if s := (FiemapShared | FiemapLast | 0x10000).String(); s != "last|shared|0x10000" {
+		t.Fatalf("unexpected flags string: %q", s)
+	}
+}
@@ -0,0 +1,104 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FileFlags are inode attributes, as reported by lsattr.
+type FileFlags uint32
+
+const (
+	FileCompress   = FileFlags(_FS_COMPR_FL)
+	FileSync       = FileFlags(_FS_SYNC_FL)
+	FileImmutable  = FileFlags(_FS_IMMUTABLE_FL)
+	FileAppend     = FileFlags(_FS_APPEND_FL)
+	FileNoDump     = FileFlags(_FS_NODUMP_FL)
+	FileNoAtime    = FileFlags(_FS_NOATIME_FL)
+	FileNoCompress = FileFlags(_FS_NOCOMP_FL)
+	FileDirSync    = FileFlags(_FS_DIRSYNC_FL)
+	FileNoCOW      = FileFlags(_FS_NOCOW_FL)
+)
+
+var fileFlagNames = []struct {
+	flag FileFlags
+	name string
+}{
+	{FileCompress, "compress"},
+	{FileSync, "sync"},
+	{FileImmutable, "immutable"},
+	{FileAppend, "append"},
+	{FileNoDump, "nodump"},
+	{FileNoAtime, "noatime"},
+	{FileNoCompress, "nocompress"},
+	{FileDirSync, "dirsync"},
+	{FileNoCOW, "nocow"},
+}
+
+func (f FileFlags) String() string {
+	if f == 0 {
+		return "<nil>"
+	}
+	var out []string
+	for _, v := range fileFlagNames {
+		if f&v.flag != 0 {
+			out = append(out, v.name)
+			f &^= v.flag
+		}
+	}
+	if f != 0 {
+		out = append(out, "0x"+strconv.FormatUint(uint64(f), 16))
+	}
+	return strings.Join(out, "|")
+}
+
+// GetFileFlags returns inode flags of a file or directory (lsattr).
+func GetFileFlags(path string) (FileFlags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	flags, err := iocGetFlags(f)
+	if err != nil {
+		return 0, &os.PathError{Op: "get flags", Path: path, Err: err}
+	}
+	return FileFlags(flags), nil
+}
+
+// SetNoCOW enables or disables copy-on-write for a file or directory (chattr +C).
+//
+// The flag only takes effect on empty files, thus an error is returned when enabling
+// it on a file with data. When set on a directory, new files will inherit the flag.
+// Note that NOCOW files are not checksummed and cannot be compressed.
+func SetNoCOW(path string, enable bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	flags, err := iocGetFlags(f)
+	if err != nil {
+		return &os.PathError{Op: "get flags", Path: path, Err: err}
+	}
+	nflags := flags &^ _FS_NOCOW_FL
+	if enable {
+		nflags |= _FS_NOCOW_FL
+	}
+	if nflags == flags {
+		return nil
+	}
+	if enable && st.Mode().IsRegular() && st.Size() != 0 {
+		return fmt.Errorf("cannot set nocow on non-empty file: %s", path)
+	}
+	if err = iocSetFlags(f, nflags); err != nil {
+		return &os.PathError{Op: "set flags", Path: path, Err: err}
+	}
+	return nil
+}
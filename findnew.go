@@ -0,0 +1,94 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// FileChange describes a file extent that was written after a given generation.
+type FileChange struct {
+	Inode  uint64
+	Path   string // relative to the subvolume root; empty if the inode has no links
+	Offset uint64 // offset in the file
+	Len    uint64
+	Gen    uint64 // generation that wrote the extent
+	Type   FileExtentType
+	// Compression of the extent data. Empty if data is not compressed.
+	Compression Compression
+}
+
+// FindNew returns file extents of a subvolume that were written in or after a given generation.
+// Paths are relative to the subvolume root, subvolume path is resolved relative to the
+// filesystem root. It is an equivalent of "btrfs subvolume find-new" and requires CAP_SYS_ADMIN.
+// Extents of unlinked inodes that still exist on disk are reported with an empty path.
+func (f *FS) FindNew(subvol string, sinceGen uint64) ([]FileChange, error) {
+	dir, err := openDirAt(f.f, subvol)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	treeID, err := getFileRootID(dir)
+	if err != nil {
+		return nil, &os.PathError{Op: "find new", Path: dir.Name(), Err: err}
+	}
+	it := newSearchIterator(dir, btrfs_ioctl_search_key{
+		tree_id:     treeID,
+		min_type:    extentDataKey,
+		max_type:    extentDataKey,
+		max_offset:  maxUint64,
+		min_transid: sinceGen,
+		max_transid: maxUint64,
+
+		max_objectid: maxUint64,
+	})
+	var (
+		out   []FileChange
+		paths = make(map[uint64]string)
+	)
+	for it.Next() {
+		item := it.Item()
+		// search range includes other key types between EXTENT_DATA of different inodes
+		if item.Type != extentDataKey {
+			continue
+		}
+		ext, err := DecodeFileExtentItem(item.Data)
+		if err != nil {
+			return nil, err
+		} else if ext.Generation < sinceGen {
+			// leaf was updated, but this particular extent is older
+			continue
+		}
+		path, ok := paths[item.ObjectID]
+		if !ok {
+			path, err = f.InodePath(uint64(treeID), item.ObjectID)
+			if errors.Is(err, syscall.ENOENT) {
+				// inode was unlinked, but it's still open or not yet cleaned up
+				path = ""
+			} else if err != nil {
+				return nil, fmt.Errorf("cannot resolve path for inode %d: %w", item.ObjectID, err)
+			}
+			paths[item.ObjectID] = path
+		}
+		ch := FileChange{
+			Inode:  item.ObjectID,
+			Path:   path,
+			Offset: item.Offset,
+			Gen:    ext.Generation,
+			Type:   ext.Type,
+
+			Compression: ext.Compression,
+		}
+		if ext.Type == FileExtentInline {
+			ch.Len = ext.RAMBytes
+		} else {
+			ch.Len = ext.NumBytes
+		}
+		out = append(out, ch)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,60 @@
+package btrfs
+
+import "os"
+
+// containsWorkDir checks if the current working directory is on the same filesystem.
+func (f *FS) containsWorkDir() (bool, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return false, err
+	}
+	if ok, err := IsBtrfs(wd); err != nil || !ok {
+		return false, err
+	}
+	dir, err := os.Open(wd)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+	// subvolumes have different st_dev, thus compare fsid
+	cur, err := iocFsInfo(dir)
+	if err != nil {
+		return false, err
+	}
+	info, err := iocFsInfo(f.file())
+	if err != nil {
+		return false, err
+	}
+	return cur.fsid == info.fsid, nil
+}
+
+// Freeze suspends all writes to the filesystem and brings it to a consistent state.
+// Filesystem must be unfrozen with Thaw.
+//
+// Since any process accessing the frozen filesystem will block, Freeze refuses to
+// freeze the filesystem containing current working directory and returns ErrFreezeWorkDir.
+// Use FreezeForce to skip the check.
+func (f *FS) Freeze() error {
+	if ok, err := f.containsWorkDir(); err != nil {
+		return err
+	} else if ok {
+		return ErrFreezeWorkDir
+	}
+	return f.FreezeForce()
+}
+
+// FreezeForce is the same as Freeze, but skips the check for the working directory.
+func (f *FS) FreezeForce() error {
+	if err := iocFIFreeze(f.file()); err != nil {
+		return &os.PathError{Op: "freeze", Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
+
+// Thaw resumes writes to the filesystem after Freeze.
+func (f *FS) Thaw() error {
+	if err := iocFIThaw(f.file()); err != nil {
+		return &os.PathError{Op: "thaw", Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
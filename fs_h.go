@@ -0,0 +1,111 @@
+package btrfs
+
+import (
+	"github.com/dennwc/btrfs/ioctl"
+	"unsafe"
+)
+
+// Generic filesystem ioctls from linux/fs.h.
+
+type fstrim_range struct {
+	start  uint64
+	len    uint64
+	minlen uint64
+}
+
+// inode flags (FS_IOC_GETFLAGS / FS_IOC_SETFLAGS)
+const (
+	_FS_COMPR_FL     = 0x00000004 // compress file
+	_FS_SYNC_FL      = 0x00000008 // synchronous updates
+	_FS_IMMUTABLE_FL = 0x00000010 // immutable file
+	_FS_APPEND_FL    = 0x00000020 // writes to file may only append
+	_FS_NODUMP_FL    = 0x00000040 // do not dump file
+	_FS_NOATIME_FL   = 0x00000080 // do not update atime
+	_FS_NOCOMP_FL    = 0x00000400 // don't compress
+	_FS_DIRSYNC_FL   = 0x00010000 // dirsync behaviour (directories only)
+	_FS_NOCOW_FL     = 0x00800000 // do not cow file
+)
+
+var (
+	_FS_IOC_GETFLAGS = ioctl.IOR('f', 1, unsafe.Sizeof(int64(0)))
+	_FS_IOC_SETFLAGS = ioctl.IOW('f', 2, unsafe.Sizeof(int64(0)))
+)
+
+// iocGetFlags returns inode flags. Despite the ioctl definition, kernel uses int for flags.
+func iocGetFlags(f ioctlFile) (uint32, error) {
+	var flags int32
+	err := doIoctl(f, _FS_IOC_GETFLAGS, &flags)
+	return uint32(flags), err
+}
+
+func iocSetFlags(f ioctlFile, flags uint32) error {
+	v := int32(flags)
+	return doIoctl(f, _FS_IOC_SETFLAGS, &v)
+}
+
+var (
+	_FIFREEZE = ioctl.IOWR('X', 119, unsafe.Sizeof(int32(0)))
+	_FITHAW   = ioctl.IOWR('X', 120, unsafe.Sizeof(int32(0)))
+	_FITRIM   = ioctl.IOWR('X', 121, unsafe.Sizeof(fstrim_range{}))
+)
+
+func iocFIFreeze(f ioctlFile) error {
+	return rawIoctl(f, _FIFREEZE, 0)
+}
+
+func iocFIThaw(f ioctlFile) error {
+	return rawIoctl(f, _FITHAW, 0)
+}
+
+func iocFITrim(f ioctlFile, arg *fstrim_range) error {
+	return doIoctl(f, _FITRIM, arg)
+}
+
+// fiemap is followed by fm_extent_count fiemap_extent structures.
+type fiemap struct {
+	fm_start          uint64 // logical offset (inclusive) at which to start mapping (in)
+	fm_length         uint64 // logical length of mapping which userspace wants (in)
+	fm_flags          uint32 // FIEMAP_FLAG_* flags for request (in/out)
+	fm_mapped_extents uint32 // number of extents that were mapped (out)
+	fm_extent_count   uint32 // size of fm_extents array (in)
+	fm_reserved       uint32
+}
+
+type fiemap_extent struct {
+	fe_logical    uint64 // logical offset in bytes for the start of the extent from the beginning of the file
+	fe_physical   uint64 // physical offset in bytes for the start of the extent from the beginning of the disk
+	fe_length     uint64 // length in bytes for this extent
+	fe_reserved64 [2]uint64
+	fe_flags      uint32 // FIEMAP_EXTENT_* flags for this extent
+	fe_reserved   [3]uint32
+}
+
+const (
+	_FIEMAP_FLAG_SYNC  = 0x00000001 // sync file data before map
+	_FIEMAP_FLAG_XATTR = 0x00000002 // map extended attribute tree
+)
+
+var _FS_IOC_FIEMAP = ioctl.IOWR('f', 11, unsafe.Sizeof(fiemap{}))
+
+// iocFiemap maps extents of the file starting from a given offset.
+// It returns a prefix of extents that was filled by the kernel.
+func iocFiemap(f ioctlFile, start, length uint64, flags uint32, extents []fiemap_extent) ([]fiemap_extent, error) {
+	const hdr = unsafe.Sizeof(fiemap{})
+	buf := make([]byte, hdr+uintptr(len(extents))*unsafe.Sizeof(fiemap_extent{}))
+	fm := (*fiemap)(unsafe.Pointer(&buf[0]))
+	fm.fm_start = start
+	fm.fm_length = length
+	fm.fm_flags = flags
+	fm.fm_extent_count = uint32(len(extents))
+	if err := doIoctl(f, _FS_IOC_FIEMAP, buf); err != nil {
+		return nil, err
+	}
+	n := int(fm.fm_mapped_extents)
+	if n > len(extents) {
+		n = len(extents)
+	}
+	for i := 0; i < n; i++ {
+		extents[i] = *(*fiemap_extent)(unsafe.Pointer(&buf[hdr+uintptr(i)*unsafe.Sizeof(fiemap_extent{})]))
+	}
+	return extents[:n], nil
+}
@@ -0,0 +1,63 @@
+package btrfs
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// InodePath returns a path of the inode relative to the root of a subvolume with a given tree id.
+// If tree id is zero, the subvolume containing the filesystem root is used.
+//
+// Only the first hard link of the inode is resolved. Arbitrary tree ids require CAP_SYS_ADMIN.
+func (f *FS) InodePath(treeID, inode uint64) (string, error) {
+	args := btrfs_ioctl_ino_lookup_args{
+		treeid:   objectID(treeID),
+		objectid: objectID(inode),
+	}
+	if err := iocInoLookup(f.file(), &args); err != nil {
+		return "", &os.PathError{Op: "ino lookup", Path: f.f.Name(), Err: err}
+	}
+	// kernel returns directory-style path with a trailing slash
+	return strings.TrimSuffix(args.Name(), "/"), nil
+}
+
+// inoPathsBufSize is the max size of the INO_PATHS output accepted by the kernel.
+const inoPathsBufSize = 4096
+
+// dataContainerSize is the size of btrfs_data_container header.
+const dataContainerSize = int(unsafe.Sizeof(btrfs_data_container{}))
+
+// InodePaths returns all paths (hard links) of the inode in the subvolume containing
+// the filesystem root. Paths are relative to the subvolume root.
+func (f *FS) InodePaths(inode uint64) ([]string, error) {
+	buf := make([]byte, inoPathsBufSize)
+	args := btrfs_ioctl_ino_path_args{
+		inum:   inode,
+		size:   uint64(len(buf)),
+		fspath: uint64(uintptr(unsafe.Pointer(&buf[0]))),
+	}
+	err := iocInoPaths(f.file(), &args)
+	runtime.KeepAlive(buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "ino paths", Path: f.f.Name(), Err: err}
+	}
+	hdr := (*btrfs_data_container)(unsafe.Pointer(&buf[0]))
+	val := buf[dataContainerSize:]
+	paths := make([]string, 0, hdr.elem_cnt)
+	for i := 0; i < int(hdr.elem_cnt); i++ {
+		// values are offsets of C strings relative to the start of values array
+		off := int(order.Uint64(val[8*i:]))
+		if off >= len(val) {
+			break
+		}
+		s := val[off:]
+		if n := bytes.IndexByte(s, 0); n >= 0 {
+			s = s[:n]
+		}
+		paths = append(paths, string(s))
+	}
+	return paths, nil
+}
@@ -0,0 +1,33 @@
+// Package fsutil contains file system helpers shared by packages that create files,
+// like send and restore.
+package fsutil
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	atFdCwd           = -0x64
+	atSymlinkNoFollow = 0x100
+)
+
+// Lutimes sets access and modification times of a file without following symlinks.
+func Lutimes(path string, atime, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	fd := atFdCwd
+	_, _, e := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd),
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNoFollow, 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Package imagetest builds on-disk btrfs structures for tests of packages that read
+// filesystem images, like btrfsdump and restore.
+package imagetest
+
+import (
+	"encoding/binary"
+	"github.com/dennwc/btrfs"
+	"hash/crc32"
+	"sort"
+)
+
+var order = binary.LittleEndian
+
+const (
+	csumSize   = 32  // size of the checksum field at the start of blocks and superblocks
+	headerSize = 101 // size of the tree block header
+	itemSize   = 25  // size of the leaf item header
+)
+
+// Item is a leaf item.
+type Item struct {
+	Key  btrfs.DiskKey
+	Data []byte
+}
+
+// PutKey encodes a disk key.
+func PutKey(p []byte, k btrfs.DiskKey) {
+	order.PutUint64(p[0:], k.ObjectID)
+	p[8] = k.Type
+	order.PutUint64(p[9:], k.Offset)
+}
+
+// PutCsum sets the crc32c checksum of a tree block or a superblock.
+func PutCsum(p []byte) {
+	order.PutUint32(p[0:], crc32.Checksum(p[csumSize:], crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// Leaf encodes a leaf of a given size at a logical address. Items are sorted by key.
+func Leaf(size int, fsid btrfs.FSID, bytenr, owner uint64, items []Item) []byte {
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i].Key, items[j].Key
+		if a.ObjectID != b.ObjectID {
+			return a.ObjectID < b.ObjectID
+		} else if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Offset < b.Offset
+	})
+	p := make([]byte, size)
+	copy(p[32:], fsid[:])
+	order.PutUint64(p[48:], bytenr)
+	order.PutUint64(p[56:], 1|1<<56) // written, mixed backref revision
+	order.PutUint64(p[80:], 7)
+	order.PutUint64(p[88:], owner)
+	order.PutUint32(p[96:], uint32(len(items)))
+	end := size - headerSize
+	for i, it := range items {
+		end -= len(it.Data)
+		copy(p[headerSize+end:], it.Data)
+		b := p[headerSize+i*itemSize:]
+		PutKey(b, it.Key)
+		order.PutUint32(b[17:], uint32(end))
+		order.PutUint32(b[21:], uint32(len(it.Data)))
+	}
+	PutCsum(p)
+	return p
+}
@@ -58,14 +58,42 @@ func IOWR(typ, nr, size uintptr) uintptr {
 }
 
 func Ioctl(f *os.File, ioc uintptr, addr uintptr) error {
-	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioc, addr)
+	_, err := IoctlRet(f, ioc, addr)
+	return err
+}
+
+// IoctlRet is the same as Ioctl, but also returns a non-negative result of the call.
+//
+// The call holds a reference to the file descriptor, so closing f concurrently
+// will not release the descriptor until the call returns.
+func IoctlRet(f *os.File, ioc uintptr, addr uintptr) (uintptr, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		r uintptr
+		e syscall.Errno
+	)
+	if err = rc.Control(func(fd uintptr) {
+		r, _, e = syscall.Syscall(syscall.SYS_IOCTL, fd, ioc, addr)
+	}); err != nil {
+		// Control only fails if the file is closed.
+		return 0, &os.PathError{Op: "ioctl", Path: f.Name(), Err: os.ErrClosed}
+	}
 	if e != 0 {
-		return e
+		return 0, e
 	}
-	return nil
+	return r, nil
 }
 
 func Do(f *os.File, ioc uintptr, arg interface{}) error {
+	_, err := DoRet(f, ioc, arg)
+	return err
+}
+
+// DoRet is the same as Do, but also returns a non-negative result of the call.
+func DoRet(f *os.File, ioc uintptr, arg interface{}) (uintptr, error) {
 	var addr uintptr
 	if arg != nil {
 		v := reflect.ValueOf(arg)
@@ -75,8 +103,8 @@ func Do(f *os.File, ioc uintptr, arg interface{}) error {
 		case reflect.Slice:
 			addr = v.Index(0).UnsafeAddr()
 		default:
-			return fmt.Errorf("expected ptr or slice, got %T")
+			return 0, fmt.Errorf("expected ptr or slice, got %T", arg)
 		}
 	}
-	return Ioctl(f, ioc, addr)
+	return IoctlRet(f, ioc, addr)
 }
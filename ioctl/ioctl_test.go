@@ -1,6 +1,8 @@
 package ioctl
 
 import (
+	"errors"
+	"os"
 	"testing"
 )
 
@@ -19,3 +21,14 @@ func TestIOC(t *testing.T) {
 		}
 	}
 }
+
+func TestIoctlClosed(t *testing.T) {
+	f, err := os.Open(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err = IoctlRet(f, IO(0x94, 8), 0); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package btrfs
+
+import (
+	"fmt"
+	"github.com/dennwc/btrfs/ioctl"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// IoctlDoer performs ioctl requests on behalf of FS. The default implementation
+// calls the kernel; FakeIoctl can be used instead to unit-test code without root
+// privileges and a real btrfs mount.
+type IoctlDoer interface {
+	// Ioctl performs the request req on the file f. Arg is either a pointer to the argument
+	// structure, a slice, nil, or an uintptr for requests that take an integer argument.
+	Ioctl(f *os.File, req uintptr, arg interface{}) (uintptr, error)
+}
+
+// KernelIoctl is an IoctlDoer that calls the kernel.
+type KernelIoctl struct{}
+
+func (KernelIoctl) Ioctl(f *os.File, req uintptr, arg interface{}) (uintptr, error) {
+	if v, ok := arg.(uintptr); ok {
+		return ioctl.IoctlRet(f, req, v)
+	}
+	return ioctl.DoRet(f, req, arg)
+}
+
+// ioctlFile is a file that ioctl requests are sent to: either an *os.File, for which the kernel
+// is called, or a doerFile that sends requests to a custom IoctlDoer.
+type ioctlFile interface {
+	Name() string
+}
+
+// doerFile is a file with a custom IoctlDoer.
+type doerFile struct {
+	*os.File
+	d IoctlDoer
+}
+
+// ioctlDoerOf returns the underlying file and the IoctlDoer of an ioctlFile.
+func ioctlDoerOf(f ioctlFile) (*os.File, IoctlDoer) {
+	switch f := f.(type) {
+	case *os.File:
+		return f, KernelIoctl{}
+	case doerFile:
+		return f.File, f.d
+	default:
+		panic(fmt.Errorf("unexpected ioctl file: %T", f))
+	}
+}
+
+// NewFSWithIoctl creates an FS for an open directory that sends all ioctl requests
+// to d instead of the kernel. The directory does not need to be on btrfs.
+//
+// Only operations on the FS itself are redirected; functions that accept paths
+// and open files on their own always call the kernel.
+func NewFSWithIoctl(f *os.File, d IoctlDoer) *FS {
+	return &FS{f: f, d: d}
+}
+
+// IoctlName returns the name of a known ioctl request, as defined in kernel headers.
+func IoctlName(req uintptr) string {
+	if s, ok := ioctlNames[req]; ok {
+		return s
+	}
+	return fmt.Sprintf("ioctl(0x%x)", req)
+}
+
+var ioctlNames = map[uintptr]string{
+	_BTRFS_IOC_SNAP_CREATE:            "BTRFS_IOC_SNAP_CREATE",
+	_BTRFS_IOC_DEFRAG:                 "BTRFS_IOC_DEFRAG",
+	_BTRFS_IOC_RESIZE:                 "BTRFS_IOC_RESIZE",
+	_BTRFS_IOC_SCAN_DEV:               "BTRFS_IOC_SCAN_DEV",
+	_BTRFS_IOC_TRANS_START:            "BTRFS_IOC_TRANS_START",
+	_BTRFS_IOC_TRANS_END:              "BTRFS_IOC_TRANS_END",
+	_BTRFS_IOC_SYNC:                   "BTRFS_IOC_SYNC",
+	_BTRFS_IOC_CLONE:                  "BTRFS_IOC_CLONE",
+	_BTRFS_IOC_ADD_DEV:                "BTRFS_IOC_ADD_DEV",
+	_BTRFS_IOC_RM_DEV:                 "BTRFS_IOC_RM_DEV",
+	_BTRFS_IOC_BALANCE:                "BTRFS_IOC_BALANCE",
+	_BTRFS_IOC_CLONE_RANGE:            "BTRFS_IOC_CLONE_RANGE",
+	_BTRFS_IOC_SUBVOL_CREATE:          "BTRFS_IOC_SUBVOL_CREATE",
+	_BTRFS_IOC_SNAP_DESTROY:           "BTRFS_IOC_SNAP_DESTROY",
+	_BTRFS_IOC_DEFRAG_RANGE:           "BTRFS_IOC_DEFRAG_RANGE",
+	_BTRFS_IOC_TREE_SEARCH:            "BTRFS_IOC_TREE_SEARCH",
+	_BTRFS_IOC_TREE_SEARCH_V2:         "BTRFS_IOC_TREE_SEARCH_V2",
+	_BTRFS_IOC_INO_LOOKUP:             "BTRFS_IOC_INO_LOOKUP",
+	_BTRFS_IOC_DEFAULT_SUBVOL:         "BTRFS_IOC_DEFAULT_SUBVOL",
+	_BTRFS_IOC_SPACE_INFO:             "BTRFS_IOC_SPACE_INFO",
+	_BTRFS_IOC_START_SYNC:             "BTRFS_IOC_START_SYNC",
+	_BTRFS_IOC_WAIT_SYNC:              "BTRFS_IOC_WAIT_SYNC",
+	_BTRFS_IOC_SNAP_CREATE_V2:         "BTRFS_IOC_SNAP_CREATE_V2",
+	_BTRFS_IOC_SUBVOL_CREATE_V2:       "BTRFS_IOC_SUBVOL_CREATE_V2",
+	_BTRFS_IOC_SUBVOL_GETFLAGS:        "BTRFS_IOC_SUBVOL_GETFLAGS",
+	_BTRFS_IOC_SUBVOL_SETFLAGS:        "BTRFS_IOC_SUBVOL_SETFLAGS",
+	_BTRFS_IOC_SCRUB:                  "BTRFS_IOC_SCRUB",
+	_BTRFS_IOC_SCRUB_CANCEL:           "BTRFS_IOC_SCRUB_CANCEL",
+	_BTRFS_IOC_SCRUB_PROGRESS:         "BTRFS_IOC_SCRUB_PROGRESS",
+	_BTRFS_IOC_DEV_INFO:               "BTRFS_IOC_DEV_INFO",
+	_BTRFS_IOC_FS_INFO:                "BTRFS_IOC_FS_INFO",
+	_BTRFS_IOC_BALANCE_V2:             "BTRFS_IOC_BALANCE_V2",
+	_BTRFS_IOC_BALANCE_CTL:            "BTRFS_IOC_BALANCE_CTL",
+	_BTRFS_IOC_BALANCE_PROGRESS:       "BTRFS_IOC_BALANCE_PROGRESS",
+	_BTRFS_IOC_INO_PATHS:              "BTRFS_IOC_INO_PATHS",
+	_BTRFS_IOC_LOGICAL_INO:            "BTRFS_IOC_LOGICAL_INO",
+	_BTRFS_IOC_SET_RECEIVED_SUBVOL:    "BTRFS_IOC_SET_RECEIVED_SUBVOL",
+	_BTRFS_IOC_SEND:                   "BTRFS_IOC_SEND",
+	_BTRFS_IOC_DEVICES_READY:          "BTRFS_IOC_DEVICES_READY",
+	_BTRFS_IOC_QUOTA_CTL:              "BTRFS_IOC_QUOTA_CTL",
+	_BTRFS_IOC_QGROUP_ASSIGN:          "BTRFS_IOC_QGROUP_ASSIGN",
+	_BTRFS_IOC_QGROUP_CREATE:          "BTRFS_IOC_QGROUP_CREATE",
+	_BTRFS_IOC_QGROUP_LIMIT:           "BTRFS_IOC_QGROUP_LIMIT",
+	_BTRFS_IOC_QUOTA_RESCAN:           "BTRFS_IOC_QUOTA_RESCAN",
+	_BTRFS_IOC_QUOTA_RESCAN_STATUS:    "BTRFS_IOC_QUOTA_RESCAN_STATUS",
+	_BTRFS_IOC_QUOTA_RESCAN_WAIT:      "BTRFS_IOC_QUOTA_RESCAN_WAIT",
+	_BTRFS_IOC_GET_FSLABEL:            "BTRFS_IOC_GET_FSLABEL",
+	_BTRFS_IOC_SET_FSLABEL:            "BTRFS_IOC_SET_FSLABEL",
+	_BTRFS_IOC_GET_DEV_STATS:          "BTRFS_IOC_GET_DEV_STATS",
+	_BTRFS_IOC_DEV_REPLACE:            "BTRFS_IOC_DEV_REPLACE",
+	_BTRFS_IOC_FILE_EXTENT_SAME:       "BTRFS_IOC_FILE_EXTENT_SAME",
+	_BTRFS_IOC_GET_FEATURES:           "BTRFS_IOC_GET_FEATURES",
+	_BTRFS_IOC_SET_FEATURES:           "BTRFS_IOC_SET_FEATURES",
+	_BTRFS_IOC_GET_SUPPORTED_FEATURES: "BTRFS_IOC_GET_SUPPORTED_FEATURES",
+	_BTRFS_IOC_RM_DEV_V2:              "BTRFS_IOC_RM_DEV_V2",
+	_BTRFS_IOC_LOGICAL_INO_V2:         "BTRFS_IOC_LOGICAL_INO_V2",
+	_BTRFS_IOC_GET_SUBVOL_INFO:        "BTRFS_IOC_GET_SUBVOL_INFO",
+	_BTRFS_IOC_GET_SUBVOL_ROOTREF:     "BTRFS_IOC_GET_SUBVOL_ROOTREF",
+	_BTRFS_IOC_INO_LOOKUP_USER:        "BTRFS_IOC_INO_LOOKUP_USER",
+	_BTRFS_IOC_SNAP_DESTROY_V2:        "BTRFS_IOC_SNAP_DESTROY_V2",
+	_FS_IOC_GETFLAGS:                  "FS_IOC_GETFLAGS",
+	_FS_IOC_SETFLAGS:                  "FS_IOC_SETFLAGS",
+	_FIFREEZE:                         "FIFREEZE",
+	_FITHAW:                           "FITHAW",
+	_FITRIM:                           "FITRIM",
+	_FS_IOC_FIEMAP:                    "FS_IOC_FIEMAP",
+	_BLKREPORTZONE:                    "BLKREPORTZONE",
+	_BLKGETZONESZ:                     "BLKGETZONESZ",
+	_BLKGETNRZONES:                    "BLKGETNRZONES",
+}
+
+// IoctlCall is an ioctl request recorded by FakeIoctl.
+type IoctlCall struct {
+	File string      // name of the file
+	Req  uintptr     // request code
+	Name string      // request name, see IoctlName
+	Arg  interface{} // request argument
+}
+
+// IoctlResponse is a scripted response to an ioctl request.
+type IoctlResponse struct {
+	Ret uintptr
+	Err error
+	// Fill is called with the request argument before returning the response.
+	// It can be used to set output fields of the argument.
+	Fill func(arg interface{})
+}
+
+// FakeIoctl is an IoctlDoer that records all requests and returns scripted responses.
+// Requests without a response fail with ENOTTY, as on filesystems other than btrfs.
+// It is safe for concurrent use.
+type FakeIoctl struct {
+	mu    sync.Mutex
+	calls []IoctlCall
+	resp  map[string][]IoctlResponse
+}
+
+// Respond adds responses for requests with a given name (e.g. "BTRFS_IOC_SYNC").
+// Responses are returned in order; the last one is repeated for all subsequent requests.
+func (f *FakeIoctl) Respond(name string, resp ...IoctlResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.resp == nil {
+		f.resp = make(map[string][]IoctlResponse)
+	}
+	f.resp[name] = append(f.resp[name], resp...)
+}
+
+// Calls returns all recorded requests.
+func (f *FakeIoctl) Calls() []IoctlCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]IoctlCall{}, f.calls...)
+}
+
+func (f *FakeIoctl) Ioctl(file *os.File, req uintptr, arg interface{}) (uintptr, error) {
+	name := IoctlName(req)
+	f.mu.Lock()
+	f.calls = append(f.calls, IoctlCall{File: file.Name(), Req: req, Name: name, Arg: arg})
+	list := f.resp[name]
+	if len(list) > 1 {
+		f.resp[name] = list[1:]
+	}
+	f.mu.Unlock()
+	if len(list) == 0 {
+		return 0, syscall.ENOTTY
+	}
+	r := list[0]
+	if r.Fill != nil {
+		r.Fill(arg)
+	}
+	return r.Ret, r.Err
+}
@@ -0,0 +1,381 @@
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestFakeIoctl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	fs := NewFSWithIoctl(d, fake)
+	defer fs.Close()
+
+	fake.Respond("BTRFS_IOC_FS_INFO", IoctlResponse{Fill: func(arg interface{}) {
+		a := arg.(*btrfs_ioctl_fs_info_args)
+		a.num_devices = 2
+		a.nodesize = 16384
+	}})
+	info, err := fs.Info()
+	if err != nil {
+		t.Fatal(err)
+	} else if info.NumDevices != 2 || info.NodeSize != 16384 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+
+	fake.Respond("BTRFS_IOC_START_SYNC", IoctlResponse{Err: syscall.EBUSY}, IoctlResponse{})
+	fake.Respond("BTRFS_IOC_WAIT_SYNC", IoctlResponse{})
+	if err = fs.Sync(); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected busy error, got: %v", err)
+	}
+	if err = fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.GetFeatures(); err != syscall.ENOTTY {
+		t.Fatalf("expected ENOTTY, got: %v", err)
+	}
+
+	var names []string
+	for _, c := range fake.Calls() {
+		if c.File != dir {
+			t.Errorf("unexpected file: %q", c.File)
+		}
+		names = append(names, c.Name)
+	}
+	exp := []string{
+		"BTRFS_IOC_FS_INFO",
+		"BTRFS_IOC_START_SYNC",
+		"BTRFS_IOC_START_SYNC", "BTRFS_IOC_WAIT_SYNC",
+		"BTRFS_IOC_GET_FEATURES",
+	}
+	if !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected calls: %q", names)
+	}
+}
+
+func TestFakeIoctlPerFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// FS instances that share the file keep their own doers
+	fake1, fake2 := &FakeIoctl{}, &FakeIoctl{}
+	fs1, fs2 := NewFSWithIoctl(d, fake1), NewFSWithIoctl(d, fake2)
+	fake2.Respond("BTRFS_IOC_FS_INFO", IoctlResponse{})
+	if _, err = fs1.Info(); err != syscall.ENOTTY {
+		t.Fatalf("expected ENOTTY, got: %v", err)
+	} else if _, err = fs2.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if n1, n2 := len(fake1.Calls()), len(fake2.Calls()); n1 != 1 || n2 != 1 {
+		t.Fatalf("unexpected number of calls: %d, %d", n1, n2)
+	}
+}
+
+func TestFSExclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	fs := NewFSWithIoctl(d, fake)
+	defer fs.Close()
+
+	var running, max int32
+	excl := IoctlResponse{Fill: func(arg interface{}) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}}
+	fake.Respond("BTRFS_IOC_BALANCE_V2", excl)
+	fake.Respond("BTRFS_IOC_RM_DEV_V2", excl)
+	fake.Respond("BTRFS_IOC_RESIZE", excl)
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 30)
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, err := fs.BalanceStart(BalanceData)
+			errc <- err
+		}()
+		go func() {
+			defer wg.Done()
+			errc <- fs.RemoveDeviceByID(2)
+		}()
+		go func() {
+			defer wg.Done()
+			errc <- fs.ResizeToMax()
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if max != 1 {
+		t.Fatalf("exclusive operations were running in parallel: %d", max)
+	}
+}
+
+func TestBalanceContextWaitingForLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	fs := NewFSWithIoctl(d, fake)
+	defer fs.Close()
+
+	// another exclusive operation is running
+	fs.excl.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := fs.BalanceContext(ctx, BalanceArgs{})
+		errc <- err
+	}()
+	cancel()
+	// give the cancellation loop a chance to run
+	time.Sleep(300 * time.Millisecond)
+	fs.excl.Unlock()
+	if err = <-errc; err != context.Canceled {
+		t.Fatalf("expected cancellation, got: %v", err)
+	}
+	for _, c := range fake.Calls() {
+		t.Errorf("unexpected call: %s", c.Name)
+	}
+}
+
+func TestSyncTransID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	fs := NewFSWithIoctl(d, fake)
+	defer fs.Close()
+
+	fake.Respond("BTRFS_IOC_START_SYNC", IoctlResponse{Fill: func(arg interface{}) {
+		*arg.(*uint64) = 42
+	}})
+	var waited []uint64
+	fake.Respond("BTRFS_IOC_WAIT_SYNC", IoctlResponse{Fill: func(arg interface{}) {
+		waited = append(waited, *arg.(*uint64))
+	}})
+	transid, err := fs.StartSync()
+	if err != nil {
+		t.Fatal(err)
+	} else if transid != 42 {
+		t.Fatalf("unexpected transid: %d", transid)
+	}
+	if err = fs.WaitSync(transid); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(waited, []uint64{42, 42}) {
+		t.Fatalf("unexpected waits: %v", waited)
+	}
+}
+
+func TestSubvolumeSyncContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	fs := NewFSWithIoctl(d, fake)
+	defer fs.Close()
+
+	exists := true // whether the root item of the subvolume is found
+	fake.Respond("BTRFS_IOC_TREE_SEARCH", IoctlResponse{Fill: func(arg interface{}) {
+		// the requested single item is returned unless it's cleared here
+		if !exists {
+			arg.(*btrfs_ioctl_search_args).key.nr_items = 0
+		}
+	}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = fs.SubvolumeSyncContext(ctx, 256); err != context.DeadlineExceeded {
+		t.Fatalf("expected a timeout, got: %v", err)
+	} else if dt := time.Since(start); dt >= subvolSyncInterval {
+		t.Fatalf("cancellation took too long: %v", dt)
+	}
+	calls := len(fake.Calls())
+
+	exists = false
+	if err = fs.SubvolumeSyncContext(context.Background(), 256); err != nil {
+		t.Fatal(err)
+	} else if n := len(fake.Calls()) - calls; n != 1 {
+		t.Fatalf("unexpected number of searches: %d", n)
+	}
+}
+
+func TestDedupeRangeBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	fake := &FakeIoctl{}
+
+	const (
+		ntargets = 2*maxDedupeTargets + 10
+		length   = 2*maxDedupeLen + 4096
+	)
+	type call struct {
+		off, length uint64
+		n           int
+	}
+	var calls []call
+	fake.Respond("BTRFS_IOC_FILE_EXTENT_SAME", IoctlResponse{Fill: func(arg interface{}) {
+		a := arg.(*btrfs_ioctl_same_args)
+		calls = append(calls, call{off: a.logical_offset, length: a.length, n: int(a.dest_count)})
+		for i := 0; i < int(a.dest_count); i++ {
+			info := (*btrfs_ioctl_same_extent_info)(unsafe.Pointer(uintptr(unsafe.Pointer(a)) + sameArgsSize + uintptr(i)*sameInfoSize))
+			// the first target differs from the source
+			if info.logical_offset == 0 {
+				info.status = _BTRFS_SAME_DATA_DIFFERS
+				continue
+			}
+			info.bytes_deduped = a.length
+		}
+	}})
+	targets := make([]DedupeTarget, ntargets)
+	for i := range targets {
+		targets[i] = DedupeTarget{File: d, Offset: int64(i) * length}
+	}
+	res, err := dedupeRangeAll(doerFile{File: d, d: fake}, 100, length, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range res {
+		if i == 0 {
+			if !r.DataDiffers || r.Bytes != 0 {
+				t.Fatalf("unexpected result for the first target: %+v", r)
+			}
+		} else if r.DataDiffers || r.Err != nil || r.Bytes != length {
+			t.Fatalf("unexpected result for target %d: %+v", i, r)
+		}
+	}
+	// each batch of targets is split into three calls by length
+	var exp []call
+	for i, n := range []int{maxDedupeTargets, maxDedupeTargets, 10} {
+		rest := n
+		if i == 0 {
+			// the first target is skipped after the data differs
+			rest--
+		}
+		exp = append(exp,
+			call{off: 100, length: maxDedupeLen, n: n},
+			call{off: 100 + maxDedupeLen, length: maxDedupeLen, n: rest},
+			call{off: 100 + 2*maxDedupeLen, length: 4096, n: rest},
+		)
+	}
+	if !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("unexpected calls:\n%v\nvs\n%v", calls, exp)
+	}
+}
+
+func TestDedupeRangePartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_fake_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := os.Create(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	const size = maxDedupeLen + 4096
+	if err = src.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeIoctl{}
+	var lengths []uint64
+	fill := func(arg interface{}) {
+		a := arg.(*btrfs_ioctl_same_args)
+		lengths = append(lengths, a.length)
+		info := (*btrfs_ioctl_same_extent_info)(unsafe.Pointer(uintptr(unsafe.Pointer(a)) + sameArgsSize))
+		info.bytes_deduped = a.length
+	}
+	fake.Respond("BTRFS_IOC_FILE_EXTENT_SAME",
+		IoctlResponse{Fill: fill},
+		IoctlResponse{Err: syscall.EIO},
+	)
+	targets := []DedupeTarget{{File: src, Offset: size}}
+	// zero length is resolved to the end of the source file
+	res, err := dedupeRangeAll(doerFile{File: src, d: fake}, 0, 0, targets)
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected an error, got: %v", err)
+	} else if len(res) != 1 || res[0].Bytes != maxDedupeLen {
+		t.Fatalf("expected results of the first call, got: %+v", res)
+	} else if !reflect.DeepEqual(lengths, []uint64{maxDedupeLen}) {
+		t.Fatalf("unexpected calls: %v", lengths)
+	}
+	if n := len(fake.Calls()); n != 2 {
+		t.Fatalf("unexpected number of calls: %d", n)
+	}
+}
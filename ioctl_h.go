@@ -1,12 +1,16 @@
 package btrfs
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"github.com/dennwc/btrfs/ioctl"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -48,6 +52,18 @@ func (id UUID) String() string {
 	return string(buf)
 }
 
+// ParseUUID parses a UUID in the canonical format (e.g. "0b2e8e95-7a1e-4b41-9d7b-5d3c1f0a2b3c").
+// Dashes are optional.
+func ParseUUID(s string) (UUID, error) {
+	var id UUID
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != UUIDSize {
+		return id, fmt.Errorf("invalid uuid: %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
 type FSID [FSIDSize]byte
 
 func (id FSID) String() string { return hex.EncodeToString(id[:]) }
@@ -65,6 +81,16 @@ func (arg *btrfs_ioctl_vol_args) SetName(name string) {
 	arg.name[n] = 0
 }
 
+// flags for btrfs_qgroup_limit
+const (
+	_BTRFS_QGROUP_LIMIT_MAX_RFER  = 1 << 0
+	_BTRFS_QGROUP_LIMIT_MAX_EXCL  = 1 << 1
+	_BTRFS_QGROUP_LIMIT_RSV_RFER  = 1 << 2
+	_BTRFS_QGROUP_LIMIT_RSV_EXCL  = 1 << 3
+	_BTRFS_QGROUP_LIMIT_RFER_CMPR = 1 << 4
+	_BTRFS_QGROUP_LIMIT_EXCL_CMPR = 1 << 5
+)
+
 type btrfs_qgroup_limit struct {
 	flags          uint64
 	max_referenced uint64
@@ -126,6 +152,8 @@ const (
 	subvolCreateAsync   = SubvolFlags(1 << 0)
 	SubvolReadOnly      = SubvolFlags(1 << 1)
 	subvolQGroupInherit = SubvolFlags(1 << 2)
+	deviceSpecByID      = SubvolFlags(1 << 3)
+	subvolSpecByID      = SubvolFlags(1 << 4)
 )
 
 type btrfs_ioctl_vol_args_v2 struct {
@@ -137,6 +165,21 @@ type btrfs_ioctl_vol_args_v2 struct {
 	name   [subvolNameMax + 1]byte
 }
 
+func (arg *btrfs_ioctl_vol_args_v2) SetName(name string) {
+	n := copy(arg.name[:], name)
+	arg.name[n] = 0
+}
+
+// SetDevID stores device id in the name field (union in C).
+func (arg *btrfs_ioctl_vol_args_v2) SetDevID(id uint64) {
+	order.PutUint64(arg.name[:8], id)
+}
+
+// SetSubvolID stores subvolume id in the name field (union in C).
+func (arg *btrfs_ioctl_vol_args_v2) SetSubvolID(id uint64) {
+	order.PutUint64(arg.name[:8], id)
+}
+
 // structure to report errors and progress to userspace, either as a
 // result of a finished scrub, a canceled scrub or a progress inquiry
 type btrfs_scrub_progress struct {
@@ -162,6 +205,8 @@ type btrfs_scrub_progress struct {
 	unverified_errors uint64
 }
 
+const _BTRFS_SCRUB_READONLY = 1
+
 type btrfs_ioctl_scrub_args struct {
 	devid    uint64               // in
 	start    uint64               // in
@@ -205,6 +250,19 @@ type btrfs_ioctl_dev_replace_status_params struct {
 	num_uncorrectable_read_errors uint64          // out
 }
 
+const (
+	_BTRFS_IOCTL_DEV_REPLACE_CMD_START  = 0
+	_BTRFS_IOCTL_DEV_REPLACE_CMD_STATUS = 1
+	_BTRFS_IOCTL_DEV_REPLACE_CMD_CANCEL = 2
+)
+
+const (
+	_BTRFS_IOCTL_DEV_REPLACE_RESULT_NO_ERROR         = 0
+	_BTRFS_IOCTL_DEV_REPLACE_RESULT_NOT_STARTED      = 1
+	_BTRFS_IOCTL_DEV_REPLACE_RESULT_ALREADY_STARTED  = 2
+	_BTRFS_IOCTL_DEV_REPLACE_RESULT_SCRUB_INPROGRESS = 3
+)
+
 type btrfs_ioctl_dev_replace_args_u1 struct {
 	cmd    uint64                               // in
 	result uint64                               // out
@@ -229,18 +287,40 @@ type btrfs_ioctl_dev_info_args struct {
 	path        [devicePathNameMax]byte // out
 }
 
-type btrfs_ioctl_fs_info_args struct {
-	max_id          uint64          // out
-	num_devices     uint64          // out
-	fsid            FSID            // out
-	nodesize        uint32          // out
-	sectorsize      uint32          // out
-	clone_alignment uint32          // out
-	_               [122*8 + 4]byte // pad to 1k
+// Path returns the device path.
+func (arg *btrfs_ioctl_dev_info_args) Path() string {
+	n := bytes.IndexByte(arg.path[:], 0)
+	if n < 0 {
+		n = len(arg.path)
+	}
+	return string(arg.path[:n])
 }
 
+type btrfs_ioctl_fs_info_args struct {
+	max_id          uint64    // out
+	num_devices     uint64    // out
+	fsid            FSID      // out
+	nodesize        uint32    // out
+	sectorsize      uint32    // out
+	clone_alignment uint32    // out
+	csum_type       uint16    // out
+	csum_size       uint16    // out
+	flags           uint64    // in/out, see _BTRFS_FS_INFO_FLAG_*
+	generation      uint64    // out
+	metadata_uuid   FSID      // out
+	_               [944]byte // pad to 1k
+}
+
+// Flags for btrfs_ioctl_fs_info_args, requesting additional fields.
+// Kernels that don't know them leave the fields zeroed.
+const (
+	_BTRFS_FS_INFO_FLAG_CSUM_INFO     = 1 << 0
+	_BTRFS_FS_INFO_FLAG_GENERATION    = 1 << 1
+	_BTRFS_FS_INFO_FLAG_METADATA_UUID = 1 << 2
+)
+
 type btrfs_ioctl_feature_flags struct {
-	compat_flags    FeatureFlags
+	compat_flags    CompatFeatures
 	compat_ro_flags FeatureFlags
 	incompat_flags  IncompatFeatures
 }
@@ -253,11 +333,37 @@ func (u argRange) asN() uint64 {
 func (u argRange) asMinMax() (min, max uint32) {
 	return order.Uint32(u[:4]), order.Uint32(u[4:])
 }
+func (u *argRange) setN(v uint64) {
+	order.PutUint64(u[:], v)
+}
+func (u *argRange) setMinMax(min, max uint32) {
+	order.PutUint32(u[:4], min)
+	order.PutUint32(u[4:], max)
+}
 
 // balance control ioctl modes
-//#define BTRFS_BALANCE_CTL_PAUSE		1
-//#define BTRFS_BALANCE_CTL_CANCEL	2
-//#define BTRFS_BALANCE_CTL_RESUME	3
+const (
+	_BTRFS_BALANCE_CTL_PAUSE  = 1
+	_BTRFS_BALANCE_CTL_CANCEL = 2
+	_BTRFS_BALANCE_CTL_RESUME = 3
+)
+
+// balance filter flags (btrfs_balance_args.flags)
+const (
+	_BTRFS_BALANCE_ARGS_PROFILES      = (1 << 0)
+	_BTRFS_BALANCE_ARGS_USAGE         = (1 << 1)
+	_BTRFS_BALANCE_ARGS_DEVID         = (1 << 2)
+	_BTRFS_BALANCE_ARGS_DRANGE        = (1 << 3)
+	_BTRFS_BALANCE_ARGS_VRANGE        = (1 << 4)
+	_BTRFS_BALANCE_ARGS_LIMIT         = (1 << 5)
+	_BTRFS_BALANCE_ARGS_LIMIT_RANGE   = (1 << 6)
+	_BTRFS_BALANCE_ARGS_STRIPES_RANGE = (1 << 7)
+	_BTRFS_BALANCE_ARGS_USAGE_RANGE   = (1 << 10)
+
+	// profile changing flags
+	_BTRFS_BALANCE_ARGS_CONVERT = (1 << 8)
+	_BTRFS_BALANCE_ARGS_SOFT    = (1 << 9)
+)
 
 // this is packed, because it should be exactly the same as its disk
 // byte order counterpart (struct btrfs_disk_balance_args)
@@ -459,11 +565,16 @@ type btrfs_ioctl_ino_path_args struct {
 type btrfs_ioctl_logical_ino_args struct {
 	logical uint64 // in
 	size    uint64 // in
-	_       [32]byte
+	_       [24]byte
+	flags   uint64 // in, v2 only
 	// struct btrfs_data_container	*inodes;	out
 	inodes uint64
 }
 
+// _BTRFS_LOGICAL_INO_ARGS_IGNORE_OFFSET returns all references to the extent,
+// not only the ones that point to the requested logical address.
+const _BTRFS_LOGICAL_INO_ARGS_IGNORE_OFFSET = 1 << 0
+
 // disk I/O failure stats
 const (
 	_BTRFS_DEV_STAT_WRITE_ERRS = iota // EIO or EREMOTEIO from lower layers
@@ -525,6 +636,10 @@ type btrfs_ioctl_timespec struct {
 	nsec uint32
 }
 
+func (t btrfs_ioctl_timespec) Time() time.Time {
+	return time.Unix(int64(t.sec), int64(t.nsec))
+}
+
 type btrfs_ioctl_received_subvol_args struct {
 	uuid     UUID                 // in
 	stransid uint64               // in
@@ -535,6 +650,72 @@ type btrfs_ioctl_received_subvol_args struct {
 	_        [16]uint64           // in
 }
 
+// btrfs_ioctl_get_subvol_info_args is filled by GET_SUBVOL_INFO for the subvolume
+// containing the file. It doesn't require CAP_SYS_ADMIN.
+type btrfs_ioctl_get_subvol_info_args struct {
+	treeid        objectID  // id of the subvolume
+	name          [256]byte // name of this subvolume, empty for the top-level subvolume
+	parent_id     objectID  // id of the parent subvolume, zero for the top-level subvolume
+	dirid         objectID  // inode number of the directory containing this subvolume
+	generation    uint64    // latest transid of this subvolume
+	flags         uint64    // flags of this subvolume
+	uuid          UUID      // uuid of this subvolume
+	parent_uuid   UUID      // uuid of the subvolume of which this subvolume is a snapshot
+	received_uuid UUID      // uuid of the subvolume from which this subvolume was received
+	ctransid      uint64    // transid when an inode was last changed
+	otransid      uint64    // transid when this subvolume was created
+	stransid      uint64    // transid when send last happened
+	rtransid      uint64    // transid when receive last happened
+	ctime         btrfs_ioctl_timespec
+	otime         btrfs_ioctl_timespec
+	stime         btrfs_ioctl_timespec
+	rtime         btrfs_ioctl_timespec
+	_             [8]uint64
+}
+
+// _BTRFS_MAX_ROOTREF_BUFFER_NUM is the max number of subvolumes returned by a single GET_SUBVOL_ROOTREF call.
+const _BTRFS_MAX_ROOTREF_BUFFER_NUM = 255
+
+// btrfs_ioctl_get_subvol_rootref_args lists subvolumes directly under the subvolume
+// containing the file. It doesn't require CAP_SYS_ADMIN.
+type btrfs_ioctl_get_subvol_rootref_args struct {
+	min_treeid objectID // in/out; id to start from, set to the next id if EOVERFLOW is returned
+	rootref    [_BTRFS_MAX_ROOTREF_BUFFER_NUM]struct {
+		treeid objectID // id of the subvolume
+		dirid  objectID // inode number of the directory containing the subvolume
+	} // out
+	num_items uint8 // out
+	_         [7]uint8
+}
+
+const (
+	_BTRFS_VOL_NAME_MAX             = 255
+	_BTRFS_INO_LOOKUP_USER_PATH_MAX = 4080 - _BTRFS_VOL_NAME_MAX - 1
+)
+
+// btrfs_ioctl_ino_lookup_user_args resolves a name and a path of the subvolume relative
+// to the subvolume containing the file. It doesn't require CAP_SYS_ADMIN,
+// but the user must have access to all directories on the path.
+type btrfs_ioctl_ino_lookup_user_args struct {
+	dirid  objectID                              // in; inode number of the directory containing the subvolume
+	treeid objectID                              // in; id of the subvolume
+	name   [_BTRFS_VOL_NAME_MAX + 1]byte         // out; name of the subvolume
+	path   [_BTRFS_INO_LOOKUP_USER_PATH_MAX]byte // out; path to the directory, with a trailing slash
+}
+
+func (arg *btrfs_ioctl_ino_lookup_user_args) Path() string {
+	n := bytes.IndexByte(arg.path[:], 0)
+	if n < 0 {
+		n = len(arg.path)
+	}
+	path := string(arg.path[:n])
+	n = bytes.IndexByte(arg.name[:], 0)
+	if n < 0 {
+		n = len(arg.name)
+	}
+	return path + string(arg.name[:n])
+}
+
 const (
 	// Caller doesn't want file data in the send stream, even if the
 	// search of clone sources doesn't find an extent. UPDATE_EXTENT
@@ -547,10 +728,18 @@ const (
 	// of the stream. This option is used when multiple snapshots are
 	// sent back to back.
 	_BTRFS_SEND_FLAG_OMIT_END_CMD = 0x4
+	// Read the protocol version in the structure
+	_BTRFS_SEND_FLAG_VERSION = 0x8
+	// Send compressed data using the ENCODED_WRITE command instead of
+	// decompressing the data and sending it with the WRITE command.
+	// This requires protocol version >= 2.
+	_BTRFS_SEND_FLAG_COMPRESSED = 0x10
 
 	_BTRFS_SEND_FLAG_MASK = _BTRFS_SEND_FLAG_NO_FILE_DATA |
 		_BTRFS_SEND_FLAG_OMIT_STREAM_HEADER |
-		_BTRFS_SEND_FLAG_OMIT_END_CMD
+		_BTRFS_SEND_FLAG_OMIT_END_CMD |
+		_BTRFS_SEND_FLAG_VERSION |
+		_BTRFS_SEND_FLAG_COMPRESSED
 )
 
 type btrfs_ioctl_send_args struct {
@@ -559,7 +748,8 @@ type btrfs_ioctl_send_args struct {
 	clone_sources       *objectID // in
 	parent_root         objectID  // in
 	flags               uint64    // in
-	_                   [4]uint64 // in
+	version             uint32    // in
+	_                   [28]byte  // in
 }
 
 var (
@@ -579,6 +769,7 @@ var (
 	_BTRFS_IOC_SNAP_DESTROY           = ioctl.IOW(ioctlMagic, 15, unsafe.Sizeof(btrfs_ioctl_vol_args{}))
 	_BTRFS_IOC_DEFRAG_RANGE           = ioctl.IOW(ioctlMagic, 16, unsafe.Sizeof(btrfs_ioctl_defrag_range_args{}))
 	_BTRFS_IOC_TREE_SEARCH            = ioctl.IOWR(ioctlMagic, 17, unsafe.Sizeof(btrfs_ioctl_search_args{}))
+	_BTRFS_IOC_TREE_SEARCH_V2         = ioctl.IOWR(ioctlMagic, 17, unsafe.Sizeof(btrfs_ioctl_search_args_v2{}))
 	_BTRFS_IOC_INO_LOOKUP             = ioctl.IOWR(ioctlMagic, 18, unsafe.Sizeof(btrfs_ioctl_ino_lookup_args{}))
 	_BTRFS_IOC_DEFAULT_SUBVOL         = ioctl.IOW(ioctlMagic, 19, 8) // uint64
 	_BTRFS_IOC_SPACE_INFO             = ioctl.IOWR(ioctlMagic, 20, unsafe.Sizeof(btrfs_ioctl_space_args{}))
@@ -597,7 +788,7 @@ var (
 	_BTRFS_IOC_BALANCE_CTL            = ioctl.IOW(ioctlMagic, 33, 4) // int32
 	_BTRFS_IOC_BALANCE_PROGRESS       = ioctl.IOR(ioctlMagic, 34, unsafe.Sizeof(btrfs_ioctl_balance_args{}))
 	_BTRFS_IOC_INO_PATHS              = ioctl.IOWR(ioctlMagic, 35, unsafe.Sizeof(btrfs_ioctl_ino_path_args{}))
-	_BTRFS_IOC_LOGICAL_INO            = ioctl.IOWR(ioctlMagic, 36, unsafe.Sizeof(btrfs_ioctl_ino_path_args{}))
+	_BTRFS_IOC_LOGICAL_INO            = ioctl.IOWR(ioctlMagic, 36, unsafe.Sizeof(btrfs_ioctl_logical_ino_args{}))
 	_BTRFS_IOC_SET_RECEIVED_SUBVOL    = ioctl.IOWR(ioctlMagic, 37, unsafe.Sizeof(btrfs_ioctl_received_subvol_args{}))
 	_BTRFS_IOC_SEND                   = ioctl.IOW(ioctlMagic, 38, unsafe.Sizeof(btrfs_ioctl_send_args{}))
 	_BTRFS_IOC_DEVICES_READY          = ioctl.IOR(ioctlMagic, 39, unsafe.Sizeof(btrfs_ioctl_vol_args{}))
@@ -616,86 +807,178 @@ var (
 	_BTRFS_IOC_GET_FEATURES           = ioctl.IOR(ioctlMagic, 57, unsafe.Sizeof(btrfs_ioctl_feature_flags{}))
 	_BTRFS_IOC_SET_FEATURES           = ioctl.IOW(ioctlMagic, 57, unsafe.Sizeof([2]btrfs_ioctl_feature_flags{}))
 	_BTRFS_IOC_GET_SUPPORTED_FEATURES = ioctl.IOR(ioctlMagic, 57, unsafe.Sizeof([3]btrfs_ioctl_feature_flags{}))
+	_BTRFS_IOC_RM_DEV_V2              = ioctl.IOW(ioctlMagic, 58, unsafe.Sizeof(btrfs_ioctl_vol_args_v2{}))
+	_BTRFS_IOC_LOGICAL_INO_V2         = ioctl.IOWR(ioctlMagic, 59, unsafe.Sizeof(btrfs_ioctl_logical_ino_args{}))
+	_BTRFS_IOC_GET_SUBVOL_INFO        = ioctl.IOR(ioctlMagic, 60, unsafe.Sizeof(btrfs_ioctl_get_subvol_info_args{}))
+	_BTRFS_IOC_GET_SUBVOL_ROOTREF     = ioctl.IOWR(ioctlMagic, 61, unsafe.Sizeof(btrfs_ioctl_get_subvol_rootref_args{}))
+	_BTRFS_IOC_INO_LOOKUP_USER        = ioctl.IOWR(ioctlMagic, 62, unsafe.Sizeof(btrfs_ioctl_ino_lookup_user_args{}))
+	_BTRFS_IOC_SNAP_DESTROY_V2        = ioctl.IOW(ioctlMagic, 63, unsafe.Sizeof(btrfs_ioctl_vol_args_v2{}))
 )
 
-func iocSnapCreate(f *os.File, in *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_SNAP_CREATE, in)
+// adminIoctls are requests that always require CAP_SYS_ADMIN. Only EPERM returned by them
+// is annotated with ErrNeedsRoot: other requests fail with EPERM for unrelated reasons,
+// for example, on immutable files.
+var adminIoctls = map[uintptr]bool{
+	_BTRFS_IOC_RESIZE:              true,
+	_BTRFS_IOC_SCAN_DEV:            true,
+	_BTRFS_IOC_ADD_DEV:             true,
+	_BTRFS_IOC_RM_DEV:              true,
+	_BTRFS_IOC_RM_DEV_V2:           true,
+	_BTRFS_IOC_BALANCE:             true,
+	_BTRFS_IOC_BALANCE_V2:          true,
+	_BTRFS_IOC_BALANCE_CTL:         true,
+	_BTRFS_IOC_TREE_SEARCH:         true,
+	_BTRFS_IOC_TREE_SEARCH_V2:      true,
+	_BTRFS_IOC_INO_LOOKUP:          true,
+	_BTRFS_IOC_DEFAULT_SUBVOL:      true,
+	_BTRFS_IOC_SCRUB:               true,
+	_BTRFS_IOC_SCRUB_CANCEL:        true,
+	_BTRFS_IOC_SCRUB_PROGRESS:      true,
+	_BTRFS_IOC_INO_PATHS:           true,
+	_BTRFS_IOC_LOGICAL_INO:         true,
+	_BTRFS_IOC_LOGICAL_INO_V2:      true,
+	_BTRFS_IOC_SEND:                true,
+	_BTRFS_IOC_QUOTA_CTL:           true,
+	_BTRFS_IOC_QGROUP_ASSIGN:       true,
+	_BTRFS_IOC_QGROUP_CREATE:       true,
+	_BTRFS_IOC_QGROUP_LIMIT:        true,
+	_BTRFS_IOC_QUOTA_RESCAN:        true,
+	_BTRFS_IOC_QUOTA_RESCAN_WAIT:   true,
+	_BTRFS_IOC_QUOTA_RESCAN_STATUS: true,
+	_BTRFS_IOC_SET_FSLABEL:         true,
+	_BTRFS_IOC_DEV_REPLACE:         true,
+	_BTRFS_IOC_SET_FEATURES:        true,
+	_FIFREEZE:                      true,
+	_FITHAW:                        true,
+	_FITRIM:                        true,
+}
+
+// doIoctl is the same as ioctl.Do, but uses the IoctlDoer of the file (see ioctlFile)
+// and annotates errno values with sentinel errors (see wrapErrno).
+func doIoctl(f ioctlFile, ioc uintptr, arg interface{}) error {
+	_, err := doIoctlRet(f, ioc, arg)
+	return err
+}
+
+// doIoctlRet is the same as doIoctl, but also returns a non-negative result of the call.
+func doIoctlRet(f ioctlFile, ioc uintptr, arg interface{}) (uintptr, error) {
+	file, d := ioctlDoerOf(f)
+	r, err := d.Ioctl(file, ioc, arg)
+	if err == syscall.EPERM && adminIoctls[ioc] {
+		return r, errnoError{errno: syscall.EPERM, kind: ErrNeedsRoot}
+	}
+	return r, wrapErrno(err)
 }
 
-func iocSnapCreateV2(f *os.File, in *btrfs_ioctl_vol_args_v2) error {
-	return ioctl.Do(f, _BTRFS_IOC_SNAP_CREATE_V2, in)
+// rawIoctl is the same as doIoctl, but passes an integer argument by value.
+func rawIoctl(f ioctlFile, ioc uintptr, addr uintptr) error {
+	_, err := doIoctlRet(f, ioc, addr)
+	return err
 }
 
-func iocDefrag(f *os.File, out *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_DEFRAG, out)
+func iocSnapCreate(f ioctlFile, in *btrfs_ioctl_vol_args) error {
+	return doIoctl(f, _BTRFS_IOC_SNAP_CREATE, in)
 }
 
-func iocResize(f *os.File, in *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_RESIZE, in)
+func iocSnapCreateV2(f ioctlFile, in *btrfs_ioctl_vol_args_v2) error {
+	return doIoctl(f, _BTRFS_IOC_SNAP_CREATE_V2, in)
 }
 
-func iocScanDev(f *os.File, out *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_SCAN_DEV, out)
+func iocDefrag(f ioctlFile, out *btrfs_ioctl_vol_args) error {
+	return doIoctl(f, _BTRFS_IOC_DEFRAG, out)
 }
 
-func iocTransStart(f *os.File) error {
-	return ioctl.Do(f, _BTRFS_IOC_TRANS_START, nil)
+func iocResize(f ioctlFile, in *btrfs_ioctl_vol_args) error {
+	return doIoctl(f, _BTRFS_IOC_RESIZE, in)
 }
 
-func iocTransEnd(f *os.File) error {
-	return ioctl.Do(f, _BTRFS_IOC_TRANS_END, nil)
+func iocScanDev(f ioctlFile, out *btrfs_ioctl_vol_args) error {
+	return doIoctl(f, _BTRFS_IOC_SCAN_DEV, out)
 }
 
-func iocSync(f *os.File) error {
-	return ioctl.Do(f, _BTRFS_IOC_SYNC, nil)
+func iocTransStart(f ioctlFile) error {
+	return doIoctl(f, _BTRFS_IOC_TRANS_START, nil)
+}
+
+func iocTransEnd(f ioctlFile) error {
+	return doIoctl(f, _BTRFS_IOC_TRANS_END, nil)
+}
+
+func iocSync(f ioctlFile) error {
+	return doIoctl(f, _BTRFS_IOC_SYNC, nil)
 }
 
 func iocClone(dst, src *os.File) error {
-	return ioctl.Ioctl(dst, _BTRFS_IOC_CLONE, src.Fd())
+	return rawIoctl(dst, _BTRFS_IOC_CLONE, src.Fd())
+}
+
+// doDevIoctl is the same as doIoctl, but converts positive results
+// returned by device management ioctls to ErrCode.
+func doDevIoctl(f ioctlFile, ioc uintptr, arg interface{}) error {
+	r, err := doIoctlRet(f, ioc, arg)
+	if err != nil {
+		return err
+	} else if r != 0 {
+		return ErrCode(r)
+	}
+	return nil
 }
 
-func iocAddDev(f *os.File, out *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_ADD_DEV, out)
+func iocAddDev(f ioctlFile, out *btrfs_ioctl_vol_args) error {
+	return doDevIoctl(f, _BTRFS_IOC_ADD_DEV, out)
 }
 
-func iocRmDev(f *os.File, out *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_RM_DEV, out)
+func iocRmDev(f ioctlFile, out *btrfs_ioctl_vol_args) error {
+	return doDevIoctl(f, _BTRFS_IOC_RM_DEV, out)
 }
 
-func iocBalance(f *os.File, out *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_BALANCE, out)
+func iocRmDevV2(f ioctlFile, in *btrfs_ioctl_vol_args_v2) error {
+	return doDevIoctl(f, _BTRFS_IOC_RM_DEV_V2, in)
 }
 
-func iocCloneRange(f *os.File, out *btrfs_ioctl_clone_range_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_CLONE_RANGE, out)
+func iocBalance(f ioctlFile, out *btrfs_ioctl_vol_args) error {
+	return doIoctl(f, _BTRFS_IOC_BALANCE, out)
 }
 
-func iocSubvolCreate(f *os.File, in *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_SUBVOL_CREATE, in)
+func iocCloneRange(f ioctlFile, out *btrfs_ioctl_clone_range_args) error {
+	return doIoctl(f, _BTRFS_IOC_CLONE_RANGE, out)
 }
 
-func iocSubvolCreateV2(f *os.File, in *btrfs_ioctl_vol_args_v2) error {
-	return ioctl.Do(f, _BTRFS_IOC_SUBVOL_CREATE, in)
+func iocSubvolCreate(f ioctlFile, in *btrfs_ioctl_vol_args) error {
+	return doIoctl(f, _BTRFS_IOC_SUBVOL_CREATE, in)
 }
 
-func iocSnapDestroy(f *os.File, in *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_SNAP_DESTROY, in)
+func iocSubvolCreateV2(f ioctlFile, in *btrfs_ioctl_vol_args_v2) error {
+	return doIoctl(f, _BTRFS_IOC_SUBVOL_CREATE_V2, in)
 }
 
-func iocDefragRange(f *os.File, out *btrfs_ioctl_defrag_range_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_DEFRAG_RANGE, out)
+func iocSnapDestroy(f ioctlFile, in *btrfs_ioctl_vol_args) error {
+	return doIoctl(f, _BTRFS_IOC_SNAP_DESTROY, in)
 }
 
-func iocTreeSearch(f *os.File, out *btrfs_ioctl_search_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_TREE_SEARCH, out)
+func iocSnapDestroyV2(f ioctlFile, in *btrfs_ioctl_vol_args_v2) error {
+	return doIoctl(f, _BTRFS_IOC_SNAP_DESTROY_V2, in)
 }
 
-func iocInoLookup(f *os.File, out *btrfs_ioctl_ino_lookup_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_INO_LOOKUP, out)
+func iocDefragRange(f ioctlFile, out *btrfs_ioctl_defrag_range_args) error {
+	return doIoctl(f, _BTRFS_IOC_DEFRAG_RANGE, out)
 }
 
-func iocDefaultSubvol(f *os.File, out *uint64) error {
-	return ioctl.Do(f, _BTRFS_IOC_DEFAULT_SUBVOL, out)
+func iocTreeSearch(f ioctlFile, out *btrfs_ioctl_search_args) error {
+	return doIoctl(f, _BTRFS_IOC_TREE_SEARCH, out)
+}
+
+// iocTreeSearchV2 expects a buffer that starts with btrfs_ioctl_search_args_v2 header.
+func iocTreeSearchV2(f ioctlFile, buf []byte) error {
+	return doIoctl(f, _BTRFS_IOC_TREE_SEARCH_V2, buf)
+}
+
+func iocInoLookup(f ioctlFile, out *btrfs_ioctl_ino_lookup_args) error {
+	return doIoctl(f, _BTRFS_IOC_INO_LOOKUP, out)
+}
+
+func iocDefaultSubvol(f ioctlFile, out *uint64) error {
+	return doIoctl(f, _BTRFS_IOC_DEFAULT_SUBVOL, out)
 }
 
 type spaceFlags uint64
@@ -710,9 +993,9 @@ type spaceInfo struct {
 	UsedBytes  uint64
 }
 
-func iocSpaceInfo(f *os.File) ([]spaceInfo, error) {
+func iocSpaceInfo(f ioctlFile) ([]spaceInfo, error) {
 	arg := &btrfs_ioctl_space_args{}
-	if err := ioctl.Do(f, _BTRFS_IOC_SPACE_INFO, arg); err != nil {
+	if err := doIoctl(f, _BTRFS_IOC_SPACE_INFO, arg); err != nil {
 		return nil, err
 	}
 	n := arg.total_spaces
@@ -727,7 +1010,7 @@ func iocSpaceInfo(f *os.File) ([]spaceInfo, error) {
 	basePtr := unsafe.Pointer(&buf[0])
 	arg = (*btrfs_ioctl_space_args)(basePtr)
 	arg.space_slots = n
-	if err := ioctl.Do(f, _BTRFS_IOC_SPACE_INFO, arg); err != nil {
+	if err := doIoctl(f, _BTRFS_IOC_SPACE_INFO, arg); err != nil {
 		return nil, err
 	} else if arg.total_spaces == 0 {
 		return nil, nil
@@ -749,128 +1032,147 @@ func iocSpaceInfo(f *os.File) ([]spaceInfo, error) {
 	return out, nil
 }
 
-func iocStartSync(f *os.File, out *uint64) error {
-	return ioctl.Do(f, _BTRFS_IOC_START_SYNC, out)
+func iocStartSync(f ioctlFile, out *uint64) error {
+	return doIoctl(f, _BTRFS_IOC_START_SYNC, out)
 }
 
-func iocWaitSync(f *os.File, out *uint64) error {
-	return ioctl.Do(f, _BTRFS_IOC_WAIT_SYNC, out)
+func iocWaitSync(f ioctlFile, out *uint64) error {
+	return doIoctl(f, _BTRFS_IOC_WAIT_SYNC, out)
 }
 
-func iocSubvolGetflags(f *os.File) (out SubvolFlags, err error) {
-	err = ioctl.Do(f, _BTRFS_IOC_SUBVOL_GETFLAGS, &out)
+func iocSubvolGetflags(f ioctlFile) (out SubvolFlags, err error) {
+	err = doIoctl(f, _BTRFS_IOC_SUBVOL_GETFLAGS, &out)
 	return
 }
 
-func iocSubvolSetflags(f *os.File, flags SubvolFlags) error {
+func iocSubvolSetflags(f ioctlFile, flags SubvolFlags) error {
 	v := uint64(flags)
-	return ioctl.Do(f, _BTRFS_IOC_SUBVOL_SETFLAGS, &v)
+	return doIoctl(f, _BTRFS_IOC_SUBVOL_SETFLAGS, &v)
 }
 
-func iocScrub(f *os.File, out *btrfs_ioctl_scrub_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_SCRUB, out)
+func iocScrub(f ioctlFile, out *btrfs_ioctl_scrub_args) error {
+	return doIoctl(f, _BTRFS_IOC_SCRUB, out)
 }
 
-func iocScrubCancel(f *os.File) error {
-	return ioctl.Do(f, _BTRFS_IOC_SCRUB_CANCEL, nil)
+func iocScrubCancel(f ioctlFile) error {
+	return doIoctl(f, _BTRFS_IOC_SCRUB_CANCEL, nil)
 }
 
-func iocScrubProgress(f *os.File, out *btrfs_ioctl_scrub_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_SCRUB_PROGRESS, out)
+func iocScrubProgress(f ioctlFile, out *btrfs_ioctl_scrub_args) error {
+	return doIoctl(f, _BTRFS_IOC_SCRUB_PROGRESS, out)
 }
 
-func iocFsInfo(f *os.File) (out btrfs_ioctl_fs_info_args, err error) {
-	err = ioctl.Do(f, _BTRFS_IOC_FS_INFO, &out)
+func iocFsInfo(f ioctlFile) (out btrfs_ioctl_fs_info_args, err error) {
+	out.flags = _BTRFS_FS_INFO_FLAG_CSUM_INFO | _BTRFS_FS_INFO_FLAG_GENERATION | _BTRFS_FS_INFO_FLAG_METADATA_UUID
+	err = doIoctl(f, _BTRFS_IOC_FS_INFO, &out)
 	return
 }
 
-func iocDevInfo(f *os.File, devid uint64, uuid UUID) (out btrfs_ioctl_dev_info_args, err error) {
+func iocDevInfo(f ioctlFile, devid uint64, uuid UUID) (out btrfs_ioctl_dev_info_args, err error) {
 	out.devid = devid
 	out.uuid = uuid
-	err = ioctl.Do(f, _BTRFS_IOC_DEV_INFO, &out)
+	err = doIoctl(f, _BTRFS_IOC_DEV_INFO, &out)
 	return
 }
 
-func iocBalanceV2(f *os.File, out *btrfs_ioctl_balance_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_BALANCE_V2, out)
+func iocBalanceV2(f ioctlFile, out *btrfs_ioctl_balance_args) error {
+	return doIoctl(f, _BTRFS_IOC_BALANCE_V2, out)
+}
+
+func iocBalanceCtl(f ioctlFile, cmd int32) error {
+	return rawIoctl(f, _BTRFS_IOC_BALANCE_CTL, uintptr(cmd))
 }
 
-func iocBalanceCtl(f *os.File, out *int32) error {
-	return ioctl.Do(f, _BTRFS_IOC_BALANCE_CTL, out)
+func iocBalanceProgress(f ioctlFile, out *btrfs_ioctl_balance_args) error {
+	return doIoctl(f, _BTRFS_IOC_BALANCE_PROGRESS, out)
 }
 
-func iocBalanceProgress(f *os.File, out *btrfs_ioctl_balance_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_BALANCE_PROGRESS, out)
+func iocInoPaths(f ioctlFile, out *btrfs_ioctl_ino_path_args) error {
+	return doIoctl(f, _BTRFS_IOC_INO_PATHS, out)
 }
 
-func iocInoPaths(f *os.File, out *btrfs_ioctl_ino_path_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_INO_PATHS, out)
+func iocLogicalIno(f ioctlFile, out *btrfs_ioctl_logical_ino_args) error {
+	return doIoctl(f, _BTRFS_IOC_LOGICAL_INO, out)
 }
 
-func iocLogicalIno(f *os.File, out *btrfs_ioctl_ino_path_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_LOGICAL_INO, out)
+func iocLogicalInoV2(f ioctlFile, out *btrfs_ioctl_logical_ino_args) error {
+	return doIoctl(f, _BTRFS_IOC_LOGICAL_INO_V2, out)
 }
 
-func iocSetReceivedSubvol(f *os.File, out *btrfs_ioctl_received_subvol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_SET_RECEIVED_SUBVOL, out)
+func iocGetSubvolInfo(f ioctlFile) (out btrfs_ioctl_get_subvol_info_args, err error) {
+	err = doIoctl(f, _BTRFS_IOC_GET_SUBVOL_INFO, &out)
+	return
 }
 
-func iocSend(f *os.File, in *btrfs_ioctl_send_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_SEND, in)
+func iocGetSubvolRootref(f ioctlFile, out *btrfs_ioctl_get_subvol_rootref_args) error {
+	return doIoctl(f, _BTRFS_IOC_GET_SUBVOL_ROOTREF, out)
 }
 
-func iocDevicesReady(f *os.File, out *btrfs_ioctl_vol_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_DEVICES_READY, out)
+func iocInoLookupUser(f ioctlFile, out *btrfs_ioctl_ino_lookup_user_args) error {
+	return doIoctl(f, _BTRFS_IOC_INO_LOOKUP_USER, out)
 }
 
-func iocQuotaCtl(f *os.File, out *btrfs_ioctl_quota_ctl_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_QUOTA_CTL, out)
+func iocSetReceivedSubvol(f ioctlFile, out *btrfs_ioctl_received_subvol_args) error {
+	return doIoctl(f, _BTRFS_IOC_SET_RECEIVED_SUBVOL, out)
 }
 
-func iocQgroupAssign(f *os.File, out *btrfs_ioctl_qgroup_assign_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_QGROUP_ASSIGN, out)
+func iocSend(f ioctlFile, in *btrfs_ioctl_send_args) error {
+	return doIoctl(f, _BTRFS_IOC_SEND, in)
 }
 
-func iocQgroupCreate(f *os.File, out *btrfs_ioctl_qgroup_create_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_QGROUP_CREATE, out)
+func iocDevicesReady(f ioctlFile, out *btrfs_ioctl_vol_args) error {
+	return doIoctl(f, _BTRFS_IOC_DEVICES_READY, out)
 }
 
-func iocQgroupLimit(f *os.File, out *btrfs_ioctl_qgroup_limit_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_QGROUP_LIMIT, out)
+func iocQuotaCtl(f ioctlFile, out *btrfs_ioctl_quota_ctl_args) error {
+	return doIoctl(f, _BTRFS_IOC_QUOTA_CTL, out)
 }
 
-func iocQuotaRescan(f *os.File, out *btrfs_ioctl_quota_rescan_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_QUOTA_RESCAN, out)
+// iocQgroupAssign returns a positive value if quota accounting became inconsistent.
+func iocQgroupAssign(f ioctlFile, out *btrfs_ioctl_qgroup_assign_args) (uintptr, error) {
+	return doIoctlRet(f, _BTRFS_IOC_QGROUP_ASSIGN, out)
 }
 
-func iocQuotaRescanStatus(f *os.File, out *btrfs_ioctl_quota_rescan_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_QUOTA_RESCAN_STATUS, out)
+func iocQgroupCreate(f ioctlFile, out *btrfs_ioctl_qgroup_create_args) error {
+	return doIoctl(f, _BTRFS_IOC_QGROUP_CREATE, out)
 }
 
-func iocQuotaRescanWait(f *os.File) error {
-	return ioctl.Do(f, _BTRFS_IOC_QUOTA_RESCAN_WAIT, nil)
+func iocQgroupLimit(f ioctlFile, out *btrfs_ioctl_qgroup_limit_args) error {
+	return doIoctl(f, _BTRFS_IOC_QGROUP_LIMIT, out)
 }
 
-func iocGetFslabel(f *os.File, out *[labelSize]byte) error {
-	return ioctl.Do(f, _BTRFS_IOC_GET_FSLABEL, out)
+func iocQuotaRescan(f ioctlFile, out *btrfs_ioctl_quota_rescan_args) error {
+	return doIoctl(f, _BTRFS_IOC_QUOTA_RESCAN, out)
 }
 
-func iocSetFslabel(f *os.File, out *[labelSize]byte) error {
-	return ioctl.Do(f, _BTRFS_IOC_SET_FSLABEL, out)
+func iocQuotaRescanStatus(f ioctlFile, out *btrfs_ioctl_quota_rescan_args) error {
+	return doIoctl(f, _BTRFS_IOC_QUOTA_RESCAN_STATUS, out)
 }
 
-func iocGetDevStats(f *os.File, out *btrfs_ioctl_get_dev_stats) error {
-	return ioctl.Do(f, _BTRFS_IOC_GET_DEV_STATS, out)
+func iocQuotaRescanWait(f ioctlFile) error {
+	return doIoctl(f, _BTRFS_IOC_QUOTA_RESCAN_WAIT, nil)
 }
 
-//func iocDevReplace(f *os.File, out *btrfs_ioctl_dev_replace_args) error {
-//	return ioctl.Do(f, _BTRFS_IOC_DEV_REPLACE, out)
-//}
+func iocGetFslabel(f ioctlFile, out *[labelSize]byte) error {
+	return doIoctl(f, _BTRFS_IOC_GET_FSLABEL, out)
+}
+
+func iocSetFslabel(f ioctlFile, out *[labelSize]byte) error {
+	return doIoctl(f, _BTRFS_IOC_SET_FSLABEL, out)
+}
+
+func iocGetDevStats(f ioctlFile, out *btrfs_ioctl_get_dev_stats) error {
+	return doIoctl(f, _BTRFS_IOC_GET_DEV_STATS, out)
+}
+
+func iocDevReplace(f ioctlFile, out *btrfs_ioctl_dev_replace_args_u1) error {
+	return doDevIoctl(f, _BTRFS_IOC_DEV_REPLACE, out)
+}
 
-func iocFileExtentSame(f *os.File, out *btrfs_ioctl_same_args) error {
-	return ioctl.Do(f, _BTRFS_IOC_FILE_EXTENT_SAME, out)
+func iocFileExtentSame(f ioctlFile, out *btrfs_ioctl_same_args) error {
+	return doIoctl(f, _BTRFS_IOC_FILE_EXTENT_SAME, out)
 }
 
-func iocSetFeatures(f *os.File, out *[2]btrfs_ioctl_feature_flags) error {
-	return ioctl.Do(f, _BTRFS_IOC_SET_FEATURES, out)
+func iocSetFeatures(f ioctlFile, out *[2]btrfs_ioctl_feature_flags) error {
+	return doIoctl(f, _BTRFS_IOC_SET_FEATURES, out)
 }
@@ -0,0 +1,197 @@
+package btrfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// FileAttrs contains btrfs-specific attributes of a file.
+type FileAttrs struct {
+	Subvolume   bool        // file is a root directory of a subvolume
+	Compression Compression // compression property; empty if not set
+	Flags       FileFlags   // inode flags
+}
+
+// AttrProvider is implemented by fs.FileInfo and fs.DirEntry values returned by DirFS.
+type AttrProvider interface {
+	// BtrfsAttrs reads btrfs-specific attributes of the file.
+	BtrfsAttrs() (FileAttrs, error)
+}
+
+// DirFS returns a read-only file system for the tree of files rooted at dir, similar to os.DirFS.
+//
+// File infos returned by Stat and directory entries returned by ReadDir implement AttrProvider.
+// Attributes are read lazily, thus walking the tree is as fast as with os.DirFS.
+func DirFS(dir string) fs.FS {
+	return dirFS{root: dir, fsys: os.DirFS(dir)}
+}
+
+// dirFSAt is like DirFS, but opens all files relative to an open directory.
+func dirFSAt(dir *os.File) fs.FS {
+	return dirFS{dir: dir, fsys: fileFS{dir: dir}}
+}
+
+var (
+	_ fs.StatFS    = dirFS{}
+	_ fs.ReadDirFS = dirFS{}
+)
+
+type dirFS struct {
+	root string   // root path; not used if dir is set
+	dir  *os.File // root directory; files are opened relative to it
+	fsys fs.FS
+}
+
+// path returns the name of the file relative to d.dir, or a full path if it's not set.
+func (d dirFS) path(name string) string {
+	if d.dir != nil {
+		return path.Clean(name)
+	}
+	return filepath.Join(d.root, filepath.FromSlash(name))
+}
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	return d.fsys.Open(name)
+}
+
+func (d dirFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(d.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return attrFileInfo{FileInfo: fi, dir: d.dir, path: d.path(name)}, nil
+}
+
+func (d dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	list, err := fs.ReadDir(d.fsys, name)
+	for i, e := range list {
+		if _, ok := e.(attrDirEntry); ok {
+			continue
+		}
+		list[i] = attrDirEntry{DirEntry: e, dir: d.dir, path: d.path(name + "/" + e.Name())}
+	}
+	return list, err
+}
+
+// fileFS is an fs.FS that opens files relative to a directory descriptor.
+type fileFS struct {
+	dir *os.File
+}
+
+func (d fileFS) open(op, name string, flags int) (*os.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &os.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return openAt(d.dir, name, flags, 0)
+}
+
+func (d fileFS) Open(name string) (fs.File, error) {
+	f, err := d.open("open", name, syscall.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return dirFile{File: f, root: d.dir, name: name}, nil
+}
+
+func (d fileFS) Stat(name string) (fs.FileInfo, error) {
+	// O_PATH doesn't require read permission and doesn't block on FIFOs
+	f, err := d.open("stat", name, oPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// dirFile is a file opened by fileFS. Directory entries it returns are resolved relative
+// to the root directory as well.
+type dirFile struct {
+	*os.File
+	root *os.File
+	name string
+}
+
+func (f dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	list, err := f.File.ReadDir(n)
+	for i, e := range list {
+		list[i] = attrDirEntry{DirEntry: e, dir: f.root, path: path.Join(f.name, e.Name())}
+	}
+	return list, err
+}
+
+type attrFileInfo struct {
+	fs.FileInfo
+	dir  *os.File
+	path string
+}
+
+func (fi attrFileInfo) BtrfsAttrs() (FileAttrs, error) {
+	return readFileAttrs(fi.dir, fi.path, fi.Mode())
+}
+
+type attrDirEntry struct {
+	fs.DirEntry
+	dir  *os.File
+	path string
+}
+
+func (e attrDirEntry) Info() (fs.FileInfo, error) {
+	var (
+		fi  fs.FileInfo
+		err error
+	)
+	if e.dir != nil {
+		fi, err = lstatAt(e.dir, e.path)
+	} else {
+		fi, err = e.DirEntry.Info()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attrFileInfo{FileInfo: fi, dir: e.dir, path: e.path}, nil
+}
+
+func (e attrDirEntry) BtrfsAttrs() (FileAttrs, error) {
+	return readFileAttrs(e.dir, e.path, e.Type())
+}
+
+// lstatAt is like os.Lstat, but resolves the name relative to a directory.
+func lstatAt(dir *os.File, name string) (fs.FileInfo, error) {
+	f, err := openAt(dir, name, oPath|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// readFileAttrs reads btrfs attributes of a file, opened relative to dir with openAt.
+// Only regular files and directories have attributes; zero value is returned for other file types.
+func readFileAttrs(dir *os.File, path string, mode fs.FileMode) (FileAttrs, error) {
+	var a FileAttrs
+	if !mode.IsRegular() && !mode.IsDir() {
+		return a, nil
+	}
+	f, err := openAt(dir, path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return a, err
+	}
+	defer f.Close()
+	if mode.IsDir() {
+		if a.Subvolume, err = isSubvolumeFile(f); err != nil {
+			return a, err
+		}
+	}
+	if a.Compression, err = getCompressionFile(f); err != nil {
+		return a, err
+	}
+	flags, err := iocGetFlags(f)
+	if err != nil {
+		return a, &os.PathError{Op: "get flags", Path: f.Name(), Err: err}
+	}
+	a.Flags = FileFlags(flags)
+	return a, nil
+}
@@ -0,0 +1,76 @@
+package btrfs
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// testDirTree creates a directory tree used by DirFS tests.
+func testDirTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "btrfs_iofs_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "a", "file"), []byte("data"), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDirFS(t *testing.T) {
+	dir := testDirTree(t)
+	defer os.RemoveAll(dir)
+	testAttrFS(t, DirFS(dir))
+}
+
+func TestFSDirFS(t *testing.T) {
+	dir := testDirTree(t)
+	defer os.RemoveAll(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	fsys := NewFSWithIoctl(d, &FakeIoctl{}).DirFS()
+	// files must be resolved relative to the descriptor, not the original path
+	moved := dir + ".moved"
+	if err = os.Rename(dir, moved); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(moved)
+	testAttrFS(t, fsys)
+}
+
+func testAttrFS(t *testing.T, fsys fs.FS) {
+	if err := fstest.TestFS(fsys, "a/file", "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := d.(AttrProvider); !ok && path != "." {
+			t.Errorf("%s: entry does not provide attributes", path)
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if _, ok := fi.(AttrProvider); !ok {
+			t.Errorf("%s: info does not provide attributes", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
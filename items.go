@@ -0,0 +1,592 @@
+package btrfs
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Well-known tree ids.
+const (
+	RootTreeID       = uint64(rootTreeObjectid)
+	ExtentTreeID     = uint64(extentTreeObjectid)
+	ChunkTreeID      = uint64(chunkTreeObjectid)
+	DevTreeID        = uint64(devTreeObjectid)
+	FSTreeID         = uint64(fsTreeObjectid)
+	CsumTreeID       = uint64(csumTreeObjectid)
+	QuotaTreeID      = uint64(quotaTreeObjectid)
+	UUIDTreeID       = uint64(uuidTreeObjectid)
+	FreeSpaceTreeID  = uint64(freeSpaceTreeObjectid)
+	BlockGroupTreeID = uint64(11) // holds block group items with the BlockGroupTree feature
+	FirstFreeID      = uint64(firstFreeObjectid)
+	LastFreeID       = uint64(lastFreeObjectid)
+	FirstChunkTreeID = uint64(firstChunkTreeObjectid)
+)
+
+// Types of tree items that can be decoded by this package.
+const (
+	KeyInodeItem      = inodeItemKey
+	KeyInodeRef       = inodeRefKey
+	KeyInodeExtref    = inodeExtrefKey
+	KeyXattrItem      = xattrItemKey
+	KeyOrphanItem     = orphanItemKey
+	KeyDirItem        = dirItemKey
+	KeyDirIndex       = dirIndexKey
+	KeyExtentData     = extentDataKey
+	KeyExtentCsum     = extentCsumKey
+	KeyRootItem       = rootItemKey
+	KeyRootBackref    = rootBackrefKey
+	KeyRootRef        = rootRefKey
+	KeyExtentItem     = extentItemKey
+	KeyMetadataItem   = metadataItemKey
+	KeyTreeBlockRef   = treeBlockRefKey
+	KeySharedBlockRef = sharedBlockRefKey
+	KeyExtentDataRef  = extentDataRefKey
+	KeySharedDataRef  = sharedDataRefKey
+	KeyBlockGroupItem = blockGroupItemKey
+	KeyDevExtent      = devExtentKey
+	KeyDevItem        = devItemKey
+	KeyChunkItem      = chunkItemKey
+)
+
+// ErrItemSize is returned by decoders when the item data is too short.
+type ErrItemSize struct {
+	Type KeyType
+	Size int
+	Exp  int
+}
+
+func (e ErrItemSize) Error() string {
+	return fmt.Sprintf("btrfs: %v item with illegal size %d (exp: %d)", e.Type, e.Size, e.Exp)
+}
+
+func decodeTimespec(p []byte) time.Time {
+	return time.Unix(int64(order.Uint64(p[0:])), int64(order.Uint32(p[8:])))
+}
+
+func decodeDiskKey(p []byte) DiskKey {
+	return DiskKey{
+		ObjectID: order.Uint64(p[0:]),
+		Type:     p[8],
+		Offset:   order.Uint64(p[9:]),
+	}
+}
+
+const inodeItemSize = 160
+
+// DecodeInodeItem decodes INODE_ITEM data.
+func DecodeInodeItem(p []byte) (InodeItem, error) {
+	if len(p) < inodeItemSize {
+		return InodeItem{}, ErrItemSize{Type: inodeItemKey, Size: len(p), Exp: inodeItemSize}
+	}
+	return InodeItem{
+		Gen:        order.Uint64(p[0:]),
+		TransID:    order.Uint64(p[8:]),
+		Size:       order.Uint64(p[16:]),
+		NBytes:     order.Uint64(p[24:]),
+		BlockGroup: order.Uint64(p[32:]),
+		NLink:      order.Uint32(p[40:]),
+		UID:        order.Uint32(p[44:]),
+		GID:        order.Uint32(p[48:]),
+		Mode:       order.Uint32(p[52:]),
+		RDev:       order.Uint64(p[56:]),
+		Flags:      order.Uint64(p[64:]),
+		Sequence:   order.Uint64(p[72:]),
+		// 4 x uint64 reserved
+		ATime: decodeTimespec(p[112:]),
+		CTime: decodeTimespec(p[124:]),
+		MTime: decodeTimespec(p[136:]),
+		OTime: decodeTimespec(p[148:]),
+	}, nil
+}
+
+const (
+	// rootItemV1Size is the size of root item before subvolume uuids and times were introduced.
+	rootItemV1Size = 239
+	rootItemSize   = 439
+)
+
+// DecodeRootItem decodes ROOT_ITEM data.
+//
+// In case the root item is smaller than expected, or if it was last written by an older
+// kernel (mismatching generation), fields introduced in the second version are left empty.
+func DecodeRootItem(p []byte) (RootItem, error) {
+	if len(p) < rootItemV1Size {
+		return RootItem{}, ErrItemSize{Type: rootItemKey, Size: len(p), Exp: rootItemSize}
+	}
+	inode, _ := DecodeInodeItem(p)
+	it := RootItem{
+		Inode:        inode,
+		Gen:          order.Uint64(p[160:]),
+		RootDirID:    order.Uint64(p[168:]),
+		ByteNr:       order.Uint64(p[176:]),
+		ByteLimit:    order.Uint64(p[184:]),
+		BytesUsed:    order.Uint64(p[192:]),
+		LastSnapshot: order.Uint64(p[200:]),
+		Flags:        order.Uint64(p[208:]),
+		Refs:         order.Uint32(p[216:]),
+		DropProgress: decodeDiskKey(p[220:]),
+		DropLevel:    p[237],
+		Level:        p[238],
+	}
+	if len(p) < rootItemSize {
+		return it, nil
+	}
+	it.GenV2 = order.Uint64(p[239:])
+	if it.GenV2 != it.Gen {
+		return it, nil
+	}
+	copy(it.UUID[:], p[247:])
+	copy(it.ParentUUID[:], p[263:])
+	copy(it.ReceivedUUID[:], p[279:])
+	it.CTransID = order.Uint64(p[295:])
+	it.OTransID = order.Uint64(p[303:])
+	it.STransID = order.Uint64(p[311:])
+	it.RTransID = order.Uint64(p[319:])
+	it.CTime = decodeTimespec(p[327:])
+	it.OTime = decodeTimespec(p[339:])
+	it.STime = decodeTimespec(p[351:])
+	it.RTime = decodeTimespec(p[363:])
+	return it, nil
+}
+
+// DecodeRootRef decodes ROOT_REF and ROOT_BACKREF data.
+func DecodeRootRef(p []byte) (RootRef, error) {
+	const sz = 18
+	if len(p) < sz {
+		return RootRef{}, ErrItemSize{Type: rootRefKey, Size: len(p), Exp: sz}
+	}
+	n := int(order.Uint16(p[16:]))
+	if len(p) < sz+n {
+		return RootRef{}, ErrItemSize{Type: rootRefKey, Size: len(p), Exp: sz + n}
+	}
+	return RootRef{
+		DirID:    objectID(order.Uint64(p[0:])),
+		Sequence: order.Uint64(p[8:]),
+		Name:     string(p[sz : sz+n]),
+	}, nil
+}
+
+// FileExtentType is a type of file extent.
+type FileExtentType uint8
+
+const (
+	FileExtentInline   = FileExtentType(fileExtentInline)
+	FileExtentReg      = FileExtentType(fileExtentReg)
+	FileExtentPrealloc = FileExtentType(fileExtentPrealloc)
+)
+
+func (t FileExtentType) String() string {
+	switch t {
+	case FileExtentInline:
+		return "inline"
+	case FileExtentReg:
+		return "regular"
+	case FileExtentPrealloc:
+		return "prealloc"
+	}
+	return "type" + strconv.Itoa(int(t))
+}
+
+func compressionByType(typ uint8) Compression {
+	switch typ {
+	case compressNone:
+		return CompressionNone
+	case compressZlib:
+		return ZLIB
+	case compressLZO:
+		return LZO
+	case compressZstd:
+		return ZSTD
+	}
+	return Compression("type" + strconv.Itoa(int(typ)))
+}
+
+// FileExtentItem is an EXTENT_DATA item that describes a range of file data.
+type FileExtentItem struct {
+	Generation    uint64 // transaction id that created this extent
+	RAMBytes      uint64 // upper limit on the size of the extent in memory
+	Compression   Compression
+	Encryption    uint8
+	OtherEncoding uint16
+	Type          FileExtentType
+
+	// Inline is the data of inline extents (possibly compressed).
+	Inline []byte
+
+	// Fields below are only valid for regular and prealloc extents.
+
+	DiskByteNr   uint64 // logical address of the extent on disk; zero for holes
+	DiskNumBytes uint64 // size of the extent on disk
+	Offset       uint64 // offset into the extent
+	NumBytes     uint64 // logical number of file bytes
+}
+
+const (
+	fileExtentInlineDataStart = 21
+	fileExtentItemSize        = 53
+)
+
+// DecodeFileExtentItem decodes EXTENT_DATA data.
+func DecodeFileExtentItem(p []byte) (FileExtentItem, error) {
+	if len(p) < fileExtentInlineDataStart {
+		return FileExtentItem{}, ErrItemSize{Type: extentDataKey, Size: len(p), Exp: fileExtentItemSize}
+	}
+	it := FileExtentItem{
+		Generation:    order.Uint64(p[0:]),
+		RAMBytes:      order.Uint64(p[8:]),
+		Compression:   compressionByType(p[16]),
+		Encryption:    p[17],
+		OtherEncoding: order.Uint16(p[18:]),
+		Type:          FileExtentType(p[20]),
+	}
+	if it.Type == FileExtentInline {
+		it.Inline = append([]byte(nil), p[fileExtentInlineDataStart:]...)
+		return it, nil
+	}
+	if len(p) < fileExtentItemSize {
+		return FileExtentItem{}, ErrItemSize{Type: extentDataKey, Size: len(p), Exp: fileExtentItemSize}
+	}
+	it.DiskByteNr = order.Uint64(p[21:])
+	it.DiskNumBytes = order.Uint64(p[29:])
+	it.Offset = order.Uint64(p[37:])
+	it.NumBytes = order.Uint64(p[45:])
+	return it, nil
+}
+
+// Extent item flags.
+const (
+	ExtentFlagData      = uint64(extentFlagData)
+	ExtentFlagTreeBlock = uint64(extentFlagTreeBlock)
+)
+
+// ExtentInlineRef is a back reference stored inline in the extent item.
+type ExtentInlineRef struct {
+	Type KeyType
+	// Offset is a root id for tree block refs, or a parent block for shared refs.
+	Offset uint64
+	// Fields below are set for data refs only.
+	Root     uint64
+	ObjectID uint64
+	FileOff  uint64
+	Count    uint32
+}
+
+// ExtentItem is an EXTENT_ITEM or METADATA_ITEM from the extent tree.
+type ExtentItem struct {
+	Refs       uint64
+	Generation uint64
+	Flags      uint64
+	// Key and Level are only set for tree blocks stored as EXTENT_ITEM (non-skinny).
+	Key   DiskKey
+	Level uint8
+	// InlineRefs contains back references stored inline.
+	InlineRefs []ExtentInlineRef
+}
+
+// DecodeExtentItem decodes EXTENT_ITEM or METADATA_ITEM data.
+// Metadata flag must be set for METADATA_ITEM (skinny metadata).
+func DecodeExtentItem(p []byte, metadata bool) (ExtentItem, error) {
+	typ := extentItemKey
+	if metadata {
+		typ = metadataItemKey
+	}
+	const sz = 24
+	if len(p) < sz {
+		return ExtentItem{}, ErrItemSize{Type: typ, Size: len(p), Exp: sz}
+	}
+	it := ExtentItem{
+		Refs:       order.Uint64(p[0:]),
+		Generation: order.Uint64(p[8:]),
+		Flags:      order.Uint64(p[16:]),
+	}
+	p = p[sz:]
+	if !metadata && it.Flags&ExtentFlagTreeBlock != 0 {
+		// btrfs_tree_block_info
+		if len(p) < 18 {
+			return it, ErrItemSize{Type: typ, Size: sz + len(p), Exp: sz + 18}
+		}
+		it.Key = decodeDiskKey(p)
+		it.Level = p[17]
+		p = p[18:]
+	}
+	for len(p) > 0 {
+		ref := ExtentInlineRef{Type: KeyType(p[0])}
+		p = p[1:]
+		var n int
+		switch ref.Type {
+		case treeBlockRefKey, sharedBlockRefKey:
+			n = 8
+		case sharedDataRefKey:
+			n = 12
+		case extentDataRefKey:
+			n = 28
+		default:
+			return it, fmt.Errorf("btrfs: unknown inline ref type: %v", ref.Type)
+		}
+		if len(p) < n {
+			return it, fmt.Errorf("btrfs: truncated inline ref %v", ref.Type)
+		}
+		switch ref.Type {
+		case extentDataRefKey:
+			ref.Root = order.Uint64(p[0:])
+			ref.ObjectID = order.Uint64(p[8:])
+			ref.FileOff = order.Uint64(p[16:])
+			ref.Count = order.Uint32(p[24:])
+		case sharedDataRefKey:
+			ref.Offset = order.Uint64(p[0:])
+			ref.Count = order.Uint32(p[8:])
+		default:
+			ref.Offset = order.Uint64(p[0:])
+		}
+		it.InlineRefs = append(it.InlineRefs, ref)
+		p = p[n:]
+	}
+	return it, nil
+}
+
+// DevItem is a DEV_ITEM from the chunk tree that describes a single device.
+type DevItem struct {
+	DevID       uint64
+	TotalBytes  uint64
+	BytesUsed   uint64
+	IOAlign     uint32
+	IOWidth     uint32
+	SectorSize  uint32
+	Type        uint64
+	Generation  uint64
+	StartOffset uint64
+	DevGroup    uint32
+	SeekSpeed   uint8
+	Bandwidth   uint8
+	UUID        UUID
+	FSID        FSID
+}
+
+const devItemSize = 98
+
+// DecodeDevItem decodes DEV_ITEM data.
+func DecodeDevItem(p []byte) (DevItem, error) {
+	if len(p) < devItemSize {
+		return DevItem{}, ErrItemSize{Type: devItemKey, Size: len(p), Exp: devItemSize}
+	}
+	it := DevItem{
+		DevID:       order.Uint64(p[0:]),
+		TotalBytes:  order.Uint64(p[8:]),
+		BytesUsed:   order.Uint64(p[16:]),
+		IOAlign:     order.Uint32(p[24:]),
+		IOWidth:     order.Uint32(p[28:]),
+		SectorSize:  order.Uint32(p[32:]),
+		Type:        order.Uint64(p[36:]),
+		Generation:  order.Uint64(p[44:]),
+		StartOffset: order.Uint64(p[52:]),
+		DevGroup:    order.Uint32(p[60:]),
+		SeekSpeed:   p[64],
+		Bandwidth:   p[65],
+	}
+	copy(it.UUID[:], p[66:])
+	copy(it.FSID[:], p[82:])
+	return it, nil
+}
+
+// BlockGroupItem is a BLOCK_GROUP_ITEM from the extent tree (or the block group tree)
+// that tracks space usage of a chunk. The key of the item is (start, BLOCK_GROUP_ITEM, length).
+type BlockGroupItem struct {
+	Used          uint64
+	ChunkObjectID uint64
+	Flags         BlockGroupFlags
+}
+
+const blockGroupItemSize = 24
+
+// DecodeBlockGroupItem decodes BLOCK_GROUP_ITEM data.
+func DecodeBlockGroupItem(p []byte) (BlockGroupItem, error) {
+	if len(p) < blockGroupItemSize {
+		return BlockGroupItem{}, ErrItemSize{Type: blockGroupItemKey, Size: len(p), Exp: blockGroupItemSize}
+	}
+	return BlockGroupItem{
+		Used:          order.Uint64(p[0:]),
+		ChunkObjectID: order.Uint64(p[8:]),
+		Flags:         BlockGroupFlags(order.Uint64(p[16:])),
+	}, nil
+}
+
+// Stripe is a single stripe of a chunk.
+type Stripe struct {
+	DevID   uint64
+	Offset  uint64
+	DevUUID UUID
+}
+
+// ChunkItem is a CHUNK_ITEM from the chunk tree that maps a logical address range
+// to physical stripes.
+type ChunkItem struct {
+	Length     uint64
+	Owner      uint64
+	StripeLen  uint64
+	Type       BlockGroupFlags
+	IOAlign    uint32
+	IOWidth    uint32
+	SectorSize uint32
+	SubStripes uint16
+	Stripes    []Stripe
+}
+
+const (
+	chunkItemSize = 48
+	stripeSize    = 32
+)
+
+// DecodeChunkItem decodes CHUNK_ITEM data.
+func DecodeChunkItem(p []byte) (ChunkItem, error) {
+	if len(p) < chunkItemSize {
+		return ChunkItem{}, ErrItemSize{Type: chunkItemKey, Size: len(p), Exp: chunkItemSize + stripeSize}
+	}
+	it := ChunkItem{
+		Length:     order.Uint64(p[0:]),
+		Owner:      order.Uint64(p[8:]),
+		StripeLen:  order.Uint64(p[16:]),
+		Type:       BlockGroupFlags(order.Uint64(p[24:])),
+		IOAlign:    order.Uint32(p[32:]),
+		IOWidth:    order.Uint32(p[36:]),
+		SectorSize: order.Uint32(p[40:]),
+		SubStripes: order.Uint16(p[46:]),
+	}
+	n := int(order.Uint16(p[44:]))
+	if exp := chunkItemSize + n*stripeSize; len(p) < exp {
+		return ChunkItem{}, ErrItemSize{Type: chunkItemKey, Size: len(p), Exp: exp}
+	}
+	it.Stripes = make([]Stripe, n)
+	for i := range it.Stripes {
+		s := p[chunkItemSize+i*stripeSize:]
+		it.Stripes[i].DevID = order.Uint64(s[0:])
+		it.Stripes[i].Offset = order.Uint64(s[8:])
+		copy(it.Stripes[i].DevUUID[:], s[16:])
+	}
+	return it, nil
+}
+
+// DirItem is a single entry of DIR_ITEM, DIR_INDEX or XATTR_ITEM.
+type DirItem struct {
+	// Location is a key of the inode (INODE_ITEM) or of the subvolume (ROOT_ITEM)
+	// referenced by the entry. It is empty for extended attributes.
+	Location DiskKey
+	TransID  uint64
+	Type     uint8 // type of the entry, as in the d_type field of dirent
+	Name     string
+	Data     []byte // value of extended attributes
+}
+
+// DecodeDirItems decodes DIR_ITEM, DIR_INDEX and XATTR_ITEM data.
+// A single DIR_ITEM may contain multiple entries with colliding name hashes.
+func DecodeDirItems(p []byte) ([]DirItem, error) {
+	var out []DirItem
+	for len(p) > 0 {
+		if len(p) < dirItemSize {
+			return out, ErrItemSize{Type: dirItemKey, Size: len(p), Exp: dirItemSize}
+		}
+		dlen := int(order.Uint16(p[25:]))
+		nlen := int(order.Uint16(p[27:]))
+		if exp := dirItemSize + nlen + dlen; len(p) < exp {
+			return out, ErrItemSize{Type: dirItemKey, Size: len(p), Exp: exp}
+		}
+		it := DirItem{
+			Location: decodeDiskKey(p),
+			TransID:  order.Uint64(p[17:]),
+			Type:     p[29],
+			Name:     string(p[dirItemSize : dirItemSize+nlen]),
+		}
+		if dlen != 0 {
+			it.Data = append([]byte(nil), p[dirItemSize+nlen:dirItemSize+nlen+dlen]...)
+		}
+		out = append(out, it)
+		p = p[dirItemSize+nlen+dlen:]
+	}
+	return out, nil
+}
+
+// InodeRef is a single entry of INODE_REF. The key offset of the item is the parent directory.
+type InodeRef struct {
+	Index uint64 // index of the entry in the parent directory
+	Name  string
+}
+
+// DecodeInodeRefs decodes INODE_REF data, which contains names of all hard links
+// of an inode in a single parent directory.
+func DecodeInodeRefs(p []byte) ([]InodeRef, error) {
+	const sz = 10
+	var out []InodeRef
+	for len(p) > 0 {
+		if len(p) < sz {
+			return out, ErrItemSize{Type: inodeRefKey, Size: len(p), Exp: sz}
+		}
+		n := int(order.Uint16(p[8:]))
+		if len(p) < sz+n {
+			return out, ErrItemSize{Type: inodeRefKey, Size: len(p), Exp: sz + n}
+		}
+		out = append(out, InodeRef{Index: order.Uint64(p[0:]), Name: string(p[sz : sz+n])})
+		p = p[sz+n:]
+	}
+	return out, nil
+}
+
+// InodeExtref is a single entry of INODE_EXTREF, used when names of hard links
+// do not fit into a single INODE_REF item.
+type InodeExtref struct {
+	Parent uint64 // parent directory
+	Index  uint64 // index of the entry in the parent directory
+	Name   string
+}
+
+// DecodeInodeExtrefs decodes INODE_EXTREF data.
+func DecodeInodeExtrefs(p []byte) ([]InodeExtref, error) {
+	const sz = 18
+	var out []InodeExtref
+	for len(p) > 0 {
+		if len(p) < sz {
+			return out, ErrItemSize{Type: inodeExtrefKey, Size: len(p), Exp: sz}
+		}
+		n := int(order.Uint16(p[16:]))
+		if len(p) < sz+n {
+			return out, ErrItemSize{Type: inodeExtrefKey, Size: len(p), Exp: sz + n}
+		}
+		out = append(out, InodeExtref{
+			Parent: order.Uint64(p[0:]),
+			Index:  order.Uint64(p[8:]),
+			Name:   string(p[sz : sz+n]),
+		})
+		p = p[sz+n:]
+	}
+	return out, nil
+}
+
+// Decode decodes the item data according to its type. It returns one of
+// InodeItem, []InodeRef, []InodeExtref, []DirItem, RootItem, RootRef, FileExtentItem,
+// ExtentItem, BlockGroupItem, DevItem or ChunkItem.
+func (it SearchItem) Decode() (interface{}, error) {
+	switch it.Type {
+	case inodeItemKey:
+		return DecodeInodeItem(it.Data)
+	case inodeRefKey:
+		return DecodeInodeRefs(it.Data)
+	case inodeExtrefKey:
+		return DecodeInodeExtrefs(it.Data)
+	case dirItemKey, dirIndexKey, xattrItemKey:
+		return DecodeDirItems(it.Data)
+	case rootItemKey:
+		return DecodeRootItem(it.Data)
+	case rootRefKey, rootBackrefKey:
+		return DecodeRootRef(it.Data)
+	case extentDataKey:
+		return DecodeFileExtentItem(it.Data)
+	case extentItemKey, metadataItemKey:
+		return DecodeExtentItem(it.Data, it.Type == metadataItemKey)
+	case blockGroupItemKey:
+		return DecodeBlockGroupItem(it.Data)
+	case devItemKey:
+		return DecodeDevItem(it.Data)
+	case chunkItemKey:
+		return DecodeChunkItem(it.Data)
+	}
+	return nil, fmt.Errorf("btrfs: decoding of %v items is not supported", it.Type)
+}
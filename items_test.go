@@ -0,0 +1,147 @@
+package btrfs
+
+import "testing"
+
+func TestDecodeRootItem(t *testing.T) {
+	p := make([]byte, rootItemSize)
+	order.PutUint64(p[160:], 42)  // generation
+	order.PutUint32(p[216:], 1)   // refs
+	order.PutUint64(p[239:], 42)  // generation_v2
+	p[247] = 0xab                 // uuid
+	order.PutUint64(p[327:], 100) // ctime.sec
+	it, err := DecodeRootItem(p)
+	if err != nil {
+		t.Fatal(err)
+	} else if it.Gen != 42 || it.Refs != 1 || it.UUID[0] != 0xab || it.CTime.Unix() != 100 {
+		t.Fatalf("unexpected item: %+v", it)
+	}
+	// old kernels didn't update generation_v2
+	order.PutUint64(p[239:], 41)
+	if it, err = DecodeRootItem(p); err != nil {
+		t.Fatal(err)
+	} else if !it.UUID.IsZero() {
+		t.Fatalf("expected no uuid: %v", it.UUID)
+	}
+	if it, err = DecodeRootItem(p[:rootItemV1Size]); err != nil {
+		t.Fatal(err)
+	} else if it.Gen != 42 {
+		t.Fatalf("unexpected generation: %d", it.Gen)
+	}
+	if _, err = DecodeRootItem(p[:100]); err == nil {
+		t.Fatal("expected an error for short item")
+	}
+}
+
+func TestDecodeRootRef(t *testing.T) {
+	p := make([]byte, 18+3)
+	order.PutUint64(p[0:], 256)
+	order.PutUint16(p[16:], 3)
+	copy(p[18:], "sub")
+	ref, err := DecodeRootRef(p)
+	if err != nil {
+		t.Fatal(err)
+	} else if ref.DirID != 256 || ref.Name != "sub" {
+		t.Fatalf("unexpected ref: %+v", ref)
+	}
+	if _, err = DecodeRootRef(p[:20]); err == nil {
+		t.Fatal("expected an error for truncated name")
+	}
+}
+
+func TestDecodeDirItems(t *testing.T) {
+	var p []byte
+	for _, name := range []string{"a", "bc"} {
+		b := make([]byte, dirItemSize+len(name))
+		order.PutUint64(b[0:], 257)
+		b[8] = byte(inodeItemKey)
+		order.PutUint16(b[27:], uint16(len(name)))
+		b[29] = byte(ftRegFile)
+		copy(b[dirItemSize:], name)
+		p = append(p, b...)
+	}
+	list, err := DecodeDirItems(p)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(list) != 2 || list[0].Name != "a" || list[1].Name != "bc" || list[1].Location.ObjectID != 257 {
+		t.Fatalf("unexpected items: %+v", list)
+	}
+	if _, err = DecodeDirItems(p[:len(p)-1]); err == nil {
+		t.Fatal("expected an error for truncated name")
+	}
+}
+
+func TestDecodeInodeRefs(t *testing.T) {
+	p := make([]byte, 10+4)
+	order.PutUint64(p[0:], 2)
+	order.PutUint16(p[8:], 4)
+	copy(p[10:], "file")
+	list, err := DecodeInodeRefs(p)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 || list[0].Index != 2 || list[0].Name != "file" {
+		t.Fatalf("unexpected refs: %+v", list)
+	}
+}
+
+func TestDecodeChunkItem(t *testing.T) {
+	p := make([]byte, chunkItemSize+2*stripeSize)
+	order.PutUint64(p[0:], 1<<30)
+	order.PutUint64(p[24:], uint64(BlockGroupMetadata)|uint64(ProfileDup))
+	order.PutUint16(p[44:], 2)
+	order.PutUint64(p[chunkItemSize+stripeSize:], 1)
+	order.PutUint64(p[chunkItemSize+stripeSize+8:], 4096)
+	it, err := DecodeChunkItem(p)
+	if err != nil {
+		t.Fatal(err)
+	} else if it.Length != 1<<30 || len(it.Stripes) != 2 || it.Stripes[1].Offset != 4096 {
+		t.Fatalf("unexpected item: %+v", it)
+	} else if s := it.Type.String(); s != "Metadata, dup" {
+		t.Fatalf("unexpected type: %q", s)
+	}
+	if _, err = DecodeChunkItem(p[:chunkItemSize+stripeSize]); err == nil {
+		t.Fatal("expected an error for missing stripes")
+	}
+}
+
+func TestDecodeBlockGroupItem(t *testing.T) {
+	p := make([]byte, blockGroupItemSize)
+	order.PutUint64(p[0:], 12345)
+	order.PutUint64(p[8:], FirstChunkTreeID)
+	order.PutUint64(p[16:], uint64(BlockGroupData)|uint64(ProfileRAID1))
+	it, err := (SearchItem{Type: KeyBlockGroupItem, Data: p}).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bg := it.(BlockGroupItem)
+	if bg.Used != 12345 || bg.ChunkObjectID != FirstChunkTreeID || bg.Flags.Profile() != ProfileRAID1 {
+		t.Fatalf("unexpected item: %+v", bg)
+	}
+	if _, err = DecodeBlockGroupItem(p[:16]); err == nil {
+		t.Fatal("expected an error for a short item")
+	}
+}
+
+func TestDecodeExtentItem(t *testing.T) {
+	p := make([]byte, 24+29+13)
+	order.PutUint64(p[0:], 2)
+	order.PutUint64(p[16:], ExtentFlagData)
+	r := p[24:]
+	r[0] = byte(extentDataRefKey)
+	order.PutUint64(r[1:], 5)
+	order.PutUint64(r[9:], 257)
+	order.PutUint32(r[25:], 1)
+	r = r[29:]
+	r[0] = byte(sharedDataRefKey)
+	order.PutUint64(r[1:], 8192)
+	order.PutUint32(r[9:], 1)
+	it, err := DecodeExtentItem(p, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(it.InlineRefs) != 2 {
+		t.Fatalf("unexpected refs: %+v", it.InlineRefs)
+	} else if ref := it.InlineRefs[0]; ref.Root != 5 || ref.ObjectID != 257 || ref.Count != 1 {
+		t.Fatalf("unexpected data ref: %+v", ref)
+	} else if ref := it.InlineRefs[1]; ref.Offset != 8192 || ref.Count != 1 {
+		t.Fatalf("unexpected shared ref: %+v", ref)
+	}
+}
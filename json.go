@@ -0,0 +1,75 @@
+package btrfs
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalText encodes the UUID in the canonical format. Zero UUID is encoded as an empty string.
+func (id UUID) MarshalText() ([]byte, error) {
+	if id.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes a UUID encoded with MarshalText.
+func (id *UUID) UnmarshalText(p []byte) error {
+	if len(p) == 0 {
+		*id = UUID{}
+		return nil
+	}
+	v, err := ParseUUID(string(p))
+	if err != nil {
+		return err
+	}
+	*id = v
+	return nil
+}
+
+// MarshalText encodes the FSID as a hex string.
+func (id FSID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes a hex-encoded FSID.
+func (id *FSID) UnmarshalText(p []byte) error {
+	b, err := hex.DecodeString(string(p))
+	if err != nil || len(b) != FSIDSize {
+		return fmt.Errorf("invalid fsid: %q", p)
+	}
+	copy(id[:], b)
+	return nil
+}
+
+// MarshalText encodes the qgroup id in "level/id" format.
+func (id QgroupID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes a qgroup id in "level/id" format.
+func (id *QgroupID) UnmarshalText(p []byte) error {
+	v, err := ParseQgroupID(string(p))
+	if err != nil {
+		return err
+	}
+	*id = v
+	return nil
+}
+
+var subvolFlagNames = []string{
+	1: "RO",
+}
+
+// MarshalJSON encodes flags as a list of names.
+func (f SubvolFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(flagNames(uint64(f), subvolFlagNames))
+}
+
+// UnmarshalJSON decodes a list of flag names.
+func (f *SubvolFlags) UnmarshalJSON(p []byte) error {
+	v, err := unmarshalFlags(p, subvolFlagNames)
+	*f = SubvolFlags(v)
+	return err
+}
@@ -0,0 +1,62 @@
+package btrfs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	uuid, err := ParseUUID("0b2e8e95-7a1e-4b41-9d7b-5d3c1f0a2b3c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := SubvolInfo{
+		RootID: 257, Name: "a",
+		Flags: SubvolReadOnly,
+		UUID:  uuid,
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["uuid"] != uuid.String() || m["parent_uuid"] != "" {
+		t.Errorf("unexpected uuids: %s", data)
+	}
+	if flags, ok := m["flags"].([]interface{}); !ok || len(flags) != 1 || flags[0] != "RO" {
+		t.Errorf("unexpected flags: %s", data)
+	}
+	var back SubvolInfo
+	if err = json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	} else if back.UUID != uuid || back.RootID != 257 {
+		t.Errorf("unexpected decoded value: %+v", back)
+	}
+
+	feat := FSFeatureFlags{Incompatible: FeatureIncompatMixedBackRef | FeatureIncompatNoHoles | 1<<40}
+	data, err = json.Marshal(feat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `{"compat":[],"compat_ro":[],"incompat":["MixedBackRef","NoHoles","0x10000000000"]}`; string(data) != exp {
+		t.Errorf("unexpected features:\n%s\nvs\n%s", data, exp)
+	}
+
+	data, err = json.Marshal(FSFeatureFlags{Incompatible: FeatureIncompatCompressZSTD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `{"compat":[],"compat_ro":[],"incompat":["CompressZSTD"]}`; string(data) != exp {
+		t.Errorf("unexpected features:\n%s\nvs\n%s", data, exp)
+	}
+	// the old name of the bit is still accepted
+	var inc IncompatFeatures
+	if err = json.Unmarshal([]byte(`["CompressLZOv2"]`), &inc); err != nil {
+		t.Fatal(err)
+	} else if inc != FeatureIncompatCompressZSTD {
+		t.Errorf("unexpected features: %v", inc)
+	}
+}
@@ -0,0 +1,102 @@
+package btrfs
+
+import (
+	"os"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// logicalInoBufSize is the max output size accepted by LOGICAL_INO.
+	logicalInoBufSize = 64 * 1024
+	// logicalInoV2BufSize is the max output size accepted by LOGICAL_INO_V2.
+	logicalInoV2BufSize = 16 * 1024 * 1024
+)
+
+// LogicalInode is a reference to a logical address from a file.
+type LogicalInode struct {
+	Root   uint64 // subvolume tree id
+	Inode  uint64 // inode number in the subvolume
+	Offset uint64 // offset in the file
+}
+
+type logicalResolveOpts struct {
+	ignoreOffset bool
+	size         int
+}
+
+// LogicalResolveOption is an option for LogicalToInodes.
+type LogicalResolveOption func(*logicalResolveOpts)
+
+// LogicalIgnoreOffset returns all files referencing the extent that contains the logical
+// address, not only the ones that point exactly to it. Requires LOGICAL_INO_V2 (kernel 4.15+).
+func LogicalIgnoreOffset() LogicalResolveOption {
+	return func(o *logicalResolveOpts) {
+		o.ignoreOffset = true
+	}
+}
+
+// LogicalBufferSize sets the size of the output buffer. Sizes above 64k require LOGICAL_INO_V2.
+// By default, the buffer is grown as needed if the kernel supports it.
+func LogicalBufferSize(n int) LogicalResolveOption {
+	return func(o *logicalResolveOpts) {
+		o.size = n
+	}
+}
+
+// LogicalToInodes returns all inodes that reference the logical address.
+// It requires CAP_SYS_ADMIN.
+func (f *FS) LogicalToInodes(logical uint64, opts ...LogicalResolveOption) ([]LogicalInode, error) {
+	var o logicalResolveOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+	size, grow := o.size, false
+	if size <= 0 {
+		size, grow = logicalInoBufSize, true
+	}
+	if size > logicalInoV2BufSize {
+		size = logicalInoV2BufSize
+	}
+	v2 := o.ignoreOffset || size > logicalInoBufSize
+	for {
+		buf := make([]byte, size)
+		args := btrfs_ioctl_logical_ino_args{
+			logical: logical,
+			size:    uint64(len(buf)),
+			inodes:  uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		}
+		if o.ignoreOffset {
+			args.flags |= _BTRFS_LOGICAL_INO_ARGS_IGNORE_OFFSET
+		}
+		var err error
+		if v2 {
+			err = iocLogicalInoV2(f.file(), &args)
+		} else {
+			err = iocLogicalIno(f.file(), &args)
+		}
+		runtime.KeepAlive(buf)
+		if err != nil {
+			return nil, &os.PathError{Op: "logical ino", Path: f.f.Name(), Err: err}
+		}
+		hdr := (*btrfs_data_container)(unsafe.Pointer(&buf[0]))
+		if hdr.bytes_missing != 0 && grow && size < logicalInoV2BufSize {
+			size += int(hdr.bytes_missing)
+			if size > logicalInoV2BufSize {
+				size = logicalInoV2BufSize
+			}
+			v2 = true
+			continue
+		}
+		val := buf[dataContainerSize:]
+		out := make([]LogicalInode, 0, hdr.elem_cnt/3)
+		for i := 0; i+3 <= int(hdr.elem_cnt); i += 3 {
+			out = append(out, LogicalInode{
+				Inode:  order.Uint64(val[8*i:]),
+				Offset: order.Uint64(val[8*(i+1):]),
+				Root:   order.Uint64(val[8*(i+2):]),
+			})
+		}
+		return out, nil
+	}
+}
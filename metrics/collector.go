@@ -0,0 +1,232 @@
+// Package metrics exports statistics of btrfs filesystems to Prometheus.
+package metrics
+
+import (
+	"github.com/dennwc/btrfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+)
+
+const namespace = "btrfs"
+
+var (
+	descDeviceErrors = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "device", "errors_total"),
+		"Number of I/O errors of a device, by error type.",
+		[]string{"mount", "devid", "device", "type"}, nil,
+	)
+	descDeviceSize = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "device", "size_bytes"),
+		"Size of a device.",
+		[]string{"mount", "devid", "device"}, nil,
+	)
+	descDeviceUsed = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "device", "allocated_bytes"),
+		"Bytes of a device allocated for chunks.",
+		[]string{"mount", "devid", "device"}, nil,
+	)
+	descDeviceMissing = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "device", "missing"),
+		"Set to 1 if the device is missing from the filesystem.",
+		[]string{"mount", "devid", "device"}, nil,
+	)
+	descSpaceTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "space", "total_bytes"),
+		"Logical size of allocated chunks, by block group type and profile.",
+		[]string{"mount", "type", "profile"}, nil,
+	)
+	descSpaceUsed = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "space", "used_bytes"),
+		"Logical bytes used in allocated chunks, by block group type and profile.",
+		[]string{"mount", "type", "profile"}, nil,
+	)
+	descQgroupReferenced = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "qgroup", "referenced_bytes"),
+		"Bytes referenced by a quota group.",
+		[]string{"mount", "qgroup", "subvolume"}, nil,
+	)
+	descQgroupExclusive = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "qgroup", "exclusive_bytes"),
+		"Bytes referenced only by a quota group.",
+		[]string{"mount", "qgroup", "subvolume"}, nil,
+	)
+	descQgroupLimit = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "qgroup", "limit_bytes"),
+		"Size limit of a quota group, by limit type. Not reported if the limit is not set.",
+		[]string{"mount", "qgroup", "subvolume", "type"}, nil,
+	)
+	descScrapeError = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "error"),
+		"Set to 1 if statistics of the filesystem could not be collected.",
+		[]string{"mount"}, nil,
+	)
+)
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// Collector collects statistics of mounted btrfs filesystems.
+//
+// It reports device error counters and sizes, space usage by block group type,
+// and, if quota is enabled, the usage of quota groups with subvolume paths.
+// Most statistics require CAP_SYS_ADMIN.
+type Collector struct {
+	// Mounts is a list of mount points of filesystems to collect statistics from.
+	Mounts []string
+	// NoQgroups disables collection of qgroup usage, which may be slow
+	// on filesystems with a large number of subvolumes.
+	NoQgroups bool
+}
+
+// NewCollector creates a collector for given mount points.
+func NewCollector(mounts ...string) *Collector {
+	return &Collector{Mounts: mounts}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		descDeviceErrors, descDeviceSize, descDeviceUsed, descDeviceMissing,
+		descSpaceTotal, descSpaceUsed,
+		descQgroupReferenced, descQgroupExclusive, descQgroupLimit,
+		descScrapeError,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, mnt := range c.Mounts {
+		failed := 0.0
+		if err := c.collectFS(ch, mnt); err != nil {
+			failed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(descScrapeError, prometheus.GaugeValue, failed, mnt)
+	}
+}
+
+func (c *Collector) collectFS(ch chan<- prometheus.Metric, mnt string) error {
+	fs, err := btrfs.Open(mnt, true)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	if err = collectDevices(ch, fs, mnt); err != nil {
+		return err
+	}
+	if err = collectSpace(ch, fs, mnt); err != nil {
+		return err
+	}
+	if c.NoQgroups {
+		return nil
+	}
+	return collectQgroups(ch, fs, mnt)
+}
+
+func collectDevices(ch chan<- prometheus.Metric, fs *btrfs.FS, mnt string) error {
+	devs, err := fs.Devices()
+	if err != nil {
+		return err
+	}
+	for _, d := range devs {
+		labels := []string{mnt, strconv.FormatUint(d.DevID, 10), d.Path}
+		missing := 0.0
+		if d.Missing {
+			missing = 1
+		}
+		ch <- prometheus.MustNewConstMetric(descDeviceMissing, prometheus.GaugeValue, missing, labels...)
+		ch <- prometheus.MustNewConstMetric(descDeviceSize, prometheus.GaugeValue, float64(d.TotalBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(descDeviceUsed, prometheus.GaugeValue, float64(d.UsedBytes), labels...)
+		if d.Missing {
+			continue
+		}
+		st, err := fs.GetDevStats(d.DevID)
+		if err != nil {
+			return err
+		}
+		for _, v := range []struct {
+			typ string
+			val uint64
+		}{
+			{"write", st.WriteErrs},
+			{"read", st.ReadErrs},
+			{"flush", st.FlushErrs},
+			{"corruption", st.CorruptionErrs},
+			{"generation", st.GenerationErrs},
+		} {
+			ch <- prometheus.MustNewConstMetric(descDeviceErrors, prometheus.CounterValue, float64(v.val), append(labels, v.typ)...)
+		}
+	}
+	return nil
+}
+
+// spaceType returns a lowercase name of the block group type, as used in metric labels.
+func spaceType(f btrfs.BlockGroupFlags) string {
+	var s []string
+	if f&btrfs.BlockGroupData != 0 {
+		s = append(s, "data")
+	}
+	if f&btrfs.BlockGroupMetadata != 0 {
+		s = append(s, "metadata")
+	}
+	if f&btrfs.BlockGroupSystem != 0 {
+		s = append(s, "system")
+	}
+	if f&btrfs.BlockGroupGlobalReserve != 0 {
+		s = append(s, "globalreserve")
+	}
+	if len(s) == 0 {
+		return "unknown"
+	}
+	return strings.Join(s, "+")
+}
+
+func collectSpace(ch chan<- prometheus.Metric, fs *btrfs.FS, mnt string) error {
+	list, err := fs.SpaceInfo()
+	if err != nil {
+		return err
+	}
+	for _, s := range list {
+		labels := []string{mnt, spaceType(s.Type), s.Type.Profile().String()}
+		ch <- prometheus.MustNewConstMetric(descSpaceTotal, prometheus.GaugeValue, float64(s.TotalBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(descSpaceUsed, prometheus.GaugeValue, float64(s.UsedBytes), labels...)
+	}
+	return nil
+}
+
+func collectQgroups(ch chan<- prometheus.Metric, fs *btrfs.FS, mnt string) error {
+	qgroups, err := fs.Qgroups()
+	if err == btrfs.ErrQuotaNotEnabled {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	subvols, err := fs.ListSubvolumes(nil)
+	if err != nil {
+		return err
+	}
+	paths := make(map[uint64]string, len(subvols))
+	for _, s := range subvols {
+		paths[uint64(s.RootID)] = s.Path
+	}
+	for _, q := range qgroups {
+		var path string
+		if q.ID.Level() == 0 {
+			path = paths[q.ID.ID()]
+			if path == "" && q.ID.ID() == btrfs.FSTreeID {
+				path = "/"
+			}
+		}
+		labels := []string{mnt, q.ID.String(), path}
+		ch <- prometheus.MustNewConstMetric(descQgroupReferenced, prometheus.GaugeValue, float64(q.Referenced), labels...)
+		ch <- prometheus.MustNewConstMetric(descQgroupExclusive, prometheus.GaugeValue, float64(q.Exclusive), labels...)
+		if q.Limit.Referenced != 0 {
+			ch <- prometheus.MustNewConstMetric(descQgroupLimit, prometheus.GaugeValue, float64(q.Limit.Referenced), append(labels, "referenced")...)
+		}
+		if q.Limit.Exclusive != 0 {
+			ch <- prometheus.MustNewConstMetric(descQgroupLimit, prometheus.GaugeValue, float64(q.Limit.Exclusive), append(labels, "exclusive")...)
+		}
+	}
+	return nil
+}
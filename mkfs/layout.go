@@ -0,0 +1,416 @@
+package mkfs
+
+import (
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+	"hash/crc32"
+	"sort"
+	"time"
+)
+
+const (
+	maxUint64 = 1<<64 - 1
+
+	firstChunk  = 1 << 20 // the first megabyte is reserved for the boot loader and the superblock
+	sysChunkLen = 4 << 20
+	minMetaLen  = 8 << 20
+	maxMetaLen  = 256 << 20
+	minDataLen  = 8 << 20
+	maxDataLen  = 1 << 30
+	stripeLen   = 64 << 10
+
+	generation = 1 // transaction id of the initial commit
+
+	headerSize = 101
+	itemSize   = 25
+
+	devItemSize  = 98
+	dirItemSize  = 30
+	rootItemSize = 439
+
+	devItemsObjectID      = 1
+	rootTreeDirObjectID   = 6
+	firstChunkTreeID      = btrfs.FirstChunkTreeID
+	dataRelocTreeObjectID = 1<<64 - 9
+
+	headerFlagWritten   = 1 << 0
+	mixedBackrefRev     = 1
+	ftDir               = 2 // BTRFS_FT_DIR
+	blockGroupItemSize  = 24
+	devExtentSize       = 48
+	treeBlockRefKeySize = 1 + 8
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// nameHash computes a hash of a directory entry name, used as a DIR_ITEM key offset.
+func nameHash(name string) uint64 {
+	// btrfs uses raw crc32c with ~1 seed and without the final inversion
+	return uint64(^crc32.Update(1, crc32c, []byte(name)))
+}
+
+// chunk is a single-stripe chunk of the new filesystem.
+type chunk struct {
+	logical, physical, length uint64
+	flags                     btrfs.BlockGroupFlags
+	used                      uint64
+	next                      uint64 // next free logical address
+}
+
+type item struct {
+	key  btrfs.DiskKey
+	data []byte
+}
+
+type block struct {
+	physical uint64
+	data     []byte
+}
+
+// layout is the content of a new filesystem.
+type layout struct {
+	opts    MkfsOptions
+	size    uint64
+	fsid    btrfs.UUID
+	devUUID btrfs.UUID
+	chunkID btrfs.UUID // chunk tree uuid
+	now     time.Time
+
+	sys, meta, data *chunk
+	roots           map[uint64]uint64 // tree id -> logical address of the root block
+	blocks          []block
+
+	features btrfs.IncompatFeatures
+}
+
+func roundDown(v, align uint64) uint64 { return v / align * align }
+
+func clamp(v, min, max uint64) uint64 {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
+	}
+	return v
+}
+
+func newLayout(size uint64, opts MkfsOptions) (*layout, error) {
+	l := &layout{
+		opts: opts,
+		size: roundDown(size, uint64(opts.SectorSize)),
+		fsid: opts.UUID,
+		now:  time.Now(),
+		features: btrfs.FeatureIncompatMixedBackRef | btrfs.FeatureIncompatExtendedIRef |
+			btrfs.FeatureIncompatSkinnyMetadata | btrfs.FeatureIncompatNoHoles,
+	}
+	if opts.NodeSize > 4096 {
+		l.features |= btrfs.FeatureIncompatBigMetadata
+	}
+	var err error
+	if l.fsid.IsZero() {
+		if l.fsid, err = randomUUID(); err != nil {
+			return nil, err
+		}
+	}
+	if l.devUUID, err = randomUUID(); err != nil {
+		return nil, err
+	}
+	if l.chunkID, err = randomUUID(); err != nil {
+		return nil, err
+	}
+	metaLen := clamp(roundDown(l.size/16, 1<<20), minMetaLen, maxMetaLen)
+	dataLen := clamp(roundDown(l.size/8, 1<<20), minDataLen, maxDataLen)
+	if min := firstChunk + sysChunkLen + metaLen + dataLen; l.size < min {
+		return nil, fmt.Errorf("%w: %d bytes, need at least %d", ErrTooSmall, l.size, min)
+	}
+	// chunks are mapped to the same physical addresses for simplicity
+	newChunk := func(off, length uint64, flags btrfs.BlockGroupFlags) *chunk {
+		return &chunk{logical: off, physical: off, length: length, flags: flags, next: off}
+	}
+	l.sys = newChunk(firstChunk, sysChunkLen, btrfs.BlockGroupSystem)
+	l.meta = newChunk(l.sys.logical+l.sys.length, metaLen, btrfs.BlockGroupMetadata)
+	l.data = newChunk(l.meta.logical+l.meta.length, dataLen, btrfs.BlockGroupData)
+
+	trees := []uint64{
+		btrfs.ChunkTreeID, btrfs.RootTreeID, btrfs.ExtentTreeID, btrfs.DevTreeID,
+		btrfs.FSTreeID, btrfs.CsumTreeID, dataRelocTreeObjectID,
+	}
+	l.roots = make(map[uint64]uint64)
+	for _, id := range trees {
+		c := l.meta
+		if id == btrfs.ChunkTreeID {
+			c = l.sys
+		}
+		l.roots[id] = c.next
+		c.next += uint64(opts.NodeSize)
+		c.used += uint64(opts.NodeSize)
+	}
+	for _, id := range trees {
+		if err = l.addLeaf(id, l.treeItems(id)); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *layout) chunks() []*chunk {
+	return []*chunk{l.sys, l.meta, l.data}
+}
+
+// treeItems returns the initial content of a tree.
+func (l *layout) treeItems(id uint64) []item {
+	switch id {
+	case btrfs.ChunkTreeID:
+		items := []item{{key(devItemsObjectID, btrfs.KeyDevItem, 1), l.devItem()}}
+		for _, c := range l.chunks() {
+			items = append(items, item{key(firstChunkTreeID, btrfs.KeyChunkItem, c.logical), l.chunkItem(c)})
+		}
+		return items
+	case btrfs.RootTreeID:
+		var items []item
+		for tree, bytenr := range l.roots {
+			if tree == btrfs.RootTreeID || tree == btrfs.ChunkTreeID {
+				continue // referenced by the superblock
+			}
+			items = append(items, item{key(tree, btrfs.KeyRootItem, 0), l.rootItem(tree, bytenr)})
+		}
+		const name = "default"
+		return append(items,
+			item{key(rootTreeDirObjectID, btrfs.KeyInodeItem, 0), l.inodeItem()},
+			item{key(rootTreeDirObjectID, btrfs.KeyInodeRef, rootTreeDirObjectID), inodeRef(0, "..")},
+			item{key(rootTreeDirObjectID, btrfs.KeyDirItem, nameHash(name)),
+				dirItem(key(btrfs.FSTreeID, btrfs.KeyRootItem, maxUint64), ftDir, name)},
+		)
+	case btrfs.ExtentTreeID:
+		var items []item
+		for tree, bytenr := range l.roots {
+			items = append(items, item{key(bytenr, btrfs.KeyMetadataItem, 0), treeBlockExtent(tree)})
+		}
+		for _, c := range l.chunks() {
+			p := make([]byte, blockGroupItemSize)
+			order.PutUint64(p[0:], c.used)
+			order.PutUint64(p[8:], firstChunkTreeID)
+			order.PutUint64(p[16:], uint64(c.flags))
+			items = append(items, item{key(c.logical, btrfs.KeyBlockGroupItem, c.length), p})
+		}
+		return items
+	case btrfs.DevTreeID:
+		var items []item
+		for _, c := range l.chunks() {
+			p := make([]byte, devExtentSize)
+			order.PutUint64(p[0:], btrfs.ChunkTreeID)
+			order.PutUint64(p[8:], firstChunkTreeID)
+			order.PutUint64(p[16:], c.logical)
+			order.PutUint64(p[24:], c.length)
+			copy(p[32:], l.chunkID[:])
+			items = append(items, item{key(1, btrfs.KeyDevExtent, c.physical), p})
+		}
+		return items
+	case btrfs.FSTreeID, dataRelocTreeObjectID:
+		return []item{
+			{key(btrfs.FirstFreeID, btrfs.KeyInodeItem, 0), l.inodeItem()},
+			{key(btrfs.FirstFreeID, btrfs.KeyInodeRef, btrfs.FirstFreeID), inodeRef(0, "..")},
+		}
+	}
+	return nil
+}
+
+func key(obj uint64, typ btrfs.KeyType, off uint64) btrfs.DiskKey {
+	return btrfs.DiskKey{ObjectID: obj, Type: byte(typ), Offset: off}
+}
+
+func putKey(p []byte, k btrfs.DiskKey) {
+	order.PutUint64(p[0:], k.ObjectID)
+	p[8] = k.Type
+	order.PutUint64(p[9:], k.Offset)
+}
+
+func less(a, b btrfs.DiskKey) bool {
+	if a.ObjectID != b.ObjectID {
+		return a.ObjectID < b.ObjectID
+	} else if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	return a.Offset < b.Offset
+}
+
+// addLeaf encodes the root leaf of a tree.
+func (l *layout) addLeaf(tree uint64, items []item) error {
+	sort.Slice(items, func(i, j int) bool { return less(items[i].key, items[j].key) })
+	bytenr := l.roots[tree]
+	p := make([]byte, l.opts.NodeSize)
+	copy(p[32:], l.fsid[:])
+	order.PutUint64(p[48:], bytenr)
+	order.PutUint64(p[56:], headerFlagWritten|mixedBackrefRev<<56)
+	copy(p[64:], l.chunkID[:])
+	order.PutUint64(p[80:], generation)
+	order.PutUint64(p[88:], tree)
+	order.PutUint32(p[96:], uint32(len(items)))
+	end := len(p) - headerSize
+	for i, it := range items {
+		end -= len(it.data)
+		if end < (i+1)*itemSize {
+			return fmt.Errorf("mkfs: tree %d does not fit into a single node", tree)
+		}
+		copy(p[headerSize+end:], it.data)
+		b := p[headerSize+i*itemSize:]
+		putKey(b, it.key)
+		order.PutUint32(b[17:], uint32(end))
+		order.PutUint32(b[21:], uint32(len(it.data)))
+	}
+	sum, err := btrfsdump.ChecksumBlock(l.opts.CsumType, p[32:])
+	if err != nil {
+		return err
+	}
+	copy(p, sum)
+	c := l.meta
+	if tree == btrfs.ChunkTreeID {
+		c = l.sys
+	}
+	l.blocks = append(l.blocks, block{physical: c.physical + (bytenr - c.logical), data: p})
+	return nil
+}
+
+// devItem encodes btrfs_dev_item of the only device.
+func (l *layout) devItem() []byte {
+	p := make([]byte, devItemSize)
+	order.PutUint64(p[0:], 1) // devid
+	order.PutUint64(p[8:], l.size)
+	var used uint64
+	for _, c := range l.chunks() {
+		used += c.length
+	}
+	order.PutUint64(p[16:], used)
+	order.PutUint32(p[24:], l.opts.SectorSize) // io_align
+	order.PutUint32(p[28:], l.opts.SectorSize) // io_width
+	order.PutUint32(p[32:], l.opts.SectorSize)
+	copy(p[66:], l.devUUID[:])
+	copy(p[82:], l.fsid[:])
+	return p
+}
+
+func (l *layout) chunkItem(c *chunk) []byte {
+	p := make([]byte, 48+32)
+	order.PutUint64(p[0:], c.length)
+	order.PutUint64(p[8:], btrfs.ExtentTreeID) // owner
+	order.PutUint64(p[16:], stripeLen)
+	order.PutUint64(p[24:], uint64(c.flags))
+	order.PutUint32(p[32:], stripeLen) // io_align
+	order.PutUint32(p[36:], stripeLen) // io_width
+	order.PutUint32(p[40:], l.opts.SectorSize)
+	order.PutUint16(p[44:], 1) // num_stripes
+	order.PutUint16(p[46:], 1) // sub_stripes
+	order.PutUint64(p[48:], 1) // devid
+	order.PutUint64(p[56:], c.physical)
+	copy(p[64:], l.devUUID[:])
+	return p
+}
+
+// inodeItem encodes an empty directory inode.
+func (l *layout) inodeItem() []byte {
+	p := make([]byte, 160)
+	order.PutUint64(p[0:], generation)
+	order.PutUint64(p[8:], generation)
+	order.PutUint64(p[24:], uint64(l.opts.NodeSize)) // nbytes
+	order.PutUint32(p[40:], 1)                       // nlink
+	order.PutUint32(p[52:], 040755)
+	for off := 112; off < 160; off += 12 {
+		encodeTime(p[off:], l.now)
+	}
+	return p
+}
+
+func (l *layout) rootItem(tree, bytenr uint64) []byte {
+	p := make([]byte, rootItemSize)
+	copy(p, l.inodeItem())
+	order.PutUint64(p[16:], 3) // size of the root inode, as set by mkfs.btrfs
+	order.PutUint64(p[160:], generation)
+	if tree == btrfs.FSTreeID || tree == dataRelocTreeObjectID {
+		order.PutUint64(p[168:], btrfs.FirstFreeID) // root dir
+	}
+	order.PutUint64(p[176:], bytenr)
+	order.PutUint64(p[192:], uint64(l.opts.NodeSize)) // bytes used
+	order.PutUint32(p[216:], 1)                       // refs
+	order.PutUint64(p[239:], generation)              // generation_v2
+	if tree == btrfs.FSTreeID {
+		if id, err := randomUUID(); err == nil {
+			copy(p[247:], id[:])
+		}
+	}
+	order.PutUint64(p[295:], generation) // ctransid
+	order.PutUint64(p[303:], generation) // otransid
+	encodeTime(p[327:], l.now)
+	encodeTime(p[339:], l.now)
+	return p
+}
+
+func inodeRef(index uint64, name string) []byte {
+	p := make([]byte, 10+len(name))
+	order.PutUint64(p[0:], index)
+	order.PutUint16(p[8:], uint16(len(name)))
+	copy(p[10:], name)
+	return p
+}
+
+func dirItem(loc btrfs.DiskKey, typ uint8, name string) []byte {
+	p := make([]byte, dirItemSize+len(name))
+	putKey(p, loc)
+	order.PutUint64(p[17:], generation)
+	order.PutUint16(p[27:], uint16(len(name)))
+	p[29] = typ
+	copy(p[dirItemSize:], name)
+	return p
+}
+
+// treeBlockExtent encodes a skinny METADATA_ITEM with a single inline tree block reference.
+func treeBlockExtent(tree uint64) []byte {
+	p := make([]byte, 24+treeBlockRefKeySize)
+	order.PutUint64(p[0:], 1) // refs
+	order.PutUint64(p[8:], generation)
+	order.PutUint64(p[16:], btrfs.ExtentFlagTreeBlock)
+	p[24] = byte(btrfs.KeyTreeBlockRef)
+	order.PutUint64(p[25:], tree)
+	return p
+}
+
+// superblock encodes a superblock copy for a given offset.
+func (l *layout) superblock(off uint64) ([]byte, error) {
+	p := make([]byte, btrfsdump.SuperblockSize)
+	copy(p[32:], l.fsid[:])
+	order.PutUint64(p[48:], off)
+	order.PutUint64(p[64:], btrfsdump.SuperblockMagic)
+	order.PutUint64(p[72:], generation)
+	order.PutUint64(p[80:], l.roots[btrfs.RootTreeID])
+	order.PutUint64(p[88:], l.roots[btrfs.ChunkTreeID])
+	order.PutUint64(p[112:], l.size)
+	var used uint64
+	for _, c := range l.chunks() {
+		used += c.used
+	}
+	order.PutUint64(p[120:], used)
+	order.PutUint64(p[128:], rootTreeDirObjectID)
+	order.PutUint64(p[136:], 1) // num_devices
+	order.PutUint32(p[144:], l.opts.SectorSize)
+	order.PutUint32(p[148:], l.opts.NodeSize)
+	order.PutUint32(p[152:], l.opts.NodeSize) // leafsize, unused
+	order.PutUint32(p[156:], l.opts.SectorSize)
+	order.PutUint64(p[164:], generation) // chunk_root_generation
+	order.PutUint64(p[188:], uint64(l.features))
+	order.PutUint16(p[196:], uint16(l.opts.CsumType))
+	copy(p[201:], l.devItem())
+	copy(p[299:], l.opts.Label)
+
+	// system chunks must be stored in the superblock to bootstrap the chunk tree
+	sys := p[811:]
+	putKey(sys, key(firstChunkTreeID, btrfs.KeyChunkItem, l.sys.logical))
+	n := copy(sys[17:], l.chunkItem(l.sys))
+	order.PutUint32(p[160:], uint32(17+n))
+
+	sum, err := btrfsdump.ChecksumBlock(l.opts.CsumType, p[32:])
+	if err != nil {
+		return nil, err
+	}
+	copy(p, sum)
+	return p, nil
+}
@@ -0,0 +1,161 @@
+// Package mkfs creates new btrfs filesystems without relying on mkfs.btrfs.
+package mkfs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+	"io"
+	"os"
+	"time"
+)
+
+var order = binary.LittleEndian
+
+// Default values of MkfsOptions.
+const (
+	DefaultNodeSize   = 16 << 10
+	DefaultSectorSize = 4096
+)
+
+// Limits of MkfsOptions.
+const (
+	MinNodeSize = 4 << 10
+	MaxNodeSize = 64 << 10
+	maxLabelLen = 255
+)
+
+var (
+	// ErrExists is returned when the device already contains a btrfs filesystem and Force is not set.
+	ErrExists = errors.New("mkfs: device already contains a btrfs filesystem")
+	// ErrTooSmall is returned when the device cannot hold the initial chunks.
+	ErrTooSmall = errors.New("mkfs: device is too small")
+)
+
+// MkfsOptions controls the layout of a new filesystem.
+type MkfsOptions struct {
+	// Label is the filesystem label, up to 255 bytes.
+	Label string
+	// NodeSize is the size of tree blocks. It must be a power of two between 4KiB and 64KiB,
+	// and not smaller than the sector size. DefaultNodeSize is used if not set.
+	NodeSize uint32
+	// SectorSize is the minimal allocation unit. It must be a power of two of at least 4KiB,
+	// and not larger than the page size, which is required by the kernel to mount the filesystem.
+	// DefaultSectorSize is used if not set.
+	SectorSize uint32
+	// CsumType is the checksum algorithm for data and metadata.
+	CsumType btrfs.CsumType
+	// UUID is the filesystem UUID. A random one is generated if not set.
+	UUID btrfs.UUID
+	// Size limits the size of the filesystem. The whole device is used if not set.
+	Size int64
+	// Force allows to overwrite an existing btrfs filesystem.
+	Force bool
+}
+
+func (opts *MkfsOptions) validate() error {
+	if opts.NodeSize == 0 {
+		opts.NodeSize = DefaultNodeSize
+	}
+	if opts.SectorSize == 0 {
+		opts.SectorSize = DefaultSectorSize
+	}
+	if opts.SectorSize&(opts.SectorSize-1) != 0 || opts.SectorSize < 4096 {
+		return fmt.Errorf("mkfs: invalid sector size: %d", opts.SectorSize)
+	} else if ps := os.Getpagesize(); int(opts.SectorSize) > ps {
+		return fmt.Errorf("mkfs: sector size %d is larger than the page size %d", opts.SectorSize, ps)
+	}
+	ns := opts.NodeSize
+	if ns&(ns-1) != 0 || ns < MinNodeSize || ns > MaxNodeSize || ns < opts.SectorSize {
+		return fmt.Errorf("mkfs: invalid node size: %d", ns)
+	}
+	if len(opts.Label) > maxLabelLen {
+		return fmt.Errorf("mkfs: label is too long: %d bytes", len(opts.Label))
+	}
+	if _, err := btrfsdump.ChecksumBlock(opts.CsumType, nil); err != nil {
+		return fmt.Errorf("mkfs: %v: %w", opts.CsumType, err)
+	}
+	return nil
+}
+
+// Format writes a new empty filesystem to a device or an image file.
+//
+// The filesystem uses a single profile for data and metadata, and contains only
+// the top-level subvolume, which is also set as the default one.
+// Additional chunks are allocated by the kernel as needed, once the filesystem is mounted.
+func Format(device string, opts MkfsOptions) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size := opts.Size
+	if size == 0 {
+		// works for both regular files and block devices
+		if size, err = f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	if !opts.Force {
+		if sb, _ := btrfsdump.ReadSuperblock(f, btrfsdump.SuperblockOffsets[0]); sb != nil {
+			return ErrExists
+		}
+	}
+	if err = write(f, size, opts); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// write formats the device of a given size.
+func write(w io.WriterAt, size int64, opts MkfsOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	l, err := newLayout(uint64(size), opts)
+	if err != nil {
+		return err
+	}
+	// wipe signatures of other filesystems at the start of the device
+	if _, err = w.WriteAt(make([]byte, firstChunk), 0); err != nil {
+		return err
+	}
+	for _, b := range l.blocks {
+		if _, err = w.WriteAt(b.data, int64(b.physical)); err != nil {
+			return err
+		}
+	}
+	for _, off := range btrfsdump.SuperblockOffsets {
+		if uint64(off)+btrfsdump.SuperblockSize > l.size {
+			break
+		}
+		sb, err := l.superblock(uint64(off))
+		if err != nil {
+			return err
+		}
+		if _, err = w.WriteAt(sb, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomUUID() (btrfs.UUID, error) {
+	var id btrfs.UUID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	// version 4, variant 1
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id, nil
+}
+
+// encodeTime encodes btrfs_timespec.
+func encodeTime(p []byte, t time.Time) {
+	order.PutUint64(p[0:], uint64(t.Unix()))
+	order.PutUint32(p[8:], uint32(t.Nanosecond()))
+}
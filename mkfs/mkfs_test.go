@@ -0,0 +1,146 @@
+package mkfs
+
+import (
+	"errors"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+	"github.com/dennwc/btrfs/check"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestNameHash(t *testing.T) {
+	// as seen in the root tree of any btrfs filesystem
+	if h := nameHash("default"); h != 2378154706 {
+		t.Fatalf("unexpected hash: %d", h)
+	}
+}
+
+func newImage(t *testing.T, size int64) string {
+	path := filepath.Join(t.TempDir(), "image")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFormat(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts MkfsOptions
+	}{
+		{name: "default", opts: MkfsOptions{Label: "test"}},
+		{name: "sha256", opts: MkfsOptions{NodeSize: 4096, CsumType: btrfs.CsumSHA256}},
+		{name: "xxhash64", opts: MkfsOptions{CsumType: btrfs.CsumXXHash64}},
+		{name: "blake2b", opts: MkfsOptions{CsumType: btrfs.CsumBLAKE2b}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := newImage(t, 100<<20)
+			if err := Format(path, c.opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := Format(path, c.opts); err != ErrExists {
+				t.Fatalf("expected an error, got: %v", err)
+			}
+			copies, err := btrfsdump.ReadSuperblocksFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, sc := range copies[:2] {
+				if sc.Err != nil {
+					t.Fatalf("superblock at %d: %v", sc.Offset, sc.Err)
+				} else if sc.Super.Label != c.opts.Label {
+					t.Fatalf("unexpected label: %q", sc.Super.Label)
+				}
+			}
+			rep, err := check.Files(check.Options{}, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range rep.Findings {
+				t.Error(f)
+			}
+			if rep.Trees != 7 {
+				t.Fatalf("unexpected number of trees: %d", rep.Trees)
+			}
+		})
+	}
+}
+
+func TestFormatOptions(t *testing.T) {
+	path := newImage(t, 10<<20)
+	if err := Format(path, MkfsOptions{}); !errors.Is(err, ErrTooSmall) {
+		t.Fatalf("expected an error, got: %v", err)
+	}
+	path = newImage(t, 100<<20)
+	for _, opts := range []MkfsOptions{
+		{NodeSize: 3000},
+		{NodeSize: 128 << 10},
+		{NodeSize: 4096, SectorSize: 8192},
+		{NodeSize: MaxNodeSize, SectorSize: 2 * uint32(os.Getpagesize())},
+		{CsumType: btrfs.CsumType(100)},
+	} {
+		if err := Format(path, opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestFormatBtrfsCheck(t *testing.T) {
+	if _, err := exec.LookPath("btrfs"); err != nil {
+		t.Skip("btrfs-progs are not installed")
+	}
+	for _, c := range []struct {
+		name string
+		opts MkfsOptions
+	}{
+		{name: "default", opts: MkfsOptions{Label: "test"}},
+		{name: "sha256", opts: MkfsOptions{NodeSize: 4096, CsumType: btrfs.CsumSHA256}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := newImage(t, 100<<20)
+			if err := Format(path, c.opts); err != nil {
+				t.Fatal(err)
+			}
+			out, err := exec.Command("btrfs", "check", "--readonly", path).CombinedOutput()
+			if err != nil {
+				t.Fatalf("btrfs check failed: %v\n%s", err, out)
+			}
+		})
+	}
+}
+
+func TestSeeding(t *testing.T) {
+	path := newImage(t, 100<<20)
+	if err := Format(path, MkfsOptions{CsumType: btrfs.CsumXXHash64}); err != nil {
+		t.Fatal(err)
+	}
+	for _, seeding := range []bool{true, false} {
+		if err := btrfs.SetSeeding(path, seeding); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := btrfs.IsSeeding(path); err != nil {
+			t.Fatal(err)
+		} else if ok != seeding {
+			t.Fatalf("unexpected seeding flag: %v", ok)
+		}
+		copies, err := btrfsdump.ReadSuperblocksFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sc := range copies[:2] {
+			if sc.Err != nil {
+				t.Fatalf("superblock at %d: %v", sc.Offset, sc.Err)
+			} else if got := sc.Super.Flags&btrfsdump.SuperFlagSeeding != 0; got != seeding {
+				t.Fatalf("unexpected flags at %d: %x", sc.Offset, sc.Super.Flags)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Flags of renameat2.
+const (
+	renameNoReplace = 1 << 0 // RENAME_NOREPLACE
+	renameExchange  = 1 << 1 // RENAME_EXCHANGE
+)
+
+// sysRenameat2 is the number of renameat2 syscall, which is not defined in syscall.
+var sysRenameat2 = map[string]uintptr{
+	"386":      353,
+	"amd64":    316,
+	"arm":      382,
+	"arm64":    276,
+	"loong64":  276,
+	"mips":     4351,
+	"mipsle":   4351,
+	"mips64":   5311,
+	"mips64le": 5311,
+	"ppc64":    357,
+	"ppc64le":  357,
+	"riscv64":  276,
+	"s390x":    347,
+}[runtime.GOARCH]
+
+func renameat2(olddir *os.File, oldpath string, newdir *os.File, newpath string, flags uint) error {
+	if sysRenameat2 == 0 {
+		return syscall.ENOSYS
+	}
+	p1, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	p2, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	return withFd(olddir, func(oldfd int) error {
+		return withFd(newdir, func(newfd int) error {
+			_, _, errno := syscall.Syscall6(sysRenameat2,
+				uintptr(oldfd), uintptr(unsafe.Pointer(p1)),
+				uintptr(newfd), uintptr(unsafe.Pointer(p2)),
+				uintptr(flags), 0)
+			if errno != 0 {
+				return errno
+			}
+			return nil
+		})
+	})
+}
+
+// PromoteSnapshot atomically replaces the subvolume at current with a snapshot by exchanging
+// their paths with renameat2(RENAME_EXCHANGE). After the swap, the old subvolume is at the path
+// of the snapshot, thus calling PromoteSnapshot again rolls the change back.
+//
+// Both subvolumes must be on the same filesystem, and the snapshot must be writable: take
+// a writable snapshot of a read-only one first. Processes that have files open in the old
+// subvolume, or use it as a working directory, keep using it. If current is a mount point,
+// the swap fails with EBUSY. It requires kernel 4.7+.
+func PromoteSnapshot(current, snapshot string) error {
+	return promoteSnapshotAt(nil, current, snapshot)
+}
+
+// PromoteSnapshot swaps subvolumes like the PromoteSnapshot function.
+// Relative paths are resolved against the opened directory.
+func (f *FS) PromoteSnapshot(current, snapshot string) error {
+	return promoteSnapshotAt(f.f, current, snapshot)
+}
+
+// promoteSnapshotAt swaps two subvolumes at paths relative to dir. See openAt.
+func promoteSnapshotAt(dir *os.File, current, snapshot string) error {
+	cur, err := openSubvolumeAt("promote snapshot", dir, current)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	snap, err := openSubvolumeAt("promote snapshot", dir, snapshot)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	if flags, err := iocSubvolGetflags(snap); err != nil {
+		return &os.PathError{Op: "get flags", Path: snap.Name(), Err: err}
+	} else if flags.ReadOnly() {
+		return &os.PathError{Op: "promote snapshot", Path: snap.Name(), Err: ErrReadOnlySnapshot}
+	}
+	cinfo, err := iocFsInfo(cur)
+	if err != nil {
+		return &os.PathError{Op: "fs info", Path: cur.Name(), Err: err}
+	}
+	sinfo, err := iocFsInfo(snap)
+	if err != nil {
+		return &os.PathError{Op: "fs info", Path: snap.Name(), Err: err}
+	} else if cinfo.fsid != sinfo.fsid {
+		return fmt.Errorf("%s and %s are on different filesystems", cur.Name(), snap.Name())
+	}
+	cdir, cname, err := openParentAt(dir, current)
+	if err != nil {
+		return err
+	}
+	defer cdir.Close()
+	sdir, sname, err := openParentAt(dir, snapshot)
+	if err != nil {
+		return err
+	}
+	defer sdir.Close()
+	if err = renameat2(sdir, sname, cdir, cname, renameExchange); err != nil {
+		return &os.LinkError{Op: "exchange", Old: snap.Name(), New: cur.Name(), Err: err}
+	}
+	return nil
+}
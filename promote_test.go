@@ -0,0 +1,40 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRenameExchange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_exchange_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{"a": "1", "b": "2"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err = renameat2(d, "a", d, "b", renameExchange); err == syscall.ENOSYS || err == syscall.EINVAL {
+		t.Skip("exchange is not supported:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	for name, exp := range map[string]string{"a": "2", "b": "1"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		} else if string(data) != exp {
+			t.Errorf("unexpected data in %s: %q vs %q", name, data, exp)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package btrfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// PropertyObject is a type of object that property can be applied to.
+type PropertyObject int
+
+const (
+	PropertyInode PropertyObject = 1 << iota
+	PropertySubvol
+	PropertyFilesystem
+)
+
+// Property describes a btrfs property.
+type Property struct {
+	Name        string
+	Description string
+	Objects     PropertyObject
+}
+
+type propHandler struct {
+	Property
+	get func(path string) (string, error)
+	set func(path, value string) error
+}
+
+var properties = map[string]propHandler{
+	"ro": {
+		Property: Property{
+			Name:        "ro",
+			Description: "read-only status of a subvolume",
+			Objects:     PropertySubvol,
+		},
+		get: getPropReadOnly,
+		set: setPropReadOnly,
+	},
+	"compression": {
+		Property: Property{
+			Name:        "compression",
+			Description: "compression algorithm for the file or directory",
+			Objects:     PropertyInode,
+		},
+		get: func(path string) (string, error) {
+			c, err := GetCompression(path)
+			return string(c), err
+		},
+		set: func(path, value string) error {
+			return SetCompression(path, Compression(value))
+		},
+	},
+	"label": {
+		Property: Property{
+			Name:        "label",
+			Description: "label of the filesystem",
+			Objects:     PropertyFilesystem,
+		},
+		get: getPropLabel,
+		set: setPropLabel,
+	},
+}
+
+func getPropReadOnly(path string) (string, error) {
+	ro, err := IsReadOnly(path)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatBool(ro), nil
+}
+
+func setPropReadOnly(path, value string) error {
+	ro, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for ro property: %q", value)
+	}
+	fs, err := Open(path, true)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	flags, err := fs.GetFlags()
+	if err != nil {
+		return err
+	}
+	if ro {
+		flags |= SubvolReadOnly
+	} else {
+		flags &^= SubvolReadOnly
+	}
+	return fs.SetFlags(flags)
+}
+
+func getPropLabel(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var buf [labelSize]byte
+	if err := iocGetFslabel(f, &buf); err != nil {
+		return "", &os.PathError{Op: "get label", Path: path, Err: err}
+	}
+	if i := bytes.IndexByte(buf[:], 0); i >= 0 {
+		return string(buf[:i]), nil
+	}
+	return string(buf[:]), nil
+}
+
+func setPropLabel(path, value string) error {
+	var buf [labelSize]byte
+	if len(value) >= len(buf) {
+		return fmt.Errorf("label is too long: %q", value)
+	}
+	copy(buf[:], value)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := iocSetFslabel(f, &buf); err != nil {
+		return &os.PathError{Op: "set label", Path: path, Err: err}
+	}
+	return nil
+}
+
+// propertyObjects detects types of objects the path refers to.
+func propertyObjects(path string) (PropertyObject, error) {
+	if ok, err := IsBtrfs(path); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, ErrNotBtrfs{Path: path}
+	}
+	obj := PropertyInode
+	if ok, err := IsSubVolume(path); err != nil {
+		return 0, err
+	} else if ok {
+		obj |= PropertySubvol
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	if root, err := findMountRoot(abs); err == nil && root == abs {
+		obj |= PropertyFilesystem
+	}
+	return obj, nil
+}
+
+func lookupProperty(path, name string) (propHandler, error) {
+	p, ok := properties[name]
+	if !ok {
+		return propHandler{}, fmt.Errorf("unknown property: %q", name)
+	}
+	obj, err := propertyObjects(path)
+	if err != nil {
+		return propHandler{}, err
+	} else if obj&p.Objects == 0 {
+		return propHandler{}, fmt.Errorf("property %q is not applicable to %s", name, path)
+	}
+	return p, nil
+}
+
+// GetProperty returns a value of a btrfs property of the object at path.
+// It is an equivalent of "btrfs property get".
+func GetProperty(path, name string) (string, error) {
+	p, err := lookupProperty(path, name)
+	if err != nil {
+		return "", err
+	}
+	return p.get(path)
+}
+
+// SetProperty sets a value of a btrfs property of the object at path.
+// It is an equivalent of "btrfs property set".
+func SetProperty(path, name, value string) error {
+	p, err := lookupProperty(path, name)
+	if err != nil {
+		return err
+	}
+	return p.set(path, value)
+}
+
+// ListProperties returns all properties applicable to the object at path.
+func ListProperties(path string) ([]Property, error) {
+	obj, err := propertyObjects(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []Property
+	for _, p := range properties {
+		if obj&p.Objects != 0 {
+			out = append(out, p.Property)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
@@ -0,0 +1,253 @@
+package btrfs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// QgroupID is an id of a quota group. It consists of a level and a subvolume or group id,
+// and is usually represented as "level/id" (e.g. "0/257" or "1/100").
+type QgroupID uint64
+
+// NewQgroupID creates a qgroup id from a level and an id.
+func NewQgroupID(level uint16, id uint64) QgroupID {
+	return QgroupID(uint64(level)<<qgroupLevelShift | id&(1<<qgroupLevelShift-1))
+}
+
+// Level returns the level of the qgroup. Level 0 qgroups correspond to subvolumes.
+func (id QgroupID) Level() uint16 {
+	return uint16(id >> qgroupLevelShift)
+}
+
+// ID returns the id part of the qgroup id. For level 0 it's the subvolume id.
+func (id QgroupID) ID() uint64 {
+	return uint64(id) & (1<<qgroupLevelShift - 1)
+}
+
+func (id QgroupID) String() string {
+	return strconv.FormatUint(uint64(id.Level()), 10) + "/" + strconv.FormatUint(id.ID(), 10)
+}
+
+// ParseQgroupID parses a qgroup id in "level/id" format. A single number is interpreted
+// as a level 0 qgroup (subvolume id).
+func ParseQgroupID(s string) (QgroupID, error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		id, err := strconv.ParseUint(s, 10, qgroupLevelShift)
+		if err != nil {
+			return 0, fmt.Errorf("invalid qgroup id: %q", s)
+		}
+		return QgroupID(id), nil
+	}
+	level, err := strconv.ParseUint(s[:i], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid qgroup level: %q", s)
+	}
+	id, err := strconv.ParseUint(s[i+1:], 10, qgroupLevelShift)
+	if err != nil {
+		return 0, fmt.Errorf("invalid qgroup id: %q", s)
+	}
+	return NewQgroupID(uint16(level), id), nil
+}
+
+func (f *FS) qgroupCreate(op string, create bool, id QgroupID) error {
+	args := btrfs_ioctl_qgroup_create_args{qgroupid: uint64(id)}
+	if create {
+		args.create = 1
+	}
+	if err := iocQgroupCreate(f.file(), &args); err != nil {
+		return fmt.Errorf("%s %v: %w", op, id, err)
+	}
+	return nil
+}
+
+// QgroupCreate creates a new quota group.
+func (f *FS) QgroupCreate(id QgroupID) error {
+	return f.qgroupCreate("qgroup create", true, id)
+}
+
+// QgroupDestroy removes a quota group.
+func (f *FS) QgroupDestroy(id QgroupID) error {
+	return f.qgroupCreate("qgroup destroy", false, id)
+}
+
+func (f *FS) qgroupAssign(op string, assign bool, child, parent QgroupID) error {
+	if child.Level() >= parent.Level() {
+		return fmt.Errorf("%s: parent level must be higher than child level (%v, %v)", op, child, parent)
+	}
+	args := btrfs_ioctl_qgroup_assign_args{src: uint64(child), dst: uint64(parent)}
+	if assign {
+		args.assign = 1
+	}
+	ret, err := iocQgroupAssign(f.file(), &args)
+	if err != nil {
+		return fmt.Errorf("%s %v to %v: %w", op, child, parent, err)
+	} else if ret > 0 {
+		// accounting is inconsistent now - schedule a rescan, as btrfs-progs does
+		if err = f.QuotaRescan(); err != nil && err != syscall.EINPROGRESS {
+			return err
+		}
+	}
+	return nil
+}
+
+// QgroupAssign makes the child qgroup a member of the parent qgroup.
+// Quota rescan is started automatically if accounting became inconsistent.
+func (f *FS) QgroupAssign(child, parent QgroupID) error {
+	return f.qgroupAssign("qgroup assign", true, child, parent)
+}
+
+// QgroupRemove removes the child qgroup from the parent qgroup.
+// Quota rescan is started automatically if accounting became inconsistent.
+func (f *FS) QgroupRemove(child, parent QgroupID) error {
+	return f.qgroupAssign("qgroup remove", false, child, parent)
+}
+
+// QgroupNoLimit can be used in QgroupLimit to remove an existing limit.
+const QgroupNoLimit = ^uint64(0)
+
+// QgroupLimit is a size limit of a quota group.
+type QgroupLimit struct {
+	// Referenced is a limit on the total amount of data referenced by the qgroup.
+	// Zero leaves current limit unchanged, QgroupNoLimit removes the limit.
+	Referenced uint64 `json:"referenced,omitempty"`
+	// Exclusive is a limit on the amount of data referenced only by this qgroup.
+	// Zero leaves current limit unchanged, QgroupNoLimit removes the limit.
+	Exclusive uint64 `json:"exclusive,omitempty"`
+	// Compressed applies limits to the compressed size of the data.
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+func (l QgroupLimit) toLimit() btrfs_qgroup_limit {
+	var lim btrfs_qgroup_limit
+	if l.Referenced != 0 {
+		lim.flags |= _BTRFS_QGROUP_LIMIT_MAX_RFER
+		lim.max_referenced = l.Referenced
+		if l.Compressed {
+			lim.flags |= _BTRFS_QGROUP_LIMIT_RFER_CMPR
+		}
+	}
+	if l.Exclusive != 0 {
+		lim.flags |= _BTRFS_QGROUP_LIMIT_MAX_EXCL
+		lim.max_exclusive = l.Exclusive
+		if l.Compressed {
+			lim.flags |= _BTRFS_QGROUP_LIMIT_EXCL_CMPR
+		}
+	}
+	return lim
+}
+
+// QgroupSetLimit sets size limits of a quota group.
+func (f *FS) QgroupSetLimit(id QgroupID, limit QgroupLimit) error {
+	args := btrfs_ioctl_qgroup_limit_args{
+		qgroupid: uint64(id),
+		lim:      limit.toLimit(),
+	}
+	if args.lim.flags == 0 {
+		return nil
+	}
+	if err := iocQgroupLimit(f.file(), &args); err != nil {
+		return fmt.Errorf("qgroup limit %v: %w", id, err)
+	}
+	return nil
+}
+
+// Qgroup is a quota group with its usage and limits.
+type Qgroup struct {
+	ID         QgroupID `json:"id"`
+	Generation uint64   `json:"generation"`
+
+	Referenced           uint64 `json:"referenced"` // bytes referenced by the qgroup
+	ReferencedCompressed uint64 `json:"referenced_compressed"`
+	Exclusive            uint64 `json:"exclusive"` // bytes referenced only by this qgroup
+	ExclusiveCompressed  uint64 `json:"exclusive_compressed"`
+
+	// Limit contains limits of the qgroup. Zero fields mean there is no limit.
+	Limit QgroupLimit `json:"limit"`
+
+	Parents  []QgroupID `json:"parents,omitempty"`
+	Children []QgroupID `json:"children,omitempty"`
+}
+
+const (
+	qgroupInfoItemSize  = 40
+	qgroupLimitItemSize = 40
+)
+
+// Qgroups returns all quota groups with their usage, limits and relations.
+// It returns ErrQuotaNotEnabled if quota is disabled on the filesystem.
+// It is an equivalent of "btrfs qgroup show -pcre" and requires CAP_SYS_ADMIN.
+func (f *FS) Qgroups() ([]Qgroup, error) {
+	it := newSearchIterator(f.file(), btrfs_ioctl_search_key{
+		tree_id:      quotaTreeObjectid,
+		max_objectid: maxUint64,
+		min_type:     qgroupInfoKey,
+		max_type:     qgroupRelationKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+	})
+	var (
+		list []QgroupID
+		m    = make(map[QgroupID]*Qgroup)
+	)
+	get := func(id QgroupID) *Qgroup {
+		g := m[id]
+		if g == nil {
+			g = &Qgroup{ID: id}
+			m[id] = g
+			list = append(list, id)
+		}
+		return g
+	}
+	for it.Next() {
+		item := it.Item()
+		p := item.Data
+		switch item.Type {
+		case qgroupInfoKey:
+			if len(p) < qgroupInfoItemSize {
+				return nil, ErrItemSize{Type: item.Type, Size: len(p), Exp: qgroupInfoItemSize}
+			}
+			g := get(QgroupID(item.Offset))
+			g.Generation = order.Uint64(p[0:])
+			g.Referenced = order.Uint64(p[8:])
+			g.ReferencedCompressed = order.Uint64(p[16:])
+			g.Exclusive = order.Uint64(p[24:])
+			g.ExclusiveCompressed = order.Uint64(p[32:])
+		case qgroupLimitKey:
+			if len(p) < qgroupLimitItemSize {
+				return nil, ErrItemSize{Type: item.Type, Size: len(p), Exp: qgroupLimitItemSize}
+			}
+			g := get(QgroupID(item.Offset))
+			flags := order.Uint64(p[0:])
+			if flags&_BTRFS_QGROUP_LIMIT_MAX_RFER != 0 {
+				g.Limit.Referenced = order.Uint64(p[8:])
+			}
+			if flags&_BTRFS_QGROUP_LIMIT_MAX_EXCL != 0 {
+				g.Limit.Exclusive = order.Uint64(p[16:])
+			}
+			g.Limit.Compressed = flags&(_BTRFS_QGROUP_LIMIT_RFER_CMPR|_BTRFS_QGROUP_LIMIT_EXCL_CMPR) != 0
+		case qgroupRelationKey:
+			// relations are stored in both directions; child always has a lower id
+			if item.ObjectID >= item.Offset {
+				continue
+			}
+			child, parent := get(QgroupID(item.ObjectID)), get(QgroupID(item.Offset))
+			child.Parents = append(child.Parents, parent.ID)
+			parent.Children = append(parent.Children, child.ID)
+		}
+	}
+	if err := it.Err(); err == syscall.ENOENT {
+		return nil, ErrQuotaNotEnabled
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	out := make([]Qgroup, 0, len(list))
+	for _, id := range list {
+		out = append(out, *m[id])
+	}
+	return out, nil
+}
@@ -0,0 +1,32 @@
+package btrfs
+
+import "testing"
+
+func TestQgroupID(t *testing.T) {
+	for _, c := range []struct {
+		s     string
+		level uint16
+		id    uint64
+		str   string
+	}{
+		{s: "0/257", level: 0, id: 257, str: "0/257"},
+		{s: "1/100", level: 1, id: 100, str: "1/100"},
+		{s: "258", level: 0, id: 258, str: "0/258"},
+	} {
+		q, err := ParseQgroupID(c.s)
+		if err != nil {
+			t.Fatal(err)
+		} else if q.Level() != c.level || q.ID() != c.id {
+			t.Fatalf("%q: unexpected qgroup: %d/%d", c.s, q.Level(), q.ID())
+		} else if s := q.String(); s != c.str {
+			t.Fatalf("%q: unexpected string: %q", c.s, s)
+		} else if q != NewQgroupID(c.level, c.id) {
+			t.Fatalf("%q: unexpected encoding: %#x", c.s, uint64(q))
+		}
+	}
+	for _, s := range []string{"", "1/", "/1", "a/1", "70000/1"} {
+		if _, err := ParseQgroupID(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
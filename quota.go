@@ -0,0 +1,66 @@
+package btrfs
+
+import (
+	"os"
+	"syscall"
+)
+
+func (f *FS) quotaCtl(op string, cmd uint64) error {
+	args := btrfs_ioctl_quota_ctl_args{cmd: cmd}
+	if err := iocQuotaCtl(f.file(), &args); err != nil {
+		return &os.PathError{Op: op, Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
+
+// QuotaEnable enables quota accounting on the filesystem.
+// Rescan of existing data is started automatically.
+func (f *FS) QuotaEnable() error {
+	return f.quotaCtl("quota enable", _BTRFS_QUOTA_CTL_ENABLE)
+}
+
+// QuotaDisable disables quota accounting and removes all qgroups.
+func (f *FS) QuotaDisable() error {
+	return f.quotaCtl("quota disable", _BTRFS_QUOTA_CTL_DISABLE)
+}
+
+// QuotaRescan starts a rescan of quota accounting for the whole filesystem.
+// It returns syscall.EINPROGRESS if rescan is already running.
+func (f *FS) QuotaRescan() error {
+	var args btrfs_ioctl_quota_rescan_args
+	if err := iocQuotaRescan(f.file(), &args); err != nil {
+		if err == syscall.EINPROGRESS {
+			return err
+		}
+		return &os.PathError{Op: "quota rescan", Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
+
+// QuotaRescanStatus is a status of quota rescan.
+type QuotaRescanStatus struct {
+	Running bool
+	// Progress is the last object id that was scanned.
+	Progress uint64
+}
+
+// QuotaRescanStatus returns the status of quota rescan.
+func (f *FS) QuotaRescanStatus() (QuotaRescanStatus, error) {
+	var args btrfs_ioctl_quota_rescan_args
+	if err := iocQuotaRescanStatus(f.file(), &args); err != nil {
+		return QuotaRescanStatus{}, &os.PathError{Op: "quota rescan status", Path: f.f.Name(), Err: err}
+	}
+	return QuotaRescanStatus{
+		Running:  args.flags != 0,
+		Progress: args.progress,
+	}, nil
+}
+
+// QuotaRescanWait waits until the currently running quota rescan finishes.
+// It returns immediately if there is no rescan in progress.
+func (f *FS) QuotaRescanWait() error {
+	if err := iocQuotaRescanWait(f.file()); err != nil {
+		return &os.PathError{Op: "quota rescan wait", Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
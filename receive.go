@@ -2,57 +2,75 @@ package btrfs
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"syscall"
 )
 
-const nativeReceive = false
-
+// Receive applies a send stream to dstDir using 'btrfs receive'.
+//
+// See the send package for a native implementation that dispatches stream
+// commands to a pluggable handler.
 func Receive(r io.Reader, dstDir string) error {
-	if !nativeReceive {
-		buf := bytes.NewBuffer(nil)
-		cmd := exec.Command("btrfs", "receive", dstDir)
-		cmd.Stdin = r
-		cmd.Stderr = buf
-		if err := cmd.Run(); err != nil {
-			if buf.Len() != 0 {
-				return errors.New(buf.String())
-			}
+	return ReceiveContext(context.Background(), r, dstDir)
+}
+
+// ReceiveContext is similar to Receive, but kills the receive process when the context is done.
+func ReceiveContext(ctx context.Context, r io.Reader, dstDir string) error {
+	return receiveAt(ctx, r, nil, dstDir)
+}
+
+// receiveAt is like ReceiveContext, but dstDir is relative to dir. See openAt.
+// The directory is passed to 'btrfs receive' as an open file descriptor.
+func receiveAt(ctx context.Context, r io.Reader, dir *os.File, dstDir string) error {
+	buf := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(ctx, "btrfs", "receive", dstDir)
+	if dir != nil {
+		dst, err := openDirAt(dir, dstDir)
+		if err != nil {
 			return err
 		}
-		return nil
+		defer dst.Close()
+		// the first extra file is fd 3 in the child process
+		cmd.Args[len(cmd.Args)-1] = fdPath(3)
+		cmd.ExtraFiles = []*os.File{dst}
 	}
-	var err error
-	dstDir, err = filepath.Abs(dstDir)
-	if err != nil {
-		return err
-	}
-	realMnt, err := findMountRoot(dstDir)
-	if err != nil {
+	cmd.Stdin = r
+	cmd.Stderr = buf
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if buf.Len() != 0 {
+			return errors.New(buf.String())
+		}
 		return err
 	}
-	dir, err := os.OpenFile(dstDir, os.O_RDONLY|syscall.O_NOATIME, 0755)
+	return nil
+}
+
+// SetReceivedSubvolume marks the subvolume at path as received from a subvolume
+// with a given UUID and transaction id. This information is used to find parents
+// for incremental streams.
+//
+// The subvolume must be writable; it is usually made read-only afterwards.
+func SetReceivedSubvolume(path string, uuid UUID, stransid uint64) error {
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	mnt, err := os.OpenFile(realMnt, os.O_RDONLY|syscall.O_NOATIME, 0755)
-	if err != nil {
-		return err
+	defer f.Close()
+	return setReceivedSubvolume(f, uuid, stransid)
+}
+
+func setReceivedSubvolume(f *os.File, uuid UUID, stransid uint64) error {
+	args := btrfs_ioctl_received_subvol_args{
+		uuid:     uuid,
+		stransid: stransid,
 	}
-	// We want to resolve the path to the subvolume we're sitting in
-	// so that we can adjust the paths of any subvols we want to receive in.
-	subvolID, err := getFileRootID(mnt)
-	if err != nil {
-		return err
+	if err := iocSetReceivedSubvol(f, &args); err != nil {
+		return &os.PathError{Op: "set received subvol", Path: f.Name(), Err: err}
 	}
-	//sr, err := send.NewStreamReader(r)
-	//if err != nil {
-	//	return err
-	//}
-	_, _ = dir, subvolID
-	panic("not implemented")
+	return nil
 }
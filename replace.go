@@ -0,0 +1,183 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+// ReplaceState is a state of the device replace operation.
+type ReplaceState uint64
+
+const (
+	ReplaceNeverStarted = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_NEVER_STARTED)
+	ReplaceStarted      = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_STARTED)
+	ReplaceFinished     = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_FINISHED)
+	ReplaceCanceled     = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_CANCELED)
+	ReplaceSuspended    = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_SUSPENDED)
+)
+
+var replaceStateNames = []string{
+	ReplaceNeverStarted: "never started",
+	ReplaceStarted:      "started",
+	ReplaceFinished:     "finished",
+	ReplaceCanceled:     "canceled",
+	ReplaceSuspended:    "suspended",
+}
+
+func (s ReplaceState) String() string {
+	if int(s) < len(replaceStateNames) {
+		return replaceStateNames[s]
+	}
+	return fmt.Sprintf("state %d", uint64(s))
+}
+
+// ReplaceStatus describes the progress of device replace operation.
+type ReplaceStatus struct {
+	State       ReplaceState
+	Progress    float64 // percent, 0 <= x <= 100
+	TimeStarted time.Time
+	TimeStopped time.Time
+
+	NumWriteErrors             uint64
+	NumUncorrectableReadErrors uint64
+
+	// SrcDevID, TotalBytes and LeftBytes are read from the device tree and might
+	// not be available without CAP_SYS_ADMIN.
+	SrcDevID   uint64
+	TotalBytes uint64
+	LeftBytes  uint64
+}
+
+func replaceResultErr(res uint64) error {
+	switch res {
+	case _BTRFS_IOCTL_DEV_REPLACE_RESULT_NO_ERROR:
+		return nil
+	case _BTRFS_IOCTL_DEV_REPLACE_RESULT_NOT_STARTED:
+		return ErrReplaceNotStarted
+	case _BTRFS_IOCTL_DEV_REPLACE_RESULT_ALREADY_STARTED:
+		return ErrReplaceAlreadyStarted
+	case _BTRFS_IOCTL_DEV_REPLACE_RESULT_SCRUB_INPROGRESS:
+		return ErrReplaceScrubInProgress
+	}
+	return fmt.Errorf("unknown device replace result: %d", res)
+}
+
+// ReplaceStart replaces the src device with the dst device and blocks until the operation
+// is completed or cancelled. Source device can be specified either by path or by device id.
+// If avoidSrc is set, the source device is read only if no other zero-defect mirror exists.
+func (f *FS) ReplaceStart(src, dst string, avoidSrc bool) error {
+	return f.replaceStart(src, dst, avoidSrc, notArmed)
+}
+
+// replaceStart starts a device replace and calls arm right before issuing the request. See withCancel.
+func (f *FS) replaceStart(src, dst string, avoidSrc bool, arm func() error) error {
+	if err := checkBlockDevice(dst); err != nil {
+		return err
+	}
+	var args btrfs_ioctl_dev_replace_args_u1
+	args.cmd = _BTRFS_IOCTL_DEV_REPLACE_CMD_START
+	if avoidSrc {
+		args.start.cont_reading_from_srcdev_mode = _BTRFS_IOCTL_DEV_REPLACE_CONT_READING_FROM_SRCDEV_MODE_AVOID
+	} else {
+		args.start.cont_reading_from_srcdev_mode = _BTRFS_IOCTL_DEV_REPLACE_CONT_READING_FROM_SRCDEV_MODE_ALWAYS
+	}
+	if id, err := strconv.ParseUint(src, 10, 64); err == nil {
+		args.start.srcdevid = id
+	} else if len(src) > devicePathNameMax {
+		return fmt.Errorf("device path is too long: %s", src)
+	} else {
+		copy(args.start.srcdev_name[:], src)
+	}
+	if len(dst) > devicePathNameMax {
+		return fmt.Errorf("device path is too long: %s", dst)
+	}
+	copy(args.start.tgtdev_name[:], dst)
+	if err := f.exclusive(func() error {
+		if err := arm(); err != nil {
+			return err
+		}
+		return iocDevReplace(f.file(), &args)
+	}); err != nil {
+		return &os.PathError{Op: "replace device", Path: src, Err: err}
+	}
+	return replaceResultErr(args.result)
+}
+
+// ReplaceContext is similar to ReplaceStart, but cancels the replace operation when the context is done.
+func (f *FS) ReplaceContext(ctx context.Context, src, dst string, avoidSrc bool) error {
+	return withCancel(ctx, f.ReplaceCancel, func(arm func() error) error {
+		return f.replaceStart(src, dst, avoidSrc, arm)
+	})
+}
+
+// ReplaceCancel cancels a running device replace operation.
+func (f *FS) ReplaceCancel() error {
+	var args btrfs_ioctl_dev_replace_args_u1
+	args.cmd = _BTRFS_IOCTL_DEV_REPLACE_CMD_CANCEL
+	if err := iocDevReplace(f.file(), &args); err != nil {
+		return err
+	}
+	return replaceResultErr(args.result)
+}
+
+// ReplaceStatus returns the status of the current or last device replace operation.
+func (f *FS) ReplaceStatus() (ReplaceStatus, error) {
+	var args btrfs_ioctl_dev_replace_args_u1
+	args.cmd = _BTRFS_IOCTL_DEV_REPLACE_CMD_STATUS
+	if err := iocDevReplace(f.file(), &args); err != nil {
+		return ReplaceStatus{}, err
+	} else if err = replaceResultErr(args.result); err != nil {
+		return ReplaceStatus{}, err
+	}
+	st := (*btrfs_ioctl_dev_replace_args_u2)(unsafe.Pointer(&args)).status
+	out := ReplaceStatus{
+		State:                      ReplaceState(st.replace_state),
+		Progress:                   float64(st.progress_1000) / 10,
+		NumWriteErrors:             st.num_write_errors,
+		NumUncorrectableReadErrors: st.num_uncorrectable_read_errors,
+	}
+	if st.time_started != 0 {
+		out.TimeStarted = time.Unix(int64(st.time_started), 0)
+	}
+	if st.time_stopped != 0 {
+		out.TimeStopped = time.Unix(int64(st.time_stopped), 0)
+	}
+	if out.State == ReplaceStarted || out.State == ReplaceSuspended {
+		if item, err := readDevReplaceItem(f.file()); err == nil {
+			out.SrcDevID = item.src_devid
+			if dev, err := iocDevInfo(f.file(), item.src_devid, UUID{}); err == nil {
+				out.TotalBytes = dev.total_bytes
+				if item.cursor_left < dev.total_bytes {
+					out.LeftBytes = dev.total_bytes - item.cursor_left
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// readDevReplaceItem reads the persistent device replace state from the device tree.
+func readDevReplaceItem(mnt ioctlFile) (*btrfs_dev_replace_item, error) {
+	res, err := treeSearchRaw(mnt, btrfs_ioctl_search_key{
+		tree_id:     devTreeObjectid,
+		min_type:    devReplaceKey,
+		max_type:    devReplaceKey,
+		max_transid: maxUint64,
+		nr_items:    1,
+	})
+	if err != nil {
+		return nil, err
+	} else if len(res) < 1 {
+		return nil, ErrNotFound
+	}
+	const sz = int(unsafe.Sizeof(btrfs_dev_replace_item{}))
+	if len(res[0].Data) < sz {
+		return nil, fmt.Errorf("btrfs: dev replace item with illegal size %d", len(res[0].Data))
+	}
+	item := *(*btrfs_dev_replace_item)(unsafe.Pointer(&res[0].Data[0]))
+	return &item, nil
+}
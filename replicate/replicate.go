@@ -0,0 +1,286 @@
+// Package replicate implements snapshot-based replication of btrfs subvolumes,
+// similar to btrbk: it creates read-only snapshots of a source subvolume and
+// transfers them incrementally to a target.
+package replicate
+
+import (
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/send"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTimeFormat is the default time format used in snapshot names.
+const DefaultTimeFormat = "20060102T150405"
+
+// Naming is a snapshot naming scheme: "<prefix>.<time>".
+type Naming struct {
+	Prefix     string // prefix of snapshot names
+	TimeFormat string // time format; DefaultTimeFormat if empty
+}
+
+func (n Naming) timeFormat() string {
+	if n.TimeFormat == "" {
+		return DefaultTimeFormat
+	}
+	return n.TimeFormat
+}
+
+// Name returns a snapshot name for a given time.
+func (n Naming) Name(t time.Time) string {
+	return n.Prefix + "." + t.Format(n.timeFormat())
+}
+
+// Parse extracts the time from a snapshot name.
+// It returns false if the name doesn't match the scheme.
+func (n Naming) Parse(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, n.Prefix+".") {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(n.timeFormat(), name[len(n.Prefix)+1:], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Snapshot is a snapshot that matches the naming scheme.
+type Snapshot struct {
+	Name string
+	Time time.Time
+}
+
+// List returns snapshots in dir that match the naming scheme, sorted by time.
+func (n Naming) List(dir string) ([]Snapshot, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []Snapshot
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		if t, ok := n.Parse(fi.Name()); ok {
+			out = append(out, Snapshot{Name: fi.Name(), Time: t})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Time.Before(out[j].Time)
+	})
+	return out, nil
+}
+
+// TargetSnapshot is a snapshot stored on the target.
+type TargetSnapshot struct {
+	Name         string
+	ReceivedUUID btrfs.UUID // zero, if unknown; such snapshots fail verification
+}
+
+// Target is a destination for replicated snapshots.
+type Target interface {
+	// Snapshots lists snapshots that were already received by the target.
+	Snapshots() ([]TargetSnapshot, error)
+	// Receive applies a send stream to the target.
+	Receive(r io.Reader) error
+}
+
+// LocalTarget is a directory on a local btrfs filesystem.
+type LocalTarget struct {
+	Dir string
+	// Native uses the native receive implementation instead of 'btrfs receive'.
+	Native bool
+}
+
+func (t LocalTarget) Snapshots() ([]TargetSnapshot, error) {
+	infos, err := ioutil.ReadDir(t.Dir)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := btrfs.Open(t.Dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	var out []TargetSnapshot
+	for _, fi := range infos {
+		path := filepath.Join(t.Dir, fi.Name())
+		if !fi.IsDir() {
+			continue
+		} else if ok, err := btrfs.IsSubVolume(path); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		info, err := fs.SubvolumeByPath(path)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, TargetSnapshot{Name: fi.Name(), ReceivedUUID: info.ReceivedUUID})
+	}
+	return out, nil
+}
+
+func (t LocalTarget) Receive(r io.Reader) error {
+	if t.Native {
+		return send.Receive(r, t.Dir)
+	}
+	return btrfs.Receive(r, t.Dir)
+}
+
+// StreamTarget writes send streams to a writer, e.g. a pipe to 'btrfs receive' on a remote host.
+// Since the target cannot be queried, the list of existing snapshots must be provided by the caller.
+type StreamTarget struct {
+	W        io.Writer
+	Existing []TargetSnapshot
+}
+
+func (t StreamTarget) Snapshots() ([]TargetSnapshot, error) {
+	return t.Existing, nil
+}
+
+func (t StreamTarget) Receive(r io.Reader) error {
+	_, err := io.Copy(t.W, r)
+	return err
+}
+
+// Config describes a replication job.
+type Config struct {
+	Source      string // source subvolume
+	SnapshotDir string // directory for source snapshots; must be on the same filesystem
+	Naming      Naming // snapshot naming scheme; prefix defaults to the source name
+	Target      Target
+}
+
+// Result describes a completed replication.
+type Result struct {
+	Snapshot string // name of the created snapshot
+	Parent   string // name of the parent used for incremental send; empty for full send
+	Verified bool   // the target reported the snapshot as received
+}
+
+// Run creates a new read-only snapshot of the source, selects the best parent from
+// snapshots that already exist on the target, sends the snapshot and verifies it
+// on the target if possible.
+func Run(conf Config) (*Result, error) {
+	now := time.Now()
+	if conf.Naming.Prefix == "" {
+		conf.Naming.Prefix = filepath.Base(conf.Source)
+	}
+	name := conf.Naming.Name(now)
+	snap := filepath.Join(conf.SnapshotDir, name)
+	if err := btrfs.SnapshotSubVolume(conf.Source, snap, true); err != nil {
+		return nil, fmt.Errorf("cannot create snapshot: %w", err)
+	}
+	res := &Result{Snapshot: name}
+	if err := replicate(conf, res); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+func replicate(conf Config, res *Result) error {
+	fs, err := btrfs.Open(conf.SnapshotDir, true)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	snap := filepath.Join(conf.SnapshotDir, res.Snapshot)
+	info, err := fs.SubvolumeByPath(snap)
+	if err != nil {
+		return err
+	}
+	local, err := conf.Naming.List(conf.SnapshotDir)
+	if err != nil {
+		return err
+	}
+	remote, err := conf.Target.Snapshots()
+	if err != nil {
+		return err
+	}
+	onTarget := make(map[string]TargetSnapshot, len(remote))
+	for _, s := range remote {
+		onTarget[s.Name] = s
+	}
+	// candidates are snapshots that exist on both sides and match the received UUID
+	var candidates []string
+	for _, s := range local {
+		if s.Name == res.Snapshot {
+			continue
+		}
+		t, ok := onTarget[s.Name]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(conf.SnapshotDir, s.Name)
+		if !t.ReceivedUUID.IsZero() {
+			si, err := fs.SubvolumeByPath(path)
+			if err != nil {
+				return err
+			} else if si.UUID != t.ReceivedUUID {
+				continue
+			}
+		}
+		candidates = append(candidates, path)
+	}
+	var parent string
+	if len(candidates) != 0 {
+		parent, err = fs.FindBestParent(snap, candidates)
+		if err == btrfs.ErrNotFound {
+			parent = ""
+		} else if err != nil {
+			return err
+		}
+	}
+	if parent != "" {
+		res.Parent = filepath.Base(parent)
+	}
+
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := btrfs.Send(pw, parent, snap)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	err = conf.Target.Receive(pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	serr := <-errc
+	if err != nil {
+		return fmt.Errorf("receive failed: %w", err)
+	} else if serr != nil {
+		return fmt.Errorf("send failed: %w", serr)
+	}
+	return verify(conf.Target, res, info.UUID)
+}
+
+// verify checks that the target has received the snapshot. The received UUID of the snapshot
+// must match the UUID of the source; a snapshot without a received UUID is not verified.
+func verify(t Target, res *Result, uuid btrfs.UUID) error {
+	switch t.(type) {
+	case StreamTarget, *StreamTarget:
+		return nil // target cannot be checked
+	}
+	list, err := t.Snapshots()
+	if err != nil {
+		return err
+	}
+	for _, s := range list {
+		if s.Name != res.Snapshot {
+			continue
+		}
+		if s.ReceivedUUID.IsZero() {
+			return fmt.Errorf("snapshot %s on target has no received uuid", s.Name)
+		} else if s.ReceivedUUID != uuid {
+			return fmt.Errorf("snapshot %s on target has unexpected received uuid: %v", s.Name, s.ReceivedUUID)
+		}
+		res.Verified = true
+		return nil
+	}
+	return fmt.Errorf("snapshot %s was not found on target", res.Snapshot)
+}
@@ -0,0 +1,117 @@
+package replicate
+
+import (
+	"bytes"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/test"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNaming(t *testing.T) {
+	n := Naming{Prefix: "home"}
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	name := n.Name(ts)
+	if name != "home.20200102T030405" {
+		t.Fatalf("unexpected name: %q", name)
+	}
+	got, ok := n.Parse(name)
+	if !ok || !got.Equal(ts) {
+		t.Fatalf("unexpected time: %v (%v)", got, ok)
+	}
+	for _, name := range []string{"home", "home.", "homes.20200102T030405", "home.2020"} {
+		if _, ok := n.Parse(name); ok {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+}
+
+type fakeTarget []TargetSnapshot
+
+func (t fakeTarget) Snapshots() ([]TargetSnapshot, error) { return t, nil }
+
+func (t fakeTarget) Receive(r io.Reader) error { return nil }
+
+func TestVerify(t *testing.T) {
+	uuid := btrfs.UUID{1, 2, 3}
+	for _, c := range []struct {
+		name     string
+		target   Target
+		verified bool
+		fail     bool
+	}{
+		{name: "stream", target: StreamTarget{W: ioutil.Discard}},
+		{name: "missing", target: fakeTarget{{Name: "other"}}, fail: true},
+		{name: "no uuid", target: fakeTarget{{Name: "snap"}}, fail: true},
+		{name: "uuid", target: fakeTarget{{Name: "snap", ReceivedUUID: uuid}}, verified: true},
+		{name: "other uuid", target: fakeTarget{{Name: "snap", ReceivedUUID: btrfs.UUID{4}}}, fail: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			res := &Result{Snapshot: "snap"}
+			err := verify(c.target, res, uuid)
+			if c.fail != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			} else if res.Verified != c.verified {
+				t.Fatalf("unexpected verified status: %v", res.Verified)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, closer := btrfstest.New(t, btrfstest.DefaultSize)
+	defer closer()
+	src := filepath.Join(dir, "src")
+	if err := btrfs.CreateSubVolume(src); err != nil {
+		t.Fatal(err)
+	}
+	snaps := filepath.Join(dir, "snaps")
+	dst := filepath.Join(dir, "dst")
+	for _, d := range []string{snaps, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := Config{
+		Source:      src,
+		SnapshotDir: snaps,
+		// snapshots are taken faster than once per second
+		Naming: Naming{TimeFormat: "20060102T150405.000000000"},
+		Target: LocalTarget{Dir: dst, Native: true},
+	}
+	run := func(data string) *Result {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		res, err := Run(conf)
+		if err != nil {
+			t.Fatal(err)
+		} else if !res.Verified {
+			t.Fatalf("snapshot %s was not verified", res.Snapshot)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dst, res.Snapshot, "file"))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, []byte(data)) {
+			t.Fatalf("unexpected data on target: %q", got)
+		}
+		return res
+	}
+	first := run("first")
+	if first.Parent != "" {
+		t.Fatalf("expected a full send, got parent: %q", first.Parent)
+	} else if _, ok := (Naming{Prefix: "src", TimeFormat: conf.Naming.TimeFormat}).Parse(first.Snapshot); !ok {
+		t.Fatalf("expected the prefix to default to the source name: %q", first.Snapshot)
+	}
+	second := run("second")
+	if second.Snapshot == first.Snapshot {
+		t.Fatalf("expected a new snapshot, got: %q", second.Snapshot)
+	} else if second.Parent != first.Snapshot {
+		t.Fatalf("expected %q as a parent, got: %q", first.Snapshot, second.Parent)
+	}
+}
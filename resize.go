@@ -0,0 +1,148 @@
+package btrfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ResizeMax is a special size specification that grows the device to all available space.
+const ResizeMax = "max"
+
+// resizeSpec is a parsed resize specification.
+type resizeSpec struct {
+	devid uint64 // zero if not set
+	max   bool
+	sign  byte // '+', '-' or zero for an absolute size
+	size  uint64
+}
+
+// parseResizeSpec parses a resize specification in the form accepted by the kernel:
+//
+//	[<devid>:][+/-]<size>[kKmMgGtTpPeE]
+//	[<devid>:]max
+func parseResizeSpec(spec string) (resizeSpec, error) {
+	var rs resizeSpec
+	s := spec
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		id, err := strconv.ParseUint(s[:i], 10, 64)
+		if err != nil {
+			return rs, fmt.Errorf("invalid device id in resize spec: %q", spec)
+		}
+		rs.devid = id
+		s = s[i+1:]
+	}
+	if s == ResizeMax {
+		rs.max = true
+		return rs, nil
+	}
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		rs.sign = s[0]
+		s = s[1:]
+	}
+	var shift uint
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("kmgtpe", s[n-1]|0x20); i >= 0 {
+			shift = 10 * uint(i+1)
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v > maxUint64>>shift {
+		return rs, fmt.Errorf("invalid resize spec: %q", spec)
+	}
+	rs.size = v << shift
+	return rs, nil
+}
+
+// checkResizeSpec validates a resize specification, see parseResizeSpec.
+func checkResizeSpec(spec string) error {
+	_, err := parseResizeSpec(spec)
+	return err
+}
+
+// checkZoned checks that the size is aligned to the zone size of a device.
+func (rs resizeSpec) checkZoned(zoneSize uint64) error {
+	if rs.max || zoneSize == 0 || rs.size%zoneSize == 0 {
+		return nil
+	}
+	return fmt.Errorf("resize by %d bytes: %w (%d bytes)", rs.size, ErrZoneMisaligned, zoneSize)
+}
+
+func (f *FS) resize(spec string) error {
+	rs, err := parseResizeSpec(spec)
+	if err != nil {
+		return err
+	}
+	if !rs.max {
+		if err = f.checkZonedResize(rs); err != nil {
+			return fmt.Errorf("resize failed: %w", err)
+		}
+	}
+	args := &btrfs_ioctl_vol_args{}
+	args.SetName(spec)
+	if err := f.exclusive(func() error {
+		return iocResize(f.file(), args)
+	}); err != nil {
+		return fmt.Errorf("resize failed: %w", err)
+	}
+	return nil
+}
+
+// checkZonedResize verifies that a new size of a device is zone-aligned on zoned filesystems.
+func (f *FS) checkZonedResize(rs resizeSpec) error {
+	zoned, err := f.IsZoned()
+	if err != nil || !zoned {
+		return err
+	}
+	devid := rs.devid
+	if devid == 0 {
+		devid = 1
+	}
+	zs, err := f.deviceZoneSize(devid)
+	if err != nil {
+		return err
+	}
+	return rs.checkZoned(zs)
+}
+
+// Resize changes the size of the filesystem according to the specification:
+//
+//	[<devid>:][+/-]<size>[kKmMgGtTpPeE]
+//	[<devid>:]max
+//
+// Size without a sign sets an absolute size, '+' grows the device and '-' shrinks it.
+// If device id is omitted, the first device is resized.
+// On zoned filesystems, the size must be a multiple of the zone size.
+func (f *FS) Resize(spec string) error {
+	return f.resize(spec)
+}
+
+// ResizeToMax grows the first device of the filesystem to all available space.
+func (f *FS) ResizeToMax() error {
+	return f.resize(ResizeMax)
+}
+
+// ResizeDevice sets the size of the device with a given id.
+func (f *FS) ResizeDevice(devid uint64, size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid device size: %d", size)
+	}
+	return f.resize(strconv.FormatUint(devid, 10) + ":" + strconv.FormatInt(size, 10))
+}
+
+// ResizeDeviceBy grows (or shrinks, if delta is negative) the device with a given id.
+func (f *FS) ResizeDeviceBy(devid uint64, delta int64) error {
+	spec := strconv.FormatUint(devid, 10) + ":"
+	if delta >= 0 {
+		spec += "+" + strconv.FormatInt(delta, 10)
+	} else {
+		spec += strconv.FormatInt(delta, 10)
+	}
+	return f.resize(spec)
+}
+
+// ResizeDeviceToMax grows the device with a given id to all available space.
+func (f *FS) ResizeDeviceToMax(devid uint64) error {
+	return f.resize(strconv.FormatUint(devid, 10) + ":" + ResizeMax)
+}
@@ -0,0 +1,70 @@
+package btrfs
+
+import (
+	"errors"
+	"testing"
+)
+
+var casesResizeSpec = []struct {
+	spec  string
+	valid bool
+}{
+	{"max", true},
+	{"2:max", true},
+	{"1024", true},
+	{"+1g", true},
+	{"-500M", true},
+	{"3:+10T", true},
+	{"", false},
+	{"+", false},
+	{"x:max", false},
+	{"10q", false},
+	{"1:2:3", false},
+}
+
+func TestResizeSpec(t *testing.T) {
+	for _, c := range casesResizeSpec {
+		err := checkResizeSpec(c.spec)
+		if c.valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", c.spec, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%q: expected an error", c.spec)
+		}
+	}
+}
+
+func TestResizeSpecZoned(t *testing.T) {
+	const zone = 256 << 20
+	for _, c := range []struct {
+		spec  string
+		size  uint64
+		valid bool
+	}{
+		{"max", 0, true},
+		{"2:max", 0, true},
+		{"1g", 1 << 30, true},
+		{"+512M", 512 << 20, true},
+		{"1:-256m", 256 << 20, true},
+		{"100M", 100 << 20, false},
+		{"1:+1000", 1000, false},
+	} {
+		rs, err := parseResizeSpec(c.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", c.spec, err)
+		} else if rs.size != c.size {
+			t.Errorf("%q: unexpected size: %d vs %d", c.spec, rs.size, c.size)
+		}
+		err = rs.checkZoned(zone)
+		if c.valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", c.spec, err)
+		} else if !c.valid && !errors.Is(err, ErrZoneMisaligned) {
+			t.Errorf("%q: expected misaligned error, got: %v", c.spec, err)
+		}
+		if err = rs.checkZoned(0); err != nil {
+			t.Errorf("%q: unexpected error for non-zoned device: %v", c.spec, err)
+		}
+	}
+	if _, err := parseResizeSpec("20e"); err == nil {
+		t.Errorf("expected overflow error")
+	}
+}
@@ -0,0 +1,391 @@
+// Package restore extracts files from unmountable btrfs filesystems.
+//
+// Files are read by walking subvolume trees directly from devices or images,
+// similar to 'btrfs restore'. The filesystem is never modified.
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+	"github.com/dennwc/btrfs/internal/fsutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+const maxUint64 = 1<<64 - 1
+
+// Options control which files are restored and how.
+type Options struct {
+	// Root is the id of the subvolume tree to restore. Zero value restores the top-level subvolume.
+	Root uint64
+	// RootTree is a logical address of an alternative root tree block, for example from
+	// one of the superblock backup roots. It allows to restore files from an older
+	// transaction if the current root tree is damaged. Zero value uses the latest root.
+	RootTree uint64
+	// Match selects files and directories by their path relative to the subvolume,
+	// starting with a slash, e.g. "/home/user/file". Everything below a matched directory
+	// is restored. Directories that do not match are still traversed, but only created
+	// if some entries in them are restored. If not set, all files are restored.
+	Match *regexp.Regexp
+	// Subvolumes enables restoring of nested subvolumes and snapshots.
+	Subvolumes bool
+	// Xattrs restores extended attributes.
+	Xattrs bool
+	// Owner restores file owners. It usually requires root privileges.
+	Owner bool
+	// Timestamps restores access and modification times.
+	Timestamps bool
+	// Overwrite replaces existing files. By default, existing files are skipped.
+	Overwrite bool
+	// Progress is called after each file is restored, with a path relative to the
+	// destination and an error, if any. Returning an error stops the restore.
+	// If not set, the first error stops the restore.
+	Progress func(path string, err error) error
+}
+
+// Roots returns all subvolume trees that can be restored from the image.
+func Roots(im *btrfsdump.Image) ([]btrfsdump.TreeRoot, error) {
+	trees, err := im.Trees()
+	if err != nil {
+		return nil, err
+	}
+	var out []btrfsdump.TreeRoot
+	for _, t := range trees {
+		if t.ID == btrfs.FSTreeID || (t.ID >= btrfs.FirstFreeID && t.ID <= btrfs.LastFreeID) {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// Files opens devices or image files of a single filesystem and restores files to dst.
+func Files(dst string, opts Options, paths ...string) error {
+	im, err := btrfsdump.Open(paths...)
+	if err != nil {
+		return err
+	}
+	defer im.Close()
+	return Restore(im, dst, opts)
+}
+
+// Restore extracts files from the image to the dst directory, which is created if necessary.
+func Restore(im *btrfsdump.Image, dst string, opts Options) error {
+	if opts.RootTree != 0 {
+		var err error
+		if im, err = im.WithRootTree(opts.RootTree); err != nil {
+			return err
+		}
+	}
+	if opts.Root == 0 {
+		opts.Root = btrfs.FSTreeID
+	}
+	r := &restorer{
+		im: im, opts: opts, dst: dst,
+		links: make(map[inodeID]string),
+		dirs:  make(map[inodeID]struct{}),
+	}
+	dir, err := r.rootDir(opts.Root)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	err = r.restoreDir(opts.Root, dir, "", opts.Match == nil)
+	if err == errStop {
+		err = r.stopErr
+	}
+	return err
+}
+
+// errStop is used internally to unwind the walk when Progress returns an error.
+var errStop = errors.New("restore: stopped")
+
+type inodeID struct {
+	tree, ino uint64
+}
+
+type restorer struct {
+	im      *btrfsdump.Image
+	opts    Options
+	dst     string
+	links   map[inodeID]string   // first restored path of inodes with multiple links
+	dirs    map[inodeID]struct{} // visited directories, to detect cycles in damaged images
+	stopErr error
+}
+
+// rootDir returns the inode number of the top directory of a subvolume.
+func (r *restorer) rootDir(tree uint64) (uint64, error) {
+	t, err := r.im.Tree(tree)
+	if err != nil {
+		return 0, fmt.Errorf("restore: cannot find tree %d: %w", tree, err)
+	}
+	if t.Item == nil || t.Item.RootDirID == 0 {
+		return btrfs.FirstFreeID, nil
+	}
+	return t.Item.RootDirID, nil
+}
+
+// progress reports the result for a single path and returns errStop if the restore must stop.
+func (r *restorer) progress(rel string, err error) error {
+	if r.opts.Progress != nil {
+		err = r.opts.Progress(rel, err)
+	}
+	if err != nil {
+		r.stopErr = err
+		return errStop
+	}
+	return nil
+}
+
+// items calls fn for all items of a given type of an inode.
+func (r *restorer) items(tree, ino uint64, typ btrfs.KeyType, fn func(it btrfsdump.Item) error) error {
+	return r.im.Search(tree,
+		btrfs.DiskKey{ObjectID: ino, Type: byte(typ)},
+		btrfs.DiskKey{ObjectID: ino, Type: byte(typ), Offset: maxUint64},
+		fn,
+	)
+}
+
+func (r *restorer) inode(tree, ino uint64) (*btrfs.InodeItem, error) {
+	var out *btrfs.InodeItem
+	err := r.items(tree, ino, btrfs.KeyInodeItem, func(it btrfsdump.Item) error {
+		v, err := btrfs.DecodeInodeItem(it.Data)
+		out = &v
+		return err
+	})
+	if err == nil && out == nil {
+		err = fmt.Errorf("restore: inode %d not found in tree %d", ino, tree)
+	}
+	return out, err
+}
+
+func (r *restorer) match(rel string, matched bool) bool {
+	return matched || r.opts.Match.MatchString(rel)
+}
+
+// validName checks if a directory entry name from the image is safe to use as a path element.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// restoreDir restores entries of a directory. Entries are only restored if matched is set,
+// or if their path matches the pattern.
+func (r *restorer) restoreDir(tree, dir uint64, rel string, matched bool) error {
+	id := inodeID{tree: tree, ino: dir}
+	if _, ok := r.dirs[id]; ok {
+		return r.progress(rel, fmt.Errorf("restore: directory cycle at inode %d in tree %d", dir, tree))
+	}
+	r.dirs[id] = struct{}{}
+	path := filepath.Join(r.dst, rel)
+	if matched && rel != "" {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return r.progress(rel, err)
+		}
+	}
+	var entries []btrfs.DirItem
+	err := r.items(tree, dir, btrfs.KeyDirIndex, func(it btrfsdump.Item) error {
+		list, err := btrfs.DecodeDirItems(it.Data)
+		entries = append(entries, list...)
+		return err
+	})
+	if err != nil {
+		if err = r.progress(rel, err); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if !validName(e.Name) {
+			if err = r.progress(rel, fmt.Errorf("restore: invalid entry name %q", e.Name)); err != nil {
+				return err
+			}
+			continue
+		}
+		crel := rel + "/" + e.Name
+		m := r.match(crel, matched)
+		switch btrfs.KeyType(e.Location.Type) {
+		case btrfs.KeyRootItem:
+			if !r.opts.Subvolumes {
+				continue
+			}
+			sub := e.Location.ObjectID
+			sdir, err := r.rootDir(sub)
+			if err == nil {
+				err = r.restoreDir(sub, sdir, crel, m)
+			} else {
+				err = r.progress(crel, err)
+			}
+			if err != nil {
+				return err
+			}
+		case btrfs.KeyInodeItem:
+			inode, err := r.inode(tree, e.Location.ObjectID)
+			if err != nil {
+				if err = r.progress(crel, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if inode.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				err = r.restoreDir(tree, e.Location.ObjectID, crel, m)
+			} else if m {
+				err = r.progress(crel, r.restoreFile(tree, e.Location.ObjectID, inode, crel))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if rel == "" {
+		return nil
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return nil // directory was not created
+	}
+	inode, err := r.inode(tree, dir)
+	if err == nil {
+		err = r.setMetadata(tree, dir, inode, path)
+	}
+	if err != nil {
+		return r.progress(rel, err)
+	}
+	return nil
+}
+
+// restoreFile restores a single non-directory inode.
+func (r *restorer) restoreFile(tree, ino uint64, inode *btrfs.InodeItem, rel string) error {
+	path := filepath.Join(r.dst, rel)
+	if _, err := os.Lstat(path); err == nil {
+		if !r.opts.Overwrite {
+			return nil
+		} else if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	id := inodeID{tree: tree, ino: ino}
+	if prev, ok := r.links[id]; ok {
+		return os.Link(prev, path)
+	}
+	var err error
+	switch inode.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		err = r.writeFile(tree, ino, inode, path)
+	case syscall.S_IFLNK:
+		var target []byte
+		if target, err = r.readData(tree, ino, inode.Size); err == nil {
+			err = os.Symlink(string(target), path)
+		}
+	default:
+		if err = syscall.Mknod(path, inode.Mode, int(inode.RDev)); err != nil {
+			err = &os.PathError{Op: "mknod", Path: path, Err: err}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if inode.NLink > 1 {
+		r.links[id] = path
+	}
+	return r.setMetadata(tree, ino, inode, path)
+}
+
+// readData reads the whole content of a small file, like a symlink target.
+func (r *restorer) readData(tree, ino uint64, size uint64) ([]byte, error) {
+	buf := make([]byte, size)
+	err := r.extents(tree, ino, func(off uint64, data []byte) error {
+		if off < size {
+			copy(buf[off:], data)
+		}
+		return nil
+	})
+	return buf, err
+}
+
+// extents calls fn for the data of each non-empty file extent.
+func (r *restorer) extents(tree, ino uint64, fn func(off uint64, data []byte) error) error {
+	return r.items(tree, ino, btrfs.KeyExtentData, func(it btrfsdump.Item) error {
+		fe, err := btrfs.DecodeFileExtentItem(it.Data)
+		if err != nil {
+			return err
+		}
+		if fe.Type == btrfs.FileExtentPrealloc || (fe.Type == btrfs.FileExtentReg && fe.DiskByteNr == 0) {
+			return nil // holes are created by truncate
+		}
+		data, err := r.im.ReadFileExtent(fe)
+		if err != nil {
+			return fmt.Errorf("extent at %d: %w", it.Key.Offset, err)
+		}
+		return fn(it.Key.Offset, data)
+	})
+}
+
+func (r *restorer) writeFile(tree, ino uint64, inode *btrfs.InodeItem, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(inode.Mode&0777))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = r.extents(tree, ino, func(off uint64, data []byte) error {
+		if off >= inode.Size {
+			return nil
+		} else if rem := inode.Size - off; uint64(len(data)) > rem {
+			data = data[:rem]
+		}
+		_, err := f.WriteAt(data, int64(off))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(int64(inode.Size)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// setMetadata applies attributes of the inode to the restored file.
+func (r *restorer) setMetadata(tree, ino uint64, inode *btrfs.InodeItem, path string) error {
+	symlink := inode.Mode&syscall.S_IFMT == syscall.S_IFLNK
+	if r.opts.Xattrs && !symlink {
+		err := r.items(tree, ino, btrfs.KeyXattrItem, func(it btrfsdump.Item) error {
+			list, err := btrfs.DecodeDirItems(it.Data)
+			if err != nil {
+				return err
+			}
+			for _, x := range list {
+				if err = syscall.Setxattr(path, x.Name, x.Data, 0); err != nil {
+					return &os.PathError{Op: "setxattr", Path: path, Err: err}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if r.opts.Owner {
+		if err := os.Lchown(path, int(inode.UID), int(inode.GID)); err != nil {
+			return err
+		}
+	}
+	if !symlink {
+		// chown clears setuid bits, so the mode is always set after it
+		if err := syscall.Chmod(path, inode.Mode&07777); err != nil {
+			return &os.PathError{Op: "chmod", Path: path, Err: err}
+		}
+	}
+	if r.opts.Timestamps {
+		if err := fsutil.Lutimes(path, inode.ATime, inode.MTime); err != nil {
+			return &os.PathError{Op: "utimes", Path: path, Err: err}
+		}
+	}
+	return nil
+}
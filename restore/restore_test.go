@@ -0,0 +1,247 @@
+package restore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/btrfsdump"
+	"github.com/dennwc/btrfs/internal/imagetest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var order = binary.LittleEndian
+
+const (
+	testNodeSize = 4096
+	testChunk    = 1 << 20 // logical and physical address of the only chunk
+	testChunkLen = 1 << 20
+	testRoot     = testChunk + testNodeSize
+	testFSTree   = testChunk + 2*testNodeSize
+	testData     = testChunk + 3*testNodeSize
+)
+
+func key(obj uint64, typ btrfs.KeyType, off uint64) btrfs.DiskKey {
+	return btrfs.DiskKey{ObjectID: obj, Type: byte(typ), Offset: off}
+}
+
+func inodeItem(mode uint32, nlink uint32, size uint64, mtime time.Time) []byte {
+	p := make([]byte, 160)
+	order.PutUint64(p[16:], size)
+	order.PutUint32(p[40:], nlink)
+	order.PutUint32(p[52:], mode)
+	order.PutUint64(p[136:], uint64(mtime.Unix()))
+	return p
+}
+
+func dirEntry(target uint64, typ btrfs.KeyType, name string, data string) []byte {
+	p := make([]byte, 30+len(name)+len(data))
+	imagetest.PutKey(p, key(target, typ, 0))
+	order.PutUint16(p[25:], uint16(len(data)))
+	order.PutUint16(p[27:], uint16(len(name)))
+	copy(p[30:], name)
+	copy(p[30+len(name):], data)
+	return p
+}
+
+func inlineExtent(data string) []byte {
+	p := make([]byte, 21+len(data))
+	order.PutUint64(p[8:], uint64(len(data)))
+	p[20] = byte(btrfs.FileExtentInline)
+	copy(p[21:], data)
+	return p
+}
+
+func regularExtent(bytenr, size uint64) []byte {
+	p := make([]byte, 53)
+	order.PutUint64(p[8:], size)
+	p[20] = byte(btrfs.FileExtentReg)
+	order.PutUint64(p[21:], bytenr)
+	order.PutUint64(p[29:], size)
+	order.PutUint64(p[45:], size)
+	return p
+}
+
+var testMTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// testImage builds an image with a single chunk that holds all trees and file data.
+// The top-level subvolume contains:
+//
+//	/file         regular file with a data extent and a hole, linked twice
+//	/link         symlink to "file"
+//	/sub/hardlink second link to /file
+//
+// Extra items are added to the subvolume tree.
+func testImage(extra ...imagetest.Item) []byte {
+	img := make([]byte, testChunk+testChunkLen)
+	var fsid btrfs.FSID
+	copy(fsid[:], "0123456789abcdef")
+
+	chunk := make([]byte, 48+32)
+	order.PutUint64(chunk[0:], testChunkLen)
+	order.PutUint64(chunk[16:], 64<<10)
+	order.PutUint64(chunk[24:], uint64(btrfs.BlockGroupSystem))
+	order.PutUint16(chunk[44:], 1)
+	order.PutUint64(chunk[48:], 1)
+	order.PutUint64(chunk[56:], testChunk)
+
+	sb := img[btrfsdump.SuperblockOffsets[0]:]
+	copy(sb[32:], fsid[:])
+	order.PutUint64(sb[48:], uint64(btrfsdump.SuperblockOffsets[0]))
+	order.PutUint64(sb[64:], btrfsdump.SuperblockMagic)
+	order.PutUint64(sb[72:], 7)
+	order.PutUint64(sb[80:], testRoot)
+	order.PutUint64(sb[88:], testChunk)
+	order.PutUint32(sb[144:], 4096)
+	order.PutUint32(sb[148:], testNodeSize)
+	order.PutUint64(sb[201:], 1) // devid
+	imagetest.PutKey(sb[811:], key(btrfs.FirstChunkTreeID, btrfs.KeyChunkItem, testChunk))
+	copy(sb[811+17:], chunk)
+	order.PutUint32(sb[160:], uint32(17+len(chunk)))
+	imagetest.PutCsum(sb[:btrfsdump.SuperblockSize])
+
+	copy(img[testChunk:], imagetest.Leaf(testNodeSize, fsid, testChunk, btrfs.ChunkTreeID, []imagetest.Item{
+		{Key: key(btrfs.FirstChunkTreeID, btrfs.KeyChunkItem, testChunk), Data: chunk},
+	}))
+
+	rootItem := make([]byte, 439)
+	order.PutUint64(rootItem[160:], 7)          // generation
+	order.PutUint64(rootItem[168:], 256)        // root dir
+	order.PutUint64(rootItem[176:], testFSTree) // bytenr
+	copy(img[testRoot:], imagetest.Leaf(testNodeSize, fsid, testRoot, btrfs.RootTreeID, []imagetest.Item{
+		{Key: key(btrfs.FSTreeID, btrfs.KeyRootItem, 0), Data: rootItem},
+	}))
+
+	data := bytes.Repeat([]byte("data"), 1024)
+	copy(img[testData:], data)
+	copy(img[testFSTree:], imagetest.Leaf(testNodeSize, fsid, testFSTree, btrfs.FSTreeID, append([]imagetest.Item{
+		{Key: key(256, btrfs.KeyInodeItem, 0), Data: inodeItem(syscall.S_IFDIR|0755, 1, 22, testMTime)},
+		{Key: key(256, btrfs.KeyDirIndex, 2), Data: dirEntry(257, btrfs.KeyInodeItem, "file", "")},
+		{Key: key(256, btrfs.KeyDirIndex, 3), Data: dirEntry(258, btrfs.KeyInodeItem, "link", "")},
+		{Key: key(256, btrfs.KeyDirIndex, 4), Data: dirEntry(259, btrfs.KeyInodeItem, "sub", "")},
+		{Key: key(257, btrfs.KeyInodeItem, 0), Data: inodeItem(syscall.S_IFREG|0640, 2, 10000, testMTime)},
+		{Key: key(257, btrfs.KeyXattrItem, 1), Data: dirEntry(0, 0, "user.test", "value")},
+		{Key: key(257, btrfs.KeyExtentData, 0), Data: regularExtent(testData, uint64(len(data)))},
+		{Key: key(258, btrfs.KeyInodeItem, 0), Data: inodeItem(syscall.S_IFLNK|0777, 1, 4, testMTime)},
+		{Key: key(258, btrfs.KeyExtentData, 0), Data: inlineExtent("file")},
+		{Key: key(259, btrfs.KeyInodeItem, 0), Data: inodeItem(syscall.S_IFDIR|0700, 1, 16, testMTime)},
+		{Key: key(259, btrfs.KeyDirIndex, 2), Data: dirEntry(257, btrfs.KeyInodeItem, "hardlink", "")},
+	}, extra...)))
+	return img
+}
+
+func TestRestore(t *testing.T) {
+	im, err := btrfsdump.NewImage(bytes.NewReader(testImage()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = Restore(im, dir, Options{Xattrs: true, Timestamps: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := append(bytes.Repeat([]byte("data"), 1024), make([]byte, 10000-4096)...)
+	if !bytes.Equal(data, exp) {
+		t.Fatalf("unexpected file data")
+	}
+	fi, err := os.Stat(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0640 || !fi.ModTime().Equal(testMTime) {
+		t.Fatalf("unexpected attributes: %v %v", fi.Mode(), fi.ModTime())
+	}
+	if fi2, err := os.Stat(filepath.Join(dir, "sub", "hardlink")); err != nil {
+		t.Fatal(err)
+	} else if !os.SameFile(fi, fi2) {
+		t.Fatal("expected a hard link")
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	} else if target != "file" {
+		t.Fatalf("unexpected symlink: %q", target)
+	}
+	if fi, err = os.Stat(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0700 || !fi.ModTime().Equal(testMTime) {
+		t.Fatalf("unexpected dir attributes: %v %v", fi.Mode(), fi.ModTime())
+	}
+	buf := make([]byte, 16)
+	if n, err := syscall.Getxattr(filepath.Join(dir, "file"), "user.test", buf); err == nil {
+		if string(buf[:n]) != "value" {
+			t.Fatalf("unexpected xattr: %q", buf[:n])
+		}
+	} else if err != syscall.ENOTSUP {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreMatch(t *testing.T) {
+	im, err := btrfsdump.NewImage(bytes.NewReader(testImage()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var paths []string
+	err = Restore(im, dir, Options{
+		Match: regexp.MustCompile(`^/sub/`),
+		Progress: func(path string, err error) error {
+			paths = append(paths, path)
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "/sub/hardlink" {
+		t.Fatalf("unexpected paths: %q", paths)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "sub", "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(filepath.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be skipped: %v", err)
+	}
+}
+
+func TestRestoreDamaged(t *testing.T) {
+	im, err := btrfsdump.NewImage(bytes.NewReader(testImage(
+		imagetest.Item{Key: key(256, btrfs.KeyDirIndex, 5), Data: dirEntry(259, btrfs.KeyInodeItem, "..", "")},
+		imagetest.Item{Key: key(256, btrfs.KeyDirIndex, 6), Data: dirEntry(257, btrfs.KeyInodeItem, "a/b", "")},
+		imagetest.Item{Key: key(256, btrfs.KeyDirIndex, 7), Data: dirEntry(257, btrfs.KeyInodeItem, "", "")},
+		// the directory links back to the root
+		imagetest.Item{Key: key(259, btrfs.KeyDirIndex, 3), Data: dirEntry(256, btrfs.KeyInodeItem, "loop", "")},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "dst")
+	var failed []string
+	err = Restore(im, dir, Options{Progress: func(path string, err error) error {
+		if err != nil {
+			failed = append(failed, path)
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(failed)
+	if exp := []string{"", "", "", "/sub/loop"}; !reflect.DeepEqual(failed, exp) {
+		t.Fatalf("unexpected failed paths: %q", failed)
+	}
+	if _, err = os.Lstat(filepath.Join(dir, "..", "hardlink")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be written outside of the destination: %v", err)
+	} else if _, err = os.Lstat(filepath.Join(dir, "sub", "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+}
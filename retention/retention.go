@@ -0,0 +1,161 @@
+// Package retention implements GFS-style (grandfather-father-son) retention policies for snapshots.
+package retention
+
+import (
+	"github.com/dennwc/btrfs"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Snapshot is a snapshot with its creation time.
+type Snapshot struct {
+	Name string
+	Time time.Time
+}
+
+// Policy defines how many snapshots to keep.
+//
+// Each period counter keeps the newest snapshot in each of the last N periods
+// that have snapshots. A snapshot is kept if any of the rules selects it.
+// The zero Policy keeps all snapshots, so an unset policy never deletes anything.
+type Policy struct {
+	Latest  int // number of most recent snapshots to keep unconditionally
+	Hourly  int
+	Daily   int
+	Weekly  int // weeks start on Monday, as in ISO 8601
+	Monthly int
+	Yearly  int
+}
+
+type periodFunc func(t time.Time) time.Time
+
+func hourOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+func dayOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func weekOf(t time.Time) time.Time {
+	d := dayOf(t)
+	wd := (int(d.Weekday()) + 6) % 7 // days since Monday
+	return d.AddDate(0, 0, -wd)
+}
+
+func monthOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+func yearOf(t time.Time) time.Time {
+	return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+}
+
+// Apply splits snapshots into the ones to keep and the ones to remove.
+// Both lists are sorted from newest to oldest.
+func (p Policy) Apply(snaps []Snapshot) (keep, remove []Snapshot) {
+	sorted := make([]Snapshot, len(snaps))
+	copy(sorted, snaps)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.After(sorted[j].Time)
+	})
+	if p == (Policy{}) {
+		return sorted, nil
+	}
+	kept := make([]bool, len(sorted))
+	for i := 0; i < p.Latest && i < len(sorted); i++ {
+		kept[i] = true
+	}
+	for _, r := range []struct {
+		n      int
+		period periodFunc
+	}{
+		{p.Hourly, hourOf},
+		{p.Daily, dayOf},
+		{p.Weekly, weekOf},
+		{p.Monthly, monthOf},
+		{p.Yearly, yearOf},
+	} {
+		var (
+			last  time.Time
+			count int
+		)
+		for i := 0; i < len(sorted) && count < r.n; i++ {
+			cur := r.period(sorted[i].Time)
+			if count != 0 && cur.Equal(last) {
+				continue
+			}
+			kept[i] = true
+			last = cur
+			count++
+		}
+	}
+	for i, s := range sorted {
+		if kept[i] {
+			keep = append(keep, s)
+		} else {
+			remove = append(remove, s)
+		}
+	}
+	return keep, remove
+}
+
+// ListDir lists subvolumes in dir with their creation times.
+// If parse is set, it is used to get the time from the snapshot name;
+// subvolumes it rejects are skipped. Otherwise, the otime of subvolumes is used.
+func ListDir(dir string, parse func(name string) (time.Time, bool)) ([]Snapshot, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fs *btrfs.FS
+	if parse == nil {
+		fs, err = btrfs.Open(dir, true)
+		if err != nil {
+			return nil, err
+		}
+		defer fs.Close()
+	}
+	var out []Snapshot
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		if parse != nil {
+			if t, ok := parse(fi.Name()); ok {
+				out = append(out, Snapshot{Name: fi.Name(), Time: t})
+			}
+			continue
+		}
+		if ok, err := btrfs.IsSubVolume(path); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		info, err := fs.SubvolumeByPath(path)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Snapshot{Name: fi.Name(), Time: info.OTime})
+	}
+	return out, nil
+}
+
+// Prune applies the policy to snapshots in dir and deletes the ones that are not kept.
+// It returns the list of deleted snapshots. See ListDir for the meaning of parse.
+func Prune(dir string, p Policy, parse func(name string) (time.Time, bool)) ([]Snapshot, error) {
+	snaps, err := ListDir(dir, parse)
+	if err != nil {
+		return nil, err
+	}
+	_, remove := p.Apply(snaps)
+	for i, s := range remove {
+		if err = btrfs.DeleteSubVolume(filepath.Join(dir, s.Name)); err != nil {
+			return remove[:i], err
+		}
+	}
+	return remove, nil
+}
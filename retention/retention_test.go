@@ -0,0 +1,51 @@
+package retention
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPolicyApply(t *testing.T) {
+	base := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC) // Tuesday
+	var snaps []Snapshot
+	// every 6 hours for 60 days
+	for i := 0; i < 60*4; i++ {
+		ts := base.Add(-time.Duration(i) * 6 * time.Hour)
+		snaps = append(snaps, Snapshot{Name: ts.Format(time.RFC3339), Time: ts})
+	}
+	p := Policy{Latest: 2, Daily: 3, Weekly: 2, Monthly: 3}
+	keep, remove := p.Apply(snaps)
+	if len(keep)+len(remove) != len(snaps) {
+		t.Fatalf("unexpected number of snapshots: %d + %d", len(keep), len(remove))
+	}
+	var names []string
+	for _, s := range keep {
+		names = append(names, s.Name)
+	}
+	exp := []string{
+		"2020-03-10T12:00:00Z", // latest, daily, weekly, monthly
+		"2020-03-10T06:00:00Z", // latest
+		"2020-03-09T18:00:00Z", // daily
+		"2020-03-08T18:00:00Z", // daily, weekly
+		"2020-02-29T18:00:00Z", // monthly
+		"2020-01-31T18:00:00Z", // monthly
+	}
+	if !reflect.DeepEqual(names, exp) {
+		t.Errorf("unexpected snapshots kept:\n%q\nvs\n%q", names, exp)
+	}
+}
+
+func TestPolicyApplyZero(t *testing.T) {
+	base := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{
+		{Name: "old", Time: base.Add(-time.Hour)},
+		{Name: "new", Time: base},
+	}
+	keep, remove := Policy{}.Apply(snaps)
+	if len(remove) != 0 {
+		t.Fatalf("expected nothing to be removed, got: %v", remove)
+	} else if len(keep) != 2 || keep[0].Name != "new" || keep[1].Name != "old" {
+		t.Fatalf("unexpected snapshots kept: %v", keep)
+	}
+}
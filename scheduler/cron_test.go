@@ -0,0 +1,47 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+var casesCron = []struct {
+	spec string
+	from string
+	next string
+}{
+	{"*/15 * * * *", "2020-03-10T12:07:30Z", "2020-03-10T12:15:00Z"},
+	{"0 3 * * *", "2020-03-10T12:07:00Z", "2020-03-11T03:00:00Z"},
+	{"@hourly", "2020-03-10T12:00:00Z", "2020-03-10T13:00:00Z"},
+	{"30 2 1 * *", "2020-12-15T00:00:00Z", "2021-01-01T02:30:00Z"},
+	{"0 0 * * 1-5", "2020-03-13T12:00:00Z", "2020-03-16T00:00:00Z"}, // Friday -> Monday
+	{"0 0 * * 7", "2020-03-10T00:00:00Z", "2020-03-15T00:00:00Z"},   // Sunday
+	{"0 0 13 * 5", "2020-03-10T00:00:00Z", "2020-03-13T00:00:00Z"},  // 13th or Friday
+	{"0 0 30 2 *", "2020-03-10T00:00:00Z", ""},
+}
+
+func TestCronSchedule(t *testing.T) {
+	for _, c := range casesCron {
+		s, err := ParseCron(c.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", c.spec, err)
+		}
+		from, _ := time.Parse(time.RFC3339, c.from)
+		got := s.Next(from)
+		var exp time.Time
+		if c.next != "" {
+			exp, _ = time.Parse(time.RFC3339, c.next)
+		}
+		if !got.Equal(exp) {
+			t.Errorf("%q: unexpected next time after %v: %v vs %v", c.spec, from, got, exp)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Package scheduler creates read-only snapshots of subvolumes on a schedule,
+// optionally pruning old snapshots with a retention policy.
+package scheduler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/replicate"
+	"github.com/dennwc/btrfs/retention"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Hook is called before or after a snapshot is taken.
+// The snapshot path is passed to the hook.
+type Hook func(j *Job, snapshot string) error
+
+// Command returns a hook that runs an external command, e.g. to flush a database.
+// The subvolume and snapshot paths are available to the command in BTRFS_SUBVOLUME
+// and BTRFS_SNAPSHOT environment variables.
+func Command(name string, args ...string) Hook {
+	return func(j *Job, snapshot string) error {
+		buf := bytes.NewBuffer(nil)
+		cmd := exec.Command(name, args...)
+		cmd.Env = append(os.Environ(), "BTRFS_SUBVOLUME="+j.Subvolume, "BTRFS_SNAPSHOT="+snapshot)
+		cmd.Stdout = buf
+		cmd.Stderr = buf
+		if err := cmd.Run(); err != nil {
+			if buf.Len() != 0 {
+				return fmt.Errorf("%s: %v: %s", name, err, buf.String())
+			}
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	}
+}
+
+// Job describes snapshots of a single subvolume.
+type Job struct {
+	Subvolume string           // subvolume to snapshot
+	Dir       string           // directory for snapshots
+	Schedule  Schedule         // when to take snapshots
+	Naming    replicate.Naming // naming scheme; prefix defaults to the subvolume name
+
+	// Pre is called before the snapshot is taken. If it fails, the snapshot is skipped.
+	Pre Hook
+	// Post is called after the snapshot is taken, even if it failed.
+	// In the latter case the snapshot path is empty.
+	Post Hook
+
+	// Retention is an optional policy applied to snapshots in Dir after each run.
+	Retention *retention.Policy
+}
+
+func (j *Job) naming() replicate.Naming {
+	n := j.Naming
+	if n.Prefix == "" {
+		n.Prefix = filepath.Base(j.Subvolume)
+	}
+	return n
+}
+
+// Run takes a snapshot immediately and returns its path.
+func (j *Job) Run(now time.Time) (string, error) {
+	n := j.naming()
+	snap := filepath.Join(j.Dir, n.Name(now))
+	if j.Pre != nil {
+		if err := j.Pre(j, snap); err != nil {
+			return "", fmt.Errorf("pre hook failed: %v", err)
+		}
+	}
+	err := btrfs.SnapshotSubVolume(j.Subvolume, snap, true)
+	if err != nil {
+		snap = ""
+	}
+	if j.Post != nil {
+		if perr := j.Post(j, snap); perr != nil && err == nil {
+			err = fmt.Errorf("post hook failed: %v", perr)
+		}
+	}
+	if err != nil {
+		return snap, err
+	}
+	if j.Retention != nil {
+		if _, err = retention.Prune(j.Dir, *j.Retention, n.Parse); err != nil {
+			return snap, fmt.Errorf("prune failed: %v", err)
+		}
+	}
+	return snap, nil
+}
+
+// Scheduler runs snapshot jobs on their schedules.
+type Scheduler struct {
+	// OnError is called when a job fails. Errors are ignored if it's not set.
+	OnError func(j *Job, err error)
+	// OnSnapshot is called after a snapshot is taken.
+	OnSnapshot func(j *Job, snapshot string)
+
+	mu   sync.Mutex
+	jobs []*Job
+}
+
+// Add registers a job. It can be called while the scheduler is running.
+func (s *Scheduler) Add(j *Job) error {
+	if j.Schedule == nil {
+		return errors.New("job has no schedule")
+	} else if j.Subvolume == "" || j.Dir == "" {
+		return errors.New("subvolume and snapshot directory must be set")
+	}
+	s.mu.Lock()
+	s.jobs = append(s.jobs, j)
+	s.mu.Unlock()
+	return nil
+}
+
+// Run executes jobs on schedule until stop is closed.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	now := time.Now()
+	next := make(map[*Job]time.Time)
+	for {
+		s.mu.Lock()
+		jobs := append([]*Job{}, s.jobs...)
+		s.mu.Unlock()
+
+		var first time.Time
+		for _, j := range jobs {
+			t, ok := next[j]
+			if !ok {
+				t = j.Schedule.Next(now)
+				next[j] = t
+			}
+			if !t.IsZero() && (first.IsZero() || t.Before(first)) {
+				first = t
+			}
+		}
+		wait := time.Minute // pick up new jobs
+		if !first.IsZero() && first.Sub(now) < wait {
+			wait = first.Sub(now)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		now = time.Now()
+		for _, j := range jobs {
+			if t := next[j]; t.IsZero() || t.After(now) {
+				continue
+			}
+			snap, err := j.Run(next[j])
+			if err != nil && s.OnError != nil {
+				s.OnError(j, err)
+			} else if err == nil && s.OnSnapshot != nil {
+				s.OnSnapshot(j, snap)
+			}
+			next[j] = j.Schedule.Next(now)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package btrfs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+)
+
+// ScrubOptions controls a scrub operation.
+type ScrubOptions struct {
+	// ReadOnly disables repair of detected errors.
+	ReadOnly bool
+	// Start and End limits the physical byte range to scrub on each device.
+	// Zero End means the end of the device.
+	Start, End uint64
+}
+
+// ScrubProgress contains statistics of a scrub operation on a single device.
+type ScrubProgress struct {
+	DataExtentsScrubbed uint64 // # of data extents scrubbed
+	TreeExtentsScrubbed uint64 // # of tree extents scrubbed
+	DataBytesScrubbed   uint64 // # of data bytes scrubbed
+	TreeBytesScrubbed   uint64 // # of tree bytes scrubbed
+	ReadErrors          uint64 // # of read errors encountered (EIO)
+	CsumErrors          uint64 // # of failed csum checks
+	// # of occurrences, where the metadata of a tree block did not match the expected values, like generation or logical
+	VerifyErrors uint64
+	// # of 4k data block for which no csum is present, probably the result of data written with nodatasum
+	NoCsum              uint64
+	CsumDiscards        uint64 // # of csum for which no data was found in the extent tree
+	SuperErrors         uint64 // # of bad super blocks encountered
+	MallocErrors        uint64 // # of internal kmalloc errors. These will likely cause an incomplete scrub
+	UncorrectableErrors uint64 // # of errors where either no intact copy was found or the writeback failed
+	CorrectedErrors     uint64 // # of errors corrected
+	// last physical address scrubbed. In case a scrub was aborted, this can be used to restart the scrub
+	LastPhysical uint64
+	// # of occurrences where a read for a full (64k) bio failed, but the re-
+	// check succeeded for each 4k piece. Intermittent error.
+	UnverifiedErrors uint64
+}
+
+// BytesScrubbed returns the total number of data and metadata bytes scrubbed.
+func (p ScrubProgress) BytesScrubbed() uint64 {
+	return p.DataBytesScrubbed + p.TreeBytesScrubbed
+}
+
+// Errors returns the total number of errors found by scrub.
+func (p ScrubProgress) Errors() uint64 {
+	return p.ReadErrors + p.CsumErrors + p.VerifyErrors + p.SuperErrors
+}
+
+func (p *btrfs_scrub_progress) Decode() ScrubProgress {
+	return ScrubProgress{
+		DataExtentsScrubbed: p.data_extents_scrubbed,
+		TreeExtentsScrubbed: p.tree_extents_scrubbed,
+		DataBytesScrubbed:   p.data_bytes_scrubbed,
+		TreeBytesScrubbed:   p.tree_bytes_scrubbed,
+		ReadErrors:          p.read_errors,
+		CsumErrors:          p.csum_errors,
+		VerifyErrors:        p.verify_errors,
+		NoCsum:              p.no_csum,
+		CsumDiscards:        p.csum_discards,
+		SuperErrors:         p.super_errors,
+		MallocErrors:        p.malloc_errors,
+		UncorrectableErrors: p.uncorrectable_errors,
+		CorrectedErrors:     p.corrected_errors,
+		LastPhysical:        p.last_physical,
+		UnverifiedErrors:    p.unverified_errors,
+	}
+}
+
+// ScrubDeviceStatus is a state of the scrub operation on a single device.
+type ScrubDeviceStatus struct {
+	DevID    uint64
+	Running  bool
+	Progress ScrubProgress
+	Err      error
+}
+
+// listDevIDs returns ids of all devices present in the filesystem.
+func listDevIDs(f ioctlFile) ([]uint64, error) {
+	info, err := iocFsInfo(f)
+	if err != nil {
+		return nil, err
+	}
+	var out []uint64
+	for i := uint64(0); i <= info.max_id; i++ {
+		_, err := iocDevInfo(f, i, UUID{})
+		if err == syscall.ENODEV {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, i)
+	}
+	return out, nil
+}
+
+// ScrubDevice runs scrub on a single device and blocks until it completes or is cancelled.
+func (f *FS) ScrubDevice(devid uint64, opts ScrubOptions) (ScrubProgress, error) {
+	args := btrfs_ioctl_scrub_args{
+		devid: devid,
+		start: opts.Start,
+		end:   opts.End,
+	}
+	if args.end == 0 {
+		args.end = maxUint64
+	}
+	if opts.ReadOnly {
+		args.flags |= _BTRFS_SCRUB_READONLY
+	}
+	err := iocScrub(f.file(), &args)
+	return args.progress.Decode(), err
+}
+
+// ScrubStart runs scrub on all devices of the filesystem in parallel and blocks until
+// all of them complete or are cancelled. Per-device results are returned, even if
+// scrub fails on some devices; the first error is returned as well.
+func (f *FS) ScrubStart(opts ScrubOptions) ([]ScrubDeviceStatus, error) {
+	ids, err := listDevIDs(f.file())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ScrubDeviceStatus, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(st *ScrubDeviceStatus, id uint64) {
+			defer wg.Done()
+			st.DevID = id
+			st.Progress, st.Err = f.ScrubDevice(id, opts)
+		}(&out[i], id)
+	}
+	wg.Wait()
+	for _, st := range out {
+		if st.Err != nil {
+			return out, st.Err
+		}
+	}
+	return out, nil
+}
+
+// ScrubContext is similar to ScrubStart, but cancels the scrub when the context is done.
+// Note that cancellation stops scrub on all devices, including the ones started by other processes.
+func (f *FS) ScrubContext(ctx context.Context, opts ScrubOptions) ([]ScrubDeviceStatus, error) {
+	var out []ScrubDeviceStatus
+	err := withCancel(ctx, f.ScrubCancel, func(arm func() error) error {
+		// scrub is not an exclusive operation
+		if err := arm(); err != nil {
+			return err
+		}
+		var err error
+		out, err = f.ScrubStart(opts)
+		return err
+	})
+	return out, err
+}
+
+// ScrubCancel cancels a running scrub on all devices.
+// It returns when all scrub operations are stopped.
+func (f *FS) ScrubCancel() error {
+	return iocScrubCancel(f.file())
+}
+
+// ScrubDeviceProgress returns the progress of a scrub running on a single device.
+// Running field will be set to false if scrub is not running on the device.
+func (f *FS) ScrubDeviceProgress(devid uint64) (ScrubDeviceStatus, error) {
+	args := btrfs_ioctl_scrub_args{devid: devid}
+	st := ScrubDeviceStatus{DevID: devid}
+	if err := iocScrubProgress(f.file(), &args); err == syscall.ENOTCONN {
+		return st, nil
+	} else if err != nil {
+		return st, err
+	}
+	st.Running = true
+	st.Progress = args.progress.Decode()
+	return st, nil
+}
+
+// ScrubStatus returns the progress of running scrub for each device of the filesystem.
+func (f *FS) ScrubStatus() ([]ScrubDeviceStatus, error) {
+	ids, err := listDevIDs(f.file())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ScrubDeviceStatus, 0, len(ids))
+	for _, id := range ids {
+		st, err := f.ScrubDeviceProgress(id)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
@@ -0,0 +1,199 @@
+package btrfs
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// KeyType is a type of an item in btrfs tree.
+type KeyType = treeKeyType
+
+// SearchKey describes a range of keys to search in one of btrfs trees.
+// Keys are compared as (ObjectID, Type, Offset) tuples, thus the search
+// returns all the keys between (MinObjectID, MinType, MinOffset) and
+// (MaxObjectID, MaxType, MaxOffset).
+type SearchKey struct {
+	// TreeID is the tree to search in; 0 is the tree of tree roots.
+	TreeID uint64
+
+	MinObjectID, MaxObjectID uint64
+	MinType, MaxType         KeyType
+	MinOffset, MaxOffset     uint64
+	// Only items with transaction id in the range will be returned.
+	// Zero MaxTransID means any transaction.
+	MinTransID, MaxTransID uint64
+}
+
+func (k SearchKey) toArgs() btrfs_ioctl_search_key {
+	sk := btrfs_ioctl_search_key{
+		tree_id:      objectID(k.TreeID),
+		min_objectid: objectID(k.MinObjectID),
+		max_objectid: objectID(k.MaxObjectID),
+		min_type:     k.MinType,
+		max_type:     k.MaxType,
+		min_offset:   k.MinOffset,
+		max_offset:   k.MaxOffset,
+		min_transid:  k.MinTransID,
+		max_transid:  k.MaxTransID,
+	}
+	if sk.max_transid == 0 {
+		sk.max_transid = maxUint64
+	}
+	return sk
+}
+
+// SearchItem is a single item returned by tree search.
+type SearchItem struct {
+	TransID  uint64
+	ObjectID uint64
+	Type     KeyType
+	Offset   uint64
+	Data     []byte
+}
+
+// advance updates the min key of the search to continue right after the last item.
+// It returns false if there are no more keys to search.
+func (sk *btrfs_ioctl_search_key) advance(objID objectID, typ treeKeyType, off uint64) bool {
+	sk.min_objectid, sk.min_type, sk.min_offset = objID, typ, off+1
+	if sk.min_offset != 0 {
+		return true
+	}
+	// offset overflow
+	sk.min_type++
+	if sk.min_type <= maxKeyType {
+		return true
+	}
+	// type overflow; kernel stores key type as uint8
+	sk.min_type = 0
+	sk.min_objectid++
+	return sk.min_objectid != 0
+}
+
+const maxKeyType = 255
+
+const defaultSearchBufSize = 64 * 1024
+
+// SearchIterator iterates over items returned by tree search.
+// It transparently handles pagination of search results.
+type SearchIterator struct {
+	f    ioctlFile
+	key  btrfs_ioctl_search_key
+	v1   bool
+	buf  []byte
+	page []SearchItem
+	cur  SearchItem
+	err  error
+	done bool
+}
+
+// Search starts a new search in the filesystem tree. It requires CAP_SYS_ADMIN.
+func (f *FS) Search(key SearchKey) *SearchIterator {
+	return newSearchIterator(f.file(), key.toArgs())
+}
+
+func newSearchIterator(f ioctlFile, key btrfs_ioctl_search_key) *SearchIterator {
+	return &SearchIterator{f: f, key: key}
+}
+
+// Next advances the iterator to the next item. It returns false at the end of results,
+// or if an error occurs.
+func (it *SearchIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.page, it.err = it.nextPage()
+		if it.err != nil {
+			return false
+		}
+	}
+	it.cur, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Item returns the current item.
+func (it *SearchIterator) Item() SearchItem {
+	return it.cur
+}
+
+// Err returns an error that stopped the iteration, if any.
+func (it *SearchIterator) Err() error {
+	return it.err
+}
+
+func (it *SearchIterator) nextPage() ([]SearchItem, error) {
+	var (
+		n   int
+		buf []byte
+	)
+	if !it.v1 {
+		var err error
+		n, buf, err = it.searchV2()
+		if err == syscall.ENOTTY {
+			// kernel doesn't support v2, fallback to v1
+			it.v1 = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if it.v1 {
+		args := btrfs_ioctl_search_args{key: it.key}
+		args.key.nr_items = 4096
+		if err := iocTreeSearch(it.f, &args); err != nil {
+			return nil, err
+		}
+		n, buf = int(args.key.nr_items), args.buf[:]
+	}
+	if n == 0 {
+		it.done = true
+		return nil, nil
+	}
+	const hdrSize = int(unsafe.Sizeof(btrfs_ioctl_search_header{}))
+	out := make([]SearchItem, 0, n)
+	for i := 0; i < n; i++ {
+		h := (*btrfs_ioctl_search_header)(unsafe.Pointer(&buf[0]))
+		buf = buf[hdrSize:]
+		out = append(out, SearchItem{
+			TransID:  h.transid,
+			ObjectID: uint64(h.objectid),
+			Type:     h.typ,
+			Offset:   h.offset,
+			Data:     append([]byte(nil), buf[:h.len]...),
+		})
+		buf = buf[h.len:]
+	}
+	last := out[len(out)-1]
+	if !it.key.advance(objectID(last.ObjectID), last.Type, last.Offset) ||
+		it.key.min_objectid > it.key.max_objectid {
+		it.done = true
+	}
+	return out, nil
+}
+
+// searchV2 runs TREE_SEARCH_V2 ioctl, growing the buffer if necessary.
+// It returns the number of items and the data buffer.
+func (it *SearchIterator) searchV2() (int, []byte, error) {
+	const hdrSize = unsafe.Sizeof(btrfs_ioctl_search_args_v2{})
+	if it.buf == nil {
+		it.buf = make([]byte, hdrSize+defaultSearchBufSize)
+	}
+	for {
+		args := (*btrfs_ioctl_search_args_v2)(unsafe.Pointer(&it.buf[0]))
+		args.key = it.key
+		args.key.nr_items = 1<<32 - 1
+		args.buf_size = uint64(len(it.buf)) - uint64(hdrSize)
+		err := iocTreeSearchV2(it.f, it.buf)
+		if err == syscall.EOVERFLOW {
+			// buffer is too small for a single item; buf_size is set to the required size
+			need := hdrSize + uintptr(args.buf_size)
+			if need <= uintptr(len(it.buf)) {
+				need = uintptr(len(it.buf)) * 2
+			}
+			it.buf = make([]byte, need)
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+		return int(args.key.nr_items), it.buf[hdrSize:], nil
+	}
+}
@@ -0,0 +1,25 @@
+package btrfs
+
+import "testing"
+
+func TestSearchKeyAdvance(t *testing.T) {
+	sk := btrfs_ioctl_search_key{max_objectid: lastFreeObjectid}
+	if !sk.advance(300, rootItemKey, 10) {
+		t.Fatal("unexpected end")
+	} else if sk.min_objectid != 300 || sk.min_type != rootItemKey || sk.min_offset != 11 {
+		t.Fatalf("unexpected key: %+v", sk)
+	}
+	if !sk.advance(300, rootItemKey, maxUint64) {
+		t.Fatal("unexpected end")
+	} else if sk.min_objectid != 300 || sk.min_type != rootItemKey+1 || sk.min_offset != 0 {
+		t.Fatalf("unexpected key: %+v", sk)
+	}
+	if !sk.advance(300, maxKeyType, maxUint64) {
+		t.Fatal("unexpected end")
+	} else if sk.min_objectid != 301 || sk.min_type != 0 || sk.min_offset != 0 {
+		t.Fatalf("unexpected key: %+v", sk)
+	}
+	if sk.advance(maxUint64, maxKeyType, maxUint64) {
+		t.Fatal("expected the end of the key space")
+	}
+}
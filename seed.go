@@ -0,0 +1,237 @@
+package btrfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Seed devices hold a read-only filesystem that can be used as a base for other filesystems.
+// A seed filesystem is mounted read-only, then a writable device is added to it (sprouting)
+// and the filesystem is remounted read-write. All changes go to the new device, while
+// the data is still read from the seed. Seed devices can be removed later, which copies
+// all the remaining data to writable devices.
+
+// Superblock fields used to toggle the seeding flag.
+const (
+	superMagic       = 0x4D5F53665248425F // "_BHRfS_M"
+	superSize        = 4096
+	superCsumSize    = 32
+	superOffBytenr   = 48
+	superOffFlags    = 56
+	superOffMagic    = 64
+	superOffIncompat = 188
+	superOffCsumType = 196
+)
+
+// superOffsets are the offsets of the primary superblock and its mirrors.
+var superOffsets = []int64{64 << 10, 64 << 20, 256 << 30}
+
+// readSuper reads the superblock at a given offset and verifies its checksum.
+func readSuper(f *os.File, off int64) ([]byte, error) {
+	p := make([]byte, superSize)
+	if _, err := f.ReadAt(p, off); err != nil {
+		return nil, err
+	}
+	if order.Uint64(p[superOffMagic:]) != superMagic || order.Uint64(p[superOffBytenr:]) != uint64(off) {
+		return nil, ErrNotBtrfs{Path: f.Name()}
+	}
+	typ := CsumType(order.Uint16(p[superOffCsumType:]))
+	sum, err := Checksum(typ, p[superCsumSize:])
+	if err != nil {
+		return nil, err
+	} else if !bytes.Equal(sum, p[:len(sum)]) {
+		return nil, fmt.Errorf("superblock checksum mismatch at %d", off)
+	}
+	return p, nil
+}
+
+// IsSeeding reports if the seeding flag is set in the primary superblock of a device.
+func IsSeeding(device string) (bool, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	p, err := readSuper(f, superOffsets[0])
+	if err != nil {
+		return false, &os.PathError{Op: "read superblock", Path: device, Err: err}
+	}
+	return order.Uint64(p[superOffFlags:])&superFlagSeeding != 0, nil
+}
+
+// SetSeeding sets or clears the seeding flag in all superblock copies of an unmounted device,
+// similar to "btrfstune -S". For filesystems with multiple devices, it must be called for each one.
+//
+// Clearing the flag on a seed that was already sprouted makes the sprouted filesystems unmountable.
+// It returns ErrDeviceBusy if the device is mounted.
+func SetSeeding(device string, seeding bool) error {
+	// O_EXCL fails on block devices that are mounted or used otherwise
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_EXCL, 0)
+	if errors.Is(err, syscall.EBUSY) {
+		return &os.PathError{Op: "open", Path: device, Err: ErrDeviceBusy}
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i, off := range superOffsets {
+		p, err := readSuper(f, off)
+		if i > 0 && err != nil {
+			// mirror does not exist; device is too small
+			break
+		} else if err != nil {
+			return &os.PathError{Op: "read superblock", Path: device, Err: err}
+		}
+		if IncompatFeatures(order.Uint64(p[superOffIncompat:]))&FeatureIncompatMetadataUUID != 0 {
+			return &os.PathError{Op: "set seeding", Path: device, Err: ErrSeedMetadataUUID}
+		}
+		flags := order.Uint64(p[superOffFlags:])
+		if seeding {
+			flags |= superFlagSeeding
+		} else {
+			flags &^= superFlagSeeding
+		}
+		order.PutUint64(p[superOffFlags:], flags)
+		sum, err := Checksum(CsumType(order.Uint16(p[superOffCsumType:])), p[superCsumSize:])
+		if err != nil {
+			return err
+		}
+		copy(p[:superCsumSize], sum)
+		if _, err = f.WriteAt(p, off); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// SeedDevices returns devices that belong to seed filesystems the filesystem was sprouted from.
+// Seed devices are listed by Devices as well. It requires CAP_SYS_ADMIN.
+func (f *FS) SeedDevices() ([]DeviceInfo, error) {
+	if err := requireAdmin("seed devices", f.f.Name()); err != nil {
+		return nil, err
+	}
+	info, err := iocFsInfo(f.file())
+	if err != nil {
+		return nil, &os.PathError{Op: "fs info", Path: f.f.Name(), Err: err}
+	}
+	// devices are stamped with the metadata UUID, which equals FSID if it was never changed
+	fsid := info.fsid
+	if info.flags&_BTRFS_FS_INFO_FLAG_METADATA_UUID != 0 {
+		fsid = info.metadata_uuid
+	}
+	it := newSearchIterator(f.file(), btrfs_ioctl_search_key{
+		tree_id:      chunkTreeObjectid,
+		min_objectid: devItemsObjectid,
+		max_objectid: devItemsObjectid,
+		min_type:     devItemKey,
+		max_type:     devItemKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+	})
+	var out []DeviceInfo
+	for it.Next() {
+		dev, err := DecodeDevItem(it.Item().Data)
+		if err != nil {
+			return nil, err
+		} else if dev.FSID == fsid {
+			continue
+		}
+		d := DeviceInfo{
+			DevID:      dev.DevID,
+			UUID:       dev.UUID,
+			TotalBytes: dev.TotalBytes,
+			UsedBytes:  dev.BytesUsed,
+		}
+		if di, err := iocDevInfo(f.file(), dev.DevID, dev.UUID); err == nil {
+			d.Path = di.Path()
+		}
+		d.Missing = d.Path == ""
+		out = append(out, d)
+	}
+	if err = it.Err(); err != nil {
+		return nil, &os.PathError{Op: "tree search", Path: f.f.Name(), Err: err}
+	}
+	return out, nil
+}
+
+// IsSprouted reports if the filesystem was sprouted from a seed and still uses seed devices.
+func (f *FS) IsSprouted() (bool, error) {
+	seeds, err := f.SeedDevices()
+	return len(seeds) != 0, err
+}
+
+// Values of statfs ST_* flags, as defined in <sys/statvfs.h>.
+// The syscall package only provides the MS_* mount flags.
+const (
+	stRdOnly     = 0x1
+	stNoSuid     = 0x2
+	stNoDev      = 0x4
+	stNoExec     = 0x8
+	stNoAtime    = 0x400
+	stNoDirAtime = 0x800
+	stRelAtime   = 0x1000
+)
+
+// statfsMountFlags maps statfs flags to mount flags preserved on remount.
+var statfsMountFlags = []struct {
+	st int64
+	ms uintptr
+}{
+	{stNoSuid, syscall.MS_NOSUID},
+	{stNoDev, syscall.MS_NODEV},
+	{stNoExec, syscall.MS_NOEXEC},
+	{stNoAtime, syscall.MS_NOATIME},
+	{stNoDirAtime, syscall.MS_NODIRATIME},
+	{stRelAtime, syscall.MS_RELATIME},
+}
+
+// Sprout adds a writable device to a filesystem mounted read-only from a seed device,
+// and remounts it read-write. Other mount flags are preserved.
+func (f *FS) Sprout(device string) error {
+	if err := requireAdmin("sprout", device); err != nil {
+		return err
+	}
+	if err := f.AddDevice(device); err != nil {
+		return err
+	}
+	path, err := filepath.Abs(f.f.Name())
+	if err != nil {
+		return err
+	}
+	root, err := findMountRoot(path)
+	if err != nil {
+		return err
+	}
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(root, &st); err != nil {
+		return &os.PathError{Op: "statfs", Path: root, Err: err}
+	}
+	flags := uintptr(syscall.MS_REMOUNT)
+	for _, m := range statfsMountFlags {
+		if int64(st.Flags)&m.st != 0 {
+			flags |= m.ms
+		}
+	}
+	if err = syscall.Mount("", root, "", flags, ""); err != nil {
+		return &os.PathError{Op: "remount", Path: root, Err: err}
+	}
+	return nil
+}
+
+// RemoveSeeds removes all seed devices from a sprouted filesystem. Data that is still stored
+// on seeds is copied to writable devices, after which the filesystem is independent from them.
+func (f *FS) RemoveSeeds() error {
+	seeds, err := f.SeedDevices()
+	if err != nil {
+		return err
+	}
+	for _, d := range seeds {
+		if err = f.RemoveDeviceByID(d.DevID); err != nil {
+			return fmt.Errorf("cannot remove seed device %d: %w", d.DevID, err)
+		}
+	}
+	return nil
+}
@@ -1,112 +1,224 @@
 package btrfs
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"unsafe"
+	"syscall"
 )
 
 func Send(w io.Writer, parent string, subvols ...string) error {
+	return SendWithOptions(w, SendOptions{Parent: parent}, subvols...)
+}
+
+// SendOptions are additional options for send.
+type SendOptions struct {
+	// Parent is a path of the parent subvolume for incremental send.
+	Parent string
+	// CloneSources are paths of additional subvolumes that may share data with sent subvolumes.
+	// Sending references to shared extents instead of data makes the stream smaller.
+	// If Parent is not set, the best parent is selected from the clone sources.
+	CloneSources []string
+	// ProtocolVersion requests a specific version of the send stream protocol.
+	// Zero means the default version (1). Version 2 requires kernel 6.0+.
+	ProtocolVersion uint32
+	// Compressed sends compressed extents as-is, without decompressing them.
+	// It requires protocol version 2, which is selected automatically.
+	Compressed bool
+	// NoFileData produces a metadata-only stream: file contents are replaced
+	// with update_extent commands that only contain offsets and sizes.
+	// Such streams cannot be received, but can be parsed to list changes quickly.
+	NoFileData bool
+	// Progress is called each time a chunk of the stream is written.
+	// It may be called from a different goroutine.
+	Progress func(SendProgress)
+}
+
+// SendProgress describes the progress of the send operation.
+type SendProgress struct {
+	Subvolume string // path of the subvolume that is being sent
+	Index     int    // index of the subvolume in the list
+	Bytes     uint64 // total number of bytes written to the stream
+}
+
+// sendProgressWriter counts bytes written to the stream and reports them to a callback.
+type sendProgressWriter struct {
+	w    io.Writer
+	fn   func(SendProgress)
+	prog SendProgress
+}
+
+func (w *sendProgressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.prog.Bytes += uint64(n)
+		w.fn(w.prog)
+	}
+	return n, err
+}
+
+// SendWithOptions is similar to Send, but allows to set additional options.
+//
+// If w is backed by a file descriptor, like *os.File or *net.TCPConn, the stream is moved
+// to it with splice(2) without copying the data through user space.
+func SendWithOptions(w io.Writer, opts SendOptions, subvols ...string) error {
+	return SendContext(context.Background(), w, opts, subvols...)
+}
+
+// SendContext is similar to SendWithOptions, but aborts the send when the context is done.
+// Cancellation does not interrupt a write to w that is blocked.
+func SendContext(ctx context.Context, w io.Writer, opts SendOptions, subvols ...string) error {
+	return sendAt(ctx, nil, w, opts, subvols...)
+}
+
+// sendAt opens subvolumes, the parent and clone sources relative to dir and sends them.
+// See openAt.
+func sendAt(ctx context.Context, dir *os.File, w io.Writer, opts SendOptions, subvols ...string) error {
+	if opts.Compressed && opts.ProtocolVersion == 0 {
+		opts.ProtocolVersion = 2
+	} else if opts.Compressed && opts.ProtocolVersion < 2 {
+		return fmt.Errorf("compressed send requires protocol version 2, got %d", opts.ProtocolVersion)
+	}
 	if len(subvols) == 0 {
 		return nil
 	}
-	// use first send subvol to determine mount_root
-	subvol, err := filepath.Abs(subvols[0])
-	if err != nil {
-		return err
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	open := func(name string) (*os.File, error) {
+		f, err := openDirAt(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		return f, nil
 	}
-	mountRoot, err := findMountRoot(subvol)
-	if err == os.ErrNotExist {
-		return fmt.Errorf("cannot find a mountpoint for %s", subvol)
-	} else if err != nil {
-		return err
+	var parent *os.File
+	if opts.Parent != "" {
+		f, err := open(opts.Parent)
+		if err != nil {
+			return err
+		}
+		parent = f
+	}
+	sources := make([]*os.File, 0, len(opts.CloneSources))
+	for _, src := range opts.CloneSources {
+		f, err := open(src)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, f)
+	}
+	subs := make([]*os.File, 0, len(subvols))
+	for _, sub := range subvols {
+		f, err := open(sub)
+		if err != nil {
+			return err
+		}
+		subs = append(subs, f)
 	}
+	return sendFiles(ctx, w, opts, parent, sources, subs)
+}
+
+// sendFiles sends open subvolumes. The parent is optional.
+func sendFiles(ctx context.Context, w io.Writer, opts SendOptions, parent *os.File, sources, subs []*os.File) error {
 	var (
 		cloneSrc []objectID
 		parentID objectID
 	)
-	if parent != "" {
-		parent, err = filepath.Abs(parent)
-		if err != nil {
-			return err
-		}
-		id, err := getPathRootID(parent)
+	if parent != nil {
+		id, err := getFileRootID(parent)
 		if err != nil {
-			return fmt.Errorf("cannot get parent root id: %v", err)
+			return fmt.Errorf("cannot get parent root id: %w", err)
 		}
 		parentID = id
 		cloneSrc = append(cloneSrc, id)
 	}
-	// check all subvolumes
-	paths := make([]string, 0, len(subvols))
-	for _, sub := range subvols {
-		sub, err = filepath.Abs(sub)
-		if err != nil {
-			return err
+	for _, src := range sources {
+		if flags, err := iocSubvolGetflags(src); err != nil {
+			return &os.PathError{Op: "get flags", Path: src.Name(), Err: err}
+		} else if !flags.ReadOnly() {
+			return fmt.Errorf("clone source %s is not read-only", src.Name())
 		}
-		paths = append(paths, sub)
-		mount, err := findMountRoot(sub)
+		id, err := getFileRootID(src)
 		if err != nil {
-			return fmt.Errorf("cannot find mount root for %v: %v", sub, err)
-		} else if mount != mountRoot {
-			return fmt.Errorf("all subvolumes must be from the same filesystem (%s is not)", sub)
+			return fmt.Errorf("cannot get clone source root id: %w", err)
 		}
-		ok, err := IsReadOnly(sub)
+		cloneSrc = append(cloneSrc, id)
+	}
+	// check all subvolumes
+	var fsid FSID
+	for i, sub := range subs {
+		info, err := iocFsInfo(sub)
 		if err != nil {
-			return err
-		} else if !ok {
-			return fmt.Errorf("subvolume %s is not read-only", sub)
+			return &os.PathError{Op: "fs info", Path: sub.Name(), Err: err}
+		} else if i == 0 {
+			fsid = info.fsid
+		} else if info.fsid != fsid {
+			return fmt.Errorf("all subvolumes must be from the same filesystem (%s is not)", sub.Name())
+		}
+		if flags, err := iocSubvolGetflags(sub); err != nil {
+			return &os.PathError{Op: "get flags", Path: sub.Name(), Err: err}
+		} else if !flags.ReadOnly() {
+			return fmt.Errorf("subvolume %s is not read-only", sub.Name())
 		}
 	}
-	mfs, err := Open(mountRoot, true)
-	if err != nil {
-		return err
+	var prog *sendProgressWriter
+	if opts.Progress != nil {
+		prog = &sendProgressWriter{w: w, fn: opts.Progress}
+		w = prog
 	}
-	defer mfs.Close()
 	full := len(cloneSrc) == 0
-	for i, sub := range paths {
+	for i, sub := range subs {
+		if prog != nil {
+			prog.prog.Subvolume, prog.prog.Index = sub.Name(), i
+		}
 		var rootID objectID
-		if !full && parent != "" {
-			rel, err := filepath.Rel(mountRoot, sub)
+		if !full {
+			id, err := getFileRootID(sub)
 			if err != nil {
-				return err
+				return fmt.Errorf("cannot find subvolume %s: %w", sub.Name(), err)
 			}
-			si, err := subvolSearchByPath(mfs.f, rel)
-			if err != nil {
-				return fmt.Errorf("cannot find subvolume %s: %v", rel, err)
-			}
-			rootID = si.RootID
-			parentID, err = findGoodParent(mfs.f, rootID, cloneSrc)
-			if err != nil {
-				return fmt.Errorf("cannot find good parent for %v: %v", rel, err)
+			rootID = id
+			// only select the parent automatically if it was not set explicitly
+			if parent == nil {
+				parentID, err = findGoodParent(sub, rootID, cloneSrc)
+				if err != nil {
+					return fmt.Errorf("cannot find good parent for %v: %w", sub.Name(), err)
+				}
 			}
 		}
-		fs, err := Open(sub, true)
-		if err != nil {
-			return err
-		}
 		var flags uint64
+		if opts.Compressed {
+			flags |= _BTRFS_SEND_FLAG_COMPRESSED
+		}
+		if opts.NoFileData {
+			flags |= _BTRFS_SEND_FLAG_NO_FILE_DATA
+		}
 		if i != 0 { // not first
 			flags |= _BTRFS_SEND_FLAG_OMIT_STREAM_HEADER
 		}
-		if i < len(paths)-1 { // not last
+		if i < len(subs)-1 { // not last
 			flags |= _BTRFS_SEND_FLAG_OMIT_END_CMD
 		}
-		err = send(w, fs.f, parentID, cloneSrc, flags)
-		fs.Close()
-		if err != nil {
-			return fmt.Errorf("error sending %s: %v", sub, err)
+		err := send(ctx, w, sub, parentID, cloneSrc, flags, opts.ProtocolVersion)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			return fmt.Errorf("error sending %s: %w", sub.Name(), err)
 		}
-		if !full && parent != "" {
+		if !full {
 			cloneSrc = append(cloneSrc, rootID)
 		}
 	}
 	return nil
 }
 
-func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, flags uint64) error {
+func send(ctx context.Context, w io.Writer, subvol *os.File, parent objectID, sources []objectID, flags uint64, version uint32) error {
 	pr, pw, err := os.Pipe()
 	if err != nil {
 		return err
@@ -114,9 +226,20 @@ func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, fla
 	errc := make(chan error, 1)
 	go func() {
 		defer pr.Close()
-		_, err := io.Copy(w, pr)
-		errc <- err
+		errc <- copyStream(w, pr)
 	}()
+	if ctx.Done() != nil {
+		// closing the read end of the pipe makes the kernel abort the send with EPIPE
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				pr.Close()
+			case <-stop:
+			}
+		}()
+	}
 	fd := pw.Fd()
 	wait := func() error {
 		pw.Close()
@@ -127,6 +250,10 @@ func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, fla
 		parent_root: parent,
 		flags:       flags,
 	}
+	if version != 0 {
+		args.flags |= _BTRFS_SEND_FLAG_VERSION
+		args.version = version
+	}
 	if len(sources) != 0 {
 		args.clone_sources = &sources[0]
 		args.clone_sources_count = uint64(len(sources))
@@ -138,6 +265,70 @@ func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, fla
 	return wait()
 }
 
+// spliceChunk is the maximal number of bytes moved by a single splice call.
+const spliceChunk = 1 << 20
+
+// copyStream copies the send stream from the read end of the pipe to w.
+// If w is backed by a file descriptor (a file, a pipe or a socket), the data is
+// moved with splice(2) and is never copied to user space.
+func copyStream(w io.Writer, pr *os.File) error {
+	dst := w
+	prog, _ := w.(*sendProgressWriter)
+	if prog != nil {
+		dst = prog.w
+	}
+	if sc, ok := dst.(syscall.Conn); ok {
+		if rc, err := sc.SyscallConn(); err == nil {
+			if ok, err := spliceStream(rc, pr, prog); ok {
+				return err
+			}
+		}
+	}
+	_, err := io.Copy(w, pr)
+	return err
+}
+
+// spliceStream moves data from the pipe to dst until the write end of the pipe is closed.
+// It returns false if dst does not support splice and no data was moved.
+func spliceStream(dst syscall.RawConn, pr *os.File, prog *sendProgressWriter) (bool, error) {
+	src, err := pr.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	// Pipe is non-blocking by default, and splice returns EAGAIN when it is empty,
+	// which cannot be told apart from dst being full. Make it blocking instead.
+	// Closing the pipe still aborts the copy after the current chunk.
+	pr.Fd()
+	for first := true; ; first = false {
+		var (
+			n    int64
+			serr error
+		)
+		err := src.Control(func(rfd uintptr) {
+			werr := dst.Write(func(wfd uintptr) bool {
+				n, serr = syscall.Splice(int(rfd), nil, int(wfd), nil, spliceChunk, 0)
+				return serr != syscall.EAGAIN
+			})
+			if serr == nil {
+				serr = werr
+			}
+		})
+		if err != nil {
+			return true, err
+		} else if first && (serr == syscall.EINVAL || serr == syscall.ENOSYS) {
+			return false, nil
+		} else if serr != nil {
+			return true, serr
+		} else if n == 0 {
+			return true, nil
+		}
+		if prog != nil {
+			prog.prog.Bytes += uint64(n)
+			prog.fn(prog.prog)
+		}
+	}
+}
+
 // readRootItem reads a root item from the tree.
 //
 // TODO(dennwc): support older kernels:
@@ -145,7 +336,7 @@ func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, fla
 // we know it's an old version of the root structure and initialize all new fields to zero.
 // The same happens if we detect mismatching generation numbers as then we know the root was
 // once mounted with an older kernel that was not aware of the root item structure change.
-func readRootItem(mnt *os.File, rootID objectID) (*rootItem, error) {
+func readRootItem(mnt ioctlFile, rootID objectID) (*RootItem, error) {
 	sk := btrfs_ioctl_search_key{
 		tree_id: rootTreeObjectid,
 		// There may be more than one ROOT_ITEM key if there are
@@ -173,13 +364,10 @@ func readRootItem(mnt *os.File, rootID objectID) (*rootItem, error) {
 				break
 			}
 			if r.ObjectID == rootID && r.Type == rootItemKey {
-				const sz = int(unsafe.Sizeof(btrfs_root_item_raw{}))
-				if len(r.Data) > sz {
-					return nil, fmt.Errorf("btrfs_root_item is larger than expected; kernel is newer than the library")
-				} else if len(r.Data) < sz { // TODO
-					return nil, fmt.Errorf("btrfs_root_item is smaller then expected; kernel version is too old")
+				p, err := DecodeRootItem(r.Data)
+				if err != nil {
+					return nil, err
 				}
-				p := asRootItem(r.Data).Decode()
 				return &p, nil
 			}
 		}
@@ -191,18 +379,49 @@ func readRootItem(mnt *os.File, rootID objectID) (*rootItem, error) {
 	return nil, ErrNotFound
 }
 
-func getParent(mnt *os.File, rootID objectID) (*SubvolInfo, error) {
+// FindBestParent selects a parent for an incremental send of subvol from a list of candidates.
+// It prefers the subvolume that subvol was snapshotted from, then its snapshots with the closest
+// generation, then repeats the same for the ancestors. Relative paths are resolved against
+// the filesystem root. It returns ErrNotFound if none of the candidates can be used.
+func (f *FS) FindBestParent(subvol string, candidates []string) (string, error) {
+	rootID, err := rootIDAt(f.f, subvol)
+	if err != nil {
+		return "", err
+	}
+	ids := make([]objectID, 0, len(candidates))
+	for _, c := range candidates {
+		id, err := rootIDAt(f.f, c)
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, id)
+	}
+	id, err := findGoodParent(f.file(), rootID, ids)
+	if err != nil {
+		return "", err
+	}
+	for i, c := range candidates {
+		if ids[i] == id {
+			return c, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func getParent(mnt ioctlFile, rootID objectID) (*SubvolInfo, error) {
 	st, err := subvolSearchByRootID(mnt, rootID, "")
 	if err != nil {
-		return nil, fmt.Errorf("cannot find subvolume %d to determine parent: %v", rootID, err)
+		return nil, fmt.Errorf("cannot find subvolume %d to determine parent: %w", rootID, err)
 	}
 	return subvolSearchByUUID(mnt, st.ParentUUID)
 }
 
-func findGoodParent(mnt *os.File, rootID objectID, cloneSrc []objectID) (objectID, error) {
+func findGoodParent(mnt ioctlFile, rootID objectID, cloneSrc []objectID) (objectID, error) {
 	parent, err := getParent(mnt, rootID)
-	if err != nil {
-		return 0, fmt.Errorf("get parent failed: %v", err)
+	if err == ErrNotFound {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("get parent failed: %w", err)
 	}
 	for _, id := range cloneSrc {
 		if id == parent.RootID {
@@ -0,0 +1,160 @@
+package send
+
+import (
+	"github.com/dennwc/btrfs"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChangeType is a type of change between two snapshots.
+type ChangeType int
+
+const (
+	ChangeAdded ChangeType = iota
+	ChangeModified
+	ChangeDeleted
+	ChangeRenamed
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	case ChangeRenamed:
+		return "renamed"
+	}
+	return "unknown"
+}
+
+// Change describes a single changed path between two snapshots.
+type Change struct {
+	Type    ChangeType
+	Path    string // path relative to the snapshot root
+	OldPath string // previous path for renamed entries
+	Size    int64  // size of a regular file; for deleted files it's the old size
+}
+
+// Diff returns a list of paths that differ between two read-only snapshots.
+// newSnap must be a snapshot of the same subvolume as oldSnap, or of one of its snapshots.
+//
+// It is implemented with a metadata-only send stream, thus no file data is read.
+func Diff(oldSnap, newSnap string) ([]Change, error) {
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := btrfs.SendWithOptions(pw, btrfs.SendOptions{Parent: oldSnap, NoFileData: true}, newSnap)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	changes, err := DiffStream(pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	serr := <-errc
+	if err != nil {
+		return nil, err
+	} else if serr != nil {
+		return nil, serr
+	}
+	for i := range changes {
+		c := &changes[i]
+		root := newSnap
+		if c.Type == ChangeDeleted {
+			root = oldSnap
+		}
+		if st, err := os.Lstat(filepath.Join(root, c.Path)); err == nil && st.Mode().IsRegular() {
+			c.Size = st.Size()
+		}
+	}
+	return changes, nil
+}
+
+type diffEntry struct {
+	typ     ChangeType
+	oldPath string
+}
+
+// DiffStream returns a list of paths changed by an incremental send stream.
+// Sizes are not filled, since streams don't contain the full information about files.
+func DiffStream(r io.Reader) ([]Change, error) {
+	sr, err := NewStreamReader(r)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]*diffEntry)
+	modified := func(p string) {
+		if m[p] == nil {
+			m[p] = &diffEntry{typ: ChangeModified}
+		}
+	}
+	removed := func(p string) {
+		e := m[p]
+		delete(m, p)
+		switch {
+		case e == nil, e.typ == ChangeModified:
+			m[p] = &diffEntry{typ: ChangeDeleted}
+		case e.typ == ChangeRenamed:
+			m[e.oldPath] = &diffEntry{typ: ChangeDeleted}
+		}
+		// files added by the stream are dropped
+	}
+	renamed := func(from, to string) {
+		e := m[from]
+		delete(m, from)
+		if e == nil {
+			e = &diffEntry{typ: ChangeRenamed, oldPath: from}
+		} else if e.typ == ChangeRenamed && e.oldPath == to {
+			e = nil // renamed back
+		}
+		if e != nil {
+			m[to] = e
+		}
+		// move tracked entries inside a renamed directory
+		prefix := from + "/"
+		for p, e := range m {
+			if strings.HasPrefix(p, prefix) {
+				delete(m, p)
+				m[to+"/"+strings.TrimPrefix(p, prefix)] = e
+			}
+		}
+	}
+loop:
+	for {
+		c, err := sr.ReadCommand()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch c := c.(type) {
+		case *StreamEnd:
+			break loop
+		case *MkfileCmd, *MkdirCmd, *MknodCmd, *MkfifoCmd, *MksockCmd, *SymlinkCmd, *LinkCmd:
+			m[cmdPath(c)] = &diffEntry{typ: ChangeAdded}
+		case *RenameCmd:
+			renamed(c.From, c.To)
+		case *UnlinkCmd:
+			removed(c.Path)
+		case *RmdirCmd:
+			removed(c.Path)
+		case *WriteCmd, *UpdateExtentCmd, *CloneCmd, *TruncateCmd, *FallocateCmd, *EncodedWriteCmd,
+			*ChmodCmd, *ChownCmd, *SetXattrCmd, *RemoveXattrCmd, *FileattrCmd:
+			modified(cmdPath(c))
+		default:
+			// subvolume and utimes commands don't change the set of paths
+		}
+	}
+	out := make([]Change, 0, len(m))
+	for p, e := range m {
+		out = append(out, Change{Type: e.typ, Path: p, OldPath: e.oldPath})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	return out, nil
+}
@@ -0,0 +1,55 @@
+package send
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDiffStream(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriter(buf, sendStreamVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Cmd{
+		&SnapshotCmd{Path: "snap"},
+		// new file created under a temporary name
+		&MkfileCmd{Path: "o260-7-0"},
+		&RenameCmd{From: "o260-7-0", To: "dir/new"},
+		&UpdateExtentCmd{Path: "dir/new", Size: 10},
+		// existing file changed
+		&UpdateExtentCmd{Path: "changed", Off: 4096, Size: 10},
+		&UTimesCmd{Path: "dir"},
+		// existing file renamed
+		&RenameCmd{From: "old", To: "moved"},
+		// existing file orphanized and removed
+		&RenameCmd{From: "gone", To: "o258-5-0"},
+		&UnlinkCmd{Path: "o258-5-0"},
+		// existing file written and then removed
+		&WriteCmd{Path: "written", Data: []byte("data")},
+		&UnlinkCmd{Path: "written"},
+		// new file added and removed
+		&MkfileCmd{Path: "o261-7-0"},
+		&UnlinkCmd{Path: "o261-7-0"},
+		&StreamEnd{},
+	} {
+		if err = w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := DiffStream(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Change{
+		{Type: ChangeModified, Path: "changed"},
+		{Type: ChangeAdded, Path: "dir/new"},
+		{Type: ChangeDeleted, Path: "gone"},
+		{Type: ChangeRenamed, Path: "moved", OldPath: "old"},
+		{Type: ChangeDeleted, Path: "written"},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected diff:\n%+v\nvs\n%+v", got, exp)
+	}
+}
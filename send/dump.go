@@ -0,0 +1,293 @@
+package send
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DumpFormat selects the output format of DumpStream.
+type DumpFormat int
+
+const (
+	// DumpText prints one line per command, like 'btrfs receive --dump'.
+	DumpText DumpFormat = iota
+	// DumpJSON prints one JSON object per command.
+	DumpJSON
+)
+
+// DumpOptions controls the output of DumpStreamWithOptions.
+type DumpOptions struct {
+	Format DumpFormat
+}
+
+// DumpStream prints a human-readable description of every command in a send stream.
+// The output matches the format of 'btrfs receive --dump', including escaping of paths and names.
+func DumpStream(r io.Reader, w io.Writer) error {
+	return DumpStreamWithOptions(r, w, DumpOptions{})
+}
+
+// DumpStreamWithOptions is like DumpStream, but allows to select the output format.
+// Multiple concatenated streams are dumped one after another.
+func DumpStreamWithOptions(r io.Reader, w io.Writer, opts DumpOptions) error {
+	d := &streamDumper{w: w, format: opts.Format}
+	if d.format == DumpJSON {
+		d.enc = json.NewEncoder(w)
+	}
+	br := bufio.NewReader(r)
+	for first := true; ; first = false {
+		if _, err := br.Peek(1); err == io.EOF && !first {
+			return nil
+		}
+		sr, err := NewStreamReader(br)
+		if err != nil {
+			return err
+		}
+		if err = d.dump(sr); err != nil {
+			return err
+		}
+	}
+}
+
+type dumpArg struct {
+	Key  string
+	Text string
+	Val  interface{}
+}
+
+func dumpUint(key string, v uint64) dumpArg {
+	return dumpArg{Key: key, Text: strconv.FormatUint(v, 10), Val: v}
+}
+
+func dumpStr(key string, v string) dumpArg {
+	return dumpArg{Key: key, Text: escapeDump(v), Val: v}
+}
+
+// escapeDump escapes a string the same way as print_path_escaped in btrfs-progs does:
+// whitespace and backslashes are escaped with a backslash, and other non-printable bytes
+// are printed as octal numbers.
+func escapeDump(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		case 0x1b:
+			b.WriteString(`\e`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\v':
+			b.WriteString(`\v`)
+		case ' ':
+			b.WriteString(`\ `)
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			if c < 0x20 || c > 0x7e {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+func dumpTime(key string, v time.Time) dumpArg {
+	return dumpArg{Key: key, Text: v.Format("2006-01-02T15:04:05-0700"), Val: v}
+}
+
+type streamDumper struct {
+	w      io.Writer
+	enc    *json.Encoder
+	format DumpFormat
+	subvol string // path of the current subvolume
+}
+
+func (d *streamDumper) dump(r *StreamReader) error {
+	for {
+		c, err := r.ReadCommand()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, ok := c.(*StreamEnd); ok {
+			return nil
+		}
+		if err = d.dumpCmd(c); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *streamDumper) path(p string) string {
+	return "./" + path.Join(d.subvol, p)
+}
+
+func (d *streamDumper) dumpCmd(c Cmd) error {
+	var (
+		p    string
+		args []dumpArg
+	)
+	switch c := c.(type) {
+	case *SubvolCmd:
+		d.subvol = c.Path
+		p = d.path("")
+		args = []dumpArg{
+			dumpStr("uuid", c.UUID.String()),
+			dumpUint("transid", c.CTransID),
+		}
+	case *SnapshotCmd:
+		d.subvol = c.Path
+		p = d.path("")
+		args = []dumpArg{
+			dumpStr("uuid", c.UUID.String()),
+			dumpUint("transid", c.CTransID),
+			dumpStr("parent_uuid", c.CloneUUID.String()),
+			dumpUint("parent_transid", c.CloneTransID),
+		}
+	case *MkfileCmd:
+		p = d.path(c.Path)
+	case *MkdirCmd:
+		p = d.path(c.Path)
+	case *MknodCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			{Key: "mode", Text: strconv.FormatUint(c.Mode, 8), Val: c.Mode},
+			{Key: "dev", Text: "0x" + strconv.FormatUint(c.Rdev, 16), Val: c.Rdev},
+		}
+	case *MkfifoCmd:
+		p = d.path(c.Path)
+	case *MksockCmd:
+		p = d.path(c.Path)
+	case *SymlinkCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{dumpStr("dest", c.Link)}
+	case *RenameCmd:
+		p = d.path(c.From)
+		args = []dumpArg{dumpStr("dest", d.path(c.To))}
+	case *LinkCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{dumpStr("dest", c.Link)}
+	case *UnlinkCmd:
+		p = d.path(c.Path)
+	case *RmdirCmd:
+		p = d.path(c.Path)
+	case *WriteCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			dumpUint("offset", c.Off),
+			dumpUint("len", uint64(len(c.Data))),
+		}
+	case *CloneCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			dumpUint("offset", c.Off),
+			dumpUint("len", c.Len),
+			dumpStr("from", d.path(c.ClonePath)),
+			dumpUint("clone_offset", c.CloneOff),
+		}
+	case *SetXattrCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			dumpStr("name", c.Name),
+			dumpStr("data", string(c.Data)),
+			dumpUint("len", uint64(len(c.Data))),
+		}
+	case *RemoveXattrCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{dumpStr("name", c.Name)}
+	case *TruncateCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{dumpUint("size", c.Size)}
+	case *ChmodCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{{Key: "mode", Text: strconv.FormatUint(c.Mode, 8), Val: c.Mode}}
+	case *ChownCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			dumpUint("gid", c.GID),
+			dumpUint("uid", c.UID),
+		}
+	case *UTimesCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			dumpTime("atime", c.ATime),
+			dumpTime("mtime", c.MTime),
+			dumpTime("ctime", c.CTime),
+		}
+	case *UpdateExtentCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			dumpUint("offset", c.Off),
+			dumpUint("len", c.Size),
+		}
+	case *FallocateCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			dumpUint("mode", c.Mode),
+			dumpUint("offset", c.Off),
+			dumpUint("len", c.Size),
+		}
+	case *FileattrCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{{Key: "fileattr", Text: "0x" + strconv.FormatUint(c.Attr, 16), Val: c.Attr}}
+	case *EncodedWriteCmd:
+		p = d.path(c.Path)
+		args = []dumpArg{
+			dumpUint("offset", c.Off),
+			dumpUint("len", uint64(len(c.Data))),
+			dumpUint("unencoded_file_len", c.UnencodedFileLen),
+			dumpUint("unencoded_len", c.UnencodedLen),
+			dumpUint("unencoded_offset", c.UnencodedOffset),
+			dumpUint("compression", c.Compression),
+			dumpUint("encryption", c.Encryption),
+		}
+	case *UnknownSendCmd:
+		for _, tlv := range c.Params {
+			args = append(args, dumpArg{Key: tlv.Attr.String(), Text: fmt.Sprint(tlv.Val), Val: tlv.Val})
+		}
+	}
+	if d.format == DumpJSON {
+		m := map[string]interface{}{
+			"cmd": c.Type().String(),
+		}
+		if p != "" {
+			m["path"] = p
+		}
+		for _, a := range args {
+			m[a.Key] = a.Val
+		}
+		return d.enc.Encode(m)
+	}
+	line := fmt.Sprintf("%-16s", c.Type().String())
+	if len(args) == 0 {
+		// path is not padded, thus an escaped trailing space is kept
+		line = strings.TrimRight(line, " ")
+		if p != "" {
+			line = fmt.Sprintf("%-16s%s", line, escapeDump(p))
+		}
+	} else {
+		line += fmt.Sprintf("%-32s", escapeDump(p))
+		for _, a := range args {
+			line += " " + a.Key + "=" + a.Text
+		}
+	}
+	_, err := fmt.Fprintln(d.w, line)
+	return err
+}
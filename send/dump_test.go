@@ -0,0 +1,67 @@
+package send
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dennwc/btrfs"
+	"testing"
+)
+
+func TestDumpStream(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriter(buf, sendStreamVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{0: 0xab, 15: 0xcd}, CTransID: 7},
+		&MkfileCmd{Path: "o257-5-0", Ino: 257},
+		&RenameCmd{From: "o257-5-0", To: "file"},
+		&WriteCmd{Path: "file", Off: 4096, Data: []byte("hello")},
+		&ChmodCmd{Path: "file", Mode: 0644},
+		&RenameCmd{From: "file", To: "a b\nc\\\xff"},
+		&UnlinkCmd{Path: "end "},
+		&StreamEnd{},
+	} {
+		if err = w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := buf.Bytes()
+
+	out := bytes.NewBuffer(nil)
+	if err = DumpStream(bytes.NewReader(stream), out); err != nil {
+		t.Fatal(err)
+	}
+	const exp = `subvol          ./vol                            uuid=ab000000-0000-0000-0000-0000000000cd transid=7
+mkfile          ./vol/o257-5-0
+rename          ./vol/o257-5-0                   dest=./vol/file
+write           ./vol/file                       offset=4096 len=5
+chmod           ./vol/file                       mode=644
+rename          ./vol/file                       dest=./vol/a\ b\nc\\\377
+` + "unlink          ./vol/end\\ \n"
+	if got := out.String(); got != exp {
+		t.Errorf("unexpected dump:\n%s\nvs\n%s", got, exp)
+	}
+
+	out.Reset()
+	err = DumpStreamWithOptions(bytes.NewReader(stream), out, DumpOptions{Format: DumpJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(out)
+	var n int
+	for dec.More() {
+		var m map[string]interface{}
+		if err = dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if m["cmd"] == "write" && (m["path"] != "./vol/file" || m["len"] != float64(5)) {
+			t.Errorf("unexpected write: %v", m)
+		}
+	}
+	if n != 7 {
+		t.Errorf("expected 7 commands, got %d", n)
+	}
+}
@@ -0,0 +1,104 @@
+package send
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// TransformStream reads send streams from r, passes each command through fn and writes
+// the result to w. If fn returns a nil command, it is removed from the stream.
+// Checksums are recalculated and stream versions are preserved.
+func TransformStream(r io.Reader, w io.Writer, fn func(c Cmd) (Cmd, error)) error {
+	br := bufio.NewReader(r)
+	for first := true; ; first = false {
+		if _, err := br.Peek(1); err == io.EOF && !first {
+			return nil
+		}
+		sr, err := NewStreamReader(br)
+		if err != nil {
+			return err
+		}
+		sw, err := NewStreamWriter(w, sr.Version())
+		if err != nil {
+			return err
+		}
+		if err = transformCommands(sr, sw, fn); err != nil {
+			return err
+		}
+	}
+}
+
+func transformCommands(r *StreamReader, w *StreamWriter, fn func(c Cmd) (Cmd, error)) error {
+	for {
+		c, err := r.ReadCommand()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, ok := c.(*StreamEnd); ok {
+			return w.WriteCommand(c)
+		}
+		c, err = fn(c)
+		if err != nil {
+			return err
+		} else if c == nil {
+			continue
+		}
+		if err = w.WriteCommand(c); err != nil {
+			return err
+		}
+	}
+}
+
+// FilterOptions controls the behavior of FilterStream.
+type FilterOptions struct {
+	// Subvolume returns a new name for a received subvolume.
+	Subvolume func(name string) string
+	// StripXattrs is a list of extended attributes to remove from the stream.
+	// Names ending with a dot match the whole namespace, e.g. "security.".
+	StripXattrs []string
+	// StripChown removes all ownership changes from the stream.
+	StripChown bool
+}
+
+func (opts *FilterOptions) stripXattr(name string) bool {
+	for _, s := range opts.StripXattrs {
+		if name == s || (strings.HasSuffix(s, ".") && strings.HasPrefix(name, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterStream copies send streams from r to w, renaming subvolumes and removing
+// selected commands. It allows to receive streams under a different name or
+// in environments where some operations are not permitted.
+func FilterStream(r io.Reader, w io.Writer, opts FilterOptions) error {
+	return TransformStream(r, w, func(c Cmd) (Cmd, error) {
+		switch c := c.(type) {
+		case *SubvolCmd:
+			if opts.Subvolume != nil {
+				c.Path = opts.Subvolume(c.Path)
+			}
+		case *SnapshotCmd:
+			if opts.Subvolume != nil {
+				c.Path = opts.Subvolume(c.Path)
+			}
+		case *SetXattrCmd:
+			if opts.stripXattr(c.Name) {
+				return nil, nil
+			}
+		case *RemoveXattrCmd:
+			if opts.stripXattr(c.Name) {
+				return nil, nil
+			}
+		case *ChownCmd:
+			if opts.StripChown {
+				return nil, nil
+			}
+		}
+		return c, nil
+	})
+}
@@ -0,0 +1,52 @@
+package send
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestFilterStream(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriter(buf, sendStreamVersionV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "vol"},
+		&MkfileCmd{Path: "file"},
+		&ChownCmd{Path: "file", UID: 1000, GID: 1000},
+		&SetXattrCmd{Path: "file", Name: "security.selinux", Data: []byte("x")},
+		&SetXattrCmd{Path: "file", Name: "user.keep", Data: []byte("y")},
+		&StreamEnd{},
+	} {
+		if err = w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := bytes.NewBuffer(nil)
+	err = FilterStream(buf, out, FilterOptions{
+		Subvolume:   func(name string) string { return name + "-restored" },
+		StripXattrs: []string{"security."},
+		StripChown:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewStreamReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	} else if r.Version() != sendStreamVersionV2 {
+		t.Fatalf("unexpected version: %d", r.Version())
+	}
+	got := readAll(t, out.Bytes())
+	exp := []Cmd{
+		&SubvolCmd{Path: "vol-restored"},
+		&MkfileCmd{Path: "file"},
+		&SetXattrCmd{Path: "file", Name: "user.keep", Data: []byte("y")},
+		&StreamEnd{},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected commands:\n%#v\nvs\n%#v", got, exp)
+	}
+}
@@ -0,0 +1,701 @@
+package send
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/internal/fsutil"
+	"github.com/dennwc/btrfs/mtab"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ReceiveHandler processes commands of a send stream.
+//
+// Paths passed to the handler are relative to the subvolume that is being received.
+// End is called after each stream in the input is processed.
+type ReceiveHandler interface {
+	Subvol(c *SubvolCmd) error
+	Snapshot(c *SnapshotCmd) error
+	Mkfile(c *MkfileCmd) error
+	Mkdir(c *MkdirCmd) error
+	Mknod(c *MknodCmd) error
+	Mkfifo(c *MkfifoCmd) error
+	Mksock(c *MksockCmd) error
+	Symlink(c *SymlinkCmd) error
+	Rename(c *RenameCmd) error
+	Link(c *LinkCmd) error
+	Unlink(c *UnlinkCmd) error
+	Rmdir(c *RmdirCmd) error
+	SetXattr(c *SetXattrCmd) error
+	RemoveXattr(c *RemoveXattrCmd) error
+	Write(c *WriteCmd) error
+	Clone(c *CloneCmd) error
+	Truncate(c *TruncateCmd) error
+	Chmod(c *ChmodCmd) error
+	Chown(c *ChownCmd) error
+	UTimes(c *UTimesCmd) error
+	UpdateExtent(c *UpdateExtentCmd) error
+	Fallocate(c *FallocateCmd) error
+	Fileattr(c *FileattrCmd) error
+	EncodedWrite(c *EncodedWriteCmd) error
+	End() error
+}
+
+// ReceiveOptions are additional options for receive.
+type ReceiveOptions struct {
+	// Progress is called after each command is processed.
+	Progress func(ReceiveProgress)
+}
+
+// ReceiveProgress describes the progress of the receive operation.
+type ReceiveProgress struct {
+	Bytes     uint64  // total number of bytes read from the stream
+	Cmd       CmdType // last processed command
+	Path      string  // path from the last processed command, if any
+	Subvolume string  // name of the subvolume that is being received
+	Files     int     // number of files, directories and links created
+}
+
+// ReceiveStream reads send streams from r and dispatches all commands to h.
+// Multiple concatenated streams are processed one after another.
+func ReceiveStream(r io.Reader, h ReceiveHandler) error {
+	return ReceiveStreamWithOptions(r, h, ReceiveOptions{})
+}
+
+// ReceiveStreamWithOptions is similar to ReceiveStream, but allows to set additional options.
+func ReceiveStreamWithOptions(r io.Reader, h ReceiveHandler, opts ReceiveOptions) error {
+	return ReceiveStreamContext(context.Background(), r, h, opts)
+}
+
+// ReceiveStreamContext is similar to ReceiveStreamWithOptions, but stops reading the stream
+// when the context is done. A read from r that is blocked at that moment is abandoned.
+// The handler is not notified about the cancellation, and End is not called.
+func ReceiveStreamContext(ctx context.Context, r io.Reader, h ReceiveHandler, opts ReceiveOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := receiveStream(&ctxReader{ctx: ctx, r: r}, h, opts)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func receiveStream(r io.Reader, h ReceiveHandler, opts ReceiveOptions) error {
+	br := bufio.NewReader(r)
+	cr := &countingReader{r: br}
+	var prog ReceiveProgress
+	for first := true; ; first = false {
+		if _, err := br.Peek(1); err == io.EOF && !first {
+			return nil
+		}
+		sr, err := NewStreamReader(cr)
+		if err != nil {
+			return err
+		}
+		if err = receiveCommands(sr, h, func(c Cmd) {
+			if opts.Progress == nil {
+				return
+			}
+			prog.Bytes = cr.n
+			prog.Cmd = c.Type()
+			prog.Path = cmdPath(c)
+			switch c := c.(type) {
+			case *SubvolCmd:
+				prog.Subvolume = c.Path
+			case *SnapshotCmd:
+				prog.Subvolume = c.Path
+			case *MkfileCmd, *MkdirCmd, *MknodCmd, *MkfifoCmd, *MksockCmd, *SymlinkCmd, *LinkCmd:
+				prog.Files++
+			}
+			opts.Progress(prog)
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += uint64(n)
+	return n, err
+}
+
+// ctxReader fails reads when the context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	} else if r.ctx.Done() == nil {
+		return r.r.Read(p)
+	}
+	ch := make(chan readResult, 1)
+	go func() {
+		n, err := r.r.Read(p)
+		ch <- readResult{n: n, err: err}
+	}()
+	select {
+	case res := <-ch:
+		return res.n, res.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+// cmdPath returns the main path argument of a command.
+func cmdPath(c Cmd) string {
+	for _, tlv := range c.encode() {
+		if tlv.Attr == sendAttrPath {
+			p, _ := tlv.Val.(string)
+			return p
+		}
+	}
+	return ""
+}
+
+func receiveCommands(r *StreamReader, h ReceiveHandler, done func(c Cmd)) error {
+	for {
+		c, err := r.ReadCommand()
+		if err == io.EOF {
+			return h.End()
+		} else if err != nil {
+			return err
+		}
+		if _, ok := c.(*StreamEnd); ok {
+			if err = h.End(); err == nil {
+				done(c)
+			}
+			return err
+		}
+		if err = dispatchCommand(h, c); err != nil {
+			return err
+		}
+		done(c)
+	}
+}
+
+func dispatchCommand(h ReceiveHandler, c Cmd) error {
+	switch c := c.(type) {
+	case *SubvolCmd:
+		return h.Subvol(c)
+	case *SnapshotCmd:
+		return h.Snapshot(c)
+	case *MkfileCmd:
+		return h.Mkfile(c)
+	case *MkdirCmd:
+		return h.Mkdir(c)
+	case *MknodCmd:
+		return h.Mknod(c)
+	case *MkfifoCmd:
+		return h.Mkfifo(c)
+	case *MksockCmd:
+		return h.Mksock(c)
+	case *SymlinkCmd:
+		return h.Symlink(c)
+	case *RenameCmd:
+		return h.Rename(c)
+	case *LinkCmd:
+		return h.Link(c)
+	case *UnlinkCmd:
+		return h.Unlink(c)
+	case *RmdirCmd:
+		return h.Rmdir(c)
+	case *SetXattrCmd:
+		return h.SetXattr(c)
+	case *RemoveXattrCmd:
+		return h.RemoveXattr(c)
+	case *WriteCmd:
+		return h.Write(c)
+	case *CloneCmd:
+		return h.Clone(c)
+	case *TruncateCmd:
+		return h.Truncate(c)
+	case *ChmodCmd:
+		return h.Chmod(c)
+	case *ChownCmd:
+		return h.Chown(c)
+	case *UTimesCmd:
+		return h.UTimes(c)
+	case *UpdateExtentCmd:
+		return h.UpdateExtent(c)
+	case *FallocateCmd:
+		return h.Fallocate(c)
+	case *FileattrCmd:
+		return h.Fileattr(c)
+	case *EncodedWriteCmd:
+		return h.EncodedWrite(c)
+	}
+	return fmt.Errorf("unsupported command: %v", c.Type())
+}
+
+// Receive applies send streams from r to a directory on btrfs.
+// It is a native equivalent of 'btrfs receive'.
+func Receive(r io.Reader, dstDir string) error {
+	return ReceiveWithOptions(r, dstDir, ReceiveOptions{})
+}
+
+// ReceiveWithOptions is similar to Receive, but allows to set additional options.
+func ReceiveWithOptions(r io.Reader, dstDir string, opts ReceiveOptions) error {
+	return ReceiveContext(context.Background(), r, dstDir, opts)
+}
+
+// ReceiveContext is similar to ReceiveWithOptions, but stops when the context is done.
+// A partially received subvolume is left in place, as with 'btrfs receive'.
+func ReceiveContext(ctx context.Context, r io.Reader, dstDir string, opts ReceiveOptions) error {
+	h, err := NewSubvolumeReceiver(dstDir)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	return ReceiveStreamContext(ctx, r, h, opts)
+}
+
+var _ ReceiveHandler = (*SubvolumeReceiver)(nil)
+
+// SubvolumeReceiver is the default ReceiveHandler that creates received subvolumes
+// in a directory on btrfs and applies stream commands to them.
+type SubvolumeReceiver struct {
+	root string    // destination directory
+	fs   *btrfs.FS // filesystem of the destination directory
+
+	mnt       string // mount point of the filesystem, resolved lazily
+	mntSubvol string // path of the subvolume mounted at mnt
+
+	cur      string // path of the current subvolume
+	uuid     btrfs.UUID
+	ctransid uint64
+
+	file     *os.File // file opened for writing
+	filePath string
+}
+
+// NewSubvolumeReceiver creates a receiver that stores subvolumes in dstDir.
+func NewSubvolumeReceiver(dstDir string) (*SubvolumeReceiver, error) {
+	dstDir, err := filepath.Abs(dstDir)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := btrfs.Open(dstDir, true)
+	if err != nil {
+		return nil, err
+	}
+	return &SubvolumeReceiver{root: dstDir, fs: fs}, nil
+}
+
+// Close releases resources held by the receiver.
+func (h *SubvolumeReceiver) Close() error {
+	err := h.closeFile()
+	if err2 := h.fs.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (h *SubvolumeReceiver) closeFile() error {
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file, h.filePath = nil, ""
+	return err
+}
+
+// path resolves a stream path relative to the current subvolume.
+func (h *SubvolumeReceiver) path(p string) (string, error) {
+	if h.cur == "" {
+		return "", errors.New("no subvolume to receive into")
+	}
+	full := filepath.Join(h.cur, p)
+	if full != h.cur && !strings.HasPrefix(full, h.cur+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes the subvolume: %q", p)
+	}
+	return full, nil
+}
+
+// subvolPath returns a path for a new subvolume in the destination directory.
+func (h *SubvolumeReceiver) subvolPath(name string) (string, error) {
+	full := filepath.Join(h.root, name)
+	if filepath.Dir(full) != h.root {
+		return "", fmt.Errorf("invalid subvolume name: %q", name)
+	}
+	return full, nil
+}
+
+// findSubvol finds a path of the local copy of the subvolume with a given UUID and transaction id.
+func (h *SubvolumeReceiver) findSubvol(uuid btrfs.UUID, transid uint64) (string, error) {
+	if uuid == h.uuid && h.cur != "" {
+		return h.cur, nil
+	}
+	info, err := h.fs.FindReceivedSubvolume(uuid, transid)
+	if err == btrfs.ErrNotFound {
+		return "", fmt.Errorf("cannot find subvolume with uuid %v and transid %d", uuid, transid)
+	} else if err != nil {
+		return "", err
+	}
+	if h.mnt == "" {
+		h.mnt, h.mntSubvol, err = findMount(h.root)
+		if err != nil {
+			return "", err
+		}
+	}
+	rel, err := filepath.Rel("/"+h.mntSubvol, "/"+info.Path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("subvolume %q is not accessible from %q", info.Path, h.mnt)
+	}
+	return filepath.Join(h.mnt, rel), nil
+}
+
+// findMount returns the btrfs mount point that contains a given path and the path
+// of the subvolume mounted there.
+func findMount(path string) (mnt, subvol string, _ error) {
+	mounts, err := mtab.Mounts()
+	if err != nil {
+		return "", "", err
+	}
+	var mp *mtab.MountPoint
+	for i, m := range mounts {
+		if m.Mount != path && !strings.HasPrefix(path, strings.TrimSuffix(m.Mount, "/")+"/") {
+			continue
+		}
+		if mp == nil || len(mp.Mount) < len(m.Mount) {
+			mp = &mounts[i]
+		}
+	}
+	if mp == nil {
+		return "", "", os.ErrNotExist
+	} else if mp.Type != "btrfs" {
+		return "", "", btrfs.ErrNotBtrfs{Path: mp.Mount}
+	}
+	for _, opt := range strings.Split(mp.Opts, ",") {
+		if strings.HasPrefix(opt, "subvol=") {
+			subvol = strings.Trim(strings.TrimPrefix(opt, "subvol="), "/")
+		}
+	}
+	return mp.Mount, subvol, nil
+}
+
+func (h *SubvolumeReceiver) Subvol(c *SubvolCmd) error {
+	// multi-subvolume streams omit the end command between subvolumes
+	if err := h.End(); err != nil {
+		return err
+	}
+	path, err := h.subvolPath(c.Path)
+	if err != nil {
+		return err
+	}
+	if err = btrfs.CreateSubVolume(path); err != nil {
+		return err
+	}
+	h.cur, h.uuid, h.ctransid = path, c.UUID, c.CTransID
+	return nil
+}
+
+func (h *SubvolumeReceiver) Snapshot(c *SnapshotCmd) error {
+	if err := h.End(); err != nil {
+		return err
+	}
+	path, err := h.subvolPath(c.Path)
+	if err != nil {
+		return err
+	}
+	parent, err := h.findSubvol(c.CloneUUID, c.CloneTransID)
+	if err != nil {
+		return err
+	}
+	if err = btrfs.SnapshotSubVolume(parent, path, false); err != nil {
+		return err
+	}
+	h.cur, h.uuid, h.ctransid = path, c.UUID, c.CTransID
+	return nil
+}
+
+func (h *SubvolumeReceiver) Mkfile(c *MkfileCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (h *SubvolumeReceiver) Mkdir(c *MkdirCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(path, 0700)
+}
+
+func (h *SubvolumeReceiver) mknod(p string, mode uint32, dev uint64) error {
+	path, err := h.path(p)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Mknod(path, mode, int(dev)); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (h *SubvolumeReceiver) Mknod(c *MknodCmd) error {
+	return h.mknod(c.Path, uint32(c.Mode), c.Rdev)
+}
+
+func (h *SubvolumeReceiver) Mkfifo(c *MkfifoCmd) error {
+	return h.mknod(c.Path, syscall.S_IFIFO|0600, 0)
+}
+
+func (h *SubvolumeReceiver) Mksock(c *MksockCmd) error {
+	return h.mknod(c.Path, syscall.S_IFSOCK|0600, 0)
+}
+
+func (h *SubvolumeReceiver) Symlink(c *SymlinkCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(c.Link, path)
+}
+
+func (h *SubvolumeReceiver) Rename(c *RenameCmd) error {
+	from, err := h.path(c.From)
+	if err != nil {
+		return err
+	}
+	to, err := h.path(c.To)
+	if err != nil {
+		return err
+	}
+	if from == h.filePath {
+		if err = h.closeFile(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(from, to)
+}
+
+func (h *SubvolumeReceiver) Link(c *LinkCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	target, err := h.path(c.Link)
+	if err != nil {
+		return err
+	}
+	return os.Link(target, path)
+}
+
+func (h *SubvolumeReceiver) Unlink(c *UnlinkCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	if path == h.filePath {
+		if err = h.closeFile(); err != nil {
+			return err
+		}
+	}
+	if err = syscall.Unlink(path); err != nil {
+		return &os.PathError{Op: "unlink", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (h *SubvolumeReceiver) Rmdir(c *RmdirCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Rmdir(path); err != nil {
+		return &os.PathError{Op: "rmdir", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (h *SubvolumeReceiver) SetXattr(c *SetXattrCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Setxattr(path, c.Name, c.Data, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (h *SubvolumeReceiver) RemoveXattr(c *RemoveXattrCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Removexattr(path, c.Name); err != nil {
+		return &os.PathError{Op: "removexattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+// openFile returns a file opened for writing. The file is kept open between
+// consecutive writes to the same path.
+func (h *SubvolumeReceiver) openFile(p string) (*os.File, error) {
+	path, err := h.path(p)
+	if err != nil {
+		return nil, err
+	}
+	if h.file != nil && h.filePath == path {
+		return h.file, nil
+	}
+	if err = h.closeFile(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	h.file, h.filePath = f, path
+	return f, nil
+}
+
+func (h *SubvolumeReceiver) Write(c *WriteCmd) error {
+	f, err := h.openFile(c.Path)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(c.Data, int64(c.Off))
+	return err
+}
+
+func (h *SubvolumeReceiver) Clone(c *CloneCmd) error {
+	f, err := h.openFile(c.Path)
+	if err != nil {
+		return err
+	}
+	subvol, err := h.findSubvol(c.CloneUUID, c.CloneCTransID)
+	if err != nil {
+		return err
+	}
+	srcPath := filepath.Join(subvol, c.ClonePath)
+	if !strings.HasPrefix(srcPath, subvol+string(filepath.Separator)) {
+		return fmt.Errorf("clone path escapes the subvolume: %q", c.ClonePath)
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return btrfs.CloneRange(f, int64(c.Off), src, int64(c.CloneOff), int64(c.Len))
+}
+
+func (h *SubvolumeReceiver) Truncate(c *TruncateCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	return os.Truncate(path, int64(c.Size))
+}
+
+func (h *SubvolumeReceiver) Chmod(c *ChmodCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Chmod(path, uint32(c.Mode)); err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (h *SubvolumeReceiver) Chown(c *ChownCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	return os.Lchown(path, int(c.UID), int(c.GID))
+}
+
+func (h *SubvolumeReceiver) UTimes(c *UTimesCmd) error {
+	path, err := h.path(c.Path)
+	if err != nil {
+		return err
+	}
+	if err = fsutil.Lutimes(path, c.ATime, c.MTime); err != nil {
+		return &os.PathError{Op: "utimes", Path: path, Err: err}
+	}
+	return nil
+}
+
+// UpdateExtent is a no-op, since streams without file data cannot be applied.
+func (h *SubvolumeReceiver) UpdateExtent(c *UpdateExtentCmd) error {
+	return nil
+}
+
+func (h *SubvolumeReceiver) Fallocate(c *FallocateCmd) error {
+	f, err := h.openFile(c.Path)
+	if err != nil {
+		return err
+	}
+	err = syscall.Fallocate(int(f.Fd()), uint32(c.Mode), int64(c.Off), int64(c.Size))
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// Fileattr is a no-op, same as in 'btrfs receive'.
+func (h *SubvolumeReceiver) Fileattr(c *FileattrCmd) error {
+	return nil
+}
+
+func (h *SubvolumeReceiver) EncodedWrite(c *EncodedWriteCmd) error {
+	return errors.New("encoded writes are not supported")
+}
+
+// End finishes the current subvolume by marking it as received and read-only.
+// It's also called when the next subvolume starts, since streams with several
+// subvolumes have no end command between them.
+func (h *SubvolumeReceiver) End() error {
+	if err := h.closeFile(); err != nil {
+		return err
+	}
+	if h.cur == "" {
+		return nil
+	}
+	cur := h.cur
+	h.cur = ""
+	if err := btrfs.SetReceivedSubvolume(cur, h.uuid, h.ctransid); err != nil {
+		return err
+	}
+	fs, err := btrfs.Open(cur, false)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	flags, err := fs.GetFlags()
+	if err != nil {
+		return err
+	}
+	return fs.SetFlags(flags | btrfs.SubvolReadOnly)
+}
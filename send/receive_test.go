@@ -0,0 +1,170 @@
+package send
+
+import (
+	"bytes"
+	"context"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/test"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordHandler struct {
+	ReceiveHandler // panics on unexpected commands
+	cmds           []string
+}
+
+func (h *recordHandler) Subvol(c *SubvolCmd) error {
+	h.cmds = append(h.cmds, "subvol "+c.Path)
+	return nil
+}
+func (h *recordHandler) Mkfile(c *MkfileCmd) error {
+	h.cmds = append(h.cmds, "mkfile "+c.Path)
+	return nil
+}
+func (h *recordHandler) Write(c *WriteCmd) error {
+	h.cmds = append(h.cmds, "write "+c.Path+" "+string(c.Data))
+	return nil
+}
+func (h *recordHandler) End() error {
+	h.cmds = append(h.cmds, "end")
+	return nil
+}
+
+func TestReceiveStream(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	for _, name := range []string{"a", "b"} {
+		w, err := NewStreamWriter(buf, sendStreamVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []Cmd{
+			&SubvolCmd{Path: name},
+			&MkfileCmd{Path: "file"},
+			&WriteCmd{Path: "file", Data: []byte(name)},
+			&StreamEnd{},
+		} {
+			if err = w.WriteCommand(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	h := &recordHandler{}
+	if err := ReceiveStream(buf, h); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"subvol a", "mkfile file", "write file a", "end",
+		"subvol b", "mkfile file", "write file b", "end",
+	}
+	if !reflect.DeepEqual(h.cmds, exp) {
+		t.Errorf("unexpected commands: %q", h.cmds)
+	}
+}
+
+func TestReceiveProgress(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriter(buf, sendStreamVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "vol"},
+		&MkfileCmd{Path: "file"},
+		&WriteCmd{Path: "file", Data: []byte("data")},
+		&StreamEnd{},
+	} {
+		if err = w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := uint64(buf.Len())
+	var last []ReceiveProgress
+	err = ReceiveStreamWithOptions(buf, &recordHandler{}, ReceiveOptions{
+		Progress: func(p ReceiveProgress) {
+			last = append(last, p)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last) != 4 {
+		t.Fatalf("expected 4 progress updates, got %d", len(last))
+	}
+	if p := last[2]; p.Cmd != sendCmdWrite || p.Path != "file" || p.Subvolume != "vol" || p.Files != 1 {
+		t.Errorf("unexpected progress: %+v", p)
+	}
+	if p := last[3]; p.Bytes != size {
+		t.Errorf("unexpected size: %d vs %d", p.Bytes, size)
+	}
+}
+
+func TestReceiveStreamContext(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ReceiveStreamContext(ctx, pr, &recordHandler{}, ReceiveOptions{})
+	}()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive was not cancelled")
+	}
+}
+
+func TestSubvolumeReceiverMulti(t *testing.T) {
+	dir, closer := btrfstest.New(t, btrfstest.DefaultSize)
+	defer closer()
+	// send omits the end command between subvolumes of the same stream
+	buf := bytes.NewBuffer(nil)
+	names := []string{"a", "b"}
+	for i, name := range names {
+		w, err := NewStreamWriter(buf, sendStreamVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds := []Cmd{
+			&SubvolCmd{Path: name, UUID: btrfs.UUID{byte(i + 1)}, CTransID: uint64(i + 10)},
+			&MkfileCmd{Path: "file"},
+		}
+		if i == len(names)-1 {
+			cmds = append(cmds, &StreamEnd{})
+		}
+		for _, c := range cmds {
+			if err = w.WriteCommand(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := Receive(buf, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := btrfs.Open(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if ro, err := btrfs.IsReadOnly(path); err != nil {
+			t.Fatal(err)
+		} else if !ro {
+			t.Errorf("%s is not read-only", name)
+		}
+		info, err := fs.SubvolumeByReceivedUUID(btrfs.UUID{byte(i + 1)})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		} else if info.Name != name {
+			t.Errorf("unexpected subvolume for %s: %q", name, info.Name)
+		}
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dennwc/btrfs"
+	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"time"
 )
 
+// NewStreamReader reads the stream header from r and returns a reader for
+// the commands that follow. Stream versions 1 and 2 are supported.
 func NewStreamReader(r io.Reader) (*StreamReader, error) {
 	// read magic and version
 	buf := make([]byte, len(sendStreamMagic)+4)
@@ -19,15 +21,43 @@ func NewStreamReader(r io.Reader) (*StreamReader, error) {
 		return nil, errors.New("unexpected stream header")
 	}
 	version := sendEndianess.Uint32(buf[sendStreamMagicSize:])
-	if version != sendStreamVersion {
+	if version != sendStreamVersion && version != sendStreamVersionV2 {
 		return nil, fmt.Errorf("stream version %d not supported", version)
 	}
-	return &StreamReader{r: r}, nil
+	return &StreamReader{r: r, version: version}, nil
 }
 
+// StreamReader decodes commands from a btrfs send stream.
 type StreamReader struct {
-	r   io.Reader
-	buf [cmdHeaderSize]byte
+	r       io.Reader
+	version uint32
+	buf     [cmdHeaderSize]byte
+}
+
+// Version returns the protocol version of the stream.
+func (r *StreamReader) Version() uint32 {
+	return r.version
+}
+
+// ErrChecksum is returned when the checksum of a command does not match its contents.
+type ErrChecksum struct {
+	Cmd CmdType
+	Exp uint32
+	Got uint32
+}
+
+func (e ErrChecksum) Error() string {
+	return fmt.Sprintf("command %v: checksum mismatch: expected %#x, got %#x", e.Cmd, e.Exp, e.Got)
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// sendCRC calculates the checksum of a command the same way the kernel does:
+// crc32c with zero seed and no final inversion.
+func sendCRC(hdr, data []byte) uint32 {
+	crc := crc32.Update(^uint32(0), crc32c, hdr)
+	crc = crc32.Update(crc, crc32c, data)
+	return ^crc
 }
 
 func (r *StreamReader) readCmdHeader() (h cmdHeader, err error) {
@@ -39,7 +69,6 @@ func (r *StreamReader) readCmdHeader() (h cmdHeader, err error) {
 		return
 	}
 	err = h.Unmarshal(r.buf[:cmdHeaderSize])
-	// TODO: check CRC
 	return
 }
 
@@ -48,75 +77,101 @@ type SendTLV struct {
 	Val  interface{}
 }
 
-func (r *StreamReader) readTLV(rd io.Reader) (*SendTLV, error) {
-	_, err := io.ReadFull(rd, r.buf[:tlvHeaderSize])
-	if err == io.EOF {
-		return nil, err
-	} else if err != nil {
-		return nil, fmt.Errorf("cannot read tlv header: %v", err)
+// parseTLV decodes a single attribute from p and returns it with the number of bytes consumed.
+func (r *StreamReader) parseTLV(p []byte) (*SendTLV, int, error) {
+	if len(p) >= 2 && r.version >= sendStreamVersionV2 &&
+		sendCmdAttr(sendEndianess.Uint16(p)) == sendAttrData {
+		// since v2 the data attribute has no length and spans till the end of the command
+		return &SendTLV{Attr: sendAttrData, Val: p[2:]}, len(p), nil
 	}
 	var h tlvHeader
-	if err = h.Unmarshal(r.buf[:tlvHeaderSize]); err != nil {
-		return nil, err
+	if err := h.Unmarshal(p); err != nil {
+		return nil, 0, fmt.Errorf("cannot read tlv header: %v", err)
 	}
-	typ := sendCmdAttr(h.Type)
-	if sendCmdAttr(typ) > sendAttrMax { // || th.Len > _BTRFS_SEND_BUF_SIZE {
-		return nil, fmt.Errorf("invalid tlv in cmd: %q", typ)
+	p = p[tlvHeaderSize:]
+	if int(h.Len) > len(p) {
+		return nil, 0, fmt.Errorf("cannot read tlv: %v", io.ErrUnexpectedEOF)
 	}
-	buf := make([]byte, h.Len)
-	_, err = io.ReadFull(rd, buf)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read tlv: %v", err)
+	typ := sendCmdAttr(h.Type)
+	if typ > sendAttrMax {
+		return nil, 0, fmt.Errorf("invalid tlv in cmd: %q", typ)
 	}
+	buf := p[:h.Len]
+	n := tlvHeaderSize + len(buf)
 	var v interface{}
 	switch typ {
-	case sendAttrCtransid, sendAttrCloneCtransid,
-		sendAttrUid, sendAttrGid, sendAttrMode,
-		sendAttrIno, sendAttrFileOffset, sendAttrSize,
-		sendAttrCloneOffset, sendAttrCloneLen:
-		if len(buf) != 8 {
-			return nil, fmt.Errorf("unexpected int64 size: %v", h.Len)
-		}
-		v = sendEndianess.Uint64(buf[:8])
-	case sendAttrPath, sendAttrPathTo, sendAttrClonePath, sendAttrXattrName:
+	case sendAttrPath, sendAttrPathTo, sendAttrPathLink,
+		sendAttrClonePath, sendAttrXattrName:
 		v = string(buf)
 	case sendAttrData, sendAttrXattrData:
 		v = buf
 	case sendAttrUuid, sendAttrCloneUuid:
 		if h.Len != btrfs.UUIDSize {
-			return nil, fmt.Errorf("unexpected UUID size: %v", h.Len)
+			return nil, 0, fmt.Errorf("unexpected UUID size: %v", h.Len)
 		}
 		var u btrfs.UUID
 		copy(u[:], buf)
 		v = u
 	case sendAttrAtime, sendAttrMtime, sendAttrCtime, sendAttrOtime:
 		if h.Len != 12 {
-			return nil, fmt.Errorf("unexpected timestamp size: %v", h.Len)
+			return nil, 0, fmt.Errorf("unexpected timestamp size: %v", h.Len)
 		}
 		v = time.Unix( // btrfs_timespec
 			int64(sendEndianess.Uint64(buf[:8])),
 			int64(sendEndianess.Uint32(buf[8:])),
 		)
 	default:
-		return nil, fmt.Errorf("unsupported tlv type: %v (len: %v)", typ, h.Len)
+		sz := sendAttrIntSize(typ)
+		if sz == 0 {
+			return nil, 0, fmt.Errorf("unsupported tlv type: %v (len: %v)", typ, h.Len)
+		} else if len(buf) != sz {
+			return nil, 0, fmt.Errorf("unexpected int%d size for %v: %v", sz*8, typ, h.Len)
+		}
+		switch sz {
+		case 8:
+			v = sendEndianess.Uint64(buf)
+		case 4:
+			v = uint64(sendEndianess.Uint32(buf))
+		}
 	}
-	return &SendTLV{Attr: typ, Val: v}, nil
+	return &SendTLV{Attr: typ, Val: v}, n, nil
 }
+
+// ReadCommand reads the next command from the stream and validates its checksum.
+// It returns io.EOF when there are no more commands.
 func (r *StreamReader) ReadCommand() (_ Cmd, gerr error) {
 	h, err := r.readCmdHeader()
 	if err != nil {
 		return nil, err
 	}
+	max := sendBufSize
+	if r.version >= sendStreamVersionV2 {
+		// the stream may come from a host with a larger page size
+		max = sendBufSizeV2(maxPageSize)
+	}
+	if int(h.Len) > max {
+		return nil, fmt.Errorf("command %v: too large: %d", h.Cmd, h.Len)
+	}
+	data := make([]byte, h.Len)
+	if _, err = io.ReadFull(r.r, data); err == io.EOF {
+		return nil, fmt.Errorf("command %v: %v", h.Cmd, io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return nil, fmt.Errorf("command %v: %v", h.Cmd, err)
+	}
+	// checksum is calculated with the crc field zeroed
+	for i := 6; i < cmdHeaderSize; i++ {
+		r.buf[i] = 0
+	}
+	if crc := sendCRC(r.buf[:], data); crc != h.Crc {
+		return nil, ErrChecksum{Cmd: h.Cmd, Exp: h.Crc, Got: crc}
+	}
 	var tlvs []SendTLV
-	rd := io.LimitReader(r.r, int64(h.Len))
-	defer io.Copy(ioutil.Discard, rd)
-	for {
-		tlv, err := r.readTLV(rd)
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	for len(data) > 0 {
+		tlv, n, err := r.parseTLV(data)
+		if err != nil {
 			return nil, fmt.Errorf("command %v: %v", h.Cmd, err)
 		}
+		data = data[n:]
 		tlvs = append(tlvs, *tlv)
 	}
 	var c Cmd
@@ -143,6 +198,34 @@ func (r *StreamReader) ReadCommand() (_ Cmd, gerr error) {
 		c = &WriteCmd{}
 	case sendCmdTruncate:
 		c = &TruncateCmd{}
+	case sendCmdMknod:
+		c = &MknodCmd{}
+	case sendCmdMkfifo:
+		c = &MkfifoCmd{}
+	case sendCmdMksock:
+		c = &MksockCmd{}
+	case sendCmdSymlink:
+		c = &SymlinkCmd{}
+	case sendCmdLink:
+		c = &LinkCmd{}
+	case sendCmdUnlink:
+		c = &UnlinkCmd{}
+	case sendCmdRmdir:
+		c = &RmdirCmd{}
+	case sendCmdSetXattr:
+		c = &SetXattrCmd{}
+	case sendCmdRemoveXattr:
+		c = &RemoveXattrCmd{}
+	case sendCmdClone:
+		c = &CloneCmd{}
+	case sendCmdUpdateExtent:
+		c = &UpdateExtentCmd{}
+	case sendCmdFallocate:
+		c = &FallocateCmd{}
+	case sendCmdFileattr:
+		c = &FileattrCmd{}
+	case sendCmdEncodedWrite:
+		c = &EncodedWriteCmd{}
 	}
 	if c == nil {
 		return &UnknownSendCmd{Kind: h.Cmd, Params: tlvs}, nil
@@ -176,6 +259,7 @@ func (e errUnexpectedAttr) Error() string {
 type Cmd interface {
 	Type() CmdType
 	decode(tlvs []SendTLV) error
+	encode() []SendTLV
 }
 
 type UnknownSendCmd struct {
@@ -190,6 +274,9 @@ func (c *UnknownSendCmd) decode(tlvs []SendTLV) error {
 	c.Params = tlvs
 	return nil
 }
+func (c *UnknownSendCmd) encode() []SendTLV {
+	return c.Params
+}
 
 type StreamEnd struct{}
 
@@ -202,6 +289,9 @@ func (c *StreamEnd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *StreamEnd) encode() []SendTLV {
+	return nil
+}
 
 type SubvolCmd struct {
 	Path     string
@@ -231,6 +321,13 @@ func (c *SubvolCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *SubvolCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrUuid, Val: c.UUID},
+		{Attr: sendAttrCtransid, Val: c.CTransID},
+	}
+}
 
 type SnapshotCmd struct {
 	Path         string
@@ -266,6 +363,15 @@ func (c *SnapshotCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *SnapshotCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrUuid, Val: c.UUID},
+		{Attr: sendAttrCtransid, Val: c.CTransID},
+		{Attr: sendAttrCloneUuid, Val: c.CloneUUID},
+		{Attr: sendAttrCloneCtransid, Val: c.CloneTransID},
+	}
+}
 
 type ChownCmd struct {
 	Path     string
@@ -294,6 +400,13 @@ func (c *ChownCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *ChownCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrUid, Val: c.UID},
+		{Attr: sendAttrGid, Val: c.GID},
+	}
+}
 
 type ChmodCmd struct {
 	Path string
@@ -320,6 +433,12 @@ func (c *ChmodCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *ChmodCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrMode, Val: c.Mode},
+	}
+}
 
 type UTimesCmd struct {
 	Path                string
@@ -350,6 +469,14 @@ func (c *UTimesCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *UTimesCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrAtime, Val: c.ATime},
+		{Attr: sendAttrMtime, Val: c.MTime},
+		{Attr: sendAttrCtime, Val: c.CTime},
+	}
+}
 
 type MkdirCmd struct {
 	Path string
@@ -376,6 +503,12 @@ func (c *MkdirCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *MkdirCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+	}
+}
 
 type RenameCmd struct {
 	From, To string
@@ -401,6 +534,12 @@ func (c *RenameCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *RenameCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.From},
+		{Attr: sendAttrPathTo, Val: c.To},
+	}
+}
 
 type MkfileCmd struct {
 	Path string
@@ -427,6 +566,12 @@ func (c *MkfileCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *MkfileCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+	}
+}
 
 type WriteCmd struct {
 	Path string
@@ -456,6 +601,13 @@ func (c *WriteCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *WriteCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrData, Val: c.Data},
+	}
+}
 
 type TruncateCmd struct {
 	Path string
@@ -482,3 +634,545 @@ func (c *TruncateCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+func (c *TruncateCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrSize, Val: c.Size},
+	}
+}
+
+type MknodCmd struct {
+	Path string
+	Ino  uint64
+	Mode uint64
+	Rdev uint64
+}
+
+func (c MknodCmd) Type() CmdType {
+	return sendCmdMknod
+}
+func (c *MknodCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrIno:
+			c.Ino, ok = tlv.Val.(uint64)
+		case sendAttrMode:
+			c.Mode, ok = tlv.Val.(uint64)
+		case sendAttrRdev:
+			c.Rdev, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *MknodCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+		{Attr: sendAttrMode, Val: c.Mode},
+		{Attr: sendAttrRdev, Val: c.Rdev},
+	}
+}
+
+type MkfifoCmd struct {
+	Path string
+	Ino  uint64
+	Mode uint64
+	Rdev uint64
+}
+
+func (c MkfifoCmd) Type() CmdType {
+	return sendCmdMkfifo
+}
+func (c *MkfifoCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrIno:
+			c.Ino, ok = tlv.Val.(uint64)
+		case sendAttrMode:
+			c.Mode, ok = tlv.Val.(uint64)
+		case sendAttrRdev:
+			c.Rdev, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *MkfifoCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+		{Attr: sendAttrMode, Val: c.Mode},
+		{Attr: sendAttrRdev, Val: c.Rdev},
+	}
+}
+
+type MksockCmd struct {
+	Path string
+	Ino  uint64
+	Mode uint64
+	Rdev uint64
+}
+
+func (c MksockCmd) Type() CmdType {
+	return sendCmdMksock
+}
+func (c *MksockCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrIno:
+			c.Ino, ok = tlv.Val.(uint64)
+		case sendAttrMode:
+			c.Mode, ok = tlv.Val.(uint64)
+		case sendAttrRdev:
+			c.Rdev, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *MksockCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+		{Attr: sendAttrMode, Val: c.Mode},
+		{Attr: sendAttrRdev, Val: c.Rdev},
+	}
+}
+
+type SymlinkCmd struct {
+	Path string
+	Ino  uint64
+	Link string
+}
+
+func (c SymlinkCmd) Type() CmdType {
+	return sendCmdSymlink
+}
+func (c *SymlinkCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrIno:
+			c.Ino, ok = tlv.Val.(uint64)
+		case sendAttrPathLink:
+			c.Link, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *SymlinkCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+		{Attr: sendAttrPathLink, Val: c.Link},
+	}
+}
+
+type LinkCmd struct {
+	Path string
+	Link string
+}
+
+func (c LinkCmd) Type() CmdType {
+	return sendCmdLink
+}
+func (c *LinkCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrPathLink:
+			c.Link, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *LinkCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrPathLink, Val: c.Link},
+	}
+}
+
+type UnlinkCmd struct {
+	Path string
+}
+
+func (c UnlinkCmd) Type() CmdType {
+	return sendCmdUnlink
+}
+func (c *UnlinkCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *UnlinkCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+	}
+}
+
+type RmdirCmd struct {
+	Path string
+}
+
+func (c RmdirCmd) Type() CmdType {
+	return sendCmdRmdir
+}
+func (c *RmdirCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *RmdirCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+	}
+}
+
+type SetXattrCmd struct {
+	Path string
+	Name string
+	Data []byte
+}
+
+func (c SetXattrCmd) Type() CmdType {
+	return sendCmdSetXattr
+}
+func (c *SetXattrCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrXattrName:
+			c.Name, ok = tlv.Val.(string)
+		case sendAttrXattrData:
+			c.Data, ok = tlv.Val.([]byte)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *SetXattrCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrXattrName, Val: c.Name},
+		{Attr: sendAttrXattrData, Val: c.Data},
+	}
+}
+
+type RemoveXattrCmd struct {
+	Path string
+	Name string
+}
+
+func (c RemoveXattrCmd) Type() CmdType {
+	return sendCmdRemoveXattr
+}
+func (c *RemoveXattrCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrXattrName:
+			c.Name, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *RemoveXattrCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrXattrName, Val: c.Name},
+	}
+}
+
+type CloneCmd struct {
+	Path          string
+	Off           uint64
+	Len           uint64
+	CloneUUID     btrfs.UUID
+	CloneCTransID uint64
+	ClonePath     string
+	CloneOff      uint64
+}
+
+func (c CloneCmd) Type() CmdType {
+	return sendCmdClone
+}
+func (c *CloneCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFileOffset:
+			c.Off, ok = tlv.Val.(uint64)
+		case sendAttrCloneLen:
+			c.Len, ok = tlv.Val.(uint64)
+		case sendAttrCloneUuid:
+			c.CloneUUID, ok = tlv.Val.(btrfs.UUID)
+		case sendAttrCloneCtransid:
+			c.CloneCTransID, ok = tlv.Val.(uint64)
+		case sendAttrClonePath:
+			c.ClonePath, ok = tlv.Val.(string)
+		case sendAttrCloneOffset:
+			c.CloneOff, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *CloneCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrCloneLen, Val: c.Len},
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrCloneUuid, Val: c.CloneUUID},
+		{Attr: sendAttrCloneCtransid, Val: c.CloneCTransID},
+		{Attr: sendAttrClonePath, Val: c.ClonePath},
+		{Attr: sendAttrCloneOffset, Val: c.CloneOff},
+	}
+}
+
+// UpdateExtentCmd is sent instead of WriteCmd when the stream is generated
+// without file data.
+type UpdateExtentCmd struct {
+	Path string
+	Off  uint64
+	Size uint64
+}
+
+func (c UpdateExtentCmd) Type() CmdType {
+	return sendCmdUpdateExtent
+}
+func (c *UpdateExtentCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFileOffset:
+			c.Off, ok = tlv.Val.(uint64)
+		case sendAttrSize:
+			c.Size, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *UpdateExtentCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrSize, Val: c.Size},
+	}
+}
+
+type FallocateCmd struct {
+	Path string
+	Mode uint64 // FALLOC_FL_* flags
+	Off  uint64
+	Size uint64
+}
+
+func (c FallocateCmd) Type() CmdType {
+	return sendCmdFallocate
+}
+func (c *FallocateCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFallocateMode:
+			c.Mode, ok = tlv.Val.(uint64)
+		case sendAttrFileOffset:
+			c.Off, ok = tlv.Val.(uint64)
+		case sendAttrSize:
+			c.Size, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *FallocateCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFallocateMode, Val: c.Mode},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrSize, Val: c.Size},
+	}
+}
+
+type FileattrCmd struct {
+	Path string
+	Attr uint64 // BTRFS_INODE_* flags
+}
+
+func (c FileattrCmd) Type() CmdType {
+	return sendCmdFileattr
+}
+func (c *FileattrCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFileattr:
+			c.Attr, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *FileattrCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileattr, Val: c.Attr},
+	}
+}
+
+// EncodedWriteCmd carries compressed file data as stored on disk.
+type EncodedWriteCmd struct {
+	Path             string
+	Off              uint64
+	UnencodedFileLen uint64
+	UnencodedLen     uint64
+	UnencodedOffset  uint64
+	Compression      uint64 // BTRFS_ENCODED_IO_COMPRESSION_*
+	Encryption       uint64
+	Data             []byte
+}
+
+func (c EncodedWriteCmd) Type() CmdType {
+	return sendCmdEncodedWrite
+}
+func (c *EncodedWriteCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFileOffset:
+			c.Off, ok = tlv.Val.(uint64)
+		case sendAttrUnencodedFileLen:
+			c.UnencodedFileLen, ok = tlv.Val.(uint64)
+		case sendAttrUnencodedLen:
+			c.UnencodedLen, ok = tlv.Val.(uint64)
+		case sendAttrUnencodedOffset:
+			c.UnencodedOffset, ok = tlv.Val.(uint64)
+		case sendAttrCompression:
+			c.Compression, ok = tlv.Val.(uint64)
+		case sendAttrEncryption:
+			c.Encryption, ok = tlv.Val.(uint64)
+		case sendAttrData:
+			c.Data, ok = tlv.Val.([]byte)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+func (c *EncodedWriteCmd) encode() []SendTLV {
+	tlvs := []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrUnencodedFileLen, Val: c.UnencodedFileLen},
+		{Attr: sendAttrUnencodedLen, Val: c.UnencodedLen},
+		{Attr: sendAttrUnencodedOffset, Val: c.UnencodedOffset},
+	}
+	// compression and encryption default to none if omitted
+	if c.Compression != 0 {
+		tlvs = append(tlvs, SendTLV{Attr: sendAttrCompression, Val: c.Compression})
+	}
+	if c.Encryption != 0 {
+		tlvs = append(tlvs, SendTLV{Attr: sendAttrEncryption, Val: c.Encryption})
+	}
+	return append(tlvs, SendTLV{Attr: sendAttrData, Val: c.Data})
+}
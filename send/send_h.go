@@ -12,13 +12,25 @@ const (
 	sendStreamMagic     = "btrfs-stream\x00"
 	sendStreamMagicSize = len(sendStreamMagic)
 	sendStreamVersion   = 1
+	sendStreamVersionV2 = 2
 )
 
 const (
 	sendBufSize  = 64 * 1024
 	sendReadSize = 48 * 1024
+
+	maxCompressed = 128 * 1024 // BTRFS_MAX_COMPRESSED
+	// maxPageSize is the largest page size supported by Linux.
+	maxPageSize = 256 * 1024
 )
 
+// sendBufSizeV2 returns the size of the v2 send buffer for a given page size.
+// The kernel defines it as ALIGN(SZ_16K + BTRFS_MAX_COMPRESSED, PAGE_SIZE).
+func sendBufSizeV2(pageSize int) int {
+	n := 16*1024 + maxCompressed
+	return (n + pageSize - 1) / pageSize * pageSize
+}
+
 const cmdHeaderSize = 10
 
 type cmdHeader struct {
@@ -99,6 +111,10 @@ var cmdTypeNames = []string{
 
 	"end",
 	"update_extent",
+
+	"fallocate",
+	"fileattr",
+	"encoded_write",
 	"<max>",
 }
 
@@ -133,6 +149,11 @@ const (
 
 	sendCmdEnd
 	sendCmdUpdateExtent
+
+	// version 2
+	sendCmdFallocate
+	sendCmdFileattr
+	sendCmdEncodedWrite
 	_sendCmdMax
 )
 
@@ -184,6 +205,15 @@ const (
 	sendAttrCloneOffset
 	sendAttrCloneLen
 
+	// version 2
+	sendAttrFallocateMode
+	sendAttrFileattr
+	sendAttrUnencodedFileLen
+	sendAttrUnencodedLen
+	sendAttrUnencodedOffset
+	sendAttrCompression
+	sendAttrEncryption
+
 	_sendAttrMax
 )
 const sendAttrMax = _sendAttrMax - 1
@@ -221,5 +251,29 @@ var sendAttrNames = []string{
 	"cloneoffset",
 	"clonelen",
 
+	"fallocatemode",
+	"fileattr",
+	"unencodedfilelen",
+	"unencodedlen",
+	"unencodedoffset",
+	"compression",
+	"encryption",
+
 	"<max>",
 }
+
+// sendAttrIntSize returns the size of an integer attribute,
+// or zero if the attribute is not an integer.
+func sendAttrIntSize(a sendCmdAttr) int {
+	switch a {
+	case sendAttrCtransid, sendAttrCloneCtransid,
+		sendAttrUid, sendAttrGid, sendAttrMode, sendAttrRdev,
+		sendAttrIno, sendAttrFileOffset, sendAttrSize,
+		sendAttrCloneOffset, sendAttrCloneLen, sendAttrFileattr,
+		sendAttrUnencodedFileLen, sendAttrUnencodedLen, sendAttrUnencodedOffset:
+		return 8
+	case sendAttrFallocateMode, sendAttrCompression, sendAttrEncryption:
+		return 4
+	}
+	return 0
+}
@@ -0,0 +1,197 @@
+package send
+
+import (
+	"bytes"
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/test"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testTLV struct {
+	attr sendCmdAttr
+	data []byte
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	sendEndianess.PutUint64(b, v)
+	return b
+}
+
+type testCmd struct {
+	cmd  CmdType
+	tlvs []testTLV
+}
+
+func buildStream(version uint32, cmds []testCmd) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(sendStreamMagic)
+	var v [4]byte
+	sendEndianess.PutUint32(v[:], version)
+	buf.Write(v[:])
+	for _, c := range cmds {
+		var data []byte
+		for _, t := range c.tlvs {
+			var h [tlvHeaderSize]byte
+			sendEndianess.PutUint16(h[0:], uint16(t.attr))
+			if version >= sendStreamVersionV2 && t.attr == sendAttrData {
+				data = append(data, h[:2]...)
+			} else {
+				sendEndianess.PutUint16(h[2:], uint16(len(t.data)))
+				data = append(data, h[:]...)
+			}
+			data = append(data, t.data...)
+		}
+		var h [cmdHeaderSize]byte
+		sendEndianess.PutUint32(h[0:], uint32(len(data)))
+		sendEndianess.PutUint16(h[4:], uint16(c.cmd))
+		sendEndianess.PutUint32(h[6:], sendCRC(h[:], data))
+		buf.Write(h[:])
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, p []byte) []Cmd {
+	r, err := NewStreamReader(bytes.NewReader(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []Cmd
+	for {
+		c, err := r.ReadCommand()
+		if err == io.EOF {
+			return out
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, c)
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	for _, vers := range []uint32{sendStreamVersion, sendStreamVersionV2} {
+		data := buildStream(vers, []testCmd{
+			{sendCmdMkfile, []testTLV{
+				{sendAttrPath, []byte("o257-5-0")},
+				{sendAttrIno, u64(257)},
+			}},
+			{sendCmdWrite, []testTLV{
+				{sendAttrPath, []byte("file")},
+				{sendAttrFileOffset, u64(4096)},
+				{sendAttrData, []byte("hello")},
+			}},
+			{sendCmdSetXattr, []testTLV{
+				{sendAttrPath, []byte("file")},
+				{sendAttrXattrName, []byte("user.a")},
+				{sendAttrXattrData, []byte("b")},
+			}},
+			{sendCmdClone, []testTLV{
+				{sendAttrPath, []byte("file")},
+				{sendAttrFileOffset, u64(0)},
+				{sendAttrCloneLen, u64(4096)},
+				{sendAttrClonePath, []byte("other")},
+				{sendAttrCloneOffset, u64(8192)},
+			}},
+			{sendCmdEnd, nil},
+		})
+		got := readAll(t, data)
+		exp := []Cmd{
+			&MkfileCmd{Path: "o257-5-0", Ino: 257},
+			&WriteCmd{Path: "file", Off: 4096, Data: []byte("hello")},
+			&SetXattrCmd{Path: "file", Name: "user.a", Data: []byte("b")},
+			&CloneCmd{Path: "file", Len: 4096, ClonePath: "other", CloneOff: 8192},
+			&StreamEnd{},
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("v%d: unexpected commands:\n%#v\nvs\n%#v", vers, got, exp)
+		}
+	}
+}
+
+func TestStreamReaderChecksum(t *testing.T) {
+	data := buildStream(sendStreamVersion, []testCmd{
+		{sendCmdUnlink, []testTLV{{sendAttrPath, []byte("file")}}},
+	})
+	data[len(data)-1] ^= 0xff
+	r, err := NewStreamReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ReadCommand()
+	if _, ok := err.(ErrChecksum); !ok {
+		t.Fatalf("expected checksum error, got: %v", err)
+	}
+}
+
+func TestStreamReaderLargeCommand(t *testing.T) {
+	if n := sendBufSizeV2(4096); n != 144*1024 {
+		t.Errorf("unexpected buffer size for 4K pages: %d", n)
+	} else if n = sendBufSizeV2(64 * 1024); n != 192*1024 {
+		t.Errorf("unexpected buffer size for 64K pages: %d", n)
+	}
+	write := func(size int) []testCmd {
+		return []testCmd{{sendCmdWrite, []testTLV{
+			{sendAttrPath, []byte("file")},
+			{sendAttrFileOffset, u64(0)},
+			{sendAttrData, make([]byte, size)},
+		}}}
+	}
+	// commands sent by a kernel with 64K pages are larger than the v2 buffer with 4K pages
+	got := readAll(t, buildStream(sendStreamVersionV2, write(160*1024)))
+	if len(got) != 1 || len(got[0].(*WriteCmd).Data) != 160*1024 {
+		t.Fatalf("unexpected commands: %d", len(got))
+	}
+	r, err := NewStreamReader(bytes.NewReader(buildStream(sendStreamVersionV2, write(maxPageSize))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.ReadCommand(); err == nil {
+		t.Fatal("expected an error for a command larger than the buffer")
+	}
+}
+
+func TestSendExplicitParent(t *testing.T) {
+	dir, closer := btrfstest.New(t, btrfstest.DefaultSize)
+	defer closer()
+	fs, err := btrfs.Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.CreateSubVolume("vol"); err != nil {
+		t.Fatal(err)
+	}
+	// snap1 and snap2 are siblings, thus snap1 is the best parent for snap2,
+	// but the parent is set explicitly to a snapshot of snap1
+	for _, s := range [][2]string{{"vol", "snap1"}, {"snap1", "other"}, {"vol", "snap2"}} {
+		if err = fs.SnapshotSubVolume(s[0], s[1], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other, err := fs.SubvolumeInfo("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	err = btrfs.SendWithOptions(buf, btrfs.SendOptions{
+		Parent:       filepath.Join(dir, "other"),
+		CloneSources: []string{filepath.Join(dir, "snap1")},
+	}, filepath.Join(dir, "snap2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := readAll(t, buf.Bytes())
+	if len(cmds) == 0 {
+		t.Fatal("empty stream")
+	}
+	c, ok := cmds[0].(*SnapshotCmd)
+	if !ok {
+		t.Fatalf("expected a snapshot command, got: %T", cmds[0])
+	} else if c.CloneUUID != other.UUID {
+		t.Fatalf("unexpected parent: %v vs %v", c.CloneUUID, other.UUID)
+	}
+}
@@ -0,0 +1,118 @@
+package send
+
+import (
+	"fmt"
+	"github.com/dennwc/btrfs"
+	"io"
+	"os"
+	"time"
+)
+
+// NewStreamWriter writes the stream header for a given protocol version to w
+// and returns a writer for stream commands. Version 0 selects version 1.
+func NewStreamWriter(w io.Writer, version uint32) (*StreamWriter, error) {
+	if version == 0 {
+		version = sendStreamVersion
+	}
+	if version != sendStreamVersion && version != sendStreamVersionV2 {
+		return nil, fmt.Errorf("stream version %d not supported", version)
+	}
+	buf := make([]byte, len(sendStreamMagic)+4)
+	copy(buf, sendStreamMagic)
+	sendEndianess.PutUint32(buf[sendStreamMagicSize:], version)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	return &StreamWriter{w: w, version: version}, nil
+}
+
+// StreamWriter encodes commands into a btrfs send stream.
+type StreamWriter struct {
+	w       io.Writer
+	version uint32
+	buf     []byte
+}
+
+// Version returns the protocol version of the stream.
+func (w *StreamWriter) Version() uint32 {
+	return w.version
+}
+
+func (w *StreamWriter) appendTLV(p []byte, tlv SendTLV, last bool) ([]byte, error) {
+	var data []byte
+	switch v := tlv.Val.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case btrfs.UUID:
+		data = v[:]
+	case time.Time:
+		data = make([]byte, 12) // btrfs_timespec
+		sendEndianess.PutUint64(data[0:], uint64(v.Unix()))
+		sendEndianess.PutUint32(data[8:], uint32(v.Nanosecond()))
+	case uint64:
+		switch sendAttrIntSize(tlv.Attr) {
+		case 8:
+			data = make([]byte, 8)
+			sendEndianess.PutUint64(data, v)
+		case 4:
+			if v > 1<<32-1 {
+				return nil, fmt.Errorf("value of %v overflows uint32: %d", tlv.Attr, v)
+			}
+			data = make([]byte, 4)
+			sendEndianess.PutUint32(data, uint32(v))
+		default:
+			return nil, fmt.Errorf("unexpected int value for %v", tlv.Attr)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value for %v: %T", tlv.Attr, tlv.Val)
+	}
+	var h [tlvHeaderSize]byte
+	sendEndianess.PutUint16(h[0:], uint16(tlv.Attr))
+	if tlv.Attr == sendAttrData && w.version >= sendStreamVersionV2 {
+		// since v2 the data attribute has no length and must be the last one
+		if !last {
+			return nil, fmt.Errorf("%v must be the last attribute", tlv.Attr)
+		}
+		p = append(p, h[:2]...)
+		return append(p, data...), nil
+	}
+	if len(data) > 0xffff {
+		return nil, fmt.Errorf("attribute %v is too large: %d", tlv.Attr, len(data))
+	}
+	sendEndianess.PutUint16(h[2:], uint16(len(data)))
+	p = append(p, h[:]...)
+	return append(p, data...), nil
+}
+
+// WriteCommand encodes a command and writes it to the stream.
+func (w *StreamWriter) WriteCommand(c Cmd) error {
+	typ := c.Type()
+	if typ == sendCmdUnspec || (typ > sendCmdUpdateExtent && w.version < sendStreamVersionV2) {
+		return fmt.Errorf("command %v is not supported in stream v%d", typ, w.version)
+	}
+	p := append(w.buf[:0], make([]byte, cmdHeaderSize)...)
+	tlvs := c.encode()
+	var err error
+	for i, tlv := range tlvs {
+		p, err = w.appendTLV(p, tlv, i == len(tlvs)-1)
+		if err != nil {
+			return fmt.Errorf("command %v: %v", typ, err)
+		}
+	}
+	w.buf = p
+	n := len(p) - cmdHeaderSize
+	max := sendBufSize
+	if w.version >= sendStreamVersionV2 {
+		max = sendBufSizeV2(os.Getpagesize())
+	}
+	if n > max {
+		return fmt.Errorf("command %v: too large: %d", typ, n)
+	}
+	sendEndianess.PutUint32(p[0:], uint32(n))
+	sendEndianess.PutUint16(p[4:], uint16(typ))
+	sendEndianess.PutUint32(p[6:], sendCRC(p[:cmdHeaderSize], p[cmdHeaderSize:]))
+	_, err = w.w.Write(p)
+	return err
+}
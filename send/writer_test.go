@@ -0,0 +1,56 @@
+package send
+
+import (
+	"bytes"
+	"github.com/dennwc/btrfs"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStreamWriter(t *testing.T) {
+	cmds := []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1, 2, 3}, CTransID: 7},
+		&MkfileCmd{Path: "o257-5-0", Ino: 257},
+		&RenameCmd{From: "o257-5-0", To: "file"},
+		&WriteCmd{Path: "file", Off: 0, Data: []byte("hello")},
+		&SymlinkCmd{Path: "link", Ino: 258, Link: "file"},
+		&UTimesCmd{Path: "file", ATime: time.Unix(1, 2), MTime: time.Unix(3, 4), CTime: time.Unix(5, 6)},
+	}
+	v2 := []Cmd{
+		&FallocateCmd{Path: "file", Mode: 1, Off: 4096, Size: 8192},
+		&EncodedWriteCmd{Path: "file", UnencodedFileLen: 10, UnencodedLen: 10, Compression: 1, Data: []byte("zz")},
+	}
+	for _, vers := range []uint32{sendStreamVersion, sendStreamVersionV2} {
+		exp := append([]Cmd{}, cmds...)
+		if vers >= sendStreamVersionV2 {
+			exp = append(exp, v2...)
+		}
+		exp = append(exp, &StreamEnd{})
+
+		buf := bytes.NewBuffer(nil)
+		w, err := NewStreamWriter(buf, vers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range exp {
+			if err = w.WriteCommand(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := readAll(t, buf.Bytes())
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("v%d: unexpected commands:\n%#v\nvs\n%#v", vers, got, exp)
+		}
+	}
+}
+
+func TestStreamWriterVersion(t *testing.T) {
+	w, err := NewStreamWriter(bytes.NewBuffer(nil), sendStreamVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteCommand(&FileattrCmd{Path: "file"}); err == nil {
+		t.Fatal("expected an error for v2 command in v1 stream")
+	}
+}
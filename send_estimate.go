@@ -0,0 +1,107 @@
+package btrfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Send stream constants required to estimate the stream size.
+// See the send package for a complete stream parser.
+const (
+	sendStreamHeaderSize = 17 // magic + version
+	sendCmdHeaderSize    = 10
+	sendTLVHeaderSize    = 4
+	sendReadSize         = 48 * 1024 // max data size in a single write command
+
+	sendCmdUpdateExtent = 22
+	sendAttrSize        = 4
+	sendAttrPath        = 15
+)
+
+// SendEstimate returns an estimated size of the send stream for given subvolumes.
+//
+// It runs send without file data and calculates the size of write commands
+// from the extents reported by the kernel, so no data is read from the disk.
+func SendEstimate(parent string, subvols ...string) (uint64, error) {
+	return sendEstimate(func(w io.Writer) error {
+		return SendWithOptions(w, SendOptions{Parent: parent, NoFileData: true}, subvols...)
+	})
+}
+
+// sendEstimate estimates the size of a no-data stream written by a given send function.
+func sendEstimate(send func(w io.Writer) error) (uint64, error) {
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := send(pw)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	size, err := estimateSendStream(pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	serr := <-errc
+	if err != nil {
+		return 0, err
+	} else if serr != nil {
+		return 0, serr
+	}
+	return size, nil
+}
+
+// estimateSendStream reads a no-data send stream and returns an estimated size
+// of the same stream with file data.
+func estimateSendStream(r io.Reader) (uint64, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, sendStreamHeaderSize)
+	if _, err := io.ReadFull(br, hdr); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("cannot read stream header: %v", err)
+	}
+	size := uint64(len(hdr))
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:sendCmdHeaderSize]); err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("cannot read command header: %v", err)
+		}
+		n := order.Uint32(hdr[0:])
+		cmd := order.Uint16(hdr[4:])
+		if cap(buf) < int(n) {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return 0, fmt.Errorf("cannot read command: %v", err)
+		}
+		if cmd != sendCmdUpdateExtent {
+			size += sendCmdHeaderSize + uint64(n)
+			continue
+		}
+		// update_extent is replaced with one or more write commands:
+		// path, file offset and data attributes
+		var path, dataSize uint64
+		for p := buf; len(p) >= sendTLVHeaderSize; {
+			typ := order.Uint16(p[0:])
+			l := int(order.Uint16(p[2:]))
+			p = p[sendTLVHeaderSize:]
+			if l > len(p) {
+				return 0, fmt.Errorf("invalid tlv length: %d", l)
+			}
+			switch typ {
+			case sendAttrPath:
+				path = uint64(l)
+			case sendAttrSize:
+				if l == 8 {
+					dataSize = order.Uint64(p)
+				}
+			}
+			p = p[l:]
+		}
+		chunks := (dataSize + sendReadSize - 1) / sendReadSize
+		overhead := sendCmdHeaderSize + (sendTLVHeaderSize + path) + (sendTLVHeaderSize + 8) + sendTLVHeaderSize
+		size += chunks*overhead + dataSize
+	}
+}
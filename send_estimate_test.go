@@ -0,0 +1,50 @@
+package btrfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEstimateSendStream(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("btrfs-stream\x00\x01\x00\x00\x00")
+	writeCmd := func(cmd uint16, tlvs ...[]byte) {
+		var data []byte
+		for _, tlv := range tlvs {
+			data = append(data, tlv...)
+		}
+		hdr := make([]byte, sendCmdHeaderSize)
+		order.PutUint32(hdr[0:], uint32(len(data)))
+		order.PutUint16(hdr[4:], cmd)
+		buf.Write(hdr)
+		buf.Write(data)
+	}
+	tlv := func(typ uint16, data []byte) []byte {
+		p := make([]byte, sendTLVHeaderSize, sendTLVHeaderSize+len(data))
+		order.PutUint16(p[0:], typ)
+		order.PutUint16(p[2:], uint16(len(data)))
+		return append(p, data...)
+	}
+	u64 := func(v uint64) []byte {
+		p := make([]byte, 8)
+		order.PutUint64(p, v)
+		return p
+	}
+	writeCmd(3, tlv(sendAttrPath, []byte("file"))) // mkfile
+	writeCmd(sendCmdUpdateExtent,
+		tlv(sendAttrPath, []byte("file")),
+		tlv(18, u64(0)), // file offset
+		tlv(sendAttrSize, u64(sendReadSize+1)),
+	)
+	writeCmd(21) // end
+
+	size, err := estimateSendStream(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const write = sendCmdHeaderSize + (4 + 4) + (4 + 8) + 4 // per write command without data
+	exp := uint64(17 + (10 + 8) + 2*write + sendReadSize + 1 + 10)
+	if size != exp {
+		t.Fatalf("unexpected size: %d vs %d", size, exp)
+	}
+}
@@ -0,0 +1,82 @@
+package btrfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_send_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("btrfs-stream"), 3*spliceChunk/10)
+	stream := func(t *testing.T) *os.File {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			pw.Write(data)
+			pw.Close()
+		}()
+		return pr
+	}
+	t.Run("file", func(t *testing.T) {
+		name := filepath.Join(dir, "file")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var last SendProgress
+		w := &sendProgressWriter{w: f, fn: func(p SendProgress) { last = p }}
+		pr := stream(t)
+		defer pr.Close()
+		if err = copyStream(w, pr); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(name); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatalf("unexpected data: %d bytes", len(got))
+		}
+		if last.Bytes != uint64(len(data)) {
+			t.Fatalf("unexpected progress: %d", last.Bytes)
+		}
+	})
+	t.Run("append", func(t *testing.T) {
+		// splice does not support files opened with O_APPEND
+		name := filepath.Join(dir, "append")
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		pr := stream(t)
+		defer pr.Close()
+		if err = copyStream(f, pr); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(name); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatalf("unexpected data: %d bytes", len(got))
+		}
+	})
+	t.Run("buffer", func(t *testing.T) {
+		var buf bytes.Buffer
+		pr := stream(t)
+		defer pr.Close()
+		if err := copyStream(&buf, pr); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("unexpected data: %d bytes", buf.Len())
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package btrfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// FileSharingInfo describes how much of the file data is shared with other files.
+type FileSharingInfo struct {
+	// Total is the number of bytes in file extents, excluding holes.
+	Total uint64 `json:"total"`
+	// Shared is the number of bytes referenced by other files, snapshots or reflinks.
+	Shared uint64 `json:"shared"`
+	// Exclusive is the number of bytes referenced only by this file.
+	Exclusive uint64 `json:"exclusive"`
+}
+
+// FileSharing reports how many bytes of a file are shared with other files and snapshots,
+// and how many are exclusive to it, similar to "btrfs filesystem du".
+// Relative paths are resolved against the opened directory.
+//
+// Extents are mapped with FIEMAP. Extents marked as shared are then checked with LOGICAL_INO,
+// since the flag is also set for extents that are referenced multiple times by the same file.
+// LOGICAL_INO requires CAP_SYS_ADMIN; without it, the FIEMAP flag is used as is.
+func (f *FS) FileSharing(path string) (*FileSharingInfo, error) {
+	file, err := openAt(f.f, path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	root, err := getFileRootID(file)
+	if err != nil {
+		return nil, &os.PathError{Op: "ino lookup", Path: file.Name(), Err: err}
+	}
+	exts, err := FileExtents(file)
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(logical uint64) ([]LogicalInode, error) {
+		return f.LogicalToInodes(logical, LogicalIgnoreOffset())
+	}
+	self := LogicalInode{Root: uint64(root), Inode: st.Sys().(*syscall.Stat_t).Ino}
+	return fileSharing(exts, self, resolve)
+}
+
+// fileSharing classifies file extents as shared or exclusive. Shared extents are resolved
+// to check that they are referenced by other inodes, not only by self.
+func fileSharing(exts []FileExtent, self LogicalInode, resolve func(logical uint64) ([]LogicalInode, error)) (*FileSharingInfo, error) {
+	info := &FileSharingInfo{}
+	// the same disk extent may be referenced by multiple file extents
+	cache := make(map[uint64]bool)
+	for _, e := range exts {
+		info.Total += e.Length
+		shared := e.Shared()
+		if shared && resolve != nil && e.Flags&(FiemapUnknown|FiemapDataInline) == 0 {
+			v, ok := cache[e.Physical]
+			if !ok {
+				refs, err := resolve(e.Physical)
+				if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTTY) || errors.Is(err, syscall.EOPNOTSUPP) {
+					// cannot resolve backrefs; trust FIEMAP from now on
+					resolve = nil
+					v = true
+				} else if err != nil {
+					return nil, err
+				} else {
+					v = sharedRefs(refs, self)
+					cache[e.Physical] = v
+				}
+			}
+			shared = v
+		}
+		if shared {
+			info.Shared += e.Length
+		} else {
+			info.Exclusive += e.Length
+		}
+	}
+	return info, nil
+}
+
+// sharedRefs reports if any of the references belongs to an inode other than self.
+func sharedRefs(refs []LogicalInode, self LogicalInode) bool {
+	for _, r := range refs {
+		if r.Root != self.Root || r.Inode != self.Inode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package btrfs
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestFileSharing(t *testing.T) {
+	self := LogicalInode{Root: 5, Inode: 257}
+	exts := []FileExtent{
+		{Logical: 0, Physical: 1 << 20, Length: 4096},
+		// referenced twice by the file itself
+		{Logical: 4096, Physical: 2 << 20, Length: 4096, Flags: FiemapShared},
+		{Logical: 8192, Physical: 2 << 20, Length: 4096, Flags: FiemapShared},
+		// shared with a snapshot
+		{Logical: 12288, Physical: 3 << 20, Length: 8192, Flags: FiemapShared},
+		{Logical: 20480, Length: 100, Flags: FiemapDataInline | FiemapNotAligned | FiemapLast},
+	}
+	calls := 0
+	resolve := func(logical uint64) ([]LogicalInode, error) {
+		calls++
+		switch logical {
+		case 2 << 20:
+			return []LogicalInode{self, {Root: 5, Inode: 257, Offset: 8192}}, nil
+		case 3 << 20:
+			return []LogicalInode{self, {Root: 256, Inode: 257}}, nil
+		}
+		t.Fatalf("unexpected resolve: %d", logical)
+		return nil, nil
+	}
+	info, err := fileSharing(exts, self, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := FileSharingInfo{Total: 20580, Shared: 8192, Exclusive: 12388}
+	if *info != exp {
+		t.Fatalf("unexpected result: %+v", *info)
+	} else if calls != 2 {
+		t.Fatalf("unexpected number of resolves: %d", calls)
+	}
+
+	// fall back to FIEMAP flags if backrefs cannot be resolved
+	info, err = fileSharing(exts, self, func(uint64) ([]LogicalInode, error) {
+		return nil, syscall.EPERM
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = FileSharingInfo{Total: 20580, Shared: 16384, Exclusive: 4196}
+	if *info != exp {
+		t.Fatalf("unexpected result: %+v", *info)
+	}
+}
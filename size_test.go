@@ -40,6 +40,9 @@ var caseSizes = []struct {
 	{obj: btrfs_ioctl_space_args{}, size: 16},
 	{obj: btrfs_data_container{}, size: 16},
 	{obj: btrfs_ioctl_ino_path_args{}, size: 56},
+	{obj: fstrim_range{}, size: 24},
+	{obj: fiemap{}, size: 32},
+	{obj: fiemap_extent{}, size: 56},
 	{obj: btrfs_ioctl_logical_ino_args{}, size: 56},
 	{obj: btrfs_ioctl_get_dev_stats{}, size: 1032},
 	{obj: btrfs_ioctl_quota_ctl_args{}, size: 16},
@@ -47,7 +50,11 @@ var caseSizes = []struct {
 	{obj: btrfs_ioctl_qgroup_create_args{}, size: 16},
 	{obj: btrfs_ioctl_timespec{}, size: 16},
 	{obj: btrfs_ioctl_received_subvol_args{}, size: 200},
+	{obj: btrfs_ioctl_get_subvol_info_args{}, size: 504},
+	{obj: btrfs_ioctl_get_subvol_rootref_args{}, size: 4096},
+	{obj: btrfs_ioctl_ino_lookup_user_args{}, size: 4096},
 	{obj: btrfs_ioctl_send_args{}, size: 72},
+	{obj: btrfs_dev_replace_item{}, size: 72},
 
 	//{obj:btrfs_timespec{},size:12},
 	//{obj:btrfs_root_ref{},size:18},
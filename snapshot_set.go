@@ -0,0 +1,133 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SnapshotSpec describes a single snapshot of a SnapshotSet.
+type SnapshotSpec struct {
+	// Source is the path of the subvolume. Relative paths are resolved against the opened directory.
+	Source string
+	// Dest is the path of the snapshot. If it's an existing directory, the snapshot
+	// is created in it with the name of the source subvolume.
+	Dest string
+	SnapshotOptions
+}
+
+// SnapshotSetOptions are options for SnapshotSet.
+type SnapshotSetOptions struct {
+	// Quiesce is called after the filesystem is synced, right before the snapshots are taken.
+	// It should suspend writes to the source subvolumes, for example, by locking the database.
+	// The returned function is called to resume the writes after the last snapshot is taken,
+	// or if the snapshots failed.
+	Quiesce func() (resume func(), err error)
+}
+
+// SnapshotSet takes snapshots of several subvolumes as close in time as possible.
+// See SnapshotSetWithOptions.
+func (f *FS) SnapshotSet(targets []SnapshotSpec) error {
+	return f.SnapshotSetWithOptions(targets, SnapshotSetOptions{})
+}
+
+// SnapshotSetWithOptions takes snapshots of several subvolumes as close in time as possible.
+// All paths are opened and checked in advance, and the filesystem is synced, thus only the
+// snapshot ioctls remain in the critical window. If any of the snapshots fails, the ones
+// that were already taken are deleted, and errors from deleting them are returned along with
+// the original error.
+//
+// Btrfs has no interface to snapshot several subvolumes atomically: every snapshot is created
+// in a separate transaction commit, and asynchronous snapshots that could share a commit were
+// removed in kernel 5.7. Each snapshot is crash-consistent, but writes that happen between
+// the snapshots may be captured by only some of them. To get snapshots that are consistent
+// with each other, writers must be suspended with Quiesce. Freezing the filesystem cannot be
+// used instead, since creating a snapshot blocks on a frozen filesystem.
+func (f *FS) SnapshotSetWithOptions(targets []SnapshotSpec, opts SnapshotSetOptions) error {
+	type target struct {
+		src  *os.File
+		dst  *os.File
+		name string
+		opts SnapshotOptions
+	}
+	list := make([]target, 0, len(targets))
+	defer func() {
+		for _, t := range list {
+			t.src.Close()
+			if t.dst != nil {
+				t.dst.Close()
+			}
+		}
+	}()
+	var fsid FSID
+	for i, spec := range targets {
+		src, err := openSubvolumeAt("snapshot subvolume", f.f, spec.Source)
+		if err != nil {
+			return err
+		}
+		list = append(list, target{src: src, opts: spec.SnapshotOptions})
+		t := &list[len(list)-1]
+		// snapshots can only be created on the same filesystem
+		info, err := iocFsInfo(src)
+		if err != nil {
+			return &os.PathError{Op: "fs info", Path: src.Name(), Err: err}
+		} else if i == 0 {
+			fsid = info.fsid
+		} else if info.fsid != fsid {
+			return fmt.Errorf("all subvolumes must be from the same filesystem (%s is not)", src.Name())
+		}
+		if t.dst, t.name, err = openSnapshotDest(filepath.Base(src.Name()), f.f, spec.Dest); err != nil {
+			return err
+		}
+		for _, p := range list[:len(list)-1] {
+			if sameFile(p.dst, t.dst) && p.name == t.name {
+				return fmt.Errorf("duplicate snapshot destination: %s", filepath.Join(t.dst.Name(), t.name))
+			}
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	// flush dirty data, so the snapshots don't have to do it in the critical window
+	if err := iocSync(list[0].src); err != nil {
+		return &os.PathError{Op: "sync", Path: list[0].src.Name(), Err: err}
+	}
+	if opts.Quiesce != nil {
+		resume, err := opts.Quiesce()
+		if err != nil {
+			return fmt.Errorf("cannot quiesce: %w", err)
+		}
+		if resume != nil {
+			defer resume()
+		}
+	}
+	for i, t := range list {
+		if err := createSnapshot(t.src, t.dst, t.name, t.opts); err != nil {
+			errs := []error{fmt.Errorf("cannot snapshot %s: %w", t.src.Name(), err)}
+			for _, p := range list[:i] {
+				var args btrfs_ioctl_vol_args
+				copy(args.name[:], p.name)
+				if err := iocSnapDestroy(p.dst, &args); err != nil {
+					errs = append(errs, fmt.Errorf("cannot remove snapshot %s: %w",
+						filepath.Join(p.dst.Name(), p.name), err))
+				}
+			}
+			return errors.Join(errs...)
+		}
+	}
+	return nil
+}
+
+// sameFile checks if two open files refer to the same inode.
+func sameFile(a, b *os.File) bool {
+	sa, err := a.Stat()
+	if err != nil {
+		return false
+	}
+	sb, err := b.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(sa, sb)
+}
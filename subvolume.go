@@ -1,12 +1,20 @@
 package btrfs
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 func checkSubVolumeName(name string) bool {
@@ -23,39 +31,109 @@ func IsSubVolume(path string) (bool, error) {
 		st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
 		return false, nil
 	}
-	return isBtrfs(path)
+	return IsBtrfs(path)
+}
+
+// ContainingSubvolume returns the root directory of the subvolume that contains a given
+// file or directory. Symlinks are resolved first. It doesn't require CAP_SYS_ADMIN.
+//
+// It fails with ErrNotFound if the subvolume root is not reachable: for example,
+// if a directory inside of the subvolume is mounted instead of the subvolume itself.
+func ContainingSubvolume(path string) (string, error) {
+	p, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if ok, err := IsBtrfs(p); err != nil {
+		return "", err
+	} else if !ok {
+		return "", ErrNotBtrfs{Path: path}
+	}
+	if st, err := os.Stat(p); err != nil {
+		return "", err
+	} else if !st.IsDir() {
+		p = filepath.Dir(p)
+	}
+	dir, err := openDirAt(nil, p)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+	root, err := openSubvolumeRoot(dir)
+	if err != nil {
+		return "", err
+	}
+	root.Close()
+	return root.Name(), nil
+}
+
+// QgroupInherit specifies qgroups that a new subvolume or snapshot will be assigned to.
+type QgroupInherit struct {
+	// Qgroups is a list of higher-level qgroups to add the new subvolume to.
+	Qgroups []QgroupID
+}
+
+// qgroupInheritSize is the size of btrfs_qgroup_inherit header.
+const qgroupInheritSize = int(unsafe.Sizeof(btrfs_qgroup_inherit{}))
+
+// encode returns btrfs_qgroup_inherit structure followed by qgroup ids.
+func (q *QgroupInherit) encode() []byte {
+	buf := make([]byte, qgroupInheritSize+8*len(q.Qgroups))
+	h := (*btrfs_qgroup_inherit)(unsafe.Pointer(&buf[0]))
+	h.num_qgroups = uint64(len(q.Qgroups))
+	for i, id := range q.Qgroups {
+		order.PutUint64(buf[qgroupInheritSize+8*i:], uint64(id))
+	}
+	return buf
+}
+
+// setInherit sets qgroup inherit fields of the ioctl args. Returned buffer
+// must be kept alive until the ioctl returns.
+func (arg *btrfs_ioctl_vol_args_v2) setInherit(q *QgroupInherit) []byte {
+	if q == nil || len(q.Qgroups) == 0 {
+		return nil
+	}
+	buf := q.encode()
+	arg.flags |= subvolQGroupInherit
+	arg.size = uint64(len(buf))
+	arg.qgroup_inherit = (*btrfs_qgroup_inherit)(unsafe.Pointer(&buf[0]))
+	return buf
+}
+
+// CreateOptions are options for creating subvolumes.
+type CreateOptions struct {
+	// Inherit assigns new subvolume to qgroups.
+	Inherit *QgroupInherit
 }
 
 func CreateSubVolume(path string) error {
-	var inherit *btrfs_qgroup_inherit // TODO
+	return CreateSubVolumeWithOptions(path, CreateOptions{})
+}
 
-	cpath, err := filepath.Abs(path)
+// CreateSubVolumeWithOptions is similar to CreateSubVolume, but allows to set additional options.
+func CreateSubVolumeWithOptions(path string, opts CreateOptions) error {
+	return createSubVolumeAt(nil, path, opts)
+}
+
+// createSubVolumeAt creates a subvolume at a path relative to dir. See openAt.
+func createSubVolumeAt(dir *os.File, path string, opts CreateOptions) error {
+	dst, newName, err := openParentAt(dir, path)
 	if err != nil {
 		return err
 	}
-	newName := filepath.Base(cpath)
-	dstDir := filepath.Dir(cpath)
+	defer dst.Close()
 	if !checkSubVolumeName(newName) {
 		return fmt.Errorf("invalid subvolume name: %s", newName)
 	} else if len(newName) >= volNameMax {
 		return fmt.Errorf("subvolume name too long: %s", newName)
 	}
-	dst, err := openDir(dstDir)
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-	if inherit != nil {
-		panic("not implemented") // TODO
-		args := btrfs_ioctl_vol_args_v2{
-			flags: subvolQGroupInherit,
-			btrfs_ioctl_vol_args_v2_u1: btrfs_ioctl_vol_args_v2_u1{
-				//size: 	qgroup_inherit_size(inherit),
-				qgroup_inherit: inherit,
-			},
-		}
+	if opts.Inherit != nil {
+		var args btrfs_ioctl_vol_args_v2
+		buf := args.setInherit(opts.Inherit)
 		copy(args.name[:], newName)
-		return iocSubvolCreateV2(dst, &args)
+		err = iocSubvolCreateV2(dst, &args)
+		runtime.KeepAlive(buf)
+		return err
 	}
 	var args btrfs_ioctl_vol_args
 	copy(args.name[:], newName)
@@ -63,85 +141,273 @@ func CreateSubVolume(path string) error {
 }
 
 func DeleteSubVolume(path string) error {
-	if ok, err := IsSubVolume(path); err != nil {
-		return err
-	} else if !ok {
-		return fmt.Errorf("not a subvolume: %s", path)
+	return deleteSubVolumeAt(nil, path)
+}
+
+// DeleteCommit controls when the deletion of a subvolume is committed to disk.
+// The space is reclaimed by the cleaner thread only after the commit, thus committing
+// makes the reclamation start at a known point. See SubvolumeSync to wait for it to finish.
+type DeleteCommit int
+
+const (
+	CommitNone  = DeleteCommit(iota) // don't wait; the deletion is committed with the next transaction
+	CommitAfter                      // commit once after all subvolumes are deleted
+	CommitEach                       // commit after each deleted subvolume
+)
+
+// DeleteOptions are options for deleting subvolumes.
+type DeleteOptions struct {
+	Commit DeleteCommit
+}
+
+// DeleteSubVolumeWithOptions is similar to DeleteSubVolume, but allows to set additional options.
+func DeleteSubVolumeWithOptions(path string, opts DeleteOptions) error {
+	return deleteSubVolumesAt(nil, opts, []string{path})
+}
+
+// DeleteSubVolumes deletes subvolumes at given paths, in order, similar to
+// "btrfs subvolume delete" with -c (CommitAfter) or -C (CommitEach).
+// If a deletion fails, subvolumes deleted before it are still committed.
+func DeleteSubVolumes(opts DeleteOptions, paths ...string) error {
+	return deleteSubVolumesAt(nil, opts, paths)
+}
+
+// deleteSubVolumesAt deletes subvolumes at paths relative to dir and commits deletions.
+func deleteSubVolumesAt(dir *os.File, opts DeleteOptions, paths []string) error {
+	// a directory on each filesystem to commit deletions after all of them
+	pending := make(map[FSID]*os.File)
+	var err error
+	for _, path := range paths {
+		if err = deleteSubVolumeCommit(dir, path, opts.Commit, pending); err != nil {
+			break
+		}
 	}
-	cpath, err := filepath.Abs(path)
+	for _, f := range pending {
+		if cerr := commitTransaction(f); cerr != nil && err == nil {
+			err = cerr
+		}
+		f.Close()
+	}
+	return err
+}
+
+// deleteSubVolumeCommit deletes a single subvolume. With CommitAfter, its parent directory
+// is added to the pending map, unless there is already a directory on the same filesystem.
+func deleteSubVolumeCommit(dir *os.File, path string, mode DeleteCommit, pending map[FSID]*os.File) error {
+	if mode == CommitNone {
+		return deleteSubVolumeAt(dir, path)
+	}
+	parent, _, err := openParentAt(dir, path)
 	if err != nil {
 		return err
 	}
-	dname := filepath.Dir(cpath)
-	vname := filepath.Base(cpath)
+	if err = deleteSubVolumeAt(dir, path); err != nil {
+		parent.Close()
+		return err
+	}
+	if mode == CommitEach {
+		err = commitTransaction(parent)
+		parent.Close()
+		return err
+	}
+	info, err := iocFsInfo(parent)
+	if err != nil {
+		parent.Close()
+		return &os.PathError{Op: "fs info", Path: parent.Name(), Err: err}
+	}
+	if _, ok := pending[info.fsid]; ok {
+		parent.Close()
+	} else {
+		pending[info.fsid] = parent
+	}
+	return nil
+}
 
-	dir, err := openDir(dname)
+// commitTransaction commits the current transaction of the filesystem and waits for it.
+func commitTransaction(f *os.File) error {
+	var transid uint64
+	if err := iocStartSync(f, &transid); err != nil {
+		return &os.PathError{Op: "start sync", Path: f.Name(), Err: err}
+	}
+	if err := iocWaitSync(f, &transid); err != nil {
+		return &os.PathError{Op: "wait sync", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// deleteSubVolumeAt deletes a subvolume at a path relative to dir. See openAt.
+func deleteSubVolumeAt(dir *os.File, path string) error {
+	sub, err := openSubvolumeAt("delete subvolume", dir, path)
 	if err != nil {
 		return err
 	}
-	defer dir.Close()
+	sub.Close()
+	parent, vname, err := openParentAt(dir, path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
 	var args btrfs_ioctl_vol_args
 	copy(args.name[:], vname)
-	return iocSnapDestroy(dir, &args)
+	return iocSnapDestroy(parent, &args)
 }
 
-func SnapshotSubVolume(subvol, dst string, ro bool) error {
-	if ok, err := IsSubVolume(subvol); err != nil {
+// DeleteSubVolumeRecursive deletes a subvolume and all the subvolumes nested in it.
+// Nested subvolumes are deleted first. It requires CAP_SYS_ADMIN to discover nested subvolumes.
+func DeleteSubVolumeRecursive(path string) error {
+	return deleteSubVolumeRecursiveAt(nil, path)
+}
+
+// deleteSubVolumeRecursiveAt is like DeleteSubVolumeRecursive, but the path is relative to dir.
+func deleteSubVolumeRecursiveAt(dir *os.File, path string) error {
+	sub, err := openSubvolumeAt("delete subvolume", dir, path)
+	if err != nil {
 		return err
-	} else if !ok {
-		return fmt.Errorf("not a subvolume: %s", subvol)
 	}
-	exists := false
-	if st, err := os.Stat(dst); err != nil && !os.IsNotExist(err) {
+	id, err := getFileRootID(sub)
+	if err == nil {
+		err = deleteNestedSubVolumes(sub, id)
+	}
+	sub.Close()
+	if err != nil {
 		return err
-	} else if err == nil {
-		if !st.IsDir() {
-			return fmt.Errorf("'%s' exists and it is not a directory", dst)
+	}
+	return deleteSubVolumeAt(dir, path)
+}
+
+type nestedSubvol struct {
+	id   objectID
+	path string // relative to parent subvolume
+}
+
+// listNestedSubVolumes returns subvolumes directly nested in a given subvolume.
+func listNestedSubVolumes(mnt *os.File, id objectID) ([]nestedSubvol, error) {
+	it := newSearchIterator(mnt, btrfs_ioctl_search_key{
+		tree_id:      rootTreeObjectid,
+		min_objectid: id,
+		max_objectid: id,
+		min_type:     rootRefKey,
+		max_type:     rootRefKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+	})
+	var out []nestedSubvol
+	for it.Next() {
+		item := it.Item()
+		ref, err := DecodeRootRef(item.Data)
+		if err != nil {
+			return nil, err
 		}
-		exists = true
-	}
-	var (
-		newName string
-		dstDir  string
-	)
-	if exists {
-		newName = filepath.Base(subvol)
-		dstDir = dst
-	} else {
-		newName = filepath.Base(dst)
-		dstDir = filepath.Dir(dst)
+		var dir string
+		if ref.DirID != firstFreeObjectid {
+			args := btrfs_ioctl_ino_lookup_args{treeid: id, objectid: ref.DirID}
+			if err := iocInoLookup(mnt, &args); err != nil {
+				return nil, err
+			}
+			dir = args.Name()
+		}
+		out = append(out, nestedSubvol{id: objectID(item.Offset), path: dir + ref.Name})
 	}
-	if !checkSubVolumeName(newName) {
-		return fmt.Errorf("invalid snapshot name '%s'", newName)
-	} else if len(newName) >= volNameMax {
-		return fmt.Errorf("snapshot name too long '%s'", newName)
+	return out, it.Err()
+}
+
+// deleteNestedSubVolumes deletes subvolumes nested in an open subvolume with a given id.
+func deleteNestedSubVolumes(sub *os.File, id objectID) error {
+	list, err := listNestedSubVolumes(sub, id)
+	if err != nil {
+		return fmt.Errorf("cannot list nested subvolumes of %s: %w", sub.Name(), err)
+	}
+	for _, n := range list {
+		if err := deleteSubVolumeRecursiveAt(sub, n.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSubVolumeByID deletes a subvolume with a given tree id.
+// Subvolume does not need to be reachable from the filesystem root. Requires kernel 5.7+.
+func (f *FS) DeleteSubVolumeByID(id uint64) error {
+	if objectID(id) == fsTreeObjectid {
+		return fmt.Errorf("cannot delete top-level subvolume")
 	}
-	fdst, err := openDir(dstDir)
+	args := btrfs_ioctl_vol_args_v2{flags: subvolSpecByID}
+	args.SetSubvolID(id)
+	if err := iocSnapDestroyV2(f.file(), &args); err != nil {
+		return fmt.Errorf("cannot delete subvolume %d: %w", id, err)
+	}
+	return nil
+}
+
+// SnapshotOptions are options for creating snapshots.
+type SnapshotOptions struct {
+	// ReadOnly creates a read-only snapshot.
+	ReadOnly bool
+	// Inherit assigns the snapshot to qgroups.
+	Inherit *QgroupInherit
+}
+
+func SnapshotSubVolume(subvol, dst string, ro bool) error {
+	return SnapshotSubVolumeWithOptions(subvol, dst, SnapshotOptions{ReadOnly: ro})
+}
+
+// SnapshotSubVolumeWithOptions is similar to SnapshotSubVolume, but allows to set additional options.
+func SnapshotSubVolumeWithOptions(subvol, dst string, opts SnapshotOptions) error {
+	src, err := openSubvolumeAt("snapshot subvolume", nil, subvol)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return snapshotAt(src, filepath.Base(src.Name()), nil, dst, opts)
+}
+
+// snapshotAt creates a snapshot of an open subvolume at a path relative to dir.
+// If the destination is an existing directory, the snapshot is created in it with a given name.
+func snapshotAt(src *os.File, name string, dir *os.File, dst string, opts SnapshotOptions) error {
+	fdst, name, err := openSnapshotDest(name, dir, dst)
 	if err != nil {
 		return err
 	}
 	defer fdst.Close()
-	// TODO: make SnapshotSubVolume a method on FS to use existing fd
-	f, err := openDir(subvol)
+	return createSnapshot(src, fdst, name, opts)
+}
+
+// openSnapshotDest opens the directory in which a snapshot will be created and returns
+// the snapshot name. If dst is an existing directory, the name is preserved.
+func openSnapshotDest(name string, dir *os.File, dst string) (*os.File, string, error) {
+	fdst, err := openDirAt(dir, dst)
+	if errors.Is(err, syscall.ENOTDIR) {
+		return nil, "", fmt.Errorf("'%s' exists and it is not a directory", dst)
+	} else if errors.Is(err, syscall.ENOENT) {
+		fdst, name, err = openParentAt(dir, dst)
+	}
 	if err != nil {
-		return fmt.Errorf("cannot open dest dir: %v", err)
+		return nil, "", err
 	}
-	defer f.Close()
+	if !checkSubVolumeName(name) {
+		fdst.Close()
+		return nil, "", fmt.Errorf("invalid snapshot name '%s'", name)
+	} else if len(name) >= volNameMax {
+		fdst.Close()
+		return nil, "", fmt.Errorf("snapshot name too long '%s'", name)
+	}
+	return fdst, name, nil
+}
+
+// createSnapshot creates a snapshot of an open subvolume in an open directory.
+func createSnapshot(src, fdst *os.File, name string, opts SnapshotOptions) error {
 	args := btrfs_ioctl_vol_args_v2{
-		fd: int64(f.Fd()),
+		fd: int64(src.Fd()),
 	}
-	if ro {
+	if opts.ReadOnly {
 		args.flags |= SubvolReadOnly
 	}
-	// TODO
-	//if inherit != nil {
-	//	args.flags |= subvolQGroupInherit
-	//	args.size = qgroup_inherit_size(inherit)
-	//	args.qgroup_inherit = inherit
-	//}
-	copy(args.name[:], newName)
-	if err := iocSnapCreateV2(fdst, &args); err != nil {
-		return fmt.Errorf("snapshot create failed: %v", err)
+	buf := args.setInherit(opts.Inherit)
+	copy(args.name[:], name)
+	err := iocSnapCreateV2(fdst, &args)
+	runtime.KeepAlive(buf)
+	if err != nil {
+		return fmt.Errorf("snapshot create failed: %w", err)
 	}
 	return nil
 }
@@ -154,6 +420,9 @@ func IsReadOnly(path string) (bool, error) {
 	return f.ReadOnly(), nil
 }
 
+// GetFlags returns flags of the subvolume containing a given directory.
+//
+// Deprecated: use GetSubvolumeFlags.
 func GetFlags(path string) (SubvolFlags, error) {
 	fs, err := Open(path, true)
 	if err != nil {
@@ -163,114 +432,270 @@ func GetFlags(path string) (SubvolFlags, error) {
 	return fs.GetFlags()
 }
 
-func listSubVolumes(f *os.File, filter func(SubvolInfo) bool) (map[objectID]SubvolInfo, error) {
-	sk := btrfs_ioctl_search_key{
-		// search in the tree of tree roots
-		tree_id: rootTreeObjectid,
+// openSubvolume opens the root directory of a subvolume.
+func openSubvolume(op, path string) (*os.File, error) {
+	return openSubvolumeAt(op, nil, path)
+}
 
-		// Set the min and max to backref keys. The search will
-		// only send back this type of key now.
-		min_type: rootItemKey,
-		max_type: rootBackrefKey,
+// GetSubvolumeFlags returns flags of the subvolume at a given path.
+// The path must be the root of a subvolume, but it may be on any mounted btrfs filesystem.
+func GetSubvolumeFlags(path string) (SubvolFlags, error) {
+	f, err := openSubvolume("get subvolume flags", path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	flags, err := iocSubvolGetflags(f)
+	if err != nil {
+		return 0, &os.PathError{Op: "get subvolume flags", Path: path, Err: err}
+	}
+	return flags, nil
+}
 
-		min_objectid: firstFreeObjectid,
+// ReadOnlyOptions controls how the read-only flag of a subvolume is changed.
+type ReadOnlyOptions struct {
+	// Force allows to make a received subvolume writable. Its received UUID is cleared,
+	// thus it can no longer be used as a parent for incremental receive.
+	Force bool
+}
 
-		// Set all the other params to the max, we'll take any objectid
-		// and any trans.
-		max_objectid: lastFreeObjectid,
-		max_offset:   maxUint64,
-		max_transid:  maxUint64,
+// SetSubvolumeReadOnly sets or clears the read-only flag of the subvolume at a given path.
+//
+// Making a received subvolume writable fails with ErrReceivedSubvolume,
+// see SetSubvolumeReadOnlyWithOptions.
+func SetSubvolumeReadOnly(path string, ro bool) error {
+	return SetSubvolumeReadOnlyWithOptions(path, ro, ReadOnlyOptions{})
+}
 
-		nr_items: 4096, // just a big number, doesn't matter much
+// SetSubvolumeReadOnlyWithOptions is similar to SetSubvolumeReadOnly, but allows to set additional options.
+func SetSubvolumeReadOnlyWithOptions(path string, ro bool, opts ReadOnlyOptions) error {
+	const op = "set subvolume flags"
+	f, err := openSubvolume(op, path)
+	if err != nil {
+		return err
 	}
-	m := make(map[objectID]SubvolInfo)
-	for {
-		out, err := treeSearchRaw(f, sk)
+	defer f.Close()
+	flags, err := iocSubvolGetflags(f)
+	if err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	} else if flags.ReadOnly() == ro {
+		return nil
+	}
+	received := false
+	if !ro {
+		uuid, err := receivedUUID(f)
 		if err != nil {
-			return nil, err
-		} else if len(out) == 0 {
-			break
-		}
-		for _, obj := range out {
-			switch obj.Type {
-			//case rootBackrefKey:
-			//	ref := asRootRef(obj.Data)
-			//	o := m[obj.ObjectID]
-			//	o.TransID = obj.TransID
-			//	o.ObjectID = obj.ObjectID
-			//	o.RefTree = obj.Offset
-			//	o.DirID = ref.DirID
-			//	o.Name = ref.Name
-			//	m[obj.ObjectID] = o
-			case rootItemKey:
-				o := m[obj.ObjectID]
-				o.RootID = obj.ObjectID
-				robj := asRootItem(obj.Data).Decode()
-				o.fillFromItem(&robj)
-				m[obj.ObjectID] = o
-			}
+			return &os.PathError{Op: op, Path: path, Err: err}
 		}
-		// record the mins in key so we can make sure the
-		// next search doesn't repeat this root
-		last := out[len(out)-1]
-		sk.min_objectid = last.ObjectID
-		sk.min_type = last.Type
-		sk.min_offset = last.Offset + 1
-		if sk.min_offset == 0 { // overflow
-			sk.min_type++
-		} else {
-			continue
+		received = !uuid.IsZero()
+		if received && !opts.Force {
+			return &os.PathError{Op: op, Path: path, Err: ErrReceivedSubvolume}
 		}
-		if sk.min_type > rootBackrefKey {
-			sk.min_type = rootItemKey
-			sk.min_objectid++
-		} else {
-			continue
+	}
+	if ro {
+		flags |= SubvolReadOnly
+	} else {
+		flags &^= SubvolReadOnly
+	}
+	if err = iocSubvolSetflags(f, flags); err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	if received {
+		// subvolume must be writable to change received UUID
+		var args btrfs_ioctl_received_subvol_args
+		if err = iocSetReceivedSubvol(f, &args); err != nil {
+			return &os.PathError{Op: "clear received subvol", Path: path, Err: err}
 		}
-		if sk.min_objectid > sk.max_objectid {
-			break
+	}
+	return nil
+}
+
+// receivedUUID returns the received UUID of the subvolume containing a given file.
+func receivedUUID(f *os.File) (UUID, error) {
+	_, received, err := subvolUUIDs(f)
+	return received, err
+}
+
+// subvolUUIDs returns the UUID and the received UUID of the subvolume containing a given file.
+func subvolUUIDs(f *os.File) (uuid, received UUID, _ error) {
+	info, err := iocGetSubvolInfo(f)
+	if err == nil {
+		return info.uuid, info.received_uuid, nil
+	} else if err != syscall.ENOTTY {
+		return UUID{}, UUID{}, err
+	}
+	// kernel older than 4.18, fallback to tree search
+	id, err := getFileRootID(f)
+	if err != nil {
+		return UUID{}, UUID{}, err
+	}
+	it, err := readRootItem(f, id)
+	if err != nil {
+		return UUID{}, UUID{}, err
+	}
+	return it.UUID, it.ReceivedUUID, nil
+}
+
+// SnapshotsOf returns all snapshots of a given subvolume, ordered by creation time.
+// Relative paths are resolved against the opened directory.
+// Snapshots of snapshots are not included.
+func (f *FS) SnapshotsOf(subvol string) ([]SubvolInfo, error) {
+	sf, err := openSubvolumeAt("snapshots", f.f, subvol)
+	if err != nil {
+		return nil, err
+	}
+	uuid, _, err := subvolUUIDs(sf)
+	sf.Close()
+	if err != nil {
+		return nil, &os.PathError{Op: "snapshots", Path: sf.Name(), Err: err}
+	}
+	return f.ListSubvolumesWithOptions(SubvolumeListOptions{
+		Filter: SubvolumeFilter{SnapshotOf: uuid},
+		Sort:   SortByOTime,
+	})
+}
+
+func listSubVolumes(f ioctlFile, filter func(SubvolInfo) bool) (map[objectID]SubvolInfo, error) {
+	m := make(map[objectID]SubvolInfo)
+	it := newSubvolumeIterator(f, SubvolumeListOptions{})
+	for it.Next() {
+		v := it.Subvolume()
+		if filter == nil || filter(v) {
+			m[v.RootID] = v
 		}
 	}
-	// resolve paths
-	for id, v := range m {
-		if path, err := subvolidResolve(f, id); err == ErrNotFound {
-			delete(m, id)
-			continue
-		} else if err != nil {
-			return m, fmt.Errorf("cannot resolve path for %v: %v", id, err)
-		} else {
-			v.Path = path
-			m[id] = v
+	return m, it.Err()
+}
+
+// sortedSubvolumes returns subvolumes from the map sorted by id.
+func sortedSubvolumes(m map[objectID]SubvolInfo) []SubvolInfo {
+	out := make([]SubvolInfo, 0, len(m))
+	for _, v := range m {
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].RootID < out[j].RootID
+	})
+	return out
+}
+
+// listSubVolumesUser lists subvolumes under the subvolume containing the file, using ioctls
+// that don't require CAP_SYS_ADMIN (kernel 4.18+). Paths are relative to that subvolume.
+// Subvolumes that the user cannot access are skipped, together with their children.
+func listSubVolumesUser(f *os.File, filter func(SubvolInfo) bool) (map[objectID]SubvolInfo, error) {
+	m := make(map[objectID]SubvolInfo)
+	if err := listSubVolumesUserUnder(f, "", m, filter); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func listSubVolumesUserUnder(dir *os.File, prefix string, m map[objectID]SubvolInfo, filter func(SubvolInfo) bool) error {
+	var args btrfs_ioctl_get_subvol_rootref_args
+	for {
+		err := iocGetSubvolRootref(dir, &args)
+		if err != nil && err != syscall.EOVERFLOW {
+			return &os.PathError{Op: "get subvolume rootref", Path: dir.Name(), Err: err}
 		}
-		if filter != nil && !filter(v) {
-			delete(m, id)
+		for _, ref := range args.rootref[:args.num_items] {
+			if err := listSubVolumeUser(dir, prefix, ref.treeid, ref.dirid, m, filter); err != nil {
+				return err
+			}
 		}
+		if err == nil {
+			return nil
+		}
+		// min_treeid is set to the next subvolume
 	}
+}
 
-	return m, nil
+// listSubVolumeUser adds a subvolume with a given id that is a child of the subvolume
+// of dir, and lists subvolumes under it.
+func listSubVolumeUser(dir *os.File, prefix string, id, dirID objectID, m map[objectID]SubvolInfo, filter func(SubvolInfo) bool) error {
+	lookup := btrfs_ioctl_ino_lookup_user_args{dirid: dirID, treeid: id}
+	if err := iocInoLookupUser(dir, &lookup); errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOENT) {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "ino lookup", Path: dir.Name(), Err: err}
+	}
+	rel := lookup.Path()
+	sub, err := openDirAt(dir, rel)
+	if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOENT) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer sub.Close()
+	args, err := iocGetSubvolInfo(sub)
+	if err != nil {
+		return &os.PathError{Op: "get subvolume info", Path: sub.Name(), Err: err}
+	} else if args.treeid != id {
+		// something else is mounted over the subvolume
+		return nil
+	}
+	v := SubvolInfo{Path: path.Join(prefix, rel)}
+	v.fillFromArgs(&args)
+	if filter == nil || filter(v) {
+		m[id] = v
+	}
+	return listSubVolumesUserUnder(sub, v.Path, m, filter)
 }
 
 type SubvolInfo struct {
-	RootID objectID
+	RootID objectID `json:"root_id"`
+
+	ParentID objectID `json:"parent_id"` // id of the tree that contains the subvolume
+	DirID    objectID `json:"dir_id"`    // inode of the directory that contains the subvolume
+	Name     string   `json:"name"`
+
+	Gen   uint64      `json:"gen"`
+	Flags SubvolFlags `json:"flags"`
+
+	UUID         UUID `json:"uuid"`
+	ParentUUID   UUID `json:"parent_uuid"`
+	ReceivedUUID UUID `json:"received_uuid"`
 
-	UUID         UUID
-	ParentUUID   UUID
-	ReceivedUUID UUID
+	CTime time.Time `json:"ctime"`
+	OTime time.Time `json:"otime"`
+	STime time.Time `json:"stime"`
+	RTime time.Time `json:"rtime"`
 
-	CTime time.Time
-	OTime time.Time
-	STime time.Time
-	RTime time.Time
+	CTransID uint64 `json:"ctransid"`
+	OTransID uint64 `json:"otransid"`
+	STransID uint64 `json:"stransid"`
+	RTransID uint64 `json:"rtransid"`
 
-	CTransID uint64
-	OTransID uint64
-	STransID uint64
-	RTransID uint64
+	Path string `json:"path"`
 
-	Path string
+	Status SubvolStatus `json:"status,omitempty"`
 }
 
-func (s *SubvolInfo) fillFromItem(it *rootItem) {
+// SubvolStatus is the state of a subvolume.
+type SubvolStatus int
+
+const (
+	SubvolActive = SubvolStatus(iota)
+	// SubvolDeleted is a subvolume that was deleted, but its data is still being freed
+	// by the cleaner thread. Space used by it is not available until the cleanup finishes.
+	SubvolDeleted
+)
+
+func (s SubvolStatus) String() string {
+	switch s {
+	case SubvolActive:
+		return "active"
+	case SubvolDeleted:
+		return "deleted"
+	}
+	return "status" + strconv.Itoa(int(s))
+}
+
+func (s *SubvolInfo) fillFromItem(it *RootItem) {
+	s.Gen = it.Gen
+	if it.Flags&rootSubvolRdonly != 0 {
+		s.Flags |= SubvolReadOnly
+	}
+
 	s.UUID = it.UUID
 	s.ReceivedUUID = it.ReceivedUUID
 	s.ParentUUID = it.ParentUUID
@@ -286,7 +711,37 @@ func (s *SubvolInfo) fillFromItem(it *rootItem) {
 	s.RTransID = it.RTransID
 }
 
-func subvolSearchByUUID(mnt *os.File, uuid UUID) (*SubvolInfo, error) {
+func (s *SubvolInfo) fillFromArgs(a *btrfs_ioctl_get_subvol_info_args) {
+	s.RootID = a.treeid
+	s.ParentID = a.parent_id
+	s.DirID = a.dirid
+	n := bytes.IndexByte(a.name[:], 0)
+	if n < 0 {
+		n = len(a.name)
+	}
+	s.Name = string(a.name[:n])
+
+	s.Gen = a.generation
+	if a.flags&rootSubvolRdonly != 0 {
+		s.Flags |= SubvolReadOnly
+	}
+
+	s.UUID = a.uuid
+	s.ReceivedUUID = a.received_uuid
+	s.ParentUUID = a.parent_uuid
+
+	s.CTime = a.ctime.Time()
+	s.OTime = a.otime.Time()
+	s.STime = a.stime.Time()
+	s.RTime = a.rtime.Time()
+
+	s.CTransID = a.ctransid
+	s.OTransID = a.otransid
+	s.STransID = a.stransid
+	s.RTransID = a.rtransid
+}
+
+func subvolSearchByUUID(mnt ioctlFile, uuid UUID) (*SubvolInfo, error) {
 	id, err := lookupUUIDSubvolItem(mnt, uuid)
 	if err != nil {
 		return nil, err
@@ -294,7 +749,7 @@ func subvolSearchByUUID(mnt *os.File, uuid UUID) (*SubvolInfo, error) {
 	return subvolSearchByRootID(mnt, id, "")
 }
 
-func subvolSearchByReceivedUUID(mnt *os.File, uuid UUID) (*SubvolInfo, error) {
+func subvolSearchByReceivedUUID(mnt ioctlFile, uuid UUID) (*SubvolInfo, error) {
 	id, err := lookupUUIDReceivedSubvolItem(mnt, uuid)
 	if err != nil {
 		return nil, err
@@ -302,53 +757,37 @@ func subvolSearchByReceivedUUID(mnt *os.File, uuid UUID) (*SubvolInfo, error) {
 	return subvolSearchByRootID(mnt, id, "")
 }
 
+// subvolSearchByPath finds a subvolume that contains a path relative to mnt. See openAt.
 func subvolSearchByPath(mnt *os.File, path string) (*SubvolInfo, error) {
-	if !filepath.IsAbs(path) {
-		path = filepath.Join(mnt.Name(), path)
-	}
-	id, err := getPathRootID(path)
+	id, err := rootIDAt(mnt, path)
 	if err != nil {
 		return nil, err
 	}
 	return subvolSearchByRootID(mnt, id, path)
 }
 
-func subvolidResolve(mnt *os.File, subvolID objectID) (string, error) {
+func subvolidResolve(mnt ioctlFile, subvolID objectID) (string, error) {
 	return subvolidResolveSub(mnt, "", subvolID)
 }
 
-func subvolidResolveSub(mnt *os.File, path string, subvolID objectID) (string, error) {
+func subvolidResolveSub(mnt ioctlFile, path string, subvolID objectID) (string, error) {
 	if subvolID == fsTreeObjectid {
 		return "", nil
 	}
-	sk := btrfs_ioctl_search_key{
-		tree_id:      rootTreeObjectid,
-		min_objectid: subvolID,
-		max_objectid: subvolID,
-		min_type:     rootBackrefKey,
-		max_type:     rootBackrefKey,
-		max_offset:   maxUint64,
-		max_transid:  maxUint64,
-		nr_items:     1,
-	}
-	results, err := treeSearchRaw(mnt, sk)
+	parent, backRef, err := readRootBackref(mnt, subvolID)
 	if err != nil {
 		return "", err
-	} else if len(results) < 1 {
-		return "", ErrNotFound
 	}
-	res := results[0]
-	if objectID(res.Offset) != fsTreeObjectid {
-		spath, err := subvolidResolveSub(mnt, path, objectID(res.Offset))
+	if parent != fsTreeObjectid {
+		spath, err := subvolidResolveSub(mnt, path, parent)
 		if err != nil {
 			return "", err
 		}
 		path = spath + "/"
 	}
-	backRef := asRootRef(res.Data)
 	if backRef.DirID != firstFreeObjectid {
 		arg := btrfs_ioctl_ino_lookup_args{
-			treeid:   objectID(res.Offset),
+			treeid:   parent,
 			objectid: backRef.DirID,
 		}
 		if err := iocInoLookup(mnt, &arg); err != nil {
@@ -359,10 +798,37 @@ func subvolidResolveSub(mnt *os.File, path string, subvolID objectID) (string, e
 	return path + backRef.Name, nil
 }
 
+// readRootBackref returns the first backref of a subvolume and the id of the tree that contains it.
+// It returns ErrNotFound if subvolume has no backrefs.
+func readRootBackref(mnt ioctlFile, subvolID objectID) (objectID, RootRef, error) {
+	sk := btrfs_ioctl_search_key{
+		tree_id:      rootTreeObjectid,
+		min_objectid: subvolID,
+		max_objectid: subvolID,
+		min_type:     rootBackrefKey,
+		max_type:     rootBackrefKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+		nr_items:     1,
+	}
+	results, err := treeSearchRaw(mnt, sk)
+	if err != nil {
+		return 0, RootRef{}, err
+	} else if len(results) < 1 {
+		return 0, RootRef{}, ErrNotFound
+	}
+	res := results[0]
+	ref, err := DecodeRootRef(res.Data)
+	if err != nil {
+		return 0, RootRef{}, err
+	}
+	return objectID(res.Offset), ref, nil
+}
+
 // subvolSearchByRootID
 //
 // Path is optional, and will be resolved automatically if not set.
-func subvolSearchByRootID(mnt *os.File, rootID objectID, path string) (*SubvolInfo, error) {
+func subvolSearchByRootID(mnt ioctlFile, rootID objectID, path string) (*SubvolInfo, error) {
 	robj, err := readRootItem(mnt, rootID)
 	if err != nil {
 		return nil, err
@@ -372,8 +838,202 @@ func subvolSearchByRootID(mnt *os.File, rootID objectID, path string) (*SubvolIn
 		Path:   path,
 	}
 	info.fillFromItem(robj)
+	if rootID != fsTreeObjectid {
+		parent, ref, err := readRootBackref(mnt, rootID)
+		if err != nil {
+			return nil, err
+		}
+		info.ParentID, info.DirID, info.Name = parent, ref.DirID, ref.Name
+	}
 	if path == "" {
 		info.Path, err = subvolidResolve(mnt, info.RootID)
 	}
 	return info, err
 }
+
+// SubvolDetails is a detailed information about a subvolume, similar to "btrfs subvolume show".
+type SubvolDetails struct {
+	SubvolInfo
+	// Snapshots is a list of paths of subvolumes that were snapshotted from this one.
+	Snapshots []string `json:"snapshots"`
+}
+
+// SubvolumeInfo returns a detailed information about a subvolume that contains a given path.
+// Relative paths are resolved against the opened directory.
+func (f *FS) SubvolumeInfo(path string) (*SubvolDetails, error) {
+	if err := requireAdmin("subvolume info", path); err != nil {
+		return nil, err
+	}
+	id, err := rootIDAt(f.f, path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := subvolSearchByRootID(f.file(), id, "")
+	if err != nil {
+		return nil, err
+	}
+	out := &SubvolDetails{SubvolInfo: *info}
+	if info.UUID.IsZero() {
+		return out, nil
+	}
+	m, err := listSubVolumes(f.file(), func(s SubvolInfo) bool {
+		return s.ParentUUID == info.UUID
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range m {
+		out.Snapshots = append(out.Snapshots, s.Path)
+	}
+	sort.Strings(out.Snapshots)
+	return out, nil
+}
+
+// SetDefaultSubvolume sets the subvolume that will be mounted by default
+// when no subvol or subvolid mount options are specified.
+// Zero id sets the default back to the top-level subvolume.
+func (f *FS) SetDefaultSubvolume(id uint64) error {
+	if id == 0 {
+		id = uint64(fsTreeObjectid)
+	}
+	if err := iocDefaultSubvol(f.file(), &id); err != nil {
+		return &os.PathError{Op: "set default subvolume", Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
+
+// dirItemSize is the size of btrfs_dir_item, without the name.
+const dirItemSize = 30
+
+// GetDefaultSubvolume returns the id of the subvolume that is mounted by default.
+func (f *FS) GetDefaultSubvolume() (uint64, error) {
+	const name = "default"
+	sk := btrfs_ioctl_search_key{
+		tree_id:      rootTreeObjectid,
+		min_objectid: rootTreeDirObjectid,
+		max_objectid: rootTreeDirObjectid,
+		min_type:     dirItemKey,
+		max_type:     dirItemKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+		nr_items:     16,
+	}
+	results, err := treeSearchRaw(f.file(), sk)
+	if err != nil {
+		return 0, err
+	}
+	for _, res := range results {
+		p := res.Data
+		// there may be multiple dir items with the same name hash
+		for len(p) >= dirItemSize {
+			dataLen := int(order.Uint16(p[25:]))
+			nameLen := int(order.Uint16(p[27:]))
+			end := dirItemSize + nameLen + dataLen
+			if len(p) < end {
+				return 0, fmt.Errorf("btrfs: truncated dir item")
+			}
+			if string(p[dirItemSize:dirItemSize+nameLen]) == name {
+				return order.Uint64(p[0:]), nil
+			}
+			p = p[end:]
+		}
+	}
+	// no default dir item - top-level subvolume is used
+	return uint64(fsTreeObjectid), nil
+}
+
+// subvolSyncInterval is the interval between checks in SubvolumeSync.
+const subvolSyncInterval = time.Second
+
+// PendingCleanups returns the number of deleted subvolumes that are not yet cleaned.
+// See SubvolumeSync to wait for them. It requires CAP_SYS_ADMIN.
+func (f *FS) PendingCleanups() (int, error) {
+	ids, err := listDeletedSubVolumes(f.file())
+	if err != nil {
+		return 0, &os.PathError{Op: "tree search", Path: f.f.Name(), Err: err}
+	}
+	return len(ids), nil
+}
+
+// listDeletedSubVolumes returns ids of subvolumes that were deleted, but not yet cleaned.
+func listDeletedSubVolumes(mnt ioctlFile) ([]uint64, error) {
+	it := newSearchIterator(mnt, btrfs_ioctl_search_key{
+		tree_id:      rootTreeObjectid,
+		min_objectid: orphanObjectid,
+		max_objectid: orphanObjectid,
+		min_type:     orphanItemKey,
+		max_type:     orphanItemKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+	})
+	var ids []uint64
+	for it.Next() {
+		ids = append(ids, it.Item().Offset)
+	}
+	return ids, it.Err()
+}
+
+// subvolExists checks if root item of a subvolume still exists.
+func subvolExists(mnt ioctlFile, id uint64) (bool, error) {
+	res, err := treeSearchRaw(mnt, btrfs_ioctl_search_key{
+		tree_id:      rootTreeObjectid,
+		min_objectid: objectID(id),
+		max_objectid: objectID(id),
+		min_type:     rootItemKey,
+		max_type:     rootItemKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+		nr_items:     1,
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(res) != 0, nil
+}
+
+// SubvolumeSync waits until deleted subvolumes with given ids are completely removed
+// from the filesystem. If no ids are given, it waits for all subvolumes that are
+// currently queued for deletion.
+func (f *FS) SubvolumeSync(ids ...uint64) error {
+	return f.SubvolumeSyncContext(context.Background(), ids...)
+}
+
+// SubvolumeSyncContext is similar to SubvolumeSync, but stops waiting when the context is done.
+// Cancellation does not affect the cleanup of deleted subvolumes.
+func (f *FS) SubvolumeSyncContext(ctx context.Context, ids ...uint64) error {
+	if len(ids) == 0 {
+		var err error
+		ids, err = listDeletedSubVolumes(f.file())
+		if err != nil {
+			return fmt.Errorf("cannot list deleted subvolumes: %w", err)
+		}
+	} else {
+		ids = append([]uint64(nil), ids...)
+	}
+	for len(ids) != 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		left := ids[:0]
+		for _, id := range ids {
+			ok, err := subvolExists(f.file(), id)
+			if err != nil {
+				return err
+			} else if ok {
+				left = append(left, id)
+			}
+		}
+		ids = left
+		if len(ids) == 0 {
+			break
+		}
+		t := time.NewTimer(subvolSyncInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
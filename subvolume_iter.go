@@ -0,0 +1,372 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SubvolumeFilter selects subvolumes by their properties. Zero fields are ignored,
+// and a subvolume must match all the other conditions.
+type SubvolumeFilter struct {
+	Snapshots  bool      // only snapshots, i.e. subvolumes with a parent UUID
+	SnapshotOf UUID      // only snapshots of the subvolume with this UUID
+	ReadOnly   bool      // only read-only subvolumes
+	ParentID   uint64    // only subvolumes directly under the subvolume with this id
+	Since      time.Time // only subvolumes created at or after this time
+	// Name is a glob pattern for the subvolume name, as accepted by path.Match.
+	// Invalid patterns match nothing.
+	Name string
+}
+
+// matchItem checks conditions that only depend on the root item.
+func (fl *SubvolumeFilter) matchItem(v *SubvolInfo) bool {
+	if fl.Snapshots && v.ParentUUID.IsZero() {
+		return false
+	} else if !fl.SnapshotOf.IsZero() && v.ParentUUID != fl.SnapshotOf {
+		return false
+	} else if fl.ReadOnly && v.Flags&SubvolReadOnly == 0 {
+		return false
+	} else if !fl.Since.IsZero() && v.OTime.Before(fl.Since) {
+		return false
+	}
+	return true
+}
+
+// matchRef checks conditions that depend on the root backref.
+func (fl *SubvolumeFilter) matchRef(v *SubvolInfo) bool {
+	if fl.ParentID != 0 && uint64(v.ParentID) != fl.ParentID {
+		return false
+	} else if fl.Name != "" {
+		if ok, _ := path.Match(fl.Name, v.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (fl *SubvolumeFilter) match(v *SubvolInfo) bool {
+	return fl.matchItem(v) && fl.matchRef(v)
+}
+
+// SubvolumeSort is a sort order of listed subvolumes.
+type SubvolumeSort int
+
+const (
+	SortByID    = SubvolumeSort(iota) // subvolume id; the only order that doesn't keep the list in memory
+	SortByPath                        // path, compared as a string
+	SortByGen                         // generation of the last change
+	SortByOTime                       // creation time
+)
+
+// SubvolumeListOptions controls which subvolumes are listed and in what order.
+type SubvolumeListOptions struct {
+	Filter  SubvolumeFilter
+	Sort    SubvolumeSort
+	Reverse bool // reverse the sort order
+	// Relative makes paths relative to the subvolume the filesystem was opened at,
+	// instead of the top-level subvolume. Subvolumes outside of it are skipped.
+	Relative bool
+	// Deleted includes subvolumes that were deleted, but are still being cleaned.
+	// They have no path, name and parent, and are not listed without CAP_SYS_ADMIN.
+	Deleted bool
+}
+
+// SubvolumeIterator iterates over subvolumes of the filesystem.
+// Subvolumes are decoded page by page as the tree search returns them,
+// thus the whole list is never kept in memory, unless sorting is requested.
+type SubvolumeIterator struct {
+	f    ioctlFile
+	it   *SearchIterator
+	opts SubvolumeListOptions
+
+	// list is set if subvolumes were collected first: either to sort them,
+	// or because tree search is not permitted and unprivileged ioctls were used
+	list     []SubvolInfo
+	fromList bool
+
+	pending *SubvolInfo         // root item waiting for its backref
+	paths   map[objectID]string // paths relative to the top-level subvolume
+	prefix  *string             // path of the opened subvolume, if Relative is set
+	cur     SubvolInfo
+	err     error
+}
+
+// SubvolumeIter returns an iterator over all subvolumes of the filesystem,
+// ordered by subvolume id. The top-level subvolume is not included.
+// Paths are resolved by following root backrefs up to the top-level subvolume.
+//
+// Without CAP_SYS_ADMIN, it lists only subvolumes under the opened one that are accessible
+// by the user, with paths relative to it. See ListSubvolumes.
+func (f *FS) SubvolumeIter() *SubvolumeIterator {
+	return f.SubvolumeIterWithOptions(SubvolumeListOptions{})
+}
+
+// SubvolumeIterWithOptions is like SubvolumeIter, but only returns subvolumes that match
+// the filter, in a given order. Filters are checked before resolving subvolume paths.
+func (f *FS) SubvolumeIterWithOptions(opts SubvolumeListOptions) *SubvolumeIterator {
+	return newSubvolumeIterator(f.file(), opts)
+}
+
+// ListSubvolumesWithOptions returns all subvolumes that match the filter, in a given order.
+func (f *FS) ListSubvolumesWithOptions(opts SubvolumeListOptions) ([]SubvolInfo, error) {
+	var out []SubvolInfo
+	it := f.SubvolumeIterWithOptions(opts)
+	for it.Next() {
+		out = append(out, it.Subvolume())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func newSubvolumeIterator(f ioctlFile, opts SubvolumeListOptions) *SubvolumeIterator {
+	return &SubvolumeIterator{
+		f:    f,
+		opts: opts,
+		it: newSearchIterator(f, btrfs_ioctl_search_key{
+			tree_id:      rootTreeObjectid,
+			min_objectid: firstFreeObjectid,
+			max_objectid: lastFreeObjectid,
+			min_type:     rootItemKey,
+			max_type:     rootBackrefKey,
+			max_offset:   maxUint64,
+			max_transid:  maxUint64,
+		}),
+		paths: map[objectID]string{fsTreeObjectid: ""},
+	}
+}
+
+// Next advances the iterator to the next subvolume. It returns false at the end of the list,
+// or if an error occurs.
+func (it *SubvolumeIterator) Next() bool {
+	if it.err != nil {
+		return false
+	} else if it.fromList {
+		return it.nextList()
+	}
+	if it.opts.Sort == SortByID && !it.opts.Reverse {
+		if it.next() {
+			return true
+		} else if !errors.Is(it.err, syscall.EPERM) {
+			return false
+		}
+		it.err = nil
+		if err := it.collectUser(); err != nil {
+			it.err = err
+			return false
+		}
+		return it.nextList()
+	}
+	// sorting requires all subvolumes
+	for it.next() {
+		it.list = append(it.list, it.cur)
+	}
+	if errors.Is(it.err, syscall.EPERM) && len(it.list) == 0 {
+		it.err = it.collectUser()
+	} else if it.err == nil {
+		it.sort()
+		it.fromList = true
+	}
+	if it.err != nil {
+		return false
+	}
+	return it.nextList()
+}
+
+// next reads the next subvolume from the tree search.
+func (it *SubvolumeIterator) next() bool {
+	if it.opts.Relative && it.prefix == nil {
+		p, err := it.rootPath()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.prefix = &p
+	}
+	for it.it.Next() {
+		if ok, err := it.item(it.it.Item()); err != nil {
+			it.err = err
+			return false
+		} else if ok {
+			return true
+		}
+	}
+	if it.err = it.it.Err(); it.err != nil {
+		return false
+	}
+	// the last subvolume has no backref
+	return it.deleted(nil)
+}
+
+// item handles a single item of the tree search. It returns true if a subvolume
+// is ready to be returned by the iterator.
+func (it *SubvolumeIterator) item(item SearchItem) (bool, error) {
+	switch item.Type {
+	case rootItemKey:
+		robj, err := DecodeRootItem(item.Data)
+		if err != nil {
+			return false, err
+		}
+		v := &SubvolInfo{RootID: objectID(item.ObjectID)}
+		v.fillFromItem(&robj)
+		if !it.opts.Filter.matchItem(v) {
+			v = nil
+		}
+		// subvolumes without backrefs are deleted, but not yet cleaned
+		return it.deleted(v), nil
+	case rootBackrefKey:
+		v := it.pending
+		it.pending = nil
+		if v == nil || v.RootID != objectID(item.ObjectID) {
+			return false, nil
+		}
+		ref, err := DecodeRootRef(item.Data)
+		if err != nil {
+			return false, err
+		}
+		v.ParentID, v.DirID, v.Name = objectID(item.Offset), ref.DirID, ref.Name
+		if !it.opts.Filter.matchRef(v) {
+			return false, nil
+		}
+		if v.Path, err = it.path(v.ParentID, v.DirID, v.Name); err == ErrNotFound {
+			// parent was deleted
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("cannot resolve path for %v: %v", v.RootID, err)
+		}
+		it.paths[v.RootID] = v.Path
+		if it.prefix != nil {
+			var ok bool
+			if v.Path, ok = trimSubvolPath(*it.prefix, v.Path); !ok {
+				return false, nil
+			}
+		}
+		it.cur = *v
+		return true, nil
+	}
+	return false, nil
+}
+
+// deleted replaces the pending subvolume with the next one. The previous subvolume
+// had no backref, thus it is returned as deleted, if requested.
+func (it *SubvolumeIterator) deleted(next *SubvolInfo) bool {
+	v := it.pending
+	it.pending = next
+	if v == nil || !it.opts.Deleted || !it.opts.Filter.matchRef(v) {
+		return false
+	}
+	v.Status = SubvolDeleted
+	it.cur = *v
+	return true
+}
+
+// collectUser lists subvolumes with unprivileged ioctls.
+func (it *SubvolumeIterator) collectUser() error {
+	// nested subvolumes are opened, thus requests always go to the kernel
+	f, _ := ioctlDoerOf(it.f)
+	m, err := listSubVolumesUser(f, func(v SubvolInfo) bool {
+		return it.opts.Filter.match(&v)
+	})
+	if err != nil {
+		return err
+	}
+	it.list = sortedSubvolumes(m)
+	it.sort()
+	it.fromList = true
+	return nil
+}
+
+// sort orders the collected list according to the options.
+func (it *SubvolumeIterator) sort() {
+	var less func(a, b *SubvolInfo) bool
+	switch it.opts.Sort {
+	case SortByPath:
+		less = func(a, b *SubvolInfo) bool { return a.Path < b.Path }
+	case SortByGen:
+		less = func(a, b *SubvolInfo) bool { return a.Gen < b.Gen }
+	case SortByOTime:
+		less = func(a, b *SubvolInfo) bool { return a.OTime.Before(b.OTime) }
+	default:
+		less = func(a, b *SubvolInfo) bool { return a.RootID < b.RootID }
+	}
+	list := it.list
+	sort.SliceStable(list, func(i, j int) bool {
+		if it.opts.Reverse {
+			return less(&list[j], &list[i])
+		}
+		return less(&list[i], &list[j])
+	})
+}
+
+func (it *SubvolumeIterator) nextList() bool {
+	if len(it.list) == 0 {
+		return false
+	}
+	it.cur, it.list = it.list[0], it.list[1:]
+	return true
+}
+
+// path resolves a path of the subvolume with a given name in a directory of the parent subvolume.
+func (it *SubvolumeIterator) path(parent, dirID objectID, name string) (string, error) {
+	ppath, ok := it.paths[parent]
+	if !ok {
+		// parent was filtered out, or moved under a subvolume with a higher id
+		var err error
+		if ppath, err = subvolidResolve(it.f, parent); err != nil {
+			return "", err
+		}
+		it.paths[parent] = ppath
+	}
+	p := ppath
+	if p != "" {
+		p += "/"
+	}
+	if dirID != firstFreeObjectid {
+		arg := btrfs_ioctl_ino_lookup_args{treeid: parent, objectid: dirID}
+		if err := iocInoLookup(it.f, &arg); err != nil {
+			return "", err
+		}
+		p += arg.Name()
+	}
+	return p + name, nil
+}
+
+// rootPath returns the path of the opened subvolume relative to the top-level subvolume.
+func (it *SubvolumeIterator) rootPath() (string, error) {
+	id, err := getFileRootID(it.f)
+	if err != nil {
+		return "", &os.PathError{Op: "ino lookup", Path: it.f.Name(), Err: err}
+	}
+	if id == fsTreeObjectid {
+		return "", nil
+	}
+	return subvolidResolve(it.f, id)
+}
+
+// trimSubvolPath returns a path relative to a given subvolume path.
+// It returns false if the path is not under that subvolume.
+func trimSubvolPath(prefix, path string) (string, bool) {
+	if prefix == "" {
+		return path, true
+	} else if !strings.HasPrefix(path, prefix+"/") {
+		return "", false
+	}
+	return path[len(prefix)+1:], true
+}
+
+// Subvolume returns the current subvolume.
+func (it *SubvolumeIterator) Subvolume() SubvolInfo {
+	return it.cur
+}
+
+// Err returns an error that stopped the iteration, if any.
+func (it *SubvolumeIterator) Err() error {
+	return it.err
+}
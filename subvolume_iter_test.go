@@ -0,0 +1,126 @@
+package btrfs
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubvolumeFilter(t *testing.T) {
+	now := time.Now()
+	subs := []SubvolInfo{
+		{RootID: 256, ParentID: 5, Name: "home", Path: "home", Gen: 30, OTime: now.Add(-time.Hour)},
+		{RootID: 257, ParentID: 5, Name: "home.1", Path: "snap/home.1", Gen: 10, OTime: now.Add(-2 * time.Hour),
+			ParentUUID: UUID{1}, Flags: SubvolReadOnly},
+		{RootID: 258, ParentID: 256, Name: "cache", Path: "home/cache", Gen: 20, OTime: now},
+		{RootID: 259, ParentID: 5, Name: "home.2", Path: "snap/home.2", Gen: 40, OTime: now.Add(time.Minute),
+			ParentUUID: UUID{1}},
+	}
+	cases := []struct {
+		name string
+		opts SubvolumeListOptions
+		exp  []objectID
+	}{
+		{name: "all", exp: []objectID{256, 257, 258, 259}},
+		{name: "snapshots", opts: SubvolumeListOptions{Filter: SubvolumeFilter{Snapshots: true}}, exp: []objectID{257, 259}},
+		{name: "snapshot of", opts: SubvolumeListOptions{Filter: SubvolumeFilter{SnapshotOf: UUID{1}}}, exp: []objectID{257, 259}},
+		{name: "snapshot of other", opts: SubvolumeListOptions{Filter: SubvolumeFilter{SnapshotOf: UUID{2}}}},
+		{name: "readonly", opts: SubvolumeListOptions{Filter: SubvolumeFilter{ReadOnly: true}}, exp: []objectID{257}},
+		{name: "parent", opts: SubvolumeListOptions{Filter: SubvolumeFilter{ParentID: 256}}, exp: []objectID{258}},
+		{name: "since", opts: SubvolumeListOptions{Filter: SubvolumeFilter{Since: now}}, exp: []objectID{258, 259}},
+		{name: "glob", opts: SubvolumeListOptions{Filter: SubvolumeFilter{Name: "home.*"}}, exp: []objectID{257, 259}},
+		{name: "bad glob", opts: SubvolumeListOptions{Filter: SubvolumeFilter{Name: "["}}},
+		{name: "by path", opts: SubvolumeListOptions{Sort: SortByPath}, exp: []objectID{256, 258, 257, 259}},
+		{name: "by gen", opts: SubvolumeListOptions{Sort: SortByGen}, exp: []objectID{257, 258, 256, 259}},
+		{name: "by otime reverse", opts: SubvolumeListOptions{Sort: SortByOTime, Reverse: true}, exp: []objectID{259, 258, 256, 257}},
+		{name: "id reverse", opts: SubvolumeListOptions{Reverse: true}, exp: []objectID{259, 258, 257, 256}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			it := &SubvolumeIterator{opts: c.opts}
+			for i := range subs {
+				if c.opts.Filter.match(&subs[i]) {
+					it.list = append(it.list, subs[i])
+				}
+			}
+			it.sort()
+			var got []objectID
+			for it.nextList() {
+				got = append(got, it.Subvolume().RootID)
+			}
+			if !reflect.DeepEqual(got, c.exp) {
+				t.Fatalf("unexpected result: %v vs %v", got, c.exp)
+			}
+		})
+	}
+}
+
+func TestTrimSubvolPath(t *testing.T) {
+	cases := []struct {
+		prefix, path string
+		exp          string
+		ok           bool
+	}{
+		{prefix: "", path: "a/b", exp: "a/b", ok: true},
+		{prefix: "@home", path: "@home/user/.snap", exp: "user/.snap", ok: true},
+		{prefix: "@home", path: "@home", ok: false},
+		{prefix: "@home", path: "@home2/a", ok: false},
+		{prefix: "@home", path: "@/a", ok: false},
+	}
+	for _, c := range cases {
+		got, ok := trimSubvolPath(c.prefix, c.path)
+		if got != c.exp || ok != c.ok {
+			t.Errorf("%q in %q: unexpected result: %q (%v)", c.path, c.prefix, got, ok)
+		}
+	}
+}
+
+func TestSubvolumeIterDeleted(t *testing.T) {
+	root := make([]byte, rootItemV1Size)
+	ref := func(name string) []byte {
+		p := make([]byte, 18+len(name))
+		order.PutUint64(p[0:], uint64(firstFreeObjectid))
+		order.PutUint16(p[16:], uint16(len(name)))
+		copy(p[18:], name)
+		return p
+	}
+	// 257 and 259 have no backrefs
+	items := []SearchItem{
+		{ObjectID: 256, Type: rootItemKey, Data: root},
+		{ObjectID: 256, Type: rootBackrefKey, Offset: 5, Data: ref("a")},
+		{ObjectID: 257, Type: rootItemKey, Data: root},
+		{ObjectID: 258, Type: rootItemKey, Data: root},
+		{ObjectID: 258, Type: rootBackrefKey, Offset: 5, Data: ref("b")},
+		{ObjectID: 259, Type: rootItemKey, Data: root},
+	}
+	for _, deleted := range []bool{false, true} {
+		it := &SubvolumeIterator{
+			opts:  SubvolumeListOptions{Deleted: deleted},
+			paths: map[objectID]string{fsTreeObjectid: ""},
+		}
+		var got []string
+		add := func() {
+			v := it.Subvolume()
+			got = append(got, fmt.Sprintf("%d:%s:%v", v.RootID, v.Path, v.Status))
+		}
+		for _, item := range items {
+			ok, err := it.item(item)
+			if err != nil {
+				t.Fatal(err)
+			} else if ok {
+				add()
+			}
+		}
+		if it.deleted(nil) {
+			add()
+		}
+		exp := []string{"256:a:active", "258:b:active"}
+		if deleted {
+			exp = []string{"256:a:active", "257::deleted", "258:b:active", "259::deleted"}
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("deleted=%v: unexpected result: %q vs %q", deleted, got, exp)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package btrfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SubvolumeNode is a subvolume in a SubvolumeTree.
+type SubvolumeNode struct {
+	SubvolInfo
+	// Parent is the subvolume that contains this one; nil for the root of the tree.
+	Parent *SubvolumeNode
+	// Children are subvolumes directly under this one, ordered by id.
+	Children []*SubvolumeNode
+	// Origin is the subvolume this one is a snapshot of. It's nil if this subvolume
+	// is not a snapshot, or if the origin was deleted.
+	Origin *SubvolumeNode
+	// Snapshots are snapshots of this subvolume, ordered by id.
+	Snapshots []*SubvolumeNode
+}
+
+// Lineage returns the chain of snapshot origins, starting from the node itself.
+func (n *SubvolumeNode) Lineage() []*SubvolumeNode {
+	var out []*SubvolumeNode
+	for ; n != nil; n = n.Origin {
+		out = append(out, n)
+	}
+	return out
+}
+
+// WalkSnapshots calls fn for all snapshots of the subvolume, including snapshots of snapshots,
+// in depth-first order. Depth of direct snapshots is 1. If fn returns an error, the walk stops.
+func (n *SubvolumeNode) WalkSnapshots(fn func(s *SubvolumeNode, depth int) error) error {
+	return n.walk(func(s *SubvolumeNode) []*SubvolumeNode { return s.Snapshots }, 1, fn)
+}
+
+// walk calls fn for all nodes reachable with a given edge function, except the node itself.
+func (n *SubvolumeNode) walk(next func(*SubvolumeNode) []*SubvolumeNode, depth int, fn func(*SubvolumeNode, int) error) error {
+	for _, c := range next(n) {
+		if err := fn(c, depth); err != nil {
+			return err
+		}
+		if err := c.walk(next, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubvolumeTree is a graph of subvolume relationships: the containment of subvolumes
+// in each other, and snapshot origins resolved by UUIDs.
+type SubvolumeTree struct {
+	// Root is the top-level subvolume, or the subvolume the filesystem was opened at,
+	// if the tree was built without CAP_SYS_ADMIN. Its info may be incomplete.
+	Root   *SubvolumeNode
+	byID   map[objectID]*SubvolumeNode
+	byUUID map[UUID]*SubvolumeNode
+}
+
+// SubvolumeTree builds a graph of all subvolumes of the filesystem.
+// See ListSubvolumes for the limitations of listing without CAP_SYS_ADMIN.
+func (f *FS) SubvolumeTree() (*SubvolumeTree, error) {
+	list, err := f.ListSubvolumes(nil)
+	if err != nil {
+		return nil, err
+	}
+	return buildSubvolumeTree(list), nil
+}
+
+// buildSubvolumeTree links subvolumes from the list. Subvolumes with an unknown
+// parent are attached to the root.
+func buildSubvolumeTree(list []SubvolInfo) *SubvolumeTree {
+	t := &SubvolumeTree{
+		Root:   &SubvolumeNode{SubvolInfo: SubvolInfo{RootID: fsTreeObjectid}},
+		byID:   make(map[objectID]*SubvolumeNode, len(list)+1),
+		byUUID: make(map[UUID]*SubvolumeNode, len(list)),
+	}
+	t.byID[fsTreeObjectid] = t.Root
+	nodes := make([]*SubvolumeNode, 0, len(list))
+	for _, v := range sortedSubvolumes(subvolumeMap(list)) {
+		n := &SubvolumeNode{SubvolInfo: v}
+		nodes = append(nodes, n)
+		t.byID[v.RootID] = n
+		if !v.UUID.IsZero() {
+			t.byUUID[v.UUID] = n
+		}
+	}
+	for _, n := range nodes {
+		p := t.byID[n.ParentID]
+		if p == nil || p == n {
+			p = t.Root
+		}
+		n.Parent = p
+		p.Children = append(p.Children, n)
+		if n.ParentUUID.IsZero() {
+			continue
+		}
+		if o := t.byUUID[n.ParentUUID]; o != nil && o != n {
+			n.Origin = o
+			o.Snapshots = append(o.Snapshots, n)
+		}
+	}
+	return t
+}
+
+func subvolumeMap(list []SubvolInfo) map[objectID]SubvolInfo {
+	m := make(map[objectID]SubvolInfo, len(list))
+	for _, v := range list {
+		m[v.RootID] = v
+	}
+	return m
+}
+
+// Node returns a subvolume with a given id, or nil if it's not in the tree.
+func (t *SubvolumeTree) Node(id uint64) *SubvolumeNode {
+	return t.byID[objectID(id)]
+}
+
+// ByUUID returns a subvolume with a given UUID, or nil if it's not in the tree.
+func (t *SubvolumeTree) ByUUID(uuid UUID) *SubvolumeNode {
+	return t.byUUID[uuid]
+}
+
+// Walk calls fn for all subvolumes in the tree, in depth-first order of containment,
+// starting from the root with depth 0. If fn returns an error, the walk stops.
+func (t *SubvolumeTree) Walk(fn func(n *SubvolumeNode, depth int) error) error {
+	if err := fn(t.Root, 0); err != nil {
+		return err
+	}
+	return t.Root.walk(func(n *SubvolumeNode) []*SubvolumeNode { return n.Children }, 1, fn)
+}
+
+// WriteDOT writes the tree in the Graphviz DOT format. Containment is drawn with solid edges
+// from parents to children, and snapshots with dashed edges from origins to snapshots.
+// Read-only subvolumes have dashed borders.
+func (t *SubvolumeTree) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph subvolumes {")
+	fmt.Fprintln(bw, "\tnode [shape=box];")
+	t.Walk(func(n *SubvolumeNode, _ int) error {
+		label := n.Path
+		if n == t.Root && label == "" {
+			label = "<FS_TREE>"
+		}
+		attrs := ""
+		if n.Flags&SubvolReadOnly != 0 {
+			attrs = ", style=dashed"
+		}
+		fmt.Fprintf(bw, "\tn%d [label=\"%s\\n%d\"%s];\n", n.RootID, dotEscape(label), n.RootID, attrs)
+		return nil
+	})
+	t.Walk(func(n *SubvolumeNode, _ int) error {
+		for _, c := range n.Children {
+			fmt.Fprintf(bw, "\tn%d -> n%d;\n", n.RootID, c.RootID)
+		}
+		for _, s := range n.Snapshots {
+			fmt.Fprintf(bw, "\tn%d -> n%d [style=dashed, color=blue];\n", n.RootID, s.RootID)
+		}
+		return nil
+	})
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// dotEscape escapes a string to be used in a quoted DOT identifier.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,77 @@
+package btrfs
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSubvolumeTree(t *testing.T) {
+	list := []SubvolInfo{
+		{RootID: 258, ParentID: 5, Path: "snap/home.1", UUID: UUID{2}, ParentUUID: UUID{1}, Flags: SubvolReadOnly},
+		{RootID: 256, ParentID: 5, Path: "home", UUID: UUID{1}},
+		{RootID: 257, ParentID: 256, Path: "home/cache", UUID: UUID{3}},
+		{RootID: 259, ParentID: 5, Path: "snap/home.1.1", UUID: UUID{4}, ParentUUID: UUID{2}},
+		// origin was deleted
+		{RootID: 260, ParentID: 5, Path: "old", UUID: UUID{5}, ParentUUID: UUID{9}},
+	}
+	tr := buildSubvolumeTree(list)
+
+	var order []objectID
+	var depths []int
+	tr.Walk(func(n *SubvolumeNode, depth int) error {
+		order = append(order, n.RootID)
+		depths = append(depths, depth)
+		return nil
+	})
+	if exp := []objectID{5, 256, 257, 258, 259, 260}; !reflect.DeepEqual(order, exp) {
+		t.Fatalf("unexpected order: %v", order)
+	} else if exp := []int{0, 1, 2, 1, 1, 1}; !reflect.DeepEqual(depths, exp) {
+		t.Fatalf("unexpected depths: %v", depths)
+	}
+
+	n := tr.Node(259)
+	var lineage []objectID
+	for _, l := range n.Lineage() {
+		lineage = append(lineage, l.RootID)
+	}
+	if exp := []objectID{259, 258, 256}; !reflect.DeepEqual(lineage, exp) {
+		t.Fatalf("unexpected lineage: %v", lineage)
+	}
+	if tr.Node(260).Origin != nil {
+		t.Fatal("unexpected origin")
+	}
+	var snaps []objectID
+	tr.ByUUID(UUID{1}).WalkSnapshots(func(s *SubvolumeNode, depth int) error {
+		snaps = append(snaps, s.RootID)
+		return nil
+	})
+	if exp := []objectID{258, 259}; !reflect.DeepEqual(snaps, exp) {
+		t.Fatalf("unexpected snapshots: %v", snaps)
+	}
+
+	var buf bytes.Buffer
+	if err := tr.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	const exp = `digraph subvolumes {
+	node [shape=box];
+	n5 [label="<FS_TREE>\n5"];
+	n256 [label="home\n256"];
+	n257 [label="home/cache\n257"];
+	n258 [label="snap/home.1\n258", style=dashed];
+	n259 [label="snap/home.1.1\n259"];
+	n260 [label="old\n260"];
+	n5 -> n256;
+	n5 -> n258;
+	n5 -> n259;
+	n5 -> n260;
+	n256 -> n257;
+	n256 -> n258 [style=dashed, color=blue];
+	n258 -> n259 [style=dashed, color=blue];
+}
+`
+	if got := buf.String(); got != exp {
+		t.Fatalf("unexpected output:\n%s", got)
+	}
+}
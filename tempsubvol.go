@@ -0,0 +1,126 @@
+package btrfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// tempSubvolPrefix is the name prefix of subvolumes created by CreateTempSubvolume.
+const tempSubvolPrefix = ".tmp-subvol-"
+
+// TempSubvolume is a subvolume with a hidden random name that is either published
+// under its final name with Promote, or deleted with Discard.
+//
+// It's similar to a file created with O_TMPFILE, except that the subvolume is visible
+// in the directory while it's being populated, and it's left behind if the process crashes.
+// Leftovers can be found by the name prefix ".tmp-subvol-".
+type TempSubvolume struct {
+	dir  *os.File // parent directory, nil after Promote or Discard
+	name string
+	path string
+}
+
+// CreateTempSubvolume creates a temporary subvolume in a given directory.
+//
+// The typical usage is to populate the subvolume at Path, call Promote on success,
+// and defer Discard to clean up on all other paths:
+//
+//	tmp, err := btrfs.CreateTempSubvolume(dir)
+//	if err != nil {
+//		return err
+//	}
+//	defer tmp.Discard()
+//	// populate tmp.Path() or tmp.Open()
+//	return tmp.Promote("layer")
+func CreateTempSubvolume(dir string) (*TempSubvolume, error) {
+	return createTempSubvolumeAt(nil, dir)
+}
+
+// CreateTempSubvolume creates a temporary subvolume like the CreateTempSubvolume function.
+// Relative paths are resolved against the opened directory.
+func (f *FS) CreateTempSubvolume(dir string) (*TempSubvolume, error) {
+	return createTempSubvolumeAt(f.f, dir)
+}
+
+// createTempSubvolumeAt creates a temporary subvolume in a directory relative to dir. See openAt.
+func createTempSubvolumeAt(dir *os.File, path string) (*TempSubvolume, error) {
+	parent, err := openDirAt(dir, path)
+	if err != nil {
+		return nil, err
+	}
+	var buf [8]byte
+	for i := 0; i < 10; i++ {
+		if _, err = rand.Read(buf[:]); err != nil {
+			break
+		}
+		name := tempSubvolPrefix + hex.EncodeToString(buf[:])
+		err = createSubVolumeAt(parent, name, CreateOptions{})
+		if err == nil {
+			return &TempSubvolume{dir: parent, name: name, path: filepath.Join(parent.Name(), name)}, nil
+		} else if err != syscall.EEXIST {
+			break
+		}
+	}
+	parent.Close()
+	return nil, &os.PathError{Op: "create temp subvolume", Path: path, Err: err}
+}
+
+// Path returns the path of the subvolume. It's built from the path the parent directory was
+// opened with and is informational only: it's not updated if the parent directory is moved or
+// renamed. Use Open to access the subvolume regardless of that.
+func (t *TempSubvolume) Path() string {
+	return t.path
+}
+
+// Open opens the subvolume relative to the directory it was created in, thus it doesn't depend
+// on the path of that directory. It fails after Promote or Discard.
+func (t *TempSubvolume) Open() (*os.File, error) {
+	if t.dir == nil {
+		return nil, &os.PathError{Op: "open", Path: t.path, Err: os.ErrClosed}
+	}
+	return openDirAt(t.dir, t.name)
+}
+
+// Promote atomically renames the subvolume to a given name, without replacing an existing file.
+// Relative names are resolved against the directory the subvolume was created in, and must stay
+// on the same subvolume as that directory. It fails with EEXIST if the name is already taken,
+// in which case the subvolume is kept and can be discarded or promoted under a different name.
+//
+// After a successful call, the subvolume is no longer temporary and Discard does nothing.
+func (t *TempSubvolume) Promote(name string) error {
+	if t.dir == nil {
+		return &os.PathError{Op: "promote", Path: t.path, Err: os.ErrClosed}
+	}
+	dst, base, err := openParentAt(t.dir, name)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if !checkSubVolumeName(base) {
+		return &os.PathError{Op: "promote", Path: name, Err: syscall.EINVAL}
+	}
+	if err = renameat2(t.dir, t.name, dst, base, renameNoReplace); err != nil {
+		return &os.LinkError{Op: "promote", Old: t.path, New: filepath.Join(dst.Name(), base), Err: err}
+	}
+	t.path = filepath.Join(dst.Name(), base)
+	t.dir.Close()
+	t.dir = nil
+	return nil
+}
+
+// Discard deletes the subvolume together with all the subvolumes nested in it.
+// It does nothing if the subvolume was already promoted or discarded.
+func (t *TempSubvolume) Discard() error {
+	if t.dir == nil {
+		return nil
+	}
+	if err := deleteSubVolumeRecursiveAt(t.dir, t.name); err != nil {
+		return err
+	}
+	t.dir.Close()
+	t.dir = nil
+	return nil
+}
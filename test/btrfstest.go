@@ -3,13 +3,11 @@ package btrfstest
 import (
 	"bytes"
 	"errors"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
 	"testing"
-	"time"
 )
 
 func run(name string, args ...string) error {
@@ -52,61 +50,18 @@ func Mount(mount string, file string) error {
 	return nil
 }
 
+// Unmount unmounts a filesystem, retrying for a few seconds if it is busy.
 func Unmount(mount string) error {
-	for i := 0; i < 5; i++ {
-		if err := run("umount", mount); err == nil {
-			break
-		} else {
-			if strings.Contains(err.Error(), "busy") {
-				time.Sleep(time.Second)
-			} else {
-				break
-			}
-		}
-	}
-	return nil
+	return unmount(mount)
 }
 
+// New creates a temporary filesystem of a given size and returns its mount point and a function to clean it up.
+// See NewVolume for details.
 func New(t testing.TB, size int64) (string, func()) {
-	f, err := ioutil.TempFile("", "btrfs_vol")
-	if err != nil {
-		t.Fatal(err)
-	}
-	name := f.Name()
-	f.Close()
-	rm := func() {
-		os.Remove(name)
-	}
-	if err = Mkfs(name, size); err != nil {
-		rm()
-	}
-	mount, err := ioutil.TempDir("", "btrfs_mount")
-	if err != nil {
-		rm()
-		t.Fatal(err)
-	}
-	if err = Mount(mount, name); err != nil {
-		rm()
-		os.RemoveAll(mount)
-		if txt := err.Error(); strings.Contains(txt, "permission denied") ||
-			strings.Contains(txt, "only root") {
-			t.Skip(err)
-		} else {
-			t.Fatal(err)
-		}
-	}
-	done := false
-	return mount, func() {
-		if done {
-			return
-		}
-		if err := Unmount(mount); err != nil {
-			log.Println("umount failed:", err)
-		}
-		if err := os.Remove(mount); err != nil {
+	v := NewVolume(t, Options{Size: size})
+	return v.Mount, func() {
+		if err := v.Close(); err != nil {
 			log.Println("cleanup failed:", err)
 		}
-		rm()
-		done = true
 	}
 }
@@ -0,0 +1,198 @@
+package btrfstest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// DefaultSize is the default size of a device backing file.
+// It is the minimal size that allows mkfs.btrfs to use default profiles.
+const DefaultSize = 256 * 1024 * 1024
+
+// Options configures a temporary filesystem.
+type Options struct {
+	Size         int64    // size of each backing file; DefaultSize is used if not set
+	Devices      int      // number of devices; defaults to 1
+	MkfsArgs     []string // additional arguments for mkfs.btrfs, e.g. "-d", "raid1"
+	MountOptions string   // comma-separated mount options, e.g. "compress=zstd"
+}
+
+// Volume is a temporary btrfs filesystem backed by files attached to loop devices.
+type Volume struct {
+	Mount   string   // mount point
+	Files   []string // backing files
+	Devices []string // loop devices, in the same order as files
+
+	dir string
+}
+
+func output(name string, args ...string) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+	err := cmd.Run()
+	out := strings.TrimSpace(buf.String())
+	if err == nil {
+		return out, nil
+	} else if out == "" {
+		return "", err
+	}
+	return "", errors.New("error: " + out)
+}
+
+// Create creates backing files in a temporary directory, attaches them to loop devices,
+// runs mkfs.btrfs and mounts the filesystem. It requires root privileges.
+//
+// The filesystem is mounted in the mount namespace of the process: a private namespace
+// is not created, since unshare in Go only affects the calling thread. The mount is made
+// private, thus mounts created under it do not propagate to other mount namespaces even
+// if the parent mount is shared (as set up by systemd).
+//
+// Volume must be closed to release all resources.
+func Create(opts Options) (_ *Volume, gerr error) {
+	if opts.Size == 0 {
+		opts.Size = DefaultSize
+	}
+	if opts.Devices == 0 {
+		opts.Devices = 1
+	}
+	dir, err := ioutil.TempDir("", "btrfs_vol_")
+	if err != nil {
+		return nil, err
+	}
+	v := &Volume{dir: dir, Mount: filepath.Join(dir, "mnt")}
+	defer func() {
+		if gerr != nil {
+			v.Close()
+		}
+	}()
+	for i := 0; i < opts.Devices; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("dev%d", i))
+		if err = createFile(name, opts.Size); err != nil {
+			return nil, err
+		}
+		v.Files = append(v.Files, name)
+		dev, err := output("losetup", "--find", "--show", name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot attach loop device: %v", err)
+		}
+		v.Devices = append(v.Devices, dev)
+	}
+	args := append([]string{"-f"}, opts.MkfsArgs...)
+	if err = run("mkfs.btrfs", append(args, v.Devices...)...); err != nil {
+		return nil, err
+	}
+	if err = os.Mkdir(v.Mount, 0755); err != nil {
+		return nil, err
+	}
+	if err = syscall.Mount(v.Devices[0], v.Mount, "btrfs", 0, opts.MountOptions); err != nil {
+		return nil, &os.PathError{Op: "mount", Path: v.Mount, Err: err}
+	}
+	if err = syscall.Mount("none", v.Mount, "", syscall.MS_PRIVATE, ""); err != nil {
+		return nil, &os.PathError{Op: "make private", Path: v.Mount, Err: err}
+	}
+	return v, nil
+}
+
+func createFile(name string, size int64) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Remount unmounts and mounts the filesystem again, e.g. to drop caches or apply new options.
+func (v *Volume) Remount(opts string) error {
+	if err := unmount(v.Mount); err != nil {
+		return err
+	}
+	if err := syscall.Mount(v.Devices[0], v.Mount, "btrfs", 0, opts); err != nil {
+		return &os.PathError{Op: "mount", Path: v.Mount, Err: err}
+	}
+	return nil
+}
+
+// unmount unmounts a filesystem, retrying for a few seconds if it is busy.
+func unmount(mount string) error {
+	var err error
+	for i := 0; i < 5; i++ {
+		if err = syscall.Unmount(mount, 0); err == nil || err == syscall.EINVAL || err == syscall.ENOENT {
+			return nil // EINVAL, ENOENT: not mounted
+		} else if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	return &os.PathError{Op: "umount", Path: mount, Err: err}
+}
+
+// Close unmounts the filesystem, detaches loop devices and removes all temporary files.
+// It is safe to call Close multiple times.
+func (v *Volume) Close() error {
+	if v.dir == "" {
+		return nil
+	}
+	var last error
+	mounted := false
+	if err := unmount(v.Mount); err != nil {
+		last, mounted = err, true
+	}
+	for _, dev := range v.Devices {
+		if err := run("losetup", "-d", dev); err != nil {
+			last = err
+		}
+	}
+	if mounted {
+		// don't remove the directory recursively, since it would delete files on the mount;
+		// backing files are removed anyway, the space is released once they are unmounted
+		for _, name := range v.Files {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				last = err
+			}
+		}
+		return last
+	}
+	if err := os.RemoveAll(v.dir); err != nil {
+		last = err
+	}
+	v.dir = ""
+	return last
+}
+
+// NewVolume creates a temporary filesystem for a test and closes it when the test completes.
+// The test is skipped if the process is not privileged or btrfs tools are not installed.
+func NewVolume(t testing.TB, opts Options) *Volume {
+	if os.Geteuid() != 0 {
+		t.Skip("root privileges are required to create btrfs volumes")
+	}
+	for _, name := range []string{"losetup", "mkfs.btrfs"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not installed", name)
+		}
+	}
+	v, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := v.Close(); err != nil {
+			t.Error("cleanup failed:", err)
+		}
+	})
+	return v
+}
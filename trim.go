@@ -0,0 +1,32 @@
+package btrfs
+
+import "os"
+
+// TrimOptions specify the range of the filesystem to discard.
+type TrimOptions struct {
+	// Start is the byte offset in the filesystem address space to start from.
+	Start uint64
+	// Len is the number of bytes to trim. Zero means the whole filesystem.
+	Len uint64
+	// MinLen is the minimal length of a free extent to be discarded.
+	// Smaller extents are skipped. Zero means the default of the device.
+	MinLen uint64
+}
+
+// Trim discards unused blocks of the filesystem (fstrim). It returns the number of bytes trimmed.
+// It requires CAP_SYS_ADMIN.
+func (f *FS) Trim(opts TrimOptions) (uint64, error) {
+	arg := fstrim_range{
+		start:  opts.Start,
+		len:    opts.Len,
+		minlen: opts.MinLen,
+	}
+	if arg.len == 0 {
+		arg.len = maxUint64
+	}
+	if err := iocFITrim(f.file(), &arg); err != nil {
+		return 0, &os.PathError{Op: "trim", Path: f.f.Name(), Err: err}
+	}
+	// kernel updates the length with the number of bytes trimmed
+	return arg.len, nil
+}
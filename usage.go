@@ -38,10 +38,10 @@ func (a spaceInfoByBlockGroup) Less(i, j int) bool {
 }
 
 type UsageInfo struct {
-	Total       uint64
-	TotalUnused uint64
+	Total       uint64 // total size of all devices
+	TotalUnused uint64 // unallocated space on all devices
 	TotalUsed   uint64
-	TotalChunks uint64
+	TotalChunks uint64 // allocated space on all devices
 
 	FreeEstimated uint64
 	FreeMin       uint64
@@ -62,11 +62,50 @@ type UsageInfo struct {
 
 	GlobalReserve     uint64
 	GlobalReserveUsed uint64
+
+	// Profiles is a per-profile breakdown of allocated space.
+	Profiles []SpaceInfo
+	// Devices lists the allocation on each device.
+	Devices []DeviceAllocation
+}
+
+// DeviceAllocation describes how much space is allocated on a device.
+type DeviceAllocation struct {
+	DevID     uint64
+	Path      string
+	Size      uint64
+	Allocated uint64
+}
+
+// Unallocated returns the amount of space that is not yet allocated for chunks.
+func (d DeviceAllocation) Unallocated() uint64 {
+	if d.Allocated > d.Size {
+		return 0
+	}
+	return d.Size - d.Allocated
 }
 
 const minUnallocatedThreshold = 16 * 1024 * 1024
 
-func spaceUsage(f *os.File) (UsageInfo, error) {
+// profileRatio returns the ratio between raw and logical space for a given
+// block group profile on a filesystem with n devices.
+func profileRatio(bg blockGroup, n int) float64 {
+	switch {
+	case bg&blockGroupRaid1c4 != 0:
+		return 4
+	case bg&blockGroupRaid1c3 != 0:
+		return 3
+	case bg&(blockGroupRaid1|blockGroupDup|blockGroupRaid10) != 0:
+		return 2
+	case bg&blockGroupRaid5 != 0 && n > 1:
+		return float64(n) / float64(n-1)
+	case bg&blockGroupRaid6 != 0 && n > 2:
+		return float64(n) / float64(n-2)
+	}
+	return 1
+}
+
+func spaceUsage(f ioctlFile) (UsageInfo, error) {
 	info, err := iocFsInfo(f)
 	if err != nil {
 		return UsageInfo{}, err
@@ -79,7 +118,15 @@ func spaceUsage(f *os.File) (UsageInfo, error) {
 		} else if err != nil {
 			return UsageInfo{}, err
 		}
-		u.Total += dev.total_bytes
+		d := DeviceAllocation{
+			DevID:     dev.devid,
+			Path:      dev.Path(),
+			Size:      dev.total_bytes,
+			Allocated: dev.bytes_used,
+		}
+		u.Devices = append(u.Devices, d)
+		u.Total += d.Size
+		u.TotalUnused += d.Unallocated()
 	}
 
 	spaces, err := iocSpaceInfo(f)
@@ -88,49 +135,42 @@ func spaceUsage(f *os.File) (UsageInfo, error) {
 	}
 	sort.Sort(spaceInfoByBlockGroup(spaces))
 	var (
-		maxDataRatio int = 1
+		maxDataRatio float64 = 1
 		mixed        bool
 	)
 	for _, s := range spaces {
-		ratio := 1
-		bg := s.Flags.BlockGroup()
-		switch {
-		case bg&blockGroupRaid0 != 0:
-			ratio = 1
-		case bg&blockGroupRaid1 != 0:
-			ratio = 2
-		case bg&blockGroupRaid5 != 0:
-			ratio = 0
-		case bg&blockGroupRaid6 != 0:
-			ratio = 0
-		case bg&blockGroupDup != 0:
-			ratio = 2
-		case bg&blockGroupRaid10 != 0:
-			ratio = 2
+		u.Profiles = append(u.Profiles, SpaceInfo{
+			Type:       BlockGroupFlags(s.Flags),
+			TotalBytes: s.TotalBytes,
+			UsedBytes:  s.UsedBytes,
+		})
+		if s.Flags&spaceInfoGlobalRsv != 0 {
+			// not a real block group, reserve is allocated from metadata
+			u.GlobalReserve = s.TotalBytes
+			u.GlobalReserveUsed = s.UsedBytes
+			continue
 		}
+		bg := s.Flags.BlockGroup()
+		ratio := profileRatio(bg, len(u.Devices))
 		if ratio > maxDataRatio {
 			maxDataRatio = ratio
 		}
-		if bg&spaceInfoGlobalRsv != 0 {
-			u.GlobalReserve = s.TotalBytes
-			u.GlobalReserveUsed = s.UsedBytes
-		}
 		if bg&(blockGroupData|blockGroupMetadata) == (blockGroupData | blockGroupMetadata) {
 			mixed = true
 		}
 		if bg&blockGroupData != 0 {
-			u.RawDataUsed += s.UsedBytes * uint64(ratio)
-			u.RawDataChunks += s.TotalBytes * uint64(ratio)
+			u.RawDataUsed += uint64(float64(s.UsedBytes) * ratio)
+			u.RawDataChunks += uint64(float64(s.TotalBytes) * ratio)
 			u.LogicalDataChunks += s.TotalBytes
 		}
 		if bg&blockGroupMetadata != 0 {
-			u.RawMetaUsed += s.UsedBytes * uint64(ratio)
-			u.RawMetaChunks += s.TotalBytes * uint64(ratio)
+			u.RawMetaUsed += uint64(float64(s.UsedBytes) * ratio)
+			u.RawMetaChunks += uint64(float64(s.TotalBytes) * ratio)
 			u.LogicalMetaChunks += s.TotalBytes
 		}
 		if bg&blockGroupSystem != 0 {
-			u.SystemUsed += s.UsedBytes * uint64(ratio)
-			u.SystemChunks += s.TotalBytes * uint64(ratio)
+			u.SystemUsed += uint64(float64(s.UsedBytes) * ratio)
+			u.SystemChunks += uint64(float64(s.TotalBytes) * ratio)
 		}
 	}
 	u.TotalChunks = u.RawDataChunks + u.SystemChunks
@@ -139,13 +179,17 @@ func spaceUsage(f *os.File) (UsageInfo, error) {
 		u.TotalChunks += u.RawMetaChunks
 		u.TotalUsed += u.RawMetaUsed
 	}
-	u.TotalUnused = u.Total - u.TotalChunks
 
-	u.DataRatio = float64(u.RawDataChunks) / float64(u.LogicalDataChunks)
+	u.DataRatio = 1
+	if u.LogicalDataChunks != 0 {
+		u.DataRatio = float64(u.RawDataChunks) / float64(u.LogicalDataChunks)
+	}
 	if mixed {
 		u.MetadataRatio = u.DataRatio
-	} else {
+	} else if u.LogicalMetaChunks != 0 {
 		u.MetadataRatio = float64(u.RawMetaChunks) / float64(u.LogicalMetaChunks)
+	} else {
+		u.MetadataRatio = 1
 	}
 
 	// We're able to fill at least DATA for the unused space
@@ -161,7 +205,11 @@ func spaceUsage(f *os.File) (UsageInfo, error) {
 	// reserve would be lost. Part of it could be permanently allocated,
 	// we have to subtract the used bytes so we don't go under zero free.
 	if mixed {
-		u.FreeEstimated -= u.GlobalReserve - u.GlobalReserveUsed
+		rsv := u.GlobalReserve - u.GlobalReserveUsed
+		if rsv > u.FreeEstimated {
+			rsv = u.FreeEstimated
+		}
+		u.FreeEstimated -= rsv
 	}
 	u.FreeMin = u.FreeEstimated
 
@@ -170,7 +218,119 @@ func spaceUsage(f *os.File) (UsageInfo, error) {
 	if u.TotalUnused >= minUnallocatedThreshold {
 		u.FreeEstimated += uint64(float64(u.TotalUnused) / u.DataRatio)
 		// Match the calculation of 'df', use the highest raid ratio
-		u.FreeMin += u.TotalUnused / uint64(maxDataRatio)
+		u.FreeMin += uint64(float64(u.TotalUnused) / maxDataRatio)
 	}
 	return u, nil
 }
+
+// SpaceInfo describes the allocation of a single block group type and profile.
+type SpaceInfo struct {
+	Type       BlockGroupFlags // type and profile of block groups
+	TotalBytes uint64          // logical size of allocated chunks
+	UsedBytes  uint64          // logical bytes used in allocated chunks
+}
+
+// SpaceInfo returns the allocation info for all block group types and profiles,
+// similar to "btrfs filesystem df". Global reserve is reported with
+// BlockGroupGlobalReserve type.
+func (f *FS) SpaceInfo() ([]SpaceInfo, error) {
+	spaces, err := iocSpaceInfo(f.file())
+	if err != nil {
+		return nil, &os.PathError{Op: "space info", Path: f.f.Name(), Err: err}
+	}
+	sort.Sort(spaceInfoByBlockGroup(spaces))
+	out := make([]SpaceInfo, 0, len(spaces))
+	for _, s := range spaces {
+		out = append(out, SpaceInfo{
+			Type:       BlockGroupFlags(s.Flags),
+			TotalBytes: s.TotalBytes,
+			UsedBytes:  s.UsedBytes,
+		})
+	}
+	return out, nil
+}
+
+// DeviceChunkUsage is the space allocated on a device for a single block group type and profile.
+type DeviceChunkUsage struct {
+	Type BlockGroupFlags
+	Size uint64
+}
+
+// DeviceUsage describes how the space of a single device is allocated,
+// similar to "btrfs device usage".
+type DeviceUsage struct {
+	DeviceAllocation
+	Chunks []DeviceChunkUsage
+}
+
+// stripeSize returns the size of a single stripe of the chunk on a device.
+func (c ChunkItem) stripeSize() uint64 {
+	n := uint64(len(c.Stripes))
+	if n == 0 {
+		return 0
+	}
+	bg := blockGroup(c.Type)
+	switch {
+	case bg&blockGroupRaid0 != 0:
+		return c.Length / n
+	case bg&blockGroupRaid10 != 0 && c.SubStripes != 0:
+		return c.Length * uint64(c.SubStripes) / n
+	case bg&blockGroupRaid5 != 0 && n > 1:
+		return c.Length / (n - 1)
+	case bg&blockGroupRaid6 != 0 && n > 2:
+		return c.Length / (n - 2)
+	}
+	// single, dup, raid1
+	return c.Length
+}
+
+// DeviceUsage returns a breakdown of space allocated on the device by block group type and profile.
+// It reads the chunk tree and requires CAP_SYS_ADMIN.
+func (f *FS) DeviceUsage(devid uint64) (*DeviceUsage, error) {
+	dev, err := iocDevInfo(f.file(), devid, UUID{})
+	if err != nil {
+		return nil, &os.PathError{Op: "dev info", Path: f.f.Name(), Err: err}
+	}
+	out := &DeviceUsage{DeviceAllocation: DeviceAllocation{
+		DevID: dev.devid,
+		Path:  dev.Path(),
+		Size:  dev.total_bytes,
+	}}
+	it := newSearchIterator(f.file(), btrfs_ioctl_search_key{
+		tree_id:      chunkTreeObjectid,
+		min_objectid: firstChunkTreeObjectid,
+		max_objectid: firstChunkTreeObjectid,
+		min_type:     chunkItemKey,
+		max_type:     chunkItemKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+	})
+	byType := make(map[BlockGroupFlags]int)
+	for it.Next() {
+		c, err := DecodeChunkItem(it.Item().Data)
+		if err != nil {
+			return nil, err
+		}
+		size := c.stripeSize()
+		for _, s := range c.Stripes {
+			if s.DevID != devid {
+				continue
+			}
+			i, ok := byType[c.Type]
+			if !ok {
+				i = len(out.Chunks)
+				byType[c.Type] = i
+				out.Chunks = append(out.Chunks, DeviceChunkUsage{Type: c.Type})
+			}
+			out.Chunks[i].Size += size
+			out.Allocated += size
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(out.Chunks, func(i, j int) bool {
+		return cmpChunkBlockGroup(blockGroup(out.Chunks[i].Type), blockGroup(out.Chunks[j].Type)) < 0
+	})
+	return out, nil
+}
@@ -0,0 +1,30 @@
+package btrfs
+
+import "testing"
+
+func TestProfileRatio(t *testing.T) {
+	for _, c := range []struct {
+		bg  blockGroup
+		n   int
+		exp float64
+	}{
+		{blockGroupData, 1, 1},
+		{blockGroupData | blockGroupRaid0, 3, 1},
+		{blockGroupData | blockGroupDup, 1, 2},
+		{blockGroupData | blockGroupRaid1, 2, 2},
+		{blockGroupData | blockGroupRaid10, 4, 2},
+		{blockGroupData | blockGroupRaid1c3, 3, 3},
+		{blockGroupMetadata | blockGroupRaid1c4, 4, 4},
+		{blockGroupData | blockGroupRaid5, 3, 1.5},
+		{blockGroupData | blockGroupRaid6, 4, 2},
+	} {
+		if r := profileRatio(c.bg, c.n); r != c.exp {
+			t.Errorf("%v on %d devices: expected %v, got %v", BlockGroupFlags(c.bg), c.n, c.exp, r)
+		}
+	}
+	if p, err := ParseProfile("RAID1C3"); err != nil {
+		t.Fatal(err)
+	} else if p != ProfileRAID1C3 || BlockGroupFlags(blockGroupData|blockGroupRaid1c3).Profile() != p {
+		t.Fatalf("unexpected profile: %v", p)
+	}
+}
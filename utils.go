@@ -1,16 +1,20 @@
 package btrfs
 
 import (
+	"context"
 	"fmt"
 	"github.com/dennwc/btrfs/mtab"
 	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
-func isBtrfs(path string) (bool, error) {
+// IsBtrfs checks if the path is on a btrfs filesystem. Unlike IsSubVolume,
+// the path may be any file or directory.
+func IsBtrfs(path string) (bool, error) {
 	var stfs syscall.Statfs_t
 	if err := syscall.Statfs(path, &stfs); err != nil {
 		return false, &os.PathError{Op: "statfs", Path: path, Err: err}
@@ -18,6 +22,59 @@ func isBtrfs(path string) (bool, error) {
 	return stfs.Type == SuperMagic, nil
 }
 
+// withCancel runs a blocking operation and calls cancel if the context is done before it returns.
+//
+// The operation must call arm right before issuing its request, after acquiring the locks it needs.
+// Cancel is never called before that, thus an operation that waits for a lock cannot cancel
+// the one started by someone else. Arm returns the context error if the context is already done,
+// in which case the operation must return without starting. Cancellation is retried periodically,
+// since the request may not be received by the kernel yet when the context is done.
+// If the operation fails after the context was cancelled, the context error is returned instead.
+func withCancel(ctx context.Context, cancel func() error, fn func(arm func() error) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	armed := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-armed:
+		case <-done:
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		for cancel() != nil {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-done:
+				return
+			}
+		}
+	}()
+	err := fn(func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		close(armed)
+		return nil
+	})
+	close(done)
+	<-stopped
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// notArmed is an arm function for operations that are not cancelled.
+func notArmed() error { return nil }
+
 func findMountRoot(path string) (string, error) {
 	mounts, err := mtab.Mounts()
 	if err != nil {
@@ -46,7 +103,7 @@ func findMountRoot(path string) (string, error) {
 // 1: path is in a btrfs filesystem
 // 2: path is a directory
 func openDir(path string) (*os.File, error) {
-	if ok, err := isBtrfs(path); err != nil {
+	if ok, err := IsBtrfs(path); err != nil {
 		return nil, err
 	} else if !ok {
 		return nil, ErrNotBtrfs{Path: path}
@@ -64,6 +121,161 @@ func openDir(path string) (*os.File, error) {
 	return file, nil
 }
 
+// atFDCWD is AT_FDCWD, which is not defined in syscall.
+const atFDCWD = -0x64
+
+// withFd calls fn with the file descriptor of f. Unlike f.Fd, it keeps the descriptor
+// open until fn returns, even if the file is closed concurrently.
+func withFd(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err = rc.Control(func(fd uintptr) {
+		ferr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// openAt opens a file relative to a directory, or relative to the current directory
+// if dir is nil. Absolute paths are opened as is. Unlike joining the path with the name
+// of the directory, it works if the directory was moved, or opened via a symlink.
+func openAt(dir *os.File, name string, flags int, perm uint32) (*os.File, error) {
+	var fd int
+	open := func(dfd int) (err error) {
+		fd, err = syscall.Openat(dfd, name, flags|syscall.O_CLOEXEC, perm)
+		return err
+	}
+	var err error
+	path := name
+	if dir != nil {
+		if !filepath.IsAbs(name) {
+			path = filepath.Join(dir.Name(), name)
+		}
+		err = withFd(dir, open)
+	} else {
+		if abs, err := filepath.Abs(name); err == nil {
+			path = abs
+		}
+		err = open(atFDCWD)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// openDirAt opens a directory with openAt.
+func openDirAt(dir *os.File, name string) (*os.File, error) {
+	return openAt(dir, name, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+}
+
+// openParentAt opens the parent directory of a path with openAt, and returns
+// the last element of the path.
+func openParentAt(dir *os.File, name string) (*os.File, string, error) {
+	if dir == nil {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return nil, "", err
+		}
+		name = abs
+	}
+	name = filepath.Clean(name)
+	parent, err := openDirAt(dir, filepath.Dir(name))
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, filepath.Base(name), nil
+}
+
+// openSubvolumeAt opens the root directory of a subvolume with openAt.
+func openSubvolumeAt(op string, dir *os.File, name string) (*os.File, error) {
+	f, err := openDirAt(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := isSubvolumeFile(f); err != nil {
+		f.Close()
+		return nil, err
+	} else if !ok {
+		f.Close()
+		return nil, &os.PathError{Op: op, Path: f.Name(), Err: ErrNotSubvolume}
+	}
+	return f, nil
+}
+
+// fstat is like syscall.Fstat, but uses withFd.
+func fstat(f *os.File, st *syscall.Stat_t) error {
+	if err := withFd(f, func(fd int) error { return syscall.Fstat(fd, st) }); err != nil {
+		return &os.PathError{Op: "stat", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// fstatfs is like syscall.Fstatfs, but uses withFd.
+func fstatfs(f *os.File, st *syscall.Statfs_t) error {
+	if err := withFd(f, func(fd int) error { return syscall.Fstatfs(fd, st) }); err != nil {
+		return &os.PathError{Op: "statfs", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// isSubvolumeFile is like IsSubVolume, but checks an open file.
+func isSubvolumeFile(f *os.File) (bool, error) {
+	var st syscall.Stat_t
+	if err := fstat(f, &st); err != nil {
+		return false, err
+	}
+	if objectID(st.Ino) != firstFreeObjectid ||
+		st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return false, nil
+	}
+	var stfs syscall.Statfs_t
+	if err := fstatfs(f, &stfs); err != nil {
+		return false, err
+	}
+	return stfs.Type == SuperMagic, nil
+}
+
+// openSubvolumeRoot opens the root directory of the subvolume that contains an open directory.
+// Each subvolume has a separate device number, thus the root is the first parent
+// directory with the inode number of a subvolume root.
+func openSubvolumeRoot(dir *os.File) (*os.File, error) {
+	var st syscall.Stat_t
+	if err := fstat(dir, &st); err != nil {
+		return nil, err
+	}
+	dev, ino := st.Dev, uint64(0)
+	cur, err := openDirAt(dir, ".")
+	if err != nil {
+		return nil, err
+	}
+	for first := true; ; first = false {
+		if err := fstat(cur, &st); err != nil {
+			cur.Close()
+			return nil, err
+		}
+		// the parent of the root directory is the directory itself
+		if st.Dev != dev || (!first && st.Ino == ino) {
+			// a directory inside of the subvolume is mounted, but not the subvolume itself
+			cur.Close()
+			return nil, &os.PathError{Op: "find subvolume", Path: dir.Name(), Err: ErrNotFound}
+		} else if objectID(st.Ino) == firstFreeObjectid {
+			return cur, nil
+		}
+		ino = st.Ino
+		parent, err := openDirAt(cur, "..")
+		cur.Close()
+		if err != nil {
+			return nil, err
+		}
+		cur = parent
+	}
+}
+
 type searchResult struct {
 	TransID  uint64
 	ObjectID objectID
@@ -72,7 +284,7 @@ type searchResult struct {
 	Data     []byte
 }
 
-func treeSearchRaw(mnt *os.File, key btrfs_ioctl_search_key) (out []searchResult, _ error) {
+func treeSearchRaw(mnt ioctlFile, key btrfs_ioctl_search_key) (out []searchResult, _ error) {
 	args := btrfs_ioctl_search_args{
 		key: key,
 	}
@@ -3,14 +3,13 @@ package btrfs
 import (
 	"encoding/binary"
 	"fmt"
-	"os"
 )
 
-func lookupUUIDSubvolItem(f *os.File, uuid UUID) (objectID, error) {
+func lookupUUIDSubvolItem(f ioctlFile, uuid UUID) (objectID, error) {
 	return uuidTreeLookupAny(f, uuid, uuidKeySubvol)
 }
 
-func lookupUUIDReceivedSubvolItem(f *os.File, uuid UUID) (objectID, error) {
+func lookupUUIDReceivedSubvolItem(f ioctlFile, uuid UUID) (objectID, error) {
 	return uuidTreeLookupAny(f, uuid, uuidKeyReceivedSubvol)
 }
 
@@ -22,7 +21,18 @@ func (id UUID) toKey() (objID objectID, off uint64) {
 
 // uuidTreeLookupAny searches uuid tree for a given uuid in specified field.
 // It returns ErrNotFound if object was not found.
-func uuidTreeLookupAny(f *os.File, uuid UUID, typ treeKeyType) (objectID, error) {
+func uuidTreeLookupAny(f ioctlFile, uuid UUID, typ treeKeyType) (objectID, error) {
+	ids, err := uuidTreeLookupAll(f, uuid, typ)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// uuidTreeLookupAll returns all subvolume ids stored for a given uuid in specified field.
+// Multiple subvolumes may share the same received uuid.
+// It returns ErrNotFound if object was not found.
+func uuidTreeLookupAll(f ioctlFile, uuid UUID, typ treeKeyType) ([]objectID, error) {
 	objId, off := uuid.toKey()
 	args := btrfs_ioctl_search_key{
 		tree_id:      uuidTreeObjectid,
@@ -37,13 +47,17 @@ func uuidTreeLookupAny(f *os.File, uuid UUID, typ treeKeyType) (objectID, error)
 	}
 	res, err := treeSearchRaw(f, args)
 	if err != nil {
-		return 0, err
+		return nil, err
 	} else if len(res) < 1 {
-		return 0, ErrNotFound
+		return nil, ErrNotFound
 	}
 	out := res[0]
-	if len(out.Data) != 8 {
-		return 0, fmt.Errorf("btrfs: uuid item with illegal size %d", len(out.Data))
+	if len(out.Data) == 0 || len(out.Data)%8 != 0 {
+		return nil, fmt.Errorf("btrfs: uuid item with illegal size %d", len(out.Data))
+	}
+	ids := make([]objectID, 0, len(out.Data)/8)
+	for p := out.Data; len(p) >= 8; p = p[8:] {
+		ids = append(ids, objectID(binary.LittleEndian.Uint64(p)))
 	}
-	return objectID(binary.LittleEndian.Uint64(out.Data)), nil
+	return ids, nil
 }
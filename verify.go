@@ -0,0 +1,278 @@
+package btrfs
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// VerifyReport is the result of checking file data against the checksum tree.
+type VerifyReport struct {
+	// Verified is the number of bytes that were compared with checksums.
+	Verified uint64 `json:"verified"`
+	// Skipped is the number of bytes that have no data checksums: inline, compressed
+	// and preallocated extents, and files with checksums disabled (nodatasum, nodatacow).
+	Skipped uint64 `json:"skipped"`
+	// Mismatches lists ranges of the file that do not match their checksums.
+	Mismatches []CsumMismatch `json:"mismatches,omitempty"`
+}
+
+// OK reports if no mismatches were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// CsumMismatch is a range of file data that does not match its checksums.
+type CsumMismatch struct {
+	Offset  uint64 `json:"offset"`  // offset in the file
+	Len     uint64 `json:"len"`     // length of the range
+	Logical uint64 `json:"logical"` // logical address of the range on disk
+	// Err is set if the data could not be read. The kernel verifies checksums on read
+	// as well, thus corrupted sectors without a good copy are usually reported with EIO.
+	Err error `json:"-"`
+}
+
+func (m CsumMismatch) String() string {
+	s := fmt.Sprintf("[%d, %d) at logical %d", m.Offset, m.Offset+m.Len, m.Logical)
+	if m.Err != nil {
+		s += ": " + m.Err.Error()
+	}
+	return s
+}
+
+// VerifyFile maps extents of a file, reads its data and compares it with checksums
+// stored in the checksum tree. Relative paths are resolved against the opened directory.
+//
+// File data is flushed to disk before the check and is read with O_DIRECT, bypassing
+// the page cache, thus the data on disk is checked rather than the cached copy. If the file
+// cannot be reopened with O_DIRECT (for example, /proc is not mounted), the page cache
+// is used instead, and corruption of cached data is only detected after it's evicted.
+// Extents without data checksums are skipped and counted in VerifyReport.Skipped.
+// It requires CAP_SYS_ADMIN.
+func (f *FS) VerifyFile(path string) (*VerifyReport, error) {
+	if err := requireAdmin("verify", path); err != nil {
+		return nil, err
+	}
+	info, err := f.Info()
+	if err != nil {
+		return nil, err
+	}
+	h, err := NewCsumHash(info.CsumType)
+	if err != nil {
+		return nil, err
+	}
+	file, err := openAt(f.f, path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return nil, err
+	} else if !st.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "verify", Path: file.Name(), Err: syscall.EINVAL}
+	}
+	ino := st.Sys().(*syscall.Stat_t).Ino
+	// data must be written to get extents and checksums
+	if err = file.Sync(); err != nil {
+		return nil, err
+	}
+	treeID, err := getFileRootID(file)
+	if err != nil {
+		return nil, &os.PathError{Op: "verify", Path: file.Name(), Err: err}
+	}
+	var r io.ReaderAt = file
+	if direct, err := openDirect(file); err == nil {
+		defer direct.Close()
+		r = direct
+	}
+	v := &fileVerifier{
+		f:      file,
+		r:      r,
+		h:      h,
+		sector: uint64(info.SectorSize),
+		size:   uint64(st.Size()),
+		// csum items are limited by the node size, which limits the range covered by them
+		maxCover: uint64(info.NodeSize) / uint64(info.CsumType.Size()) * uint64(info.SectorSize),
+		rep:      &VerifyReport{},
+	}
+	it := newSearchIterator(file, btrfs_ioctl_search_key{
+		tree_id:      treeID,
+		min_objectid: objectID(ino),
+		max_objectid: objectID(ino),
+		min_type:     extentDataKey,
+		max_type:     extentDataKey,
+		max_offset:   maxUint64,
+		max_transid:  maxUint64,
+	})
+	for it.Next() {
+		item := it.Item()
+		ext, err := DecodeFileExtentItem(item.Data)
+		if err != nil {
+			return nil, err
+		}
+		if err = v.extent(item.Offset, ext); err != nil {
+			return nil, &os.PathError{Op: "verify", Path: file.Name(), Err: err}
+		}
+	}
+	if err = it.Err(); err != nil {
+		return nil, &os.PathError{Op: "verify", Path: file.Name(), Err: err}
+	}
+	return v.rep, nil
+}
+
+// openDirect opens a file again with O_DIRECT.
+func openDirect(f *os.File) (*os.File, error) {
+	var direct *os.File
+	err := withFd(f, func(fd int) (err error) {
+		direct, err = openAt(nil, fdPath(uintptr(fd)), syscall.O_RDONLY|syscall.O_DIRECT, 0)
+		return err
+	})
+	return direct, err
+}
+
+// alignedBuffer allocates a buffer aligned to its size, which must be a power of two,
+// as required by O_DIRECT.
+func alignedBuffer(size uint64) []byte {
+	buf := make([]byte, 2*size)
+	off := uint64(uintptr(unsafe.Pointer(&buf[0]))) & (size - 1)
+	if off != 0 {
+		off = size - off
+	}
+	return buf[off : off+size : off+size]
+}
+
+type fileVerifier struct {
+	f        *os.File    // file used for tree search
+	r        io.ReaderAt // file data
+	h        hash.Hash
+	sector   uint64
+	size     uint64 // file size
+	maxCover uint64 // max range covered by a single csum item
+	rep      *VerifyReport
+}
+
+// extent verifies a single file extent item at a given file offset.
+func (v *fileVerifier) extent(off uint64, ext FileExtentItem) error {
+	if off >= v.size {
+		// preallocated past EOF
+		return nil
+	}
+	n := ext.NumBytes
+	if ext.Type == FileExtentInline {
+		n = ext.RAMBytes
+	}
+	if off+n > v.size {
+		n = v.size - off
+	}
+	switch {
+	case ext.Type == FileExtentInline, ext.Type == FileExtentPrealloc, ext.Compression != CompressionNone:
+		// inline data is protected by metadata checksums; prealloc extents have no data,
+		// and checksums of compressed extents cover compressed data
+		v.rep.Skipped += n
+		return nil
+	case ext.DiskByteNr == 0:
+		// hole
+		return nil
+	}
+	logical := ext.DiskByteNr + ext.Offset
+	sums, err := v.lookupCsums(logical, (n+v.sector-1)/v.sector)
+	if err != nil {
+		return err
+	}
+	v.verify(off, logical, n, sums)
+	return nil
+}
+
+// lookupCsums returns checksums of n sectors starting from a given logical address.
+// Sectors without checksums are set to nil.
+func (v *fileVerifier) lookupCsums(logical, n uint64) ([][]byte, error) {
+	sums := make([][]byte, n)
+	end := logical + n*v.sector
+	start := uint64(0)
+	if logical > v.maxCover {
+		start = logical - v.maxCover
+	}
+	it := newSearchIterator(v.f, btrfs_ioctl_search_key{
+		tree_id:      csumTreeObjectid,
+		min_objectid: extentCsumObjectid,
+		max_objectid: extentCsumObjectid,
+		min_type:     extentCsumKey,
+		max_type:     extentCsumKey,
+		min_offset:   start,
+		max_offset:   end - 1,
+		max_transid:  maxUint64,
+	})
+	for it.Next() {
+		item := it.Item()
+		fillCsums(sums, logical, v.sector, item.Offset, item.Data, v.h.Size())
+	}
+	return sums, it.Err()
+}
+
+// fillCsums copies checksums from an EXTENT_CSUM item that starts at a given logical address
+// to sums, which holds checksums of sectors starting from logical address start.
+func fillCsums(sums [][]byte, start, sector, off uint64, data []byte, size int) {
+	for i := 0; (i+1)*size <= len(data); i++ {
+		l := off + uint64(i)*sector
+		if l < start {
+			continue
+		}
+		j := (l - start) / sector
+		if j >= uint64(len(sums)) {
+			break
+		}
+		sums[j] = data[i*size : (i+1)*size]
+	}
+}
+
+// verify reads n bytes of file data at a given offset and compares them with sector checksums.
+func (v *fileVerifier) verify(off, logical, n uint64, sums [][]byte) {
+	buf := alignedBuffer(v.sector)
+	for i := range sums {
+		pos := uint64(i) * v.sector
+		l := v.sector
+		if pos+l > n {
+			l = n - pos
+		}
+		if sums[i] == nil {
+			v.rep.Skipped += l
+			continue
+		}
+		// whole sectors are read for O_DIRECT; the tail of the last sector is zeroed on disk
+		got, err := v.r.ReadAt(buf, int64(off+pos))
+		if err == io.EOF && uint64(got) >= l {
+			err = nil
+		}
+		for j := uint64(got); j < v.sector; j++ {
+			buf[j] = 0
+		}
+		if err != nil {
+			v.mismatch(off+pos, logical+pos, l, err)
+			continue
+		}
+		v.h.Reset()
+		v.h.Write(buf)
+		if !bytes.Equal(v.h.Sum(nil), sums[i]) {
+			v.mismatch(off+pos, logical+pos, l, nil)
+			continue
+		}
+		v.rep.Verified += l
+	}
+}
+
+// mismatch records a mismatched range, merging it with the previous one if possible.
+func (v *fileVerifier) mismatch(off, logical, n uint64, err error) {
+	if k := len(v.rep.Mismatches); k > 0 {
+		last := &v.rep.Mismatches[k-1]
+		if last.Offset+last.Len == off && last.Logical+last.Len == logical && (last.Err == nil) == (err == nil) {
+			last.Len += n
+			return
+		}
+	}
+	v.rep.Mismatches = append(v.rep.Mismatches, CsumMismatch{Offset: off, Len: n, Logical: logical, Err: err})
+}
@@ -0,0 +1,82 @@
+package btrfs
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+type errReaderAt struct {
+	r   *bytes.Reader
+	bad int64 // offset of a sector that fails to read
+}
+
+func (r errReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off == r.bad {
+		return 0, syscall.EIO
+	}
+	return r.r.ReadAt(p, off)
+}
+
+func TestFileVerifier(t *testing.T) {
+	const sector = 4096
+	data := make([]byte, 6*sector+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	// csum item covers all sectors, starting one sector before the extent
+	const logical = 1 << 20
+	var item []byte
+	for i := -1; i < 7; i++ {
+		buf := make([]byte, sector)
+		if i >= 0 && i*sector < len(data) {
+			copy(buf, data[i*sector:])
+		}
+		sum, err := Checksum(CsumCRC32C, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item = append(item, sum...)
+	}
+	// corrupt sectors 2 and 3, and drop the checksum of sector 5
+	item[4*3] ^= 1
+	item[4*4] ^= 1
+	sums := make([][]byte, 7)
+	fillCsums(sums, logical, sector, logical-sector, item, 4)
+	sums[5] = nil
+
+	h, _ := NewCsumHash(CsumCRC32C)
+	v := &fileVerifier{
+		r:      errReaderAt{r: bytes.NewReader(data), bad: 4 * sector},
+		h:      h,
+		sector: sector,
+		size:   uint64(len(data)),
+		rep:    &VerifyReport{},
+	}
+	v.verify(0, logical, uint64(len(data)), sums)
+	rep := v.rep
+	if rep.Verified != 2*sector+100 || rep.Skipped != sector {
+		t.Fatalf("unexpected counters: %+v", rep)
+	}
+	if len(rep.Mismatches) != 2 {
+		t.Fatalf("unexpected mismatches: %v", rep.Mismatches)
+	}
+	if m := rep.Mismatches[0]; m.Offset != 2*sector || m.Len != 2*sector || m.Logical != logical+2*sector || m.Err != nil {
+		t.Fatalf("unexpected mismatch: %v", m)
+	}
+	if m := rep.Mismatches[1]; m.Offset != 4*sector || m.Len != sector || m.Err != syscall.EIO {
+		t.Fatalf("unexpected read error: %v", m)
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, size := range []uint64{512, 4096, 65536} {
+		buf := alignedBuffer(size)
+		if uint64(len(buf)) != size || uint64(cap(buf)) != size {
+			t.Errorf("unexpected size: %d, %d", len(buf), cap(buf))
+		} else if p := uint64(uintptr(unsafe.Pointer(&buf[0]))); p%size != 0 {
+			t.Errorf("buffer is not aligned to %d: %x", size, p)
+		}
+	}
+}
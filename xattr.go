@@ -2,8 +2,12 @@ package btrfs
 
 import (
 	"bytes"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
+	"unsafe"
 )
 
 const (
@@ -11,15 +15,76 @@ const (
 	xattrCompression = xattrPrefix + "compression"
 )
 
+// Compression is a compression algorithm with an optional level, e.g. "zstd:3".
 type Compression string
 
 const (
 	CompressionNone = Compression("")
 	LZO             = Compression("lzo")
 	ZLIB            = Compression("zlib")
+	ZSTD            = Compression("zstd")
 )
 
+// compressionLevels lists allowed level ranges for each algorithm.
+var compressionLevels = map[Compression][2]int{
+	ZLIB: {1, 9},
+	ZSTD: {1, 15},
+}
+
+// WithLevel returns the same compression algorithm with a given level.
+func (c Compression) WithLevel(level int) Compression {
+	return c.Algorithm() + Compression(":"+strconv.Itoa(level))
+}
+
+// Algorithm returns the compression algorithm without the level.
+func (c Compression) Algorithm() Compression {
+	if i := strings.IndexByte(string(c), ':'); i >= 0 {
+		return c[:i]
+	}
+	return c
+}
+
+// Level returns the compression level. It returns false if level is not set.
+func (c Compression) Level() (int, bool) {
+	i := strings.IndexByte(string(c), ':')
+	if i < 0 {
+		return 0, false
+	}
+	level, err := strconv.Atoi(string(c[i+1:]))
+	if err != nil {
+		return 0, false
+	}
+	return level, true
+}
+
+// Validate checks if compression algorithm is known and the level is in the allowed range.
+func (c Compression) Validate() error {
+	alg := c.Algorithm()
+	switch alg {
+	case CompressionNone, LZO, ZLIB, ZSTD:
+	default:
+		return fmt.Errorf("unsupported compression: %q", string(c))
+	}
+	if alg == c {
+		return nil
+	}
+	level, ok := c.Level()
+	if !ok {
+		return fmt.Errorf("invalid compression level: %q", string(c))
+	}
+	r, ok := compressionLevels[alg]
+	if !ok {
+		return fmt.Errorf("compression %q does not support levels", string(alg))
+	} else if level < r[0] || level > r[1] {
+		return fmt.Errorf("compression level for %s must be in range [%d, %d], got %d", alg, r[0], r[1], level)
+	}
+	return nil
+}
+
 func SetCompression(path string, v Compression) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
 	var value []byte
 	if v != CompressionNone {
 		var err error
@@ -36,9 +101,27 @@ func SetCompression(path string, v Compression) error {
 }
 
 func GetCompression(path string) (Compression, error) {
+	return readCompression(path, func(dest []byte) (int, error) {
+		return syscall.Getxattr(path, xattrCompression, dest)
+	})
+}
+
+// getCompressionFile is like GetCompression, but reads the property of an open file.
+func getCompressionFile(f *os.File) (Compression, error) {
+	return readCompression(f.Name(), func(dest []byte) (sz int, err error) {
+		err = withFd(f, func(fd int) error {
+			sz, err = fgetxattr(fd, xattrCompression, dest)
+			return err
+		})
+		return sz, err
+	})
+}
+
+// readCompression reads the compression property with a given getxattr function.
+func readCompression(path string, getxattr func(dest []byte) (int, error)) (Compression, error) {
 	var buf []byte
 	for {
-		sz, err := syscall.Getxattr(path, xattrCompression, nil)
+		sz, err := getxattr(nil)
 		if err == syscall.ENODATA || sz == 0 {
 			return CompressionNone, nil
 		} else if err != nil {
@@ -49,7 +132,7 @@ func GetCompression(path string) (Compression, error) {
 		} else {
 			buf = buf[:sz]
 		}
-		sz, err = syscall.Getxattr(path, xattrCompression, buf)
+		sz, err = getxattr(buf)
 		if err == syscall.ENODATA {
 			return CompressionNone, nil
 		} else if err == syscall.ERANGE {
@@ -64,3 +147,21 @@ func GetCompression(path string) (Compression, error) {
 	buf = bytes.TrimSuffix(buf, []byte{0})
 	return Compression(buf), nil
 }
+
+// fgetxattr is like syscall.Getxattr, but reads the attribute of a file descriptor.
+func fgetxattr(fd int, attr string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return 0, err
+	}
+	var d unsafe.Pointer
+	if len(dest) > 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	sz, _, errno := syscall.Syscall6(syscall.SYS_FGETXATTR, uintptr(fd),
+		uintptr(unsafe.Pointer(p)), uintptr(d), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(sz), nil
+}
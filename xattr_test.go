@@ -0,0 +1,33 @@
+package btrfs
+
+import "testing"
+
+func TestCompressionValidate(t *testing.T) {
+	for _, c := range []struct {
+		c   Compression
+		alg Compression
+		ok  bool
+	}{
+		{c: CompressionNone, alg: CompressionNone, ok: true},
+		{c: LZO, alg: LZO, ok: true},
+		{c: ZSTD.WithLevel(3), alg: ZSTD, ok: true},
+		{c: ZLIB.WithLevel(9), alg: ZLIB, ok: true},
+		{c: ZSTD.WithLevel(16), alg: ZSTD},
+		{c: ZLIB.WithLevel(0), alg: ZLIB},
+		{c: LZO.WithLevel(1), alg: LZO},
+		{c: "zstd:x", alg: ZSTD},
+		{c: "lz4", alg: "lz4"},
+	} {
+		if alg := c.c.Algorithm(); alg != c.alg {
+			t.Errorf("%q: unexpected algorithm: %q", c.c, alg)
+		}
+		if err := c.c.Validate(); c.ok && err != nil {
+			t.Errorf("%q: unexpected error: %v", c.c, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%q: expected an error", c.c)
+		}
+	}
+	if l, ok := Compression("zstd:7").Level(); !ok || l != 7 {
+		t.Fatalf("unexpected level: %d, %v", l, ok)
+	}
+}
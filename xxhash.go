@@ -0,0 +1,117 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxHash64 with a zero seed, as used for btrfs checksums.
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+type xxHash64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int // bytes in buf
+}
+
+func newXXHash64() *xxHash64 {
+	h := &xxHash64{}
+	h.Reset()
+	return h
+}
+
+func xxRound(acc, in uint64) uint64 {
+	acc += in * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (h *xxHash64) Reset() {
+	p1 := xxPrime1 // wraps around at runtime
+	h.v = [4]uint64{p1 + xxPrime2, xxPrime2, 0, -p1}
+	h.total = 0
+	h.n = 0
+}
+
+func (h *xxHash64) Size() int      { return 8 }
+func (h *xxHash64) BlockSize() int { return 32 }
+
+func (h *xxHash64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+	}
+}
+
+func (h *xxHash64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < len(h.buf) {
+			return n, nil
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.stripe(p)
+	}
+	h.n = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxHash64) Sum64() uint64 {
+	var v uint64
+	if h.total >= 32 {
+		v = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, x := range h.v {
+			v = xxMerge(v, x)
+		}
+	} else {
+		v = xxPrime5
+	}
+	v += h.total
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		v ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		v = bits.RotateLeft64(v, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		v ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		v = bits.RotateLeft64(v, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		v ^= uint64(b) * xxPrime5
+		v = bits.RotateLeft64(v, 11) * xxPrime1
+	}
+	v ^= v >> 33
+	v *= xxPrime2
+	v ^= v >> 29
+	v *= xxPrime3
+	v ^= v >> 32
+	return v
+}
+
+// Sum appends the checksum in little-endian, as it is stored on disk.
+func (h *xxHash64) Sum(b []byte) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], h.Sum64())
+	return append(b, buf[:]...)
+}
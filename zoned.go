@@ -0,0 +1,311 @@
+package btrfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ZoneModel is a zone model of a block device.
+type ZoneModel int
+
+const (
+	// ZoneModelNone is a regular block device.
+	ZoneModelNone = ZoneModel(iota)
+	// ZoneModelHostAware is a zoned device that accepts random writes to sequential zones.
+	ZoneModelHostAware
+	// ZoneModelHostManaged is a zoned device that requires sequential writes (HM-SMR, ZNS).
+	ZoneModelHostManaged
+)
+
+func (m ZoneModel) String() string {
+	switch m {
+	case ZoneModelNone:
+		return "none"
+	case ZoneModelHostAware:
+		return "host-aware"
+	case ZoneModelHostManaged:
+		return "host-managed"
+	}
+	return fmt.Sprintf("ZoneModel(%d)", int(m))
+}
+
+// ZoneInfo describes zones of a block device.
+type ZoneInfo struct {
+	Model    ZoneModel `json:"model"`
+	ZoneSize uint64    `json:"zone_size"` // in bytes
+	NumZones uint32    `json:"num_zones"`
+}
+
+// Zoned reports if the device is zoned.
+func (z ZoneInfo) Zoned() bool {
+	return z.Model != ZoneModelNone
+}
+
+// ZoneType is a type of a single zone.
+type ZoneType uint8
+
+const (
+	ZoneConventional      = ZoneType(1) // random writes are allowed
+	ZoneSeqWriteRequired  = ZoneType(2)
+	ZoneSeqWritePreferred = ZoneType(3)
+)
+
+func (t ZoneType) String() string {
+	switch t {
+	case ZoneConventional:
+		return "conventional"
+	case ZoneSeqWriteRequired:
+		return "seq-write-required"
+	case ZoneSeqWritePreferred:
+		return "seq-write-preferred"
+	}
+	return fmt.Sprintf("ZoneType(%d)", uint8(t))
+}
+
+// ZoneCond is a condition of a single zone.
+type ZoneCond uint8
+
+const (
+	ZoneCondNotWP    = ZoneCond(0x0) // conventional zone without a write pointer
+	ZoneCondEmpty    = ZoneCond(0x1)
+	ZoneCondImpOpen  = ZoneCond(0x2) // implicitly opened by a write
+	ZoneCondExpOpen  = ZoneCond(0x3) // explicitly opened
+	ZoneCondClosed   = ZoneCond(0x4)
+	ZoneCondReadOnly = ZoneCond(0xd)
+	ZoneCondFull     = ZoneCond(0xe)
+	ZoneCondOffline  = ZoneCond(0xf)
+)
+
+var zoneCondNames = map[ZoneCond]string{
+	ZoneCondNotWP:    "not-wp",
+	ZoneCondEmpty:    "empty",
+	ZoneCondImpOpen:  "implicit-open",
+	ZoneCondExpOpen:  "explicit-open",
+	ZoneCondClosed:   "closed",
+	ZoneCondReadOnly: "read-only",
+	ZoneCondFull:     "full",
+	ZoneCondOffline:  "offline",
+}
+
+func (c ZoneCond) String() string {
+	if s, ok := zoneCondNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("ZoneCond(0x%x)", uint8(c))
+}
+
+// Zone describes a single zone of a zoned block device. All offsets are in bytes.
+type Zone struct {
+	Start        uint64   `json:"start"`
+	Len          uint64   `json:"len"`
+	WritePointer uint64   `json:"wp"`
+	Capacity     uint64   `json:"capacity"` // usable size of the zone, may be less than Len
+	Type         ZoneType `json:"type"`
+	Cond         ZoneCond `json:"cond"`
+}
+
+// devNum splits a device number into major and minor numbers.
+func devNum(dev uint64) (major, minor uint64) {
+	major = (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor = dev&0xff | (dev>>12)&^0xff
+	return
+}
+
+// sysfsZoneModel reads the zone model of a block device from sysfs.
+func sysfsZoneModel(rdev uint64) (ZoneModel, error) {
+	major, minor := devNum(rdev)
+	dir := "/sys/dev/block/" + strconv.FormatUint(major, 10) + ":" + strconv.FormatUint(minor, 10)
+	if _, err := os.Stat(dir + "/partition"); err == nil {
+		// partitions share the request queue of the whole disk;
+		// path is not cleaned intentionally, so ".." is resolved relative to the symlink target
+		dir += "/.."
+	}
+	data, err := ioutil.ReadFile(dir + "/queue/zoned")
+	if os.IsNotExist(err) {
+		// kernel without zoned devices support
+		return ZoneModelNone, nil
+	} else if err != nil {
+		return ZoneModelNone, err
+	}
+	switch s := strings.TrimSpace(string(data)); s {
+	case "none":
+		return ZoneModelNone, nil
+	case "host-aware":
+		return ZoneModelHostAware, nil
+	case "host-managed":
+		return ZoneModelHostManaged, nil
+	default:
+		return ZoneModelNone, fmt.Errorf("unknown zone model: %q", s)
+	}
+}
+
+// BlockDeviceZoned detects if a block device is zoned and returns its zone geometry.
+// Regular files and non-zoned devices are reported with ZoneModelNone.
+func BlockDeviceZoned(path string) (ZoneInfo, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return ZoneInfo{}, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return ZoneInfo{}, nil
+	}
+	model, err := sysfsZoneModel(uint64(st.Rdev))
+	if err != nil {
+		return ZoneInfo{}, &os.PathError{Op: "zone model", Path: path, Err: err}
+	} else if model == ZoneModelNone {
+		return ZoneInfo{}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ZoneInfo{}, err
+	}
+	defer f.Close()
+	sz, err := iocGetZoneSize(f)
+	if err != nil {
+		return ZoneInfo{}, &os.PathError{Op: "get zone size", Path: path, Err: err}
+	}
+	nr, err := iocGetNrZones(f)
+	if err != nil {
+		return ZoneInfo{}, &os.PathError{Op: "get zones count", Path: path, Err: err}
+	}
+	return ZoneInfo{Model: model, ZoneSize: uint64(sz) * blkSectorSize, NumZones: nr}, nil
+}
+
+// ReportZones returns up to n zones of a zoned block device, starting from the zone that
+// contains a given byte offset. If n is zero or negative, all the remaining zones are returned.
+func ReportZones(path string, start uint64, n int) ([]Zone, error) {
+	if start%blkSectorSize != 0 {
+		return nil, fmt.Errorf("zone report offset is not aligned to %d bytes: %d", blkSectorSize, start)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	const batch = 256
+	buf := make([]blk_zone, batch)
+	sector := start / blkSectorSize
+	var out []Zone
+	for n <= 0 || len(out) < n {
+		zones, err := iocReportZones(f, sector, buf)
+		if err != nil {
+			return out, &os.PathError{Op: "report zones", Path: path, Err: err}
+		} else if len(zones) == 0 {
+			break
+		}
+		for _, z := range zones {
+			out = append(out, Zone{
+				Start:        z.start * blkSectorSize,
+				Len:          z.len * blkSectorSize,
+				WritePointer: z.wp * blkSectorSize,
+				Capacity:     z.capacity * blkSectorSize,
+				Type:         ZoneType(z.typ),
+				Cond:         ZoneCond(z.cond),
+			})
+			if n > 0 && len(out) == n {
+				break
+			}
+		}
+		last := zones[len(zones)-1]
+		sector = last.start + last.len
+	}
+	return out, nil
+}
+
+// IsZoned reports if the filesystem uses zoned mode.
+func (f *FS) IsZoned() (bool, error) {
+	feat, err := f.GetFeatures()
+	if err != nil {
+		return false, err
+	}
+	return feat.Incompatible&FeatureIncompatZoned != 0, nil
+}
+
+// ZoneSize returns the zone size of the filesystem devices.
+// Zero is returned if devices are not zoned (or if zoned mode is emulated).
+func (f *FS) ZoneSize() (uint64, error) {
+	devs, err := f.Devices()
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range devs {
+		if d.Missing {
+			continue
+		}
+		zi, err := BlockDeviceZoned(d.Path)
+		if err != nil {
+			return 0, err
+		}
+		return zi.ZoneSize, nil
+	}
+	return 0, nil
+}
+
+// deviceZoneSize returns the zone size of a device with a given id, or zero if it's not zoned.
+func (f *FS) deviceZoneSize(devid uint64) (uint64, error) {
+	dev, err := iocDevInfo(f.file(), devid, UUID{})
+	if err != nil {
+		return 0, &os.PathError{Op: "dev info", Path: f.f.Name(), Err: err}
+	}
+	path := dev.Path()
+	if path == "" {
+		return 0, nil
+	}
+	zi, err := BlockDeviceZoned(path)
+	if err != nil {
+		return 0, err
+	}
+	return zi.ZoneSize, nil
+}
+
+// zonedProfileSupported reports if a profile can be used on a zoned filesystem.
+// Data chunks with redundancy or striping require the raid stripe tree.
+func zonedProfileSupported(p Profile, data, rst bool) bool {
+	switch p {
+	case ProfileSingle:
+		return true
+	case ProfileDup, ProfileRAID0, ProfileRAID1, ProfileRAID10:
+		return !data || rst
+	}
+	return false
+}
+
+// validateZoned checks that balance does not convert chunks to profiles that are
+// not supported on a zoned filesystem with given incompatible features.
+func (a BalanceArgs) validateZoned(incompat IncompatFeatures) error {
+	if incompat&FeatureIncompatZoned == 0 {
+		return nil
+	}
+	rst := incompat&FeatureIncompatRAIDStripeTree != 0
+	for _, c := range []struct {
+		typ  string
+		f    *BalanceFilter
+		data bool
+	}{
+		{"data", a.Data, true},
+		{"metadata", a.Metadata, false},
+		{"system", a.System, false},
+	} {
+		if c.f == nil || c.f.Convert == 0 {
+			continue
+		}
+		if !zonedProfileSupported(c.f.Convert, c.data, rst) {
+			return fmt.Errorf("%s: cannot convert to %v: %w", c.typ, c.f.Convert, ErrZonedProfile)
+		}
+	}
+	return nil
+}
+
+// converts reports if balance changes profiles of any chunk type.
+func (a BalanceArgs) converts() bool {
+	for _, f := range []*BalanceFilter{a.Data, a.Metadata, a.System} {
+		if f != nil && f.Convert != 0 {
+			return true
+		}
+	}
+	return false
+}